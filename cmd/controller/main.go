@@ -2,19 +2,30 @@ package main
 
 import (
 	"flag"
+	"os"
+	"time"
 
 	"github.com/fydmer/fileserver/internal/app"
+	"github.com/fydmer/fileserver/internal/domain/service"
+	"github.com/fydmer/fileserver/internal/repositories/access"
 	"github.com/fydmer/fileserver/internal/repositories/infra"
 	"github.com/fydmer/fileserver/internal/repositories/storage"
 	"github.com/fydmer/fileserver/internal/schema/database"
 	"github.com/fydmer/fileserver/internal/servers/httpserver"
 	"github.com/fydmer/fileserver/internal/services/controller"
 	"github.com/fydmer/fileserver/pkg/pgconn"
+	"github.com/fydmer/fileserver/pkg/tlsconf"
 )
 
 type Config struct {
-	Port     int
-	Postgres pgconn.Config
+	Port       int
+	S3Port     int
+	S3         httpserver.S3Config
+	Postgres   pgconn.Config
+	NodeTLS    tlsconf.Config
+	NodeSecret string
+	AdminToken string
+	Controller controller.Config
 }
 
 func main() {
@@ -23,6 +34,9 @@ func main() {
 	config := &Config{}
 	{
 		flag.IntVar(&config.Port, "port", 8080, "API server port")
+		flag.IntVar(&config.S3Port, "s3-port", 0, "S3-compatible API server port, 0 disables it")
+		flag.StringVar(&config.S3.Region, "s3-region", "us-east-1", "Region expected in S3 request signatures")
+		flag.StringVar(&config.S3.Domain, "s3-domain", "", "Domain of virtual-hosted S3 buckets \"<bucket>.<domain>\", path-style requests are served when empty")
 		flag.StringVar(&config.Postgres.Host, "postgres.host", "postgres", "Postgres hostname")
 		flag.UintVar(&config.Postgres.Port, "postgres.port", 5432, "Postgres port")
 		flag.StringVar(&config.Postgres.DB, "postgres.db", "postgres", "Postgres database")
@@ -30,6 +44,33 @@ func main() {
 		flag.StringVar(&config.Postgres.Password, "postgres.password", "password", "Postgres password")
 		flag.IntVar(&config.Postgres.MaxIdleConns, "postgres.max_idle_conns", 10, "Postgres Max idle connections")
 		flag.IntVar(&config.Postgres.MaxOpenConns, "postgres.max_open_conns", 30, "Postgres Max open connections")
+		flag.IntVar(&config.Controller.DataShards, "data-shards", 6, "Number of parts each file is split into")
+		flag.IntVar(&config.Controller.ParityShards, "parity-shards", 0, "Number of Reed-Solomon parity parts, 0 disables erasure coding")
+		flag.IntVar(&config.Controller.Replicas, "replicas", 1, "Number of nodes each file part is written to")
+		flag.IntVar(&config.Controller.Concurrency, "concurrency", 4, "Number of file parts transferred at once by a request")
+		flag.IntVar(&config.Controller.BufferSize, "buffer-size", 4*1024*1024, "Size in bytes of a file part buffer in memory")
+		flag.StringVar(&config.Controller.SpoolDir, "spool-dir", "", "Directory for spooled uploads, defaults to the system temp dir")
+		flag.DurationVar(&config.Controller.HeartbeatInterval, "heartbeat-interval", 5*time.Second, "Interval between node pings")
+		flag.DurationVar(&config.Controller.NodeDownAfter, "node-down-after", 15*time.Second, "Time without answer after which a node is marked down")
+		flag.DurationVar(&config.Controller.ScrubInterval, "scrub-interval", 24*time.Hour, "Interval between verifications of all stored file parts, 0 disables them")
+		flag.Int64Var(&config.Controller.ScrubRate, "scrub-rate", 16*1024*1024, "Bytes per second read from node disks by the verification")
+		flag.DurationVar(&config.Controller.RepairInterval, "repair-interval", time.Minute, "Interval between searches for lost file parts, 0 disables them")
+		flag.DurationVar(&config.Controller.RepairDelay, "repair-delay", 10*time.Minute, "Time a node may be down before its file parts are restored elsewhere")
+		flag.DurationVar(&config.Controller.RebalanceInterval, "rebalance-interval", time.Hour, "Interval between rebalancings of node disk usage, 0 disables them")
+		flag.Float64Var(&config.Controller.RebalanceThreshold, "rebalance-threshold", 0.1, "Share of capacity a node may be used above the mean before its file parts are moved")
+		flag.Int64Var(&config.Controller.RebalanceRate, "rebalance-rate", 16*1024*1024, "Bytes per second moved between nodes by the rebalancing")
+		flag.IntVar(&config.Controller.NodeMaxConns, "node-max-conns", 4, "Maximum connections to a node")
+		flag.IntVar(&config.Controller.NodeMaxStreams, "node-max-streams", 16, "Maximum operations running at once on a node connection")
+		flag.DurationVar(&config.Controller.NodeIdleTimeout, "node-idle-timeout", 90*time.Second, "Time an unused node connection is kept open")
+		flag.Int64Var(&config.Controller.UploadChunkSize, "upload-chunk-size", 64*1024*1024, "Size in bytes of a file part stored by resumable uploads")
+		flag.DurationVar(&config.Controller.UploadExpiry, "upload-expiry", 24*time.Hour, "Time an unfinished resumable upload is kept since its last chunk")
+		flag.DurationVar(&config.Controller.ReplacedFileDelay, "replaced-file-delay", time.Minute, "Time the parts of a replaced file and the moved replicas are kept for downloads in progress")
+		flag.StringVar(&config.NodeTLS.CertFile, "node-tls-cert", "", "TLS client certificate file presented to nodes")
+		flag.StringVar(&config.NodeTLS.KeyFile, "node-tls-key", "", "TLS client private key file")
+		flag.StringVar(&config.NodeTLS.CAFile, "node-tls-ca", "", "CA file verifying node certificates, enables TLS for the node connections")
+		flag.StringVar(&config.NodeTLS.ServerName, "node-tls-server-name", "", "Name expected in node certificates, defaults to the node host")
+		flag.StringVar(&config.NodeSecret, "node-secret", os.Getenv("FILESERVER_NODE_SECRET"), "Pre-shared key to authenticate on nodes, defaults to $FILESERVER_NODE_SECRET")
+		flag.StringVar(&config.AdminToken, "admin-token", os.Getenv("FILESERVER_ADMIN_TOKEN"), "Token of the admin API key created at start, defaults to $FILESERVER_ADMIN_TOKEN")
 		flag.Parse()
 	}
 
@@ -55,7 +96,38 @@ func main() {
 		a.Panic(err)
 	}
 
-	controllerService := controller.NewController(infraRepo, storageRepo)
+	if config.Controller.NodeTLS, err = tlsconf.NewClientConfig(&config.NodeTLS); err != nil {
+		a.Panic(err)
+	}
+
+	config.Controller.NodeSecret = []byte(config.NodeSecret)
+
+	accessRepo, err := access.NewRepository(pgConn)
+	if err != nil {
+		a.Panic(err)
+	}
+
+	controllerService, err := controller.NewController(infraRepo, storageRepo, accessRepo, &config.Controller)
+	if err != nil {
+		a.Panic(err)
+	}
+
+	if config.AdminToken != "" {
+		if _, err = controllerService.CreateApiKey(a.Context(), &service.ControllerCreateApiKeyIn{
+			Name:  "admin",
+			Role:  service.ControllerRoleAdmin,
+			Token: config.AdminToken,
+		}); err != nil {
+			a.Panic(err)
+		}
+	}
+
+	go controllerService.RunHeartbeat(a.Context())
+	go controllerService.RunScrubber(a.Context())
+	go controllerService.RunRepair(a.Context())
+	go controllerService.RunRebalancer(a.Context())
+	go controllerService.RunUploadCleaner(a.Context())
+	go controllerService.RunReplacedCleaner(a.Context())
 
 	server, err := httpserver.RunControllerServer(a.Context(), config.Port, controllerService)
 	if err != nil {
@@ -65,5 +137,15 @@ func main() {
 		server.Close()
 	})
 
+	if config.S3Port > 0 {
+		s3Server, err := httpserver.RunS3Server(a.Context(), config.S3Port, controllerService, &config.S3)
+		if err != nil {
+			a.Panic(err)
+		}
+		a.AddStopFn(func() {
+			s3Server.Close()
+		})
+	}
+
 	a.Keep()
 }
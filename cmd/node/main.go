@@ -2,16 +2,28 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
+	"time"
 
 	"github.com/fydmer/fileserver/internal/app"
 	"github.com/fydmer/fileserver/internal/repositories/diskfile"
 	"github.com/fydmer/fileserver/internal/servers/tcpserver"
 	"github.com/fydmer/fileserver/internal/services/node"
+	"github.com/fydmer/fileserver/pkg/controllercli"
+	"github.com/fydmer/fileserver/pkg/tlsconf"
 )
 
 type Config struct {
-	Port    int
-	RootDir string
+	Port             int
+	RootDir          string
+	Controller       string
+	ControllerToken  string
+	AdvertiseAddr    string
+	RegisterInterval time.Duration
+	TLS              tlsconf.Config
+	Secret           string
+	Node             node.Config
 }
 
 func main() {
@@ -21,6 +33,15 @@ func main() {
 	{
 		flag.IntVar(&config.Port, "port", 8123, "Port to listen on")
 		flag.StringVar(&config.RootDir, "root-dir", "./data", "Root directory to serve files from")
+		flag.StringVar(&config.Controller, "controller", "", "Controller API address to register on, e.g. http://controller:8080")
+		flag.StringVar(&config.ControllerToken, "controller-token", os.Getenv("FILESERVER_CONTROLLER_TOKEN"), "Admin API token to register with, defaults to $FILESERVER_CONTROLLER_TOKEN")
+		flag.StringVar(&config.AdvertiseAddr, "advertise-addr", "", "Address the controller connects to, defaults to <hostname>:<port>")
+		flag.DurationVar(&config.RegisterInterval, "register-interval", 30*time.Second, "Interval between registrations on the controller")
+		flag.Int64Var(&config.Node.MaxBytes, "max-bytes", 0, "Disk space quota in bytes, 0 means the whole disk")
+		flag.StringVar(&config.TLS.CertFile, "tls-cert", "", "TLS certificate file, enables TLS for the controller connections")
+		flag.StringVar(&config.TLS.KeyFile, "tls-key", "", "TLS private key file")
+		flag.StringVar(&config.TLS.CAFile, "tls-ca", "", "CA file verifying controller client certificates, enables mutual TLS")
+		flag.StringVar(&config.Secret, "secret", os.Getenv("FILESERVER_NODE_SECRET"), "Pre-shared key the controller authenticates with, defaults to $FILESERVER_NODE_SECRET")
 		flag.Parse()
 	}
 
@@ -29,13 +50,35 @@ func main() {
 		a.Panic(err)
 	}
 
-	nodeService := node.NewNode(diskfileRepo)
+	nodeService := node.NewNode(diskfileRepo, &config.Node)
 
-	server, err := tcpserver.RunNodeServer(a.Context(), config.Port, nodeService)
+	tlsConfig, err := tlsconf.NewServerConfig(&config.TLS)
+	if err != nil {
+		a.Panic(err)
+	}
+
+	server, err := tcpserver.RunNodeServer(a.Context(), config.Port, tlsConfig, []byte(config.Secret), nodeService)
 	if err != nil {
 		a.Panic(err)
 	}
 	a.AddStopFn(server.Close)
 
+	if config.Controller != "" {
+		if config.AdvertiseAddr == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				a.Panic(err)
+			}
+			config.AdvertiseAddr = fmt.Sprintf("%s:%d", hostname, config.Port)
+		}
+
+		controllerCli, err := controllercli.NewClient(a.Context(), config.Controller, config.ControllerToken)
+		if err != nil {
+			a.Panic(err)
+		}
+
+		go node.KeepRegistered(a.Context(), controllerCli, config.AdvertiseAddr, config.RegisterInterval)
+	}
+
 	a.Keep()
 }
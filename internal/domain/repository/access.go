@@ -0,0 +1,83 @@
+package repository
+
+import (
+	"context"
+	"time"
+)
+
+// AccessRole grants everything the lower roles are allowed.
+type AccessRole int
+
+const (
+	AccessRoleReadOnly = AccessRole(iota)
+	AccessRoleReadWrite
+	AccessRoleAdmin
+)
+
+// AccessApiKey is a client of the API, only the hash of its token is stored.
+type AccessApiKey struct {
+	Id        string
+	Name      string
+	Role      AccessRole
+	CreatedAt time.Time
+}
+
+// AccessCreateApiKeyIn updates the name and the role of a key with the same
+// token hash.
+type AccessCreateApiKeyIn struct {
+	Name      string
+	Role      AccessRole
+	TokenHash string
+}
+
+type AccessCreateApiKeyOut struct {
+	Key *AccessApiKey
+}
+
+type AccessGetApiKeyIn struct {
+	TokenHash string
+}
+
+type AccessGetApiKeyOut struct {
+	Key *AccessApiKey
+}
+
+type AccessListApiKeysIn struct{}
+
+type AccessListApiKeysOut struct {
+	Keys []*AccessApiKey
+}
+
+type AccessDeleteApiKeyIn struct {
+	Id string
+}
+
+type AccessDeleteApiKeyOut struct{}
+
+// AccessSetS3CredentialsIn replaces the S3 credentials of the key, SigV4
+// needs the secret itself so it is stored as is.
+type AccessSetS3CredentialsIn struct {
+	Id        string
+	AccessKey string
+	Secret    string
+}
+
+type AccessSetS3CredentialsOut struct{}
+
+type AccessGetS3CredentialsIn struct {
+	AccessKey string
+}
+
+type AccessGetS3CredentialsOut struct {
+	Key    *AccessApiKey
+	Secret string
+}
+
+type Access interface {
+	CreateApiKey(ctx context.Context, in *AccessCreateApiKeyIn) (*AccessCreateApiKeyOut, error)
+	GetApiKey(ctx context.Context, in *AccessGetApiKeyIn) (*AccessGetApiKeyOut, error)
+	ListApiKeys(ctx context.Context, in *AccessListApiKeysIn) (*AccessListApiKeysOut, error)
+	DeleteApiKey(ctx context.Context, in *AccessDeleteApiKeyIn) (*AccessDeleteApiKeyOut, error)
+	SetS3Credentials(ctx context.Context, in *AccessSetS3CredentialsIn) (*AccessSetS3CredentialsOut, error)
+	GetS3Credentials(ctx context.Context, in *AccessGetS3CredentialsIn) (*AccessGetS3CredentialsOut, error)
+}
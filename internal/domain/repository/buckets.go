@@ -0,0 +1,55 @@
+package repository
+
+import (
+	"time"
+)
+
+// StorageBucket scopes file locations, its files are split into DataShards
+// with ParityShards and Replicas copies. A bucket with DataShards of 0, like
+// the default one, follows the controller configuration. Versioning buckets
+// keep the older versions of replaced and deleted files.
+type StorageBucket struct {
+	Id           string
+	Name         string
+	Owner        string
+	DataShards   int
+	ParityShards int
+	Replicas     int
+	Versioning   bool
+	CreatedAt    time.Time
+}
+
+// StorageCreateBucketIn leaves the bucket without an owner when Owner is empty.
+type StorageCreateBucketIn struct {
+	Name         string
+	Owner        string
+	DataShards   int
+	ParityShards int
+	Replicas     int
+	Versioning   bool
+}
+
+type StorageCreateBucketOut struct {
+	Bucket *StorageBucket
+}
+
+type StorageGetBucketIn struct {
+	Name string
+}
+
+type StorageGetBucketOut struct {
+	Bucket *StorageBucket
+}
+
+type StorageListBucketsIn struct{}
+
+type StorageListBucketsOut struct {
+	Buckets []*StorageBucket
+}
+
+// StorageDeleteBucketIn removes a bucket without files, directories and uploads.
+type StorageDeleteBucketIn struct {
+	Id string
+}
+
+type StorageDeleteBucketOut struct{}
@@ -14,8 +14,11 @@ type DiskfileWriteOut struct {
 	Written int64
 }
 
+// DiskfileReadIn reads Length bytes from Offset, the rest of the file if Length is 0.
 type DiskfileReadIn struct {
 	Name        string
+	Offset      int64
+	Length      int64
 	Destination io.Writer
 }
 
@@ -29,8 +32,17 @@ type DiskfileRemoveIn struct {
 
 type DiskfileRemoveOut struct{}
 
+type DiskfileUsageIn struct{}
+
+type DiskfileUsageOut struct {
+	TotalBytes int64
+	FreeBytes  int64
+	UsedBytes  int64
+}
+
 type Diskfile interface {
 	Write(ctx context.Context, in *DiskfileWriteIn) (*DiskfileWriteOut, error)
 	Read(ctx context.Context, in *DiskfileReadIn) (*DiskfileReadOut, error)
 	Remove(ctx context.Context, in *DiskfileRemoveIn) (*DiskfileRemoveOut, error)
+	Usage(ctx context.Context, in *DiskfileUsageIn) (*DiskfileUsageOut, error)
 }
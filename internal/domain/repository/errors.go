@@ -8,5 +8,15 @@ var (
 	ErrResourceNotFound      = errors.New("resource not found")
 	ErrBadRequest            = errors.New("bad request")
 	ErrResourceAlreadyExists = errors.New("resource already exists")
+	ErrConflict              = errors.New("resource conflict")
+	ErrResourceGone          = errors.New("resource gone")
+	ErrPreconditionFailed    = errors.New("precondition failed")
+	ErrInsufficientStorage   = errors.New("insufficient storage")
+	ErrUnauthenticated       = errors.New("unauthenticated")
+	ErrPermissionDenied      = errors.New("permission denied")
+	ErrChecksumMismatch      = errors.New("checksum mismatch")
+	ErrDataLost              = errors.New("data lost")
+	ErrMisconfigured         = errors.New("misconfigured")
+	ErrUnavailable           = errors.New("resource unavailable")
 	ErrUnknown               = errors.New("unknown error")
 )
@@ -1,14 +1,34 @@
 package repository
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
+type InfraNodeState int
+
+const (
+	InfraNodeStateUp = InfraNodeState(iota)
+	InfraNodeStateDown
+)
+
+// InfraNode is draining while its shards are moved away before the removal,
+// no new shards are placed on it.
 type InfraNode struct {
-	Id   string
-	Addr string
+	Id         string
+	Addr       string
+	State      InfraNodeState
+	Draining   bool
+	LastSeen   time.Time
+	TotalBytes int64
+	FreeBytes  int64
 }
 
+// InfraCreateNodeIn fails with ErrResourceGone for the address of a removed
+// node unless Force is set.
 type InfraCreateNodeIn struct {
-	Addr string
+	Addr  string
+	Force bool
 }
 
 type InfraCreateNodeOut struct {
@@ -30,16 +50,48 @@ type InfraListNodesOut struct {
 }
 
 type InfraGetFreerNodesIn struct {
-	Count int
+	Count        int
+	MinFreeBytes int64
 }
 
 type InfraGetFreerNodesOut struct {
 	Nodes []*InfraNode
 }
 
+type InfraNodeCapacity struct {
+	TotalBytes int64
+	FreeBytes  int64
+}
+
+type InfraSetNodeStateIn struct {
+	Id       string
+	State    InfraNodeState
+	LastSeen time.Time
+	Capacity *InfraNodeCapacity
+}
+
+type InfraSetNodeStateOut struct{}
+
+type InfraSetNodeDrainingIn struct {
+	Id       string
+	Draining bool
+}
+
+type InfraSetNodeDrainingOut struct{}
+
+// InfraDeleteNodeIn removes the node and keeps its address decommissioned.
+type InfraDeleteNodeIn struct {
+	Id string
+}
+
+type InfraDeleteNodeOut struct{}
+
 type Infra interface {
 	CreateNode(ctx context.Context, in *InfraCreateNodeIn) (*InfraCreateNodeOut, error)
 	GetNode(ctx context.Context, in *InfraGetNodeIn) (*InfraGetNodeOut, error)
 	ListNodes(ctx context.Context, in *InfraListNodesIn) (*InfraListNodesOut, error)
 	GetFreerNodes(ctx context.Context, in *InfraGetFreerNodesIn) (*InfraGetFreerNodesOut, error)
+	SetNodeState(ctx context.Context, in *InfraSetNodeStateIn) (*InfraSetNodeStateOut, error)
+	SetNodeDraining(ctx context.Context, in *InfraSetNodeDrainingIn) (*InfraSetNodeDrainingOut, error)
+	DeleteNode(ctx context.Context, in *InfraDeleteNodeIn) (*InfraDeleteNodeOut, error)
 }
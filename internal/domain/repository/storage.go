@@ -21,23 +21,101 @@ type StorageCreateShard struct {
 	Size   int64
 }
 
+// StorageCreateFileIn leaves the file without an owner when Owner is empty,
+// Replicas is the number of copies of each shard the repair keeps.
+// StorageCreateFileIn makes a Pending file for a new version in a versioned
+// bucket, it is not found at the location until it is published.
 type StorageCreateFileIn struct {
-	Location string
-	Shards   []*StorageCreateShard
+	BucketId     string
+	Location     string
+	Owner        string
+	Size         int64
+	DataShards   int
+	ParityShards int
+	BlockSize    int
+	Replicas     int
+	Pending      bool
+	Shards       []*StorageCreateShard
 }
 
 type StorageCreateFileOut struct {
 	Id string
 }
 
+// StorageSetShardStatusIn keeps the stored checksum when Checksum is empty.
 type StorageSetShardStatusIn struct {
+	FileId   string
+	NodeId   string
+	Index    int
+	Status   StorageShardStatus
+	Checksum string
+}
+
+type StorageSetShardStatusOut struct{}
+
+// StorageAddShardIn adds a new replica of a shard, an existing row of the
+// same node is replaced and a dropped one is not removed anymore.
+type StorageAddShardIn struct {
 	FileId string
 	NodeId string
 	Index  int
-	Status StorageShardStatus
+	Size   int64
 }
 
-type StorageSetShardStatusOut struct{}
+type StorageAddShardOut struct{}
+
+type StorageDeleteShardIn struct {
+	FileId string
+	NodeId string
+	Index  int
+}
+
+type StorageDeleteShardOut struct{}
+
+// StorageDropShardIn deletes the replica record, its data is left for
+// downloads in progress and listed by StorageListDroppedShardsIn after Delay.
+type StorageDropShardIn struct {
+	FileId string
+	NodeId string
+	Index  int
+	Delay  time.Duration
+}
+
+type StorageDropShardOut struct{}
+
+// StorageListDroppedShardsIn lists dropped replicas on the NodeIds whose
+// delay is over, oldest first.
+type StorageListDroppedShardsIn struct {
+	NodeIds []string
+	Limit   int
+}
+
+type StorageDroppedShard struct {
+	FileId string
+	NodeId string
+	Index  int
+}
+
+type StorageListDroppedShardsOut struct {
+	Shards []*StorageDroppedShard
+}
+
+// StorageDeleteDroppedShardIn forgets the dropped replica once its data is
+// removed.
+type StorageDeleteDroppedShardIn struct {
+	FileId string
+	NodeId string
+	Index  int
+}
+
+type StorageDeleteDroppedShardOut struct{}
+
+type StorageSetFileChecksumIn struct {
+	FileId   string
+	Checksum string
+}
+
+type StorageSetFileChecksumOut struct{}
 
 type StorageGetFileIn struct {
 	FileId string
@@ -49,20 +127,194 @@ type StorageShard struct {
 	Size      int64
 	CreatedAt time.Time
 	Status    StorageShardStatus
+	Checksum  string
 }
 
+// StorageGetFileOut has Replicas of 0 for files stored before the number
+// of replicas was recorded.
 type StorageGetFileOut struct {
-	Id       string
-	Location string
-	Shards   []*StorageShard
+	Id           string
+	Bucket       string
+	Location     string
+	Owner        string
+	Size         int64
+	CreatedAt    time.Time
+	DataShards   int
+	ParityShards int
+	BlockSize    int
+	Replicas     int
+	Checksum     string
+	// Latest is false for older versions and pending files.
+	Latest bool
+	Shards []*StorageShard
 }
 
 type StorageGetFileByLocationIn struct {
+	BucketId string
 	Location string
 }
 
 type StorageGetFileByLocationOut = StorageGetFileOut
 
+// StorageListFilesIn pages through files ordered by id, AfterId is the last id
+// of the previous page.
+type StorageListFilesIn struct {
+	AfterId string
+	Limit   int
+}
+
+type StorageListFilesOut struct {
+	Ids []string
+}
+
+// StorageListReplacedFilesIn lists files replaced by another upload at least
+// Delay ago, oldest first.
+type StorageListReplacedFilesIn struct {
+	Delay time.Duration
+	Limit int
+}
+
+type StorageListReplacedFilesOut struct {
+	Ids []string
+}
+
+// StorageListEntriesIn pages through files and directories whose location
+// starts with Prefix, ordered by location, After is the last location of the
+// previous page. Locations having Delimiter after the Prefix are rolled up
+// into Prefixes ending with the delimiter.
+type StorageListEntriesIn struct {
+	BucketId  string
+	Prefix    string
+	Delimiter string
+	After     string
+	Limit     int
+}
+
+// StorageEntry is a file or a directory, locations of directories end with "/".
+type StorageEntry struct {
+	Id        string
+	Location  string
+	Owner     string
+	Size      int64
+	Checksum  string
+	CreatedAt time.Time
+	Directory bool
+}
+
+// StorageListEntriesOut has Next set to the last returned location or prefix
+// when more entries follow.
+type StorageListEntriesOut struct {
+	Entries  []*StorageEntry
+	Prefixes []string
+	Next     string
+}
+
+type StorageFileSort int
+
+const (
+	StorageFileSortLocation = StorageFileSort(iota)
+	StorageFileSortSize
+	StorageFileSortCreatedAt
+)
+
+// StorageSearchFilesIn pages through files whose location starts with Prefix
+// and that pass the set filters, MaxSize of 0 and zero times are not set.
+// Files are ordered by Sort and then by location, After is the last file of
+// the previous page.
+type StorageSearchFilesIn struct {
+	BucketId      string
+	Prefix        string
+	Owner         string
+	MinSize       int64
+	MaxSize       int64
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Sort          StorageFileSort
+	Desc          bool
+	After         *StorageEntry
+	Limit         int
+}
+
+// StorageSearchFilesOut reports whether More files follow the last one.
+type StorageSearchFilesOut struct {
+	Files []*StorageEntry
+	More  bool
+}
+
+// StorageCreateDirectoryIn has Location ending with "/", the directory is
+// left without an owner when Owner is empty.
+type StorageCreateDirectoryIn struct {
+	BucketId string
+	Location string
+	Owner    string
+}
+
+type StorageCreateDirectoryOut struct {
+	Id string
+}
+
+type StorageGetDirectoryIn struct {
+	BucketId string
+	Location string
+}
+
+type StorageGetDirectoryOut struct {
+	Id        string
+	Location  string
+	Owner     string
+	CreatedAt time.Time
+}
+
+type StorageDeleteDirectoryIn struct {
+	Id string
+}
+
+type StorageDeleteDirectoryOut struct{}
+
+type StorageCountNodeShardsIn struct {
+	NodeId string
+}
+
+// StorageCountNodeShardsOut has Dropped replicas of the node still kept for
+// downloads in progress.
+type StorageCountNodeShardsOut struct {
+	Count   int64
+	Dropped int64
+}
+
+type StorageGetNodesUsageIn struct{}
+
+// StorageNodeUsage is the number and the total size of shards stored on a node.
+type StorageNodeUsage struct {
+	NodeId string
+	Shards int64
+	Bytes  int64
+}
+
+type StorageGetNodesUsageOut struct {
+	Nodes []*StorageNodeUsage
+}
+
+// StorageListNodeShardsIn pages through healthy shards of a node ordered by
+// file id and index, AfterFileId and AfterIndex are the last ones of the
+// previous page.
+type StorageListNodeShardsIn struct {
+	NodeId      string
+	AfterFileId string
+	AfterIndex  int
+	Limit       int
+}
+
+type StorageNodeShard struct {
+	FileId string
+	Index  int
+	Size   int64
+}
+
+type StorageListNodeShardsOut struct {
+	Shards []*StorageNodeShard
+}
+
 type StorageDeleteFileIn struct {
 	Id string
 }
@@ -72,7 +324,40 @@ type StorageDeleteFileOut struct{}
 type Storage interface {
 	CreateFile(ctx context.Context, in *StorageCreateFileIn) (*StorageCreateFileOut, error)
 	SetShardStatus(ctx context.Context, in *StorageSetShardStatusIn) (*StorageSetShardStatusOut, error)
+	AddShard(ctx context.Context, in *StorageAddShardIn) (*StorageAddShardOut, error)
+	DeleteShard(ctx context.Context, in *StorageDeleteShardIn) (*StorageDeleteShardOut, error)
+	DropShard(ctx context.Context, in *StorageDropShardIn) (*StorageDropShardOut, error)
+	ListDroppedShards(ctx context.Context, in *StorageListDroppedShardsIn) (*StorageListDroppedShardsOut, error)
+	DeleteDroppedShard(ctx context.Context, in *StorageDeleteDroppedShardIn) (*StorageDeleteDroppedShardOut, error)
+	SetFileChecksum(ctx context.Context, in *StorageSetFileChecksumIn) (*StorageSetFileChecksumOut, error)
 	GetFile(ctx context.Context, in *StorageGetFileIn) (*StorageGetFileOut, error)
 	GetFileByLocation(ctx context.Context, in *StorageGetFileByLocationIn) (*StorageGetFileByLocationOut, error)
+	ListFiles(ctx context.Context, in *StorageListFilesIn) (*StorageListFilesOut, error)
+	ListReplacedFiles(ctx context.Context, in *StorageListReplacedFilesIn) (*StorageListReplacedFilesOut, error)
+	ListEntries(ctx context.Context, in *StorageListEntriesIn) (*StorageListEntriesOut, error)
+	SearchFiles(ctx context.Context, in *StorageSearchFilesIn) (*StorageSearchFilesOut, error)
+	CreateDirectory(ctx context.Context, in *StorageCreateDirectoryIn) (*StorageCreateDirectoryOut, error)
+	GetDirectory(ctx context.Context, in *StorageGetDirectoryIn) (*StorageGetDirectoryOut, error)
+	DeleteDirectory(ctx context.Context, in *StorageDeleteDirectoryIn) (*StorageDeleteDirectoryOut, error)
+	CountNodeShards(ctx context.Context, in *StorageCountNodeShardsIn) (*StorageCountNodeShardsOut, error)
+	GetNodesUsage(ctx context.Context, in *StorageGetNodesUsageIn) (*StorageGetNodesUsageOut, error)
+	ListNodeShards(ctx context.Context, in *StorageListNodeShardsIn) (*StorageListNodeShardsOut, error)
 	DeleteFile(ctx context.Context, in *StorageDeleteFileIn) (*StorageDeleteFileOut, error)
+	PublishFile(ctx context.Context, in *StoragePublishFileIn) (*StoragePublishFileOut, error)
+	ArchiveFile(ctx context.Context, in *StorageArchiveFileIn) (*StorageArchiveFileOut, error)
+	ListVersions(ctx context.Context, in *StorageListVersionsIn) (*StorageListVersionsOut, error)
+	GetVersion(ctx context.Context, in *StorageGetVersionIn) (*StorageGetVersionOut, error)
+	RestoreVersion(ctx context.Context, in *StorageRestoreVersionIn) (*StorageRestoreVersionOut, error)
+	DeleteVersion(ctx context.Context, in *StorageDeleteVersionIn) (*StorageDeleteVersionOut, error)
+	CreateUpload(ctx context.Context, in *StorageCreateUploadIn) (*StorageCreateUploadOut, error)
+	GetUpload(ctx context.Context, in *StorageGetUploadIn) (*StorageGetUploadOut, error)
+	SetUploadProgress(ctx context.Context, in *StorageSetUploadProgressIn) (*StorageSetUploadProgressOut, error)
+	SetUploadPart(ctx context.Context, in *StorageSetUploadPartIn) (*StorageSetUploadPartOut, error)
+	CompleteUpload(ctx context.Context, in *StorageCompleteUploadIn) (*StorageCompleteUploadOut, error)
+	DeleteUpload(ctx context.Context, in *StorageDeleteUploadIn) (*StorageDeleteUploadOut, error)
+	ListExpiredUploads(ctx context.Context, in *StorageListExpiredUploadsIn) (*StorageListExpiredUploadsOut, error)
+	CreateBucket(ctx context.Context, in *StorageCreateBucketIn) (*StorageCreateBucketOut, error)
+	GetBucket(ctx context.Context, in *StorageGetBucketIn) (*StorageGetBucketOut, error)
+	ListBuckets(ctx context.Context, in *StorageListBucketsIn) (*StorageListBucketsOut, error)
+	DeleteBucket(ctx context.Context, in *StorageDeleteBucketIn) (*StorageDeleteBucketOut, error)
 }
@@ -0,0 +1,125 @@
+package repository
+
+import (
+	"time"
+)
+
+// StorageCreateUploadIn reserves a file id for a resumable upload, Shards are
+// stored one by one and the upload expires after Expiry without progress.
+// Shards of a Multipart upload are placed by StorageSetUploadPartIn instead,
+// its size is known at completion only. Replicas is recorded for the file.
+// An upload to a Versioned bucket or a Replace one may have a file at its
+// location, a Replace upload takes its place on completion.
+type StorageCreateUploadIn struct {
+	BucketId  string
+	Location  string
+	Owner     string
+	Size      int64
+	ChunkSize int64
+	Multipart bool
+	Replicas  int
+	Versioned bool
+	Replace   bool
+	Expiry    time.Duration
+	Shards    []*StorageCreateShard
+}
+
+type StorageCreateUploadOut struct {
+	Id string
+}
+
+type StorageGetUploadIn struct {
+	Id string
+}
+
+// StorageUploadShard has an empty Checksum until it is stored.
+type StorageUploadShard struct {
+	NodeId   string
+	Index    int
+	Size     int64
+	Checksum string
+}
+
+// StorageGetUploadOut is an upload which has not expired yet, Uploaded bytes
+// are stored and HashState is the marshaled SHA-256 of them.
+type StorageGetUploadOut struct {
+	Id        string
+	FileId    string
+	Bucket    string
+	Location  string
+	Owner     string
+	Size      int64
+	ChunkSize int64
+	Multipart bool
+	Replace   bool
+	Replicas  int
+	Uploaded  int64
+	HashState []byte
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	Shards    []*StorageUploadShard
+}
+
+// StorageSetUploadProgressIn records the shard Index as stored and moves the
+// upload from From to To bytes, it fails with ErrConflict when the upload is
+// not at From anymore.
+type StorageSetUploadProgressIn struct {
+	Id        string
+	From      int64
+	To        int64
+	HashState []byte
+	Index     int
+	Checksum  string
+	Expiry    time.Duration
+}
+
+type StorageSetUploadProgressOut struct{}
+
+// StorageSetUploadPartIn replaces the replicas of the part Index of a
+// multipart upload with the stored Shards.
+type StorageSetUploadPartIn struct {
+	Id     string
+	Index  int
+	Shards []*StorageUploadShard
+	Expiry time.Duration
+}
+
+// StorageSetUploadPartOut returns the replaced replicas, their data is left
+// on the nodes.
+type StorageSetUploadPartOut struct {
+	Replaced []*StorageUploadShard
+}
+
+// StorageCompleteUploadIn turns a fully stored upload into a file with healthy
+// shards and removes the upload. A multipart upload becomes a file of Size
+// bytes made of its first Parts parts, the rest of them are dropped. In a
+// Versioned bucket the file becomes the latest version of the location, a
+// replacing upload takes the place of the file at the location.
+type StorageCompleteUploadIn struct {
+	Id        string
+	Checksum  string
+	Size      int64
+	Parts     int
+	Versioned bool
+}
+
+// StorageCompleteUploadOut has an empty VersionId out of versioned buckets.
+type StorageCompleteUploadOut struct {
+	FileId    string
+	VersionId string
+}
+
+type StorageDeleteUploadIn struct {
+	Id string
+}
+
+type StorageDeleteUploadOut struct{}
+
+type StorageListExpiredUploadsIn struct {
+	Limit int
+}
+
+// StorageListExpiredUploadsOut returns the expired uploads with their shards.
+type StorageListExpiredUploadsOut struct {
+	Uploads []*StorageGetUploadOut
+}
@@ -0,0 +1,111 @@
+package repository
+
+import (
+	"slices"
+	"time"
+)
+
+// StorageFileVersion is a version of a location in a versioning bucket, a
+// delete marker has an empty FileId.
+type StorageFileVersion struct {
+	Id        string
+	Location  string
+	FileId    string
+	Owner     string
+	Size      int64
+	Checksum  string
+	CreatedAt time.Time
+}
+
+// StoragePublishFileIn makes the pending file the latest one of its location
+// if the conditions hold for the current latest file. With Versioned the
+// previous file is kept as an older version, otherwise it is marked replaced
+// and its shards are removed later.
+type StoragePublishFileIn struct {
+	FileId     string
+	Versioned  bool
+	Conditions StorageFileConditions
+}
+
+type StoragePublishFileOut struct {
+	VersionId string
+	Replaced  bool
+}
+
+// StorageFileConditions are preconditions on the latest file of a location,
+// the entity tags are file checksums and "*" matches any file.
+type StorageFileConditions struct {
+	IfMatch     []string
+	IfNoneMatch []string
+}
+
+// Match reports whether the conditions hold, checksum is the one of the
+// latest file when exists.
+func (c StorageFileConditions) Match(exists bool, checksum string) bool {
+	matches := func(etags []string) bool {
+		return exists && (slices.Contains(etags, "*") || checksum != "" && slices.Contains(etags, checksum))
+	}
+	if len(c.IfMatch) > 0 && !matches(c.IfMatch) {
+		return false
+	}
+	if len(c.IfNoneMatch) > 0 && matches(c.IfNoneMatch) {
+		return false
+	}
+	return true
+}
+
+// StorageArchiveFileIn hides the latest file of a versioning bucket behind a
+// delete marker of Owner.
+type StorageArchiveFileIn struct {
+	FileId string
+	Owner  string
+}
+
+type StorageArchiveFileOut struct {
+	VersionId string
+}
+
+type StorageListVersionsIn struct {
+	BucketId string
+	Location string
+}
+
+// StorageListVersionsOut has the newest version first, it is the latest one.
+type StorageListVersionsOut struct {
+	Versions []*StorageFileVersion
+}
+
+type StorageGetVersionIn struct {
+	BucketId string
+	Location string
+	Id       string
+}
+
+type StorageGetVersionOut = StorageFileVersion
+
+// StorageRestoreVersionIn makes a new latest version of Owner with the file
+// of an older version.
+type StorageRestoreVersionIn struct {
+	BucketId string
+	Location string
+	Id       string
+	Owner    string
+}
+
+type StorageRestoreVersionOut struct {
+	VersionId string
+}
+
+// StorageDeleteVersionIn removes a version for good, the newest remaining
+// version becomes the latest one.
+type StorageDeleteVersionIn struct {
+	BucketId string
+	Location string
+	Id       string
+}
+
+// StorageDeleteVersionOut has the id of the file no version refers to any
+// more, its shards are to be deleted.
+type StorageDeleteVersionOut struct {
+	UnusedFileId string
+}
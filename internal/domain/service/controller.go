@@ -3,53 +3,670 @@ package service
 import (
 	"context"
 	"io"
+	"time"
 )
 
+// ControllerJoinNodeIn with Force joins the address of a removed node again,
+// otherwise it fails with ErrResourceGone.
 type ControllerJoinNodeIn struct {
-	Addr string
+	Addr  string
+	Force bool
 }
 
 type ControllerJoinNodeOut struct {
 	Id string
 }
 
+type ControllerGetNodeIn struct {
+	Id string
+}
+
+// ControllerGetNodeOut describes a node, Shards is the number of shards on it.
+type ControllerGetNodeOut struct {
+	Id         string
+	Addr       string
+	Up         bool
+	Draining   bool
+	LastSeen   time.Time
+	TotalBytes int64
+	FreeBytes  int64
+	Shards     int64
+}
+
+type ControllerRemoveNodeIn struct {
+	Id string
+}
+
+// ControllerRemoveNodeOut reports whether the node is removed at once, else it
+// is draining until its Shards are moved to other nodes.
+type ControllerRemoveNodeOut struct {
+	Removed bool
+	Shards  int64
+}
+
+// ControllerDefaultBucket holds the files of requests with an empty Bucket.
+const ControllerDefaultBucket = "default"
+
+// ControllerBucket scopes file locations, new files of the bucket are split
+// into DataShards with ParityShards and Replicas copies. A Versioning bucket
+// keeps replaced and deleted files as older versions.
+type ControllerBucket struct {
+	Name         string
+	Owner        string
+	DataShards   int
+	ParityShards int
+	Replicas     int
+	Versioning   bool
+	CreatedAt    time.Time
+}
+
+// ControllerCreateBucketIn has the settings of new files, DataShards and
+// Replicas of 0 and nil ParityShards are taken from the controller
+// configuration and stored with the bucket.
+type ControllerCreateBucketIn struct {
+	Name         string
+	Owner        string
+	DataShards   int
+	ParityShards *int
+	Replicas     int
+	Versioning   bool
+}
+
+type ControllerCreateBucketOut struct {
+	Bucket *ControllerBucket
+}
+
+type ControllerGetBucketIn struct {
+	Name string
+}
+
+type ControllerGetBucketOut struct {
+	Bucket *ControllerBucket
+}
+
+type ControllerListBucketsIn struct{}
+
+type ControllerListBucketsOut struct {
+	Buckets []*ControllerBucket
+}
+
+// ControllerDeleteBucketIn removes an empty bucket, the default bucket can't
+// be removed.
+type ControllerDeleteBucketIn struct {
+	Name string
+}
+
+type ControllerDeleteBucketOut struct{}
+
+// ControllerUploadFileIn leaves the file without an owner when Owner is empty.
+// With Replace the file takes the place of the existing one once all its
+// shards are stored, IfMatch and IfNoneMatch are checksums the existing file
+// must or must not have, "*" matches any file.
 type ControllerUploadFileIn struct {
-	Location string
-	Size     int64
-	Content  io.Reader
+	Bucket      string
+	Location    string
+	Owner       string
+	Size        int64
+	Content     io.Reader
+	Replace     bool
+	IfMatch     []string
+	IfNoneMatch []string
 }
 
+// ControllerUploadFileOut has an empty Version out of versioning buckets,
+// Replaced is set when the upload took the place of an existing file.
 type ControllerUploadFileOut struct {
-	Id string
+	Id       string
+	Version  string
+	Replaced bool
 }
 
+// ControllerSearchFileIn finds the latest file at the location or the file
+// of the Version when it is set.
 type ControllerSearchFileIn struct {
+	Bucket   string
 	Location string
+	Version  string
 }
 
+// ControllerSearchFileOut has an empty Owner for files uploaded before the
+// ownership was recorded or by a deleted key.
 type ControllerSearchFileOut struct {
-	Id     string
-	Size   int64
-	Status int
+	Id         string
+	Owner      string
+	Size       int64
+	Status     int
+	ModifiedAt time.Time
+	// Checksum is the hex encoded SHA-256 of the content, empty for files
+	// uploaded before checksums were introduced.
+	Checksum string
+}
+
+type ControllerFileSort int
+
+const (
+	ControllerFileSortLocation = ControllerFileSort(iota)
+	ControllerFileSortSize
+	ControllerFileSortCreatedAt
+)
+
+// ControllerListFilesIn pages through files whose location starts with
+// Prefix, Cursor is the Next of the previous page. Locations having
+// Delimiter after the Prefix are rolled up into Prefixes, such listings
+// are sorted by location only and can't be filtered. MaxSize of 0 and zero
+// times are not set. Without a Cursor the listing sorted by location in the
+// ascending order starts after the After location.
+type ControllerListFilesIn struct {
+	Bucket        string
+	Prefix        string
+	Delimiter     string
+	Owner         string
+	MinSize       int64
+	MaxSize       int64
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Sort          ControllerFileSort
+	Desc          bool
+	Cursor        string
+	After         string
+	Limit         int
+}
+
+type ControllerFileEntry struct {
+	Id        string
+	Location  string
+	Owner     string
+	Size      int64
+	Checksum  string
+	CreatedAt time.Time
+}
+
+// ControllerDirectory has Location ending with "/".
+type ControllerDirectory struct {
+	Id        string
+	Location  string
+	Owner     string
+	CreatedAt time.Time
+}
+
+// ControllerListFilesOut has Next set when more entries follow, Directories
+// and Prefixes are only listed with a delimiter.
+type ControllerListFilesOut struct {
+	Files       []*ControllerFileEntry
+	Directories []*ControllerDirectory
+	Prefixes    []string
+	Next        string
+}
+
+// ControllerCreateDirectoryIn accepts Location with or without the trailing "/".
+type ControllerCreateDirectoryIn struct {
+	Bucket   string
+	Location string
+	Owner    string
+}
+
+type ControllerCreateDirectoryOut struct {
+	Directory *ControllerDirectory
+}
+
+type ControllerSearchDirectoryIn struct {
+	Bucket   string
+	Location string
+}
+
+type ControllerSearchDirectoryOut struct {
+	Directory *ControllerDirectory
+}
+
+// ControllerDeleteDirectoryIn removes an empty directory.
+type ControllerDeleteDirectoryIn struct {
+	Bucket   string
+	Location string
+}
+
+type ControllerDeleteDirectoryOut struct{}
+
+// ControllerGetFileInfoIn finds the file as ControllerSearchFileIn does.
+type ControllerGetFileInfoIn struct {
+	Bucket   string
+	Location string
+	Version  string
+}
+
+// ControllerShardInfo is a replica of a shard, NodeAddr is empty for removed nodes.
+type ControllerShardInfo struct {
+	Index     int
+	NodeId    string
+	NodeAddr  string
+	Size      int64
+	Status    int
+	Checksum  string
+	CreatedAt time.Time
+}
+
+// ControllerGetFileInfoOut describes a file and the placement of its shards,
+// Status is the one of ControllerSearchFileOut.
+type ControllerGetFileInfoOut struct {
+	Id           string
+	Bucket       string
+	Location     string
+	Owner        string
+	Size         int64
+	Status       int
+	CreatedAt    time.Time
+	ModifiedAt   time.Time
+	Checksum     string
+	DataShards   int
+	ParityShards int
+	BlockSize    int
+	Replicas     int
+	Shards       []*ControllerShardInfo
+}
+
+// ControllerUpload is a resumable upload, Uploaded bytes are stored and the
+// next chunk starts there. Chunks are ChunkSize bytes except the last one.
+// A Multipart upload is made of parts stored in any order, its Size is known
+// when it is completed.
+type ControllerUpload struct {
+	Id        string
+	Bucket    string
+	Location  string
+	Owner     string
+	Size      int64
+	ChunkSize int64
+	Multipart bool
+	Uploaded  int64
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// ControllerCreateUploadIn leaves the file without an owner when Owner is empty.
+// With Replace the completed file takes the place of the existing one.
+type ControllerCreateUploadIn struct {
+	Bucket    string
+	Location  string
+	Owner     string
+	Size      int64
+	Multipart bool
+	Replace   bool
+}
+
+type ControllerCreateUploadOut struct {
+	Upload *ControllerUpload
+}
+
+type ControllerGetUploadIn struct {
+	Id string
+}
+
+type ControllerGetUploadOut struct {
+	Upload *ControllerUpload
+}
+
+// ControllerUploadChunkIn writes Size bytes of Content at Offset, which must
+// be the Uploaded bytes of the upload. Size is a multiple of the chunk size
+// unless the chunk ends the file.
+type ControllerUploadChunkIn struct {
+	Id      string
+	Offset  int64
+	Size    int64
+	Content io.Reader
+}
+
+// ControllerUploadChunkOut is the upload after the chunk.
+type ControllerUploadChunkOut struct {
+	Upload *ControllerUpload
+}
+
+// ControllerUploadPartIn stores Size bytes of Content as the part Number of a
+// multipart upload, a stored part with the same number is replaced.
+type ControllerUploadPartIn struct {
+	Id      string
+	Number  int
+	Size    int64
+	Content io.Reader
+}
+
+// ControllerUploadPartOut has the hex SHA-256 of the part.
+type ControllerUploadPartOut struct {
+	Checksum string
+}
+
+// ControllerUploadPart is a stored part of a multipart upload.
+type ControllerUploadPart struct {
+	Number   int
+	Checksum string
+}
+
+// ControllerCompleteUploadIn lists the Parts of a multipart upload making the
+// file in the increasing order of their numbers. The other parts are dropped.
+type ControllerCompleteUploadIn struct {
+	Id    string
+	Parts []*ControllerUploadPart
 }
 
+// ControllerCompleteUploadOut has the SHA-256 of the whole file.
+type ControllerCompleteUploadOut struct {
+	Id       string
+	Version  string
+	Size     int64
+	Checksum string
+}
+
+type ControllerAbortUploadIn struct {
+	Id string
+}
+
+type ControllerAbortUploadOut struct{}
+
+// ControllerDownloadFileIn reads Length bytes from Offset, the rest of the file if Length is 0.
 type ControllerDownloadFileIn struct {
 	Id      string
+	Offset  int64
+	Length  int64
 	Content io.Writer
 }
 
 type ControllerDownloadFileOut struct{}
 
+// ControllerDeleteFileIn hides the latest file of a versioning bucket behind a
+// delete marker of Owner, other files are removed.
 type ControllerDeleteFileIn struct {
+	Id    string
+	Owner string
+}
+
+// ControllerDeleteFileOut has the Version of the delete marker.
+type ControllerDeleteFileOut struct {
+	Version string
+}
+
+// ControllerFileVersion is a version of a location, a Deleted version is a
+// delete marker. The Latest version is the one found at the location.
+type ControllerFileVersion struct {
+	Id        string
+	Location  string
+	FileId    string
+	Owner     string
+	Size      int64
+	Checksum  string
+	Deleted   bool
+	Latest    bool
+	CreatedAt time.Time
+}
+
+type ControllerListVersionsIn struct {
+	Bucket   string
+	Location string
+}
+
+// ControllerListVersionsOut has the newest version first.
+type ControllerListVersionsOut struct {
+	Versions []*ControllerFileVersion
+}
+
+// ControllerRestoreVersionIn makes a new latest version of Owner with the
+// content of the Version.
+type ControllerRestoreVersionIn struct {
+	Bucket   string
+	Location string
+	Version  string
+	Owner    string
+}
+
+type ControllerRestoreVersionOut struct {
+	Version string
+}
+
+// ControllerPurgeVersionIn removes the Version for good, the newest
+// remaining version becomes the latest one.
+type ControllerPurgeVersionIn struct {
+	Bucket   string
+	Location string
+	Version  string
+}
+
+type ControllerPurgeVersionOut struct{}
+
+// ControllerScrubReport counts shards checked by a scrubbing pass. Shards that
+// could not be checked (not uploaded yet, without checksum, on a down node)
+// are Skipped.
+type ControllerScrubReport struct {
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Files      int64
+	Shards     int64
+	Bytes      int64
+	Verified   int64
+	Corrupted  int64
+	Missing    int64
+	Skipped    int64
+}
+
+type ControllerGetScrubStatusIn struct{}
+
+type ControllerGetScrubStatusOut struct {
+	Running bool
+	Current *ControllerScrubReport
+	Last    *ControllerScrubReport
+}
+
+type ControllerStartScrubIn struct{}
+
+type ControllerStartScrubOut struct {
+	Started bool
+}
+
+// ControllerRepairReport counts shards restored by a repair pass. Files are
+// Degraded when some of their shards have fewer healthy replicas than
+// configured, Failed shards could not be restored.
+type ControllerRepairReport struct {
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Files      int64
+	Degraded   int64
+	Repaired   int64
+	Failed     int64
+	Bytes      int64
+}
+
+type ControllerGetRepairStatusIn struct{}
+
+type ControllerGetRepairStatusOut struct {
+	Running bool
+	Current *ControllerRepairReport
+	Last    *ControllerRepairReport
+}
+
+type ControllerStartRepairIn struct{}
+
+type ControllerStartRepairOut struct {
+	Started bool
+}
+
+// ControllerRebalanceReport counts shards moved by a rebalancing pass, Failed
+// moves are planned again by the next pass.
+type ControllerRebalanceReport struct {
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Planned    int64
+	Moved      int64
+	Failed     int64
+	Skipped    int64
+	Bytes      int64
+}
+
+type ControllerGetRebalanceStatusIn struct{}
+
+type ControllerGetRebalanceStatusOut struct {
+	Running bool
+	Current *ControllerRebalanceReport
+	Last    *ControllerRebalanceReport
+}
+
+type ControllerStartRebalanceIn struct{}
+
+type ControllerStartRebalanceOut struct {
+	Started bool
+}
+
+type ControllerPlanRebalanceIn struct{}
+
+// ControllerRebalanceNode is the disk usage of a node, Usage is the share of
+// the node capacity taken by shards now and PlannedUsage after the moves.
+type ControllerRebalanceNode struct {
+	Id           string
+	UsedBytes    int64
+	TotalBytes   int64
+	Usage        float64
+	PlannedUsage float64
+}
+
+type ControllerRebalanceMove struct {
+	FileId     string
+	Index      int
+	Size       int64
+	FromNodeId string
+	ToNodeId   string
+}
+
+type ControllerPlanRebalanceOut struct {
+	MeanUsage float64
+	Nodes     []*ControllerRebalanceNode
+	Moves     []*ControllerRebalanceMove
+}
+
+type ControllerGetNodePoolsIn struct{}
+
+// ControllerNodePool is the usage of the connections to a node, Conns, Idle
+// and Streams are the current numbers, the rest are counted since the
+// controller start.
+type ControllerNodePool struct {
+	NodeId    string
+	Conns     int
+	Idle      int
+	Streams   int
+	Dials     int64
+	Reuses    int64
+	Waits     int64
+	Unhealthy int64
+	Expired   int64
+}
+
+type ControllerGetNodePoolsOut struct {
+	Pools []*ControllerNodePool
+}
+
+// ControllerRole grants everything the lower roles are allowed.
+type ControllerRole int
+
+const (
+	ControllerRoleReadOnly = ControllerRole(iota)
+	ControllerRoleReadWrite
+	ControllerRoleAdmin
+)
+
+type ControllerApiKey struct {
+	Id        string
+	Name      string
+	Role      ControllerRole
+	CreatedAt time.Time
+}
+
+type ControllerAuthenticateIn struct {
+	Token string
+}
+
+type ControllerAuthenticateOut struct {
+	Key *ControllerApiKey
+}
+
+// ControllerCreateApiKeyIn generates a token when Token is empty, a key with
+// the same token gets the new name and role.
+type ControllerCreateApiKeyIn struct {
+	Name  string
+	Role  ControllerRole
+	Token string
+}
+
+// ControllerCreateApiKeyOut returns the token once, only its hash is stored.
+type ControllerCreateApiKeyOut struct {
+	Key   *ControllerApiKey
+	Token string
+}
+
+type ControllerCreateS3CredentialsIn struct {
+	KeyId string
+}
+
+// ControllerCreateS3CredentialsOut returns new S3 credentials of the key,
+// the previous ones stop working.
+type ControllerCreateS3CredentialsOut struct {
+	AccessKey string
+	Secret    string
+}
+
+type ControllerAuthenticateS3In struct {
+	AccessKey string
+}
+
+// ControllerAuthenticateS3Out returns the secret to check the SigV4 signature
+// of the request with.
+type ControllerAuthenticateS3Out struct {
+	Key    *ControllerApiKey
+	Secret string
+}
+
+type ControllerListApiKeysIn struct{}
+
+type ControllerListApiKeysOut struct {
+	Keys []*ControllerApiKey
+}
+
+type ControllerDeleteApiKeyIn struct {
 	Id string
 }
 
-type ControllerDeleteFileOut struct{}
+type ControllerDeleteApiKeyOut struct{}
 
 type Controller interface {
 	JoinNode(ctx context.Context, in *ControllerJoinNodeIn) (*ControllerJoinNodeOut, error)
+	GetNode(ctx context.Context, in *ControllerGetNodeIn) (*ControllerGetNodeOut, error)
+	RemoveNode(ctx context.Context, in *ControllerRemoveNodeIn) (*ControllerRemoveNodeOut, error)
 	UploadFile(ctx context.Context, in *ControllerUploadFileIn) (*ControllerUploadFileOut, error)
 	SearchFile(ctx context.Context, in *ControllerSearchFileIn) (*ControllerSearchFileOut, error)
 	DownloadFile(ctx context.Context, in *ControllerDownloadFileIn) (*ControllerDownloadFileOut, error)
 	DeleteFile(ctx context.Context, in *ControllerDeleteFileIn) (*ControllerDeleteFileOut, error)
+	ListVersions(ctx context.Context, in *ControllerListVersionsIn) (*ControllerListVersionsOut, error)
+	RestoreVersion(ctx context.Context, in *ControllerRestoreVersionIn) (*ControllerRestoreVersionOut, error)
+	PurgeVersion(ctx context.Context, in *ControllerPurgeVersionIn) (*ControllerPurgeVersionOut, error)
+	CreateBucket(ctx context.Context, in *ControllerCreateBucketIn) (*ControllerCreateBucketOut, error)
+	GetBucket(ctx context.Context, in *ControllerGetBucketIn) (*ControllerGetBucketOut, error)
+	ListBuckets(ctx context.Context, in *ControllerListBucketsIn) (*ControllerListBucketsOut, error)
+	DeleteBucket(ctx context.Context, in *ControllerDeleteBucketIn) (*ControllerDeleteBucketOut, error)
+	CreateUpload(ctx context.Context, in *ControllerCreateUploadIn) (*ControllerCreateUploadOut, error)
+	GetUpload(ctx context.Context, in *ControllerGetUploadIn) (*ControllerGetUploadOut, error)
+	UploadChunk(ctx context.Context, in *ControllerUploadChunkIn) (*ControllerUploadChunkOut, error)
+	UploadPart(ctx context.Context, in *ControllerUploadPartIn) (*ControllerUploadPartOut, error)
+	CompleteUpload(ctx context.Context, in *ControllerCompleteUploadIn) (*ControllerCompleteUploadOut, error)
+	AbortUpload(ctx context.Context, in *ControllerAbortUploadIn) (*ControllerAbortUploadOut, error)
+	ListFiles(ctx context.Context, in *ControllerListFilesIn) (*ControllerListFilesOut, error)
+	GetFileInfo(ctx context.Context, in *ControllerGetFileInfoIn) (*ControllerGetFileInfoOut, error)
+	CreateDirectory(ctx context.Context, in *ControllerCreateDirectoryIn) (*ControllerCreateDirectoryOut, error)
+	SearchDirectory(ctx context.Context, in *ControllerSearchDirectoryIn) (*ControllerSearchDirectoryOut, error)
+	DeleteDirectory(ctx context.Context, in *ControllerDeleteDirectoryIn) (*ControllerDeleteDirectoryOut, error)
+	GetScrubStatus(ctx context.Context, in *ControllerGetScrubStatusIn) (*ControllerGetScrubStatusOut, error)
+	StartScrub(ctx context.Context, in *ControllerStartScrubIn) (*ControllerStartScrubOut, error)
+	GetRepairStatus(ctx context.Context, in *ControllerGetRepairStatusIn) (*ControllerGetRepairStatusOut, error)
+	StartRepair(ctx context.Context, in *ControllerStartRepairIn) (*ControllerStartRepairOut, error)
+	GetRebalanceStatus(ctx context.Context, in *ControllerGetRebalanceStatusIn) (*ControllerGetRebalanceStatusOut, error)
+	StartRebalance(ctx context.Context, in *ControllerStartRebalanceIn) (*ControllerStartRebalanceOut, error)
+	PlanRebalance(ctx context.Context, in *ControllerPlanRebalanceIn) (*ControllerPlanRebalanceOut, error)
+	GetNodePools(ctx context.Context, in *ControllerGetNodePoolsIn) (*ControllerGetNodePoolsOut, error)
+	Authenticate(ctx context.Context, in *ControllerAuthenticateIn) (*ControllerAuthenticateOut, error)
+	CreateApiKey(ctx context.Context, in *ControllerCreateApiKeyIn) (*ControllerCreateApiKeyOut, error)
+	ListApiKeys(ctx context.Context, in *ControllerListApiKeysIn) (*ControllerListApiKeysOut, error)
+	DeleteApiKey(ctx context.Context, in *ControllerDeleteApiKeyIn) (*ControllerDeleteApiKeyOut, error)
+	CreateS3Credentials(ctx context.Context, in *ControllerCreateS3CredentialsIn) (*ControllerCreateS3CredentialsOut, error)
+	AuthenticateS3(ctx context.Context, in *ControllerAuthenticateS3In) (*ControllerAuthenticateS3Out, error)
 }
@@ -7,15 +7,19 @@ import (
 
 type NodeSaveFileIn struct {
 	Name       string
+	Size       int64
 	DataReader io.Reader
 }
 
 type NodeSaveFileOut struct {
-	Written int64
+	Written  int64
+	Checksum string
 }
 
 type NodeGetFileIn struct {
 	Name       string
+	Offset     int64
+	Length     int64
 	DataWriter io.Writer
 }
 
@@ -29,8 +33,26 @@ type NodeDeleteFileIn struct {
 
 type NodeDeleteFileOut struct{}
 
+type NodeHashFileIn struct {
+	Name string
+}
+
+type NodeHashFileOut struct {
+	Size     int64
+	Checksum string
+}
+
+type NodePingIn struct{}
+
+type NodePingOut struct {
+	TotalBytes int64
+	FreeBytes  int64
+}
+
 type Node interface {
 	SaveFile(ctx context.Context, in *NodeSaveFileIn) (*NodeSaveFileOut, error)
 	GetFile(ctx context.Context, in *NodeGetFileIn) (*NodeGetFileOut, error)
 	DeleteFile(ctx context.Context, in *NodeDeleteFileIn) (*NodeDeleteFileOut, error)
+	HashFile(ctx context.Context, in *NodeHashFileIn) (*NodeHashFileOut, error)
+	Ping(ctx context.Context, in *NodePingIn) (*NodePingOut, error)
 }
@@ -0,0 +1,72 @@
+package nodeerr
+
+import (
+	"errors"
+	"net"
+
+	"github.com/fydmer/fileserver/internal/domain/repository"
+	"github.com/fydmer/fileserver/pkg/nodecli"
+	"github.com/fydmer/fileserver/pkg/nodeproto"
+)
+
+// Parse maps a failure reported by a node onto a repository error, the
+// original error is kept in the chain.
+func Parse(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var target error
+	var protoErr *nodeproto.Error
+	var netErr net.Error
+	switch {
+	case errors.Is(err, nodecli.ErrFileNotFound):
+		target = repository.ErrResourceNotFound
+	case errors.Is(err, nodecli.ErrChecksumMismatch):
+		target = repository.ErrChecksumMismatch
+	case errors.As(err, &protoErr):
+		switch protoErr.Status {
+		case nodeproto.StatusNotFound:
+			target = repository.ErrResourceNotFound
+		case nodeproto.StatusInsufficientStorage:
+			target = repository.ErrInsufficientStorage
+		case nodeproto.StatusPermissionDenied, nodeproto.StatusUnauthenticated:
+			// the node disk or the node secret is misconfigured, not the client
+			target = repository.ErrMisconfigured
+		case nodeproto.StatusChecksumMismatch:
+			target = repository.ErrChecksumMismatch
+		case nodeproto.StatusBadRequest:
+			target = repository.ErrBadRequest
+		case nodeproto.StatusCanceled:
+			return err
+		case nodeproto.StatusUnsupported:
+			target = repository.ErrUnavailable
+		default:
+			target = repository.ErrUnknown
+		}
+	case errors.Is(err, nodeproto.ErrClosed), errors.As(err, &netErr):
+		target = repository.ErrUnavailable
+	default:
+		return err
+	}
+
+	if errors.Is(err, target) {
+		return err
+	}
+	return &nodeError{target: target, err: err}
+}
+
+// nodeError matches the repository error keeping the message of the node,
+// which already tells the reason.
+type nodeError struct {
+	target error
+	err    error
+}
+
+func (e *nodeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *nodeError) Unwrap() []error {
+	return []error{e.target, e.err}
+}
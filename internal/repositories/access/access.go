@@ -0,0 +1,121 @@
+package access
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/fydmer/fileserver/internal/domain/repository"
+	"github.com/fydmer/fileserver/internal/errors/pgerr"
+)
+
+type Repository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) (*Repository, error) {
+	return &Repository{db: db}, nil
+}
+
+func (r *Repository) CreateApiKey(ctx context.Context, in *repository.AccessCreateApiKeyIn) (*repository.AccessCreateApiKeyOut, error) {
+	query := `insert into api_keys (name, role, token_hash) values ($1, $2, $3) 
+    on conflict (token_hash) do update set name = excluded.name, role = excluded.role 
+    returning id, name, role, created_at`
+
+	key, err := scanApiKey(r.db.QueryRowContext(ctx, query, in.Name, in.Role, in.TokenHash))
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return &repository.AccessCreateApiKeyOut{
+		Key: key,
+	}, nil
+}
+
+func (r *Repository) GetApiKey(ctx context.Context, in *repository.AccessGetApiKeyIn) (*repository.AccessGetApiKeyOut, error) {
+	query := `select id, name, role, created_at from api_keys where token_hash = $1`
+
+	key, err := scanApiKey(r.db.QueryRowContext(ctx, query, in.TokenHash))
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return &repository.AccessGetApiKeyOut{
+		Key: key,
+	}, nil
+}
+
+func (r *Repository) ListApiKeys(ctx context.Context, _ *repository.AccessListApiKeysIn) (*repository.AccessListApiKeysOut, error) {
+	query := `select id, name, role, created_at from api_keys order by created_at, id`
+
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+	defer rows.Close()
+
+	out := &repository.AccessListApiKeysOut{}
+	for rows.Next() {
+		key, err := scanApiKey(rows)
+		if err != nil {
+			return nil, pgerr.Parse(err)
+		}
+		out.Keys = append(out.Keys, key)
+	}
+
+	return out, nil
+}
+
+func (r *Repository) DeleteApiKey(ctx context.Context, in *repository.AccessDeleteApiKeyIn) (*repository.AccessDeleteApiKeyOut, error) {
+	query := `delete from api_keys where id = $1`
+
+	result, err := r.db.ExecContext(ctx, query, in.Id)
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return nil, repository.ErrResourceNotFound
+	}
+
+	return &repository.AccessDeleteApiKeyOut{}, nil
+}
+
+func (r *Repository) SetS3Credentials(ctx context.Context, in *repository.AccessSetS3CredentialsIn) (*repository.AccessSetS3CredentialsOut, error) {
+	query := `update api_keys set s3_access_key = $2, s3_secret = $3 where id = $1`
+
+	result, err := r.db.ExecContext(ctx, query, in.Id, in.AccessKey, in.Secret)
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return nil, repository.ErrResourceNotFound
+	}
+
+	return &repository.AccessSetS3CredentialsOut{}, nil
+}
+
+func (r *Repository) GetS3Credentials(ctx context.Context, in *repository.AccessGetS3CredentialsIn) (*repository.AccessGetS3CredentialsOut, error) {
+	query := `select id, name, role, created_at, s3_secret from api_keys where s3_access_key = $1`
+
+	key := &repository.AccessApiKey{}
+	var secret string
+	if err := r.db.QueryRowContext(ctx, query, in.AccessKey).Scan(&key.Id, &key.Name, &key.Role, &key.CreatedAt, &secret); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return &repository.AccessGetS3CredentialsOut{
+		Key:    key,
+		Secret: secret,
+	}, nil
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanApiKey(row scanner) (*repository.AccessApiKey, error) {
+	key := &repository.AccessApiKey{}
+	if err := row.Scan(&key.Id, &key.Name, &key.Role, &key.CreatedAt); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
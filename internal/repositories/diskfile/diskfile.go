@@ -5,14 +5,17 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 
 	"github.com/fydmer/fileserver/internal/domain/repository"
 )
 
 type Repository struct {
 	rootDir string
+	used    atomic.Int64
 }
 
 const chunkSize = 1 * 1024 * 1024
@@ -37,21 +40,49 @@ func NewRepository(rootDir string) (*Repository, error) {
 		return nil, fmt.Errorf("permission denied")
 	}
 
-	return &Repository{
+	r := &Repository{
 		rootDir: rootDir,
-	}, nil
+	}
+
+	if err = filepath.WalkDir(rootDir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		r.used.Add(info.Size())
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (x *Repository) fileSize(name string) int64 {
+	st, err := os.Stat(filepath.Join(x.rootDir, name))
+	if err != nil {
+		return 0
+	}
+	return st.Size()
 }
 
 func (x *Repository) Write(ctx context.Context, in *repository.DiskfileWriteIn) (*repository.DiskfileWriteOut, error) {
+	prevSize := x.fileSize(in.Name)
+
 	f, err := os.Create(filepath.Join(x.rootDir, in.Name))
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
+	x.used.Add(-prevSize)
 
 	r := &ctxReader{ctx: ctx, chunkSize: chunkSize, reader: in.Source}
 
 	written, err := io.Copy(f, r)
+	x.used.Add(written)
 	if err != nil {
 		return nil, err
 	}
@@ -63,13 +94,26 @@ func (x *Repository) Write(ctx context.Context, in *repository.DiskfileWriteIn)
 
 func (x *Repository) Read(ctx context.Context, in *repository.DiskfileReadIn) (*repository.DiskfileReadOut, error) {
 	f, err := os.Open(filepath.Join(x.rootDir, in.Name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %w", repository.ErrResourceNotFound, err)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	defer f.Close()
 
-	r := &ctxReader{ctx: ctx, chunkSize: chunkSize, reader: f}
+	var src io.Reader = f
+	if in.Offset > 0 {
+		if _, err = f.Seek(in.Offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	if in.Length > 0 {
+		src = io.LimitReader(f, in.Length)
+	}
+
+	r := &ctxReader{ctx: ctx, chunkSize: chunkSize, reader: src}
 
 	written, err := io.Copy(in.Destination, r)
 	if err != nil {
@@ -81,11 +125,29 @@ func (x *Repository) Read(ctx context.Context, in *repository.DiskfileReadIn) (*
 }
 
 func (x *Repository) Remove(_ context.Context, in *repository.DiskfileRemoveIn) (*repository.DiskfileRemoveOut, error) {
+	size := x.fileSize(in.Name)
+
 	err := os.Remove(filepath.Join(x.rootDir, in.Name))
 	if err != nil {
 		if !errors.Is(err, os.ErrNotExist) {
 			return nil, err
 		}
+		return &repository.DiskfileRemoveOut{}, nil
 	}
+
+	x.used.Add(-size)
 	return &repository.DiskfileRemoveOut{}, nil
 }
+
+func (x *Repository) Usage(_ context.Context, _ *repository.DiskfileUsageIn) (*repository.DiskfileUsageOut, error) {
+	total, free, err := statfs(x.rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &repository.DiskfileUsageOut{
+		TotalBytes: total,
+		FreeBytes:  free,
+		UsedBytes:  x.used.Load(),
+	}, nil
+}
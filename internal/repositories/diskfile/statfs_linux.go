@@ -0,0 +1,15 @@
+//go:build linux
+
+package diskfile
+
+import (
+	"syscall"
+)
+
+func statfs(path string) (total, free int64, err error) {
+	st := &syscall.Statfs_t{}
+	if err = syscall.Statfs(path, st); err != nil {
+		return 0, 0, err
+	}
+	return int64(st.Blocks) * st.Bsize, int64(st.Bavail) * st.Bsize, nil
+}
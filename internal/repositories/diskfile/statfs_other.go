@@ -0,0 +1,11 @@
+//go:build !linux
+
+package diskfile
+
+import (
+	"errors"
+)
+
+func statfs(_ string) (total, free int64, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
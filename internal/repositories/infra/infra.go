@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 
 	"github.com/fydmer/fileserver/internal/domain/repository"
 	"github.com/fydmer/fileserver/internal/errors/pgerr"
@@ -18,12 +19,41 @@ func NewRepository(db *sql.DB) (*Repository, error) {
 }
 
 func (r *Repository) CreateNode(ctx context.Context, in *repository.InfraCreateNodeIn) (*repository.InfraCreateNodeOut, error) {
-	query := `insert into nodes (addr) values ($1) returning id`
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	if _, err = tx.ExecContext(ctx, `select pg_advisory_xact_lock(hashtext('nodes.addr'))`); err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+
+	if in.Force {
+		if _, err = tx.ExecContext(ctx, `delete from decommissioned_nodes where addr = $1`, in.Addr); err != nil {
+			return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+		}
+	} else {
+		var decommissioned bool
+		decommissionedQuery := `select exists(select 1 from decommissioned_nodes where addr = $1)`
+		if err = tx.QueryRowContext(ctx, decommissionedQuery, in.Addr).Scan(&decommissioned); err != nil {
+			return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+		}
+		if decommissioned {
+			return nil, errors.Join(fmt.Errorf("%w: node %s is decommissioned", repository.ErrResourceGone, in.Addr), tx.Rollback())
+		}
+	}
+
+	query := `insert into nodes (addr) values ($1) 
+    on conflict (addr) do update set addr = excluded.addr returning id`
 	node := &repository.InfraNode{
 		Addr: in.Addr,
 	}
 
-	if err := r.db.QueryRowContext(ctx, query, in.Addr).Scan(&node.Id); err != nil {
+	if err = tx.QueryRowContext(ctx, query, in.Addr).Scan(&node.Id); err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+
+	if err = tx.Commit(); err != nil {
 		return nil, pgerr.Parse(err)
 	}
 
@@ -33,9 +63,9 @@ func (r *Repository) CreateNode(ctx context.Context, in *repository.InfraCreateN
 }
 
 func (r *Repository) GetNode(ctx context.Context, in *repository.InfraGetNodeIn) (*repository.InfraGetNodeOut, error) {
-	query := `select id, addr from nodes where id=$1`
-	node := &repository.InfraNode{}
-	if err := r.db.QueryRowContext(ctx, query, in.Id).Scan(&node.Id, &node.Addr); err != nil {
+	query := `select id, addr, state, draining, last_seen, total_bytes, free_bytes from nodes where id=$1`
+	node, err := scanNode(r.db.QueryRowContext(ctx, query, in.Id))
+	if err != nil {
 		return nil, pgerr.Parse(err)
 	}
 	return &repository.InfraGetNodeOut{
@@ -44,7 +74,7 @@ func (r *Repository) GetNode(ctx context.Context, in *repository.InfraGetNodeIn)
 }
 
 func (r *Repository) ListNodes(ctx context.Context, _ *repository.InfraListNodesIn) (*repository.InfraListNodesOut, error) {
-	query := `select id, addr from nodes`
+	query := `select id, addr, state, draining, last_seen, total_bytes, free_bytes from nodes`
 	rows, err := r.db.QueryContext(ctx, query)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -56,8 +86,8 @@ func (r *Repository) ListNodes(ctx context.Context, _ *repository.InfraListNodes
 
 	var nodes []*repository.InfraNode
 	for rows.Next() {
-		node := &repository.InfraNode{}
-		if err := rows.Scan(&node.Id, &node.Addr); err != nil {
+		node, err := scanNode(rows)
+		if err != nil {
 			return nil, pgerr.Parse(err)
 		}
 		nodes = append(nodes, node)
@@ -68,9 +98,14 @@ func (r *Repository) ListNodes(ctx context.Context, _ *repository.InfraListNodes
 }
 
 func (r *Repository) GetFreerNodes(ctx context.Context, in *repository.InfraGetFreerNodesIn) (*repository.InfraGetFreerNodesOut, error) {
-	query := `select n.id, n.addr from nodes n left join shards s on n.id = s.node_id 
-    where status not in ($2) or status is null group by (n.id, n.addr) order by coalesce(sum(size), 0) limit $1`
-	rows, err := r.db.QueryContext(ctx, query, in.Count, repository.StorageShardStatusError)
+	// free space is reported by heartbeats, shards being written right now are not counted there yet
+	query := `select n.id, n.addr, n.state, n.draining, n.last_seen, n.total_bytes, n.free_bytes - coalesce(sum(s.size), 0) 
+    from nodes n left join shards s on n.id = s.node_id and s.status in ($4, $5)
+    where n.state = $3 and not n.draining and n.total_bytes > 0 
+    group by n.id having n.free_bytes - coalesce(sum(s.size), 0) >= $2
+    order by (n.free_bytes - coalesce(sum(s.size), 0))::float8 / n.total_bytes desc limit $1`
+	rows, err := r.db.QueryContext(ctx, query, in.Count, in.MinFreeBytes, repository.InfraNodeStateUp,
+		repository.StorageShardStatusNew, repository.StorageShardStatusInProgress)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return &repository.InfraGetFreerNodesOut{}, nil
@@ -81,8 +116,8 @@ func (r *Repository) GetFreerNodes(ctx context.Context, in *repository.InfraGetF
 
 	var nodes []*repository.InfraNode
 	for rows.Next() {
-		node := &repository.InfraNode{}
-		if err := rows.Scan(&node.Id, &node.Addr); err != nil {
+		node, err := scanNode(rows)
+		if err != nil {
 			return nil, pgerr.Parse(err)
 		}
 		nodes = append(nodes, node)
@@ -92,3 +127,80 @@ func (r *Repository) GetFreerNodes(ctx context.Context, in *repository.InfraGetF
 		Nodes: nodes,
 	}, nil
 }
+
+func (r *Repository) SetNodeState(ctx context.Context, in *repository.InfraSetNodeStateIn) (*repository.InfraSetNodeStateOut, error) {
+	query := `update nodes set state = $2, last_seen = coalesce($3, last_seen), 
+    total_bytes = coalesce($4, total_bytes), free_bytes = coalesce($5, free_bytes) where id = $1`
+
+	lastSeen := sql.NullTime{Time: in.LastSeen.UTC(), Valid: !in.LastSeen.IsZero()}
+	totalBytes, freeBytes := sql.NullInt64{}, sql.NullInt64{}
+	if in.Capacity != nil {
+		totalBytes = sql.NullInt64{Int64: in.Capacity.TotalBytes, Valid: true}
+		freeBytes = sql.NullInt64{Int64: in.Capacity.FreeBytes, Valid: true}
+	}
+
+	if _, err := r.db.ExecContext(ctx, query, in.Id, in.State, lastSeen, totalBytes, freeBytes); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return &repository.InfraSetNodeStateOut{}, nil
+}
+
+func (r *Repository) SetNodeDraining(ctx context.Context, in *repository.InfraSetNodeDrainingIn) (*repository.InfraSetNodeDrainingOut, error) {
+	query := `update nodes set draining = $2 where id = $1`
+
+	result, err := r.db.ExecContext(ctx, query, in.Id, in.Draining)
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return nil, repository.ErrResourceNotFound
+	}
+
+	return &repository.InfraSetNodeDrainingOut{}, nil
+}
+
+func (r *Repository) DeleteNode(ctx context.Context, in *repository.InfraDeleteNodeIn) (*repository.InfraDeleteNodeOut, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	if _, err = tx.ExecContext(ctx, `select pg_advisory_xact_lock(hashtext('nodes.addr'))`); err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+
+	var addr string
+	if err = tx.QueryRowContext(ctx, `delete from nodes where id = $1 returning addr`, in.Id).Scan(&addr); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &repository.InfraDeleteNodeOut{}, tx.Rollback()
+		}
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+
+	decommissionQuery := `insert into decommissioned_nodes (addr) values ($1) 
+    on conflict (addr) do update set removed_at = current_timestamp`
+	if _, err = tx.ExecContext(ctx, decommissionQuery, addr); err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return &repository.InfraDeleteNodeOut{}, nil
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanNode(row scanner) (*repository.InfraNode, error) {
+	node := &repository.InfraNode{}
+	lastSeen := sql.NullTime{}
+	if err := row.Scan(&node.Id, &node.Addr, &node.State, &node.Draining, &lastSeen, &node.TotalBytes, &node.FreeBytes); err != nil {
+		return nil, err
+	}
+	node.LastSeen = lastSeen.Time
+	return node, nil
+}
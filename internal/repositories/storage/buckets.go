@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/fydmer/fileserver/internal/domain/repository"
+	"github.com/fydmer/fileserver/internal/errors/pgerr"
+)
+
+const bucketColumns = `id, name, coalesce(owner::text, ''), data_shards, parity_shards, replicas, versioning, created_at`
+
+func (r *Repository) CreateBucket(ctx context.Context, in *repository.StorageCreateBucketIn) (*repository.StorageCreateBucketOut, error) {
+	query := `insert into buckets (name, owner, data_shards, parity_shards, replicas, versioning)
+    values ($1, nullif($2, '')::uuid, $3, $4, $5, $6) returning ` + bucketColumns
+
+	bucket, err := scanBucket(r.db.QueryRowContext(ctx, query, in.Name, in.Owner, in.DataShards, in.ParityShards, in.Replicas,
+		in.Versioning))
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return &repository.StorageCreateBucketOut{
+		Bucket: bucket,
+	}, nil
+}
+
+func (r *Repository) GetBucket(ctx context.Context, in *repository.StorageGetBucketIn) (*repository.StorageGetBucketOut, error) {
+	query := `select ` + bucketColumns + ` from buckets where lower(name) = lower($1)`
+
+	bucket, err := scanBucket(r.db.QueryRowContext(ctx, query, in.Name))
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return &repository.StorageGetBucketOut{
+		Bucket: bucket,
+	}, nil
+}
+
+func (r *Repository) ListBuckets(ctx context.Context, _ *repository.StorageListBucketsIn) (*repository.StorageListBucketsOut, error) {
+	query := `select ` + bucketColumns + ` from buckets order by lower(name) collate "C"`
+
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	defer rows.Close()
+
+	out := &repository.StorageListBucketsOut{}
+	for rows.Next() {
+		bucket, err := scanBucket(rows)
+		if err != nil {
+			return nil, pgerr.Parse(err)
+		}
+		out.Buckets = append(out.Buckets, bucket)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return out, nil
+}
+
+// DeleteBucket takes the exclusive lock of the bucket root, so no file or
+// directory is created in the bucket while it is checked for emptiness.
+func (r *Repository) DeleteBucket(ctx context.Context, in *repository.StorageDeleteBucketIn) (*repository.StorageDeleteBucketOut, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	if err = lockPath(ctx, tx, in.Id, "", false); err != nil {
+		return nil, errors.Join(err, tx.Rollback())
+	}
+
+	var used bool
+	usedQuery := `select exists(select 1 from files where bucket_id = $1)
+    or exists(select 1 from directories where bucket_id = $1)
+    or exists(select 1 from uploads where bucket_id = $1)
+    or exists(select 1 from file_versions where bucket_id = $1)`
+	if err = tx.QueryRowContext(ctx, usedQuery, in.Id).Scan(&used); err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+	if used {
+		return nil, errors.Join(fmt.Errorf("%w: bucket is not empty", repository.ErrConflict), tx.Rollback())
+	}
+
+	result, err := tx.ExecContext(ctx, `delete from buckets where id = $1`, in.Id)
+	if err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return nil, errors.Join(repository.ErrResourceNotFound, err, tx.Rollback())
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return &repository.StorageDeleteBucketOut{}, nil
+}
+
+func scanBucket(row scanner) (*repository.StorageBucket, error) {
+	bucket := &repository.StorageBucket{}
+	if err := row.Scan(&bucket.Id, &bucket.Name, &bucket.Owner, &bucket.DataShards, &bucket.ParityShards,
+		&bucket.Replicas, &bucket.Versioning, &bucket.CreatedAt); err != nil {
+		return nil, err
+	}
+	return bucket, nil
+}
@@ -4,11 +4,17 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/fydmer/fileserver/internal/domain/repository"
 	"github.com/fydmer/fileserver/internal/errors/pgerr"
+	"github.com/lib/pq"
 )
 
+const nilUUID = "00000000-0000-0000-0000-000000000000"
+
 type Repository struct {
 	db *sql.DB
 }
@@ -23,10 +29,16 @@ func (r *Repository) CreateFile(ctx context.Context, in *repository.StorageCreat
 		return nil, pgerr.Parse(err)
 	}
 
+	if err = checkLocation(ctx, tx, in.BucketId, in.Location); err != nil {
+		return nil, errors.Join(err, tx.Rollback())
+	}
+
 	var fileId string
 
-	fileQuery := `insert into files (location) values ($1) returning id`
-	if err = tx.QueryRowContext(ctx, fileQuery, in.Location).Scan(&fileId); err != nil {
+	fileQuery := `insert into files (bucket_id, location, size, data_shards, parity_shards, block_size, replicas, owner, latest) 
+    values ($1, $2, $3, $4, $5, $6, $7, nullif($8, '')::uuid, $9) returning id`
+	if err = tx.QueryRowContext(ctx, fileQuery, in.BucketId, in.Location, in.Size, in.DataShards, in.ParityShards, in.BlockSize,
+		in.Replicas, in.Owner, !in.Pending).Scan(&fileId); err != nil {
 		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
 	}
 
@@ -47,9 +59,10 @@ func (r *Repository) CreateFile(ctx context.Context, in *repository.StorageCreat
 }
 
 func (r *Repository) SetShardStatus(ctx context.Context, in *repository.StorageSetShardStatusIn) (*repository.StorageSetShardStatusOut, error) {
-	query := `update shards set status = $4 where file_id = $1 and node_id = $2 and index = $3`
+	query := `update shards set status = $4, checksum = coalesce(nullif($5, ''), checksum) 
+    where file_id = $1 and node_id = $2 and index = $3`
 
-	_, err := r.db.ExecContext(ctx, query, in.FileId, in.NodeId, in.Index, in.Status)
+	_, err := r.db.ExecContext(ctx, query, in.FileId, in.NodeId, in.Index, in.Status, in.Checksum)
 	if err != nil {
 		return nil, pgerr.Parse(err)
 	}
@@ -57,9 +70,102 @@ func (r *Repository) SetShardStatus(ctx context.Context, in *repository.StorageS
 	return &repository.StorageSetShardStatusOut{}, nil
 }
 
+func (r *Repository) AddShard(ctx context.Context, in *repository.StorageAddShardIn) (*repository.StorageAddShardOut, error) {
+	query := `with undropped as (delete from dropped_shards where file_id = $1 and node_id = $2 and index = $3)
+    insert into shards (file_id, node_id, index, size, status) values ($1, $2, $3, $4, $5)
+    on conflict (file_id, node_id, index) do update 
+    set size = excluded.size, status = excluded.status, checksum = null, created_at = current_timestamp`
+
+	if _, err := r.db.ExecContext(ctx, query, in.FileId, in.NodeId, in.Index, in.Size, repository.StorageShardStatusNew); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return &repository.StorageAddShardOut{}, nil
+}
+
+func (r *Repository) DeleteShard(ctx context.Context, in *repository.StorageDeleteShardIn) (*repository.StorageDeleteShardOut, error) {
+	query := `delete from shards where file_id = $1 and node_id = $2 and index = $3`
+
+	if _, err := r.db.ExecContext(ctx, query, in.FileId, in.NodeId, in.Index); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return &repository.StorageDeleteShardOut{}, nil
+}
+
+func (r *Repository) DropShard(ctx context.Context, in *repository.StorageDropShardIn) (*repository.StorageDropShardOut, error) {
+	query := `with dropped as (delete from shards where file_id = $1 and node_id = $2 and index = $3
+    returning file_id, node_id, index)
+    insert into dropped_shards (file_id, node_id, index, delete_after)
+    select file_id, node_id, index, current_timestamp + make_interval(secs => $4) from dropped
+    on conflict (file_id, node_id, index) do update set delete_after = excluded.delete_after`
+
+	if _, err := r.db.ExecContext(ctx, query, in.FileId, in.NodeId, in.Index, in.Delay.Seconds()); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return &repository.StorageDropShardOut{}, nil
+}
+
+func (r *Repository) ListDroppedShards(ctx context.Context, in *repository.StorageListDroppedShardsIn) (*repository.StorageListDroppedShardsOut, error) {
+	query := `select file_id, node_id, index from dropped_shards
+    where node_id = any($1::uuid[]) and delete_after <= current_timestamp order by delete_after limit $2`
+
+	rows, err := r.db.QueryContext(ctx, query, pq.Array(in.NodeIds), in.Limit)
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	defer rows.Close()
+
+	out := &repository.StorageListDroppedShardsOut{}
+	for rows.Next() {
+		shard := &repository.StorageDroppedShard{}
+		if err = rows.Scan(&shard.FileId, &shard.NodeId, &shard.Index); err != nil {
+			return nil, pgerr.Parse(err)
+		}
+		out.Shards = append(out.Shards, shard)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return out, nil
+}
+
+func (r *Repository) DeleteDroppedShard(ctx context.Context, in *repository.StorageDeleteDroppedShardIn) (*repository.StorageDeleteDroppedShardOut, error) {
+	query := `delete from dropped_shards where file_id = $1 and node_id = $2 and index = $3`
+
+	if _, err := r.db.ExecContext(ctx, query, in.FileId, in.NodeId, in.Index); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return &repository.StorageDeleteDroppedShardOut{}, nil
+}
+
+func (r *Repository) SetFileChecksum(ctx context.Context, in *repository.StorageSetFileChecksumIn) (*repository.StorageSetFileChecksumOut, error) {
+	query := `update files set checksum = $2 where id = $1`
+
+	if _, err := r.db.ExecContext(ctx, query, in.FileId, in.Checksum); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return &repository.StorageSetFileChecksumOut{}, nil
+}
+
 func (r *Repository) GetFile(ctx context.Context, in *repository.StorageGetFileIn) (*repository.StorageGetFileOut, error) {
-	query := `select f.location, s.node_id, s.index, s.size, s.created_at, s.status 
-    from shards s inner join files f on f.id = s.file_id where file_id = $1`
+	fileQuery := `select b.name, f.location, f.size, f.data_shards, f.parity_shards, f.block_size, f.replicas, 
+    coalesce(f.checksum, ''), coalesce(f.owner::text, ''), f.latest, f.created_at 
+    from files f join buckets b on b.id = f.bucket_id where f.id = $1`
+
+	file := &repository.StorageGetFileOut{Id: in.FileId}
+	if err := r.db.QueryRowContext(ctx, fileQuery, in.FileId).
+		Scan(&file.Bucket, &file.Location, &file.Size, &file.DataShards, &file.ParityShards, &file.BlockSize, &file.Replicas,
+			&file.Checksum, &file.Owner, &file.Latest, &file.CreatedAt); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	query := `select node_id, index, size, created_at, status, coalesce(checksum, '') from shards where file_id = $1`
 
 	rows, err := r.db.QueryContext(ctx, query, in.FileId)
 	if err != nil {
@@ -68,34 +174,144 @@ func (r *Repository) GetFile(ctx context.Context, in *repository.StorageGetFileI
 
 	defer rows.Close()
 
-	var location string
-	var shards []*repository.StorageShard
 	for rows.Next() {
 		shard := &repository.StorageShard{}
-		if err = rows.Scan(&location, &shard.NodeId, &shard.Index, &shard.Size, &shard.CreatedAt, &shard.Status); err != nil {
+		if err = rows.Scan(&shard.NodeId, &shard.Index, &shard.Size, &shard.CreatedAt, &shard.Status, &shard.Checksum); err != nil {
 			return nil, pgerr.Parse(err)
 		}
-		shards = append(shards, shard)
+		file.Shards = append(file.Shards, shard)
 	}
 
-	return &repository.StorageGetFileOut{
-		Id:       in.FileId,
-		Location: location,
-		Shards:   shards,
-	}, nil
+	return file, nil
 }
 
 func (r *Repository) GetFileByLocation(ctx context.Context, in *repository.StorageGetFileByLocationIn) (*repository.StorageGetFileByLocationOut, error) {
-	query := `select id from files where lower(location) = lower($1)`
+	query := `select id from files where bucket_id = $1 and lower(location) = lower($2) and latest`
 
 	var id string
-	if err := r.db.QueryRowContext(ctx, query, in.Location).Scan(&id); err != nil {
+	if err := r.db.QueryRowContext(ctx, query, in.BucketId, in.Location).Scan(&id); err != nil {
 		return nil, pgerr.Parse(err)
 	}
 
 	return r.GetFile(ctx, &repository.StorageGetFileIn{FileId: id})
 }
 
+func (r *Repository) ListFiles(ctx context.Context, in *repository.StorageListFilesIn) (*repository.StorageListFilesOut, error) {
+	query := `select id from files where id > $1 order by id limit $2`
+
+	afterId := in.AfterId
+	if afterId == "" {
+		afterId = nilUUID
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, afterId, in.Limit)
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	defer rows.Close()
+
+	out := &repository.StorageListFilesOut{}
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, pgerr.Parse(err)
+		}
+		out.Ids = append(out.Ids, id)
+	}
+
+	return out, nil
+}
+
+func (r *Repository) ListReplacedFiles(ctx context.Context, in *repository.StorageListReplacedFilesIn) (*repository.StorageListReplacedFilesOut, error) {
+	query := `select id from files where replaced_at <= current_timestamp - make_interval(secs => $1) 
+    order by replaced_at limit $2`
+
+	rows, err := r.db.QueryContext(ctx, query, in.Delay.Seconds(), in.Limit)
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	defer rows.Close()
+
+	out := &repository.StorageListReplacedFilesOut{}
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, pgerr.Parse(err)
+		}
+		out.Ids = append(out.Ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return out, nil
+}
+
+func (r *Repository) CountNodeShards(ctx context.Context, in *repository.StorageCountNodeShardsIn) (*repository.StorageCountNodeShardsOut, error) {
+	query := `select (select count(*) from shards where node_id = $1),
+    (select count(*) from dropped_shards where node_id = $1 and delete_after > current_timestamp)`
+
+	out := &repository.StorageCountNodeShardsOut{}
+	if err := r.db.QueryRowContext(ctx, query, in.NodeId).Scan(&out.Count, &out.Dropped); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return out, nil
+}
+
+func (r *Repository) GetNodesUsage(ctx context.Context, _ *repository.StorageGetNodesUsageIn) (*repository.StorageGetNodesUsageOut, error) {
+	query := `select node_id, count(*), coalesce(sum(size), 0) from shards group by node_id`
+
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	defer rows.Close()
+
+	out := &repository.StorageGetNodesUsageOut{}
+	for rows.Next() {
+		usage := &repository.StorageNodeUsage{}
+		if err = rows.Scan(&usage.NodeId, &usage.Shards, &usage.Bytes); err != nil {
+			return nil, pgerr.Parse(err)
+		}
+		out.Nodes = append(out.Nodes, usage)
+	}
+
+	return out, nil
+}
+
+func (r *Repository) ListNodeShards(ctx context.Context, in *repository.StorageListNodeShardsIn) (*repository.StorageListNodeShardsOut, error) {
+	query := `select file_id, index, size from shards 
+    where node_id = $1 and status = $2 and (file_id, index) > ($3, $4) 
+    order by file_id, index limit $5`
+
+	afterFileId := in.AfterFileId
+	if afterFileId == "" {
+		afterFileId = nilUUID
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, in.NodeId, repository.StorageShardStatusOK, afterFileId, in.AfterIndex, in.Limit)
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	defer rows.Close()
+
+	out := &repository.StorageListNodeShardsOut{}
+	for rows.Next() {
+		shard := &repository.StorageNodeShard{}
+		if err = rows.Scan(&shard.FileId, &shard.Index, &shard.Size); err != nil {
+			return nil, pgerr.Parse(err)
+		}
+		out.Shards = append(out.Shards, shard)
+	}
+
+	return out, nil
+}
+
 func (r *Repository) DeleteFile(ctx context.Context, in *repository.StorageDeleteFileIn) (*repository.StorageDeleteFileOut, error) {
 	query := `delete from files where id = $1`
 
@@ -105,3 +321,291 @@ func (r *Repository) DeleteFile(ctx context.Context, in *repository.StorageDelet
 
 	return &repository.StorageDeleteFileOut{}, nil
 }
+
+func (r *Repository) ListEntries(ctx context.Context, in *repository.StorageListEntriesIn) (*repository.StorageListEntriesOut, error) {
+	query := `select location, id, size, checksum, owner, created_at, directory from (
+        select location, id::text id, size, coalesce(checksum, '') checksum, coalesce(owner::text, '') owner, 
+        created_at, false directory from files 
+        where bucket_id = $1 and latest and lower(location) collate "C" like lower($2) and lower(location) collate "C" > lower($3) 
+        union all 
+        select path, id::text, 0, '', coalesce(owner::text, ''), created_at, true from directories 
+        where bucket_id = $1 and lower(path) collate "C" like lower($2) and lower(path) collate "C" > lower($3) 
+        and lower(path) <> lower($4)
+    ) e order by lower(location) collate "C" limit $5`
+
+	out := &repository.StorageListEntriesOut{}
+	after, last, count := in.After, "", 0
+	for count <= in.Limit {
+		entries, err := r.queryEntries(ctx, query, in.BucketId, likePrefix(in.Prefix), after, in.Prefix, in.Limit+1-count)
+		if err != nil {
+			return nil, err
+		}
+
+		// a rolled up prefix covers the rest of the page, so the next query starts after it
+		rolledUp := false
+		for _, entry := range entries {
+			if prefix, ok := rollUp(entry.Location, in.Prefix, in.Delimiter); ok {
+				after, rolledUp = prefix+string(utf8.MaxRune), true
+				if strings.ToLower(prefix) > strings.ToLower(in.After) {
+					if count++; count <= in.Limit {
+						out.Prefixes, last = append(out.Prefixes, prefix), prefix
+					}
+				}
+				break
+			}
+			if count++; count > in.Limit {
+				break
+			}
+			out.Entries, after, last = append(out.Entries, entry), entry.Location, entry.Location
+		}
+		if !rolledUp {
+			break
+		}
+	}
+	if count > in.Limit {
+		out.Next = last
+	}
+
+	return out, nil
+}
+
+var fileSortColumns = map[repository.StorageFileSort]string{
+	repository.StorageFileSortLocation:  `lower(location) collate "C"`,
+	repository.StorageFileSortSize:      `size`,
+	repository.StorageFileSortCreatedAt: `created_at`,
+}
+
+func (r *Repository) SearchFiles(ctx context.Context, in *repository.StorageSearchFilesIn) (*repository.StorageSearchFilesOut, error) {
+	column, ok := fileSortColumns[in.Sort]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown sort %d", repository.ErrBadRequest, in.Sort)
+	}
+
+	args := []any{in.BucketId, likePrefix(in.Prefix)}
+	conditions := []string{`bucket_id = $1`, `latest`, `lower(location) collate "C" like lower($2)`}
+	where := func(condition string, values ...any) {
+		var params []any
+		for _, value := range values {
+			args = append(args, value)
+			params = append(params, fmt.Sprintf("$%d", len(args)))
+		}
+		conditions = append(conditions, fmt.Sprintf(condition, params...))
+	}
+
+	if in.Owner != "" {
+		where("owner::text = %s", in.Owner)
+	}
+	if in.MinSize > 0 {
+		where("size >= %s", in.MinSize)
+	}
+	if in.MaxSize > 0 {
+		where("size <= %s", in.MaxSize)
+	}
+	if !in.CreatedAfter.IsZero() {
+		where("created_at >= %s::timestamp", in.CreatedAfter)
+	}
+	if !in.CreatedBefore.IsZero() {
+		where("created_at < %s::timestamp", in.CreatedBefore)
+	}
+
+	direction, compare := "asc", ">"
+	if in.Desc {
+		direction, compare = "desc", "<"
+	}
+	if after := in.After; after != nil {
+		switch in.Sort {
+		case repository.StorageFileSortSize:
+			where(`(size, lower(location) collate "C") `+compare+` (%s, lower(%s))`, after.Size, after.Location)
+		case repository.StorageFileSortCreatedAt:
+			where(`(created_at, lower(location) collate "C") `+compare+` (%s::timestamp, lower(%s))`, after.CreatedAt, after.Location)
+		default:
+			where(`lower(location) collate "C" `+compare+` lower(%s)`, after.Location)
+		}
+	}
+
+	order := column + " " + direction
+	if in.Sort != repository.StorageFileSortLocation {
+		order += `, lower(location) collate "C" ` + direction
+	}
+
+	args = append(args, in.Limit+1)
+	query := fmt.Sprintf(`select location, id::text, size, coalesce(checksum, ''), coalesce(owner::text, ''), created_at, false 
+    from files where %s order by %s limit $%d`, strings.Join(conditions, " and "), order, len(args))
+
+	files, err := r.queryEntries(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &repository.StorageSearchFilesOut{Files: files}
+	if len(files) > in.Limit {
+		out.Files, out.More = files[:in.Limit], true
+	}
+
+	return out, nil
+}
+
+func (r *Repository) queryEntries(ctx context.Context, query string, args ...any) ([]*repository.StorageEntry, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	defer rows.Close()
+
+	var entries []*repository.StorageEntry
+	for rows.Next() {
+		entry := &repository.StorageEntry{}
+		if err = rows.Scan(&entry.Location, &entry.Id, &entry.Size, &entry.Checksum, &entry.Owner, &entry.CreatedAt, &entry.Directory); err != nil {
+			return nil, pgerr.Parse(err)
+		}
+		entries = append(entries, entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return entries, nil
+}
+
+func (r *Repository) CreateDirectory(ctx context.Context, in *repository.StorageCreateDirectoryIn) (*repository.StorageCreateDirectoryOut, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	if err = checkLocation(ctx, tx, in.BucketId, in.Location); err != nil {
+		return nil, errors.Join(err, tx.Rollback())
+	}
+
+	query := `insert into directories (bucket_id, path, owner) values ($1, $2, nullif($3, '')::uuid) returning id`
+
+	out := &repository.StorageCreateDirectoryOut{}
+	if err = tx.QueryRowContext(ctx, query, in.BucketId, in.Location, in.Owner).Scan(&out.Id); err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return out, nil
+}
+
+func (r *Repository) GetDirectory(ctx context.Context, in *repository.StorageGetDirectoryIn) (*repository.StorageGetDirectoryOut, error) {
+	query := `select id, path, coalesce(owner::text, ''), created_at from directories where bucket_id = $1 and lower(path) = lower($2)`
+
+	out := &repository.StorageGetDirectoryOut{}
+	if err := r.db.QueryRowContext(ctx, query, in.BucketId, in.Location).Scan(&out.Id, &out.Location, &out.Owner, &out.CreatedAt); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return out, nil
+}
+
+func (r *Repository) DeleteDirectory(ctx context.Context, in *repository.StorageDeleteDirectoryIn) (*repository.StorageDeleteDirectoryOut, error) {
+	query := `delete from directories where id = $1`
+
+	if _, err := r.db.ExecContext(ctx, query, in.Id); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return &repository.StorageDeleteDirectoryOut{}, nil
+}
+
+// checkLocation fails when a new file or directory (location ending with "/")
+// has a file of the bucket on its path or, for a file, a directory with the
+// same name. The locks of lockLocation serialize the check with other
+// creations on the same path until the transaction ends.
+func checkLocation(ctx context.Context, tx *sql.Tx, bucketId, location string) error {
+	if err := lockLocation(ctx, tx, bucketId, location); err != nil {
+		return err
+	}
+
+	name, isDir := strings.CutSuffix(location, "/")
+
+	var parents []string
+	for i := range name {
+		if name[i] == '/' {
+			parents = append(parents, name[:i])
+		}
+	}
+	if isDir {
+		parents = append(parents, name)
+	}
+
+	var clash string
+	parentsQuery := `select location from files 
+    where bucket_id = $1 and latest and lower(location) in (select lower(p) from unnest($2::text[]) p) limit 1`
+	err := tx.QueryRowContext(ctx, parentsQuery, bucketId, pq.Array(parents)).Scan(&clash)
+	if err == nil {
+		return fmt.Errorf("%w: %s is a file", repository.ErrConflict, clash)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return pgerr.Parse(err)
+	}
+	if isDir {
+		return nil
+	}
+
+	dirQuery := `select path from directories where bucket_id = $1 and lower(path) = lower($2) 
+    union all select location from files where bucket_id = $1 and latest and lower(location) collate "C" like lower($3) limit 1`
+	err = tx.QueryRowContext(ctx, dirQuery, bucketId, name+"/", likePrefix(name+"/")).Scan(&clash)
+	if err == nil {
+		return fmt.Errorf("%w: %s is a directory", repository.ErrConflict, name)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return pgerr.Parse(err)
+	}
+
+	return nil
+}
+
+// lockLocation takes shared locks of the bucket root and the parent
+// directories and an exclusive lock of the location, so only creations whose
+// paths contain one another wait for each other. Locks are taken from the
+// root down, which keeps their order the same in all transactions.
+func lockLocation(ctx context.Context, tx *sql.Tx, bucketId, location string) error {
+	name := strings.TrimSuffix(location, "/")
+
+	if err := lockPath(ctx, tx, bucketId, "", true); err != nil {
+		return err
+	}
+	for i := range name {
+		if name[i] == '/' {
+			if err := lockPath(ctx, tx, bucketId, name[:i], true); err != nil {
+				return err
+			}
+		}
+	}
+	return lockPath(ctx, tx, bucketId, name, false)
+}
+
+// lockPath takes the transaction lock of a path in the bucket, the empty path
+// is the root of the bucket.
+func lockPath(ctx context.Context, tx *sql.Tx, bucketId, path string, shared bool) error {
+	query := `select pg_advisory_xact_lock(hashtext($1::text || '/' || lower($2::text)))`
+	if shared {
+		query = `select pg_advisory_xact_lock_shared(hashtext($1::text || '/' || lower($2::text)))`
+	}
+	if _, err := tx.ExecContext(ctx, query, bucketId, path); err != nil {
+		return pgerr.Parse(err)
+	}
+	return nil
+}
+
+// rollUp returns the part of the location up to the first delimiter after the prefix.
+func rollUp(location, prefix, delimiter string) (string, bool) {
+	if delimiter == "" || len(location) < len(prefix) {
+		return "", false
+	}
+	i := strings.Index(location[len(prefix):], delimiter)
+	if i < 0 {
+		return "", false
+	}
+	return location[:len(prefix)+i+len(delimiter)], true
+}
+
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix) + "%"
+}
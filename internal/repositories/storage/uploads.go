@@ -0,0 +1,305 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/fydmer/fileserver/internal/domain/repository"
+	"github.com/fydmer/fileserver/internal/errors/pgerr"
+)
+
+const uploadColumns = `id, file_id, (select name from buckets where buckets.id = uploads.bucket_id), location, 
+    coalesce(owner::text, ''), size, chunk_size, multipart, replace, replicas, uploaded, hash_state, created_at, expires_at`
+
+func (r *Repository) CreateUpload(ctx context.Context, in *repository.StorageCreateUploadIn) (*repository.StorageCreateUploadOut, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	if err = checkLocation(ctx, tx, in.BucketId, in.Location); err != nil {
+		return nil, errors.Join(err, tx.Rollback())
+	}
+
+	var exists bool
+	existsQuery := `select exists(select 1 from files where bucket_id = $1 and lower(location) = lower($2) and latest) and not $3`
+	if err = tx.QueryRowContext(ctx, existsQuery, in.BucketId, in.Location, in.Versioned || in.Replace).Scan(&exists); err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+	if exists {
+		return nil, errors.Join(fmt.Errorf("%w: file %s", repository.ErrResourceAlreadyExists, in.Location), tx.Rollback())
+	}
+
+	var uploadId string
+
+	uploadQuery := `insert into uploads (bucket_id, location, owner, size, chunk_size, multipart, replicas, expires_at, replace)
+    values ($1, $2, nullif($3, '')::uuid, $4, $5, $6, $7, current_timestamp + make_interval(secs => $8), $9) returning id`
+	if err = tx.QueryRowContext(ctx, uploadQuery, in.BucketId, in.Location, in.Owner, in.Size, in.ChunkSize, in.Multipart,
+		in.Replicas, in.Expiry.Seconds(), in.Replace).Scan(&uploadId); err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+
+	for _, shard := range in.Shards {
+		shardQuery := `insert into upload_shards (upload_id, node_id, index, size) values ($1, $2, $3, $4)`
+		if _, err = tx.ExecContext(ctx, shardQuery, uploadId, shard.NodeId, shard.Index, shard.Size); err != nil {
+			return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return &repository.StorageCreateUploadOut{
+		Id: uploadId,
+	}, nil
+}
+
+func (r *Repository) GetUpload(ctx context.Context, in *repository.StorageGetUploadIn) (*repository.StorageGetUploadOut, error) {
+	query := `select ` + uploadColumns + ` from uploads where id = $1 and expires_at > current_timestamp`
+
+	upload, err := scanUpload(r.db.QueryRowContext(ctx, query, in.Id))
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	if upload.Shards, err = r.uploadShards(ctx, upload.Id); err != nil {
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+func (r *Repository) SetUploadProgress(ctx context.Context, in *repository.StorageSetUploadProgressIn) (*repository.StorageSetUploadProgressOut, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	uploadQuery := `update uploads set uploaded = $3, hash_state = $4,
+    expires_at = current_timestamp + make_interval(secs => $5)
+    where id = $1 and uploaded = $2 and expires_at > current_timestamp`
+
+	result, err := tx.ExecContext(ctx, uploadQuery, in.Id, in.From, in.To, in.HashState, in.Expiry.Seconds())
+	if err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return nil, errors.Join(fmt.Errorf("%w: upload is not at %d bytes", repository.ErrConflict, in.From), err, tx.Rollback())
+	}
+
+	shardQuery := `update upload_shards set checksum = $3 where upload_id = $1 and index = $2`
+	if _, err = tx.ExecContext(ctx, shardQuery, in.Id, in.Index, in.Checksum); err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return &repository.StorageSetUploadProgressOut{}, nil
+}
+
+func (r *Repository) SetUploadPart(ctx context.Context, in *repository.StorageSetUploadPartIn) (*repository.StorageSetUploadPartOut, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	uploadQuery := `update uploads set expires_at = current_timestamp + make_interval(secs => $2)
+    where id = $1 and multipart and expires_at > current_timestamp`
+
+	result, err := tx.ExecContext(ctx, uploadQuery, in.Id, in.Expiry.Seconds())
+	if err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return nil, errors.Join(repository.ErrResourceNotFound, err, tx.Rollback())
+	}
+
+	replacedQuery := `delete from upload_shards where upload_id = $1 and index = $2
+    returning node_id, index, size, coalesce(checksum, '')`
+
+	rows, err := tx.QueryContext(ctx, replacedQuery, in.Id, in.Index)
+	if err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+
+	out := &repository.StorageSetUploadPartOut{}
+	for rows.Next() {
+		shard := &repository.StorageUploadShard{}
+		if err = rows.Scan(&shard.NodeId, &shard.Index, &shard.Size, &shard.Checksum); err != nil {
+			return nil, pgerr.Parse(errors.Join(err, rows.Close(), tx.Rollback()))
+		}
+		out.Replaced = append(out.Replaced, shard)
+	}
+	if err = errors.Join(rows.Err(), rows.Close()); err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+
+	for _, shard := range in.Shards {
+		shardQuery := `insert into upload_shards (upload_id, node_id, index, size, checksum) values ($1, $2, $3, $4, $5)`
+		if _, err = tx.ExecContext(ctx, shardQuery, in.Id, shard.NodeId, in.Index, shard.Size, shard.Checksum); err != nil {
+			return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return out, nil
+}
+
+func (r *Repository) CompleteUpload(ctx context.Context, in *repository.StorageCompleteUploadIn) (*repository.StorageCompleteUploadOut, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	uploadQuery := `select ` + uploadColumns + ` from uploads where id = $1 and expires_at > current_timestamp for update`
+
+	upload, err := scanUpload(tx.QueryRowContext(ctx, uploadQuery, in.Id))
+	if err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+	size, parts := upload.Size, -1
+	if upload.Multipart {
+		size, parts = in.Size, in.Parts
+	} else if upload.Uploaded != upload.Size {
+		return nil, errors.Join(fmt.Errorf("%w: %d of %d bytes are uploaded",
+			repository.ErrConflict, upload.Uploaded, upload.Size), tx.Rollback())
+	}
+
+	if parts >= 0 {
+		dropQuery := `delete from upload_shards where upload_id = $1 and index >= $2`
+		if _, err = tx.ExecContext(ctx, dropQuery, upload.Id, parts); err != nil {
+			return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+		}
+	}
+
+	var bucketId string
+	if err = tx.QueryRowContext(ctx, `select bucket_id from uploads where id = $1`, upload.Id).Scan(&bucketId); err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+
+	if err = checkLocation(ctx, tx, bucketId, upload.Location); err != nil {
+		return nil, errors.Join(err, tx.Rollback())
+	}
+
+	fileQuery := `insert into files (id, bucket_id, location, size, data_shards, parity_shards, block_size, replicas, owner, checksum, 
+    latest) values ($1, $2, $3, $4, (select count(distinct index) from upload_shards where upload_id = $5), 0, 0, $6, 
+    nullif($7, '')::uuid, $8, $9)`
+	pending := in.Versioned || upload.Replace
+	if _, err = tx.ExecContext(ctx, fileQuery, upload.FileId, bucketId, upload.Location, size, upload.Id, upload.Replicas,
+		upload.Owner, in.Checksum, !pending); err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+
+	out := &repository.StorageCompleteUploadOut{FileId: upload.FileId}
+	if pending {
+		published, err := publishFile(ctx, tx, bucketId, upload.Location, upload.FileId, upload.Owner, in.Versioned,
+			repository.StorageFileConditions{})
+		if err != nil {
+			return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+		}
+		out.VersionId = published.VersionId
+	}
+
+	shardsQuery := `insert into shards (file_id, node_id, index, size, status, checksum)
+    select $1, node_id, index, size, $3, checksum from upload_shards where upload_id = $2`
+	if _, err = tx.ExecContext(ctx, shardsQuery, upload.FileId, upload.Id, repository.StorageShardStatusOK); err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+
+	if _, err = tx.ExecContext(ctx, `delete from uploads where id = $1`, upload.Id); err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return out, nil
+}
+
+func (r *Repository) DeleteUpload(ctx context.Context, in *repository.StorageDeleteUploadIn) (*repository.StorageDeleteUploadOut, error) {
+	query := `delete from uploads where id = $1`
+
+	if _, err := r.db.ExecContext(ctx, query, in.Id); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return &repository.StorageDeleteUploadOut{}, nil
+}
+
+func (r *Repository) ListExpiredUploads(ctx context.Context, in *repository.StorageListExpiredUploadsIn) (*repository.StorageListExpiredUploadsOut, error) {
+	query := `select ` + uploadColumns + ` from uploads where expires_at <= current_timestamp order by expires_at limit $1`
+
+	rows, err := r.db.QueryContext(ctx, query, in.Limit)
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	defer rows.Close()
+
+	out := &repository.StorageListExpiredUploadsOut{}
+	for rows.Next() {
+		upload, err := scanUpload(rows)
+		if err != nil {
+			return nil, pgerr.Parse(err)
+		}
+		out.Uploads = append(out.Uploads, upload)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	for _, upload := range out.Uploads {
+		if upload.Shards, err = r.uploadShards(ctx, upload.Id); err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+func (r *Repository) uploadShards(ctx context.Context, uploadId string) ([]*repository.StorageUploadShard, error) {
+	query := `select node_id, index, size, coalesce(checksum, '') from upload_shards where upload_id = $1 order by index, node_id`
+
+	rows, err := r.db.QueryContext(ctx, query, uploadId)
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	defer rows.Close()
+
+	var shards []*repository.StorageUploadShard
+	for rows.Next() {
+		shard := &repository.StorageUploadShard{}
+		if err = rows.Scan(&shard.NodeId, &shard.Index, &shard.Size, &shard.Checksum); err != nil {
+			return nil, pgerr.Parse(err)
+		}
+		shards = append(shards, shard)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return shards, nil
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUpload(row scanner) (*repository.StorageGetUploadOut, error) {
+	upload := &repository.StorageGetUploadOut{}
+	if err := row.Scan(&upload.Id, &upload.FileId, &upload.Bucket, &upload.Location, &upload.Owner, &upload.Size,
+		&upload.ChunkSize, &upload.Multipart, &upload.Replace, &upload.Replicas, &upload.Uploaded, &upload.HashState, &upload.CreatedAt, &upload.ExpiresAt); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
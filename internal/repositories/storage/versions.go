@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/fydmer/fileserver/internal/domain/repository"
+	"github.com/fydmer/fileserver/internal/errors/pgerr"
+)
+
+const versionColumns = `v.id, v.location, coalesce(v.file_id::text, ''), coalesce(v.owner::text, ''),
+    coalesce(f.size, 0), coalesce(f.checksum, ''), v.created_at`
+
+func (r *Repository) PublishFile(ctx context.Context, in *repository.StoragePublishFileIn) (*repository.StoragePublishFileOut, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	var bucketId, location, owner string
+	fileQuery := `select bucket_id, location, coalesce(owner::text, '') from files where id = $1 and not latest`
+	if err = tx.QueryRowContext(ctx, fileQuery, in.FileId).Scan(&bucketId, &location, &owner); err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+
+	if err = checkLocation(ctx, tx, bucketId, location); err != nil {
+		return nil, errors.Join(err, tx.Rollback())
+	}
+
+	out, err := publishFile(ctx, tx, bucketId, location, in.FileId, owner, in.Versioned, in.Conditions)
+	if err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return out, nil
+}
+
+func (r *Repository) ArchiveFile(ctx context.Context, in *repository.StorageArchiveFileIn) (*repository.StorageArchiveFileOut, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	var bucketId, location string
+	fileQuery := `select bucket_id, location from files where id = $1 and latest`
+	if err = tx.QueryRowContext(ctx, fileQuery, in.FileId).Scan(&bucketId, &location); err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+
+	if err = lockLocation(ctx, tx, bucketId, location); err != nil {
+		return nil, errors.Join(err, tx.Rollback())
+	}
+
+	// the file may have been replaced before the lock was taken
+	archiveQuery := `update files set latest = false where id = $1 and latest returning bucket_id`
+	if err = tx.QueryRowContext(ctx, archiveQuery, in.FileId).Scan(&bucketId); err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+
+	out := &repository.StorageArchiveFileOut{}
+	markerQuery := `insert into file_versions (bucket_id, location, owner) values ($1, $2, nullif($3, '')::uuid) returning id`
+	if err = tx.QueryRowContext(ctx, markerQuery, bucketId, location, in.Owner).Scan(&out.VersionId); err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return out, nil
+}
+
+func (r *Repository) ListVersions(ctx context.Context, in *repository.StorageListVersionsIn) (*repository.StorageListVersionsOut, error) {
+	query := `select ` + versionColumns + ` from file_versions v left join files f on f.id = v.file_id
+    where v.bucket_id = $1 and lower(v.location) = lower($2) order by v.created_at desc`
+
+	rows, err := r.db.QueryContext(ctx, query, in.BucketId, in.Location)
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	defer rows.Close()
+
+	out := &repository.StorageListVersionsOut{}
+	for rows.Next() {
+		version, err := scanVersion(rows)
+		if err != nil {
+			return nil, pgerr.Parse(err)
+		}
+		out.Versions = append(out.Versions, version)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return out, nil
+}
+
+func (r *Repository) GetVersion(ctx context.Context, in *repository.StorageGetVersionIn) (*repository.StorageGetVersionOut, error) {
+	query := `select ` + versionColumns + ` from file_versions v left join files f on f.id = v.file_id
+    where v.bucket_id = $1 and lower(v.location) = lower($2) and v.id::text = $3`
+
+	version, err := scanVersion(r.db.QueryRowContext(ctx, query, in.BucketId, in.Location, in.Id))
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return version, nil
+}
+
+func (r *Repository) RestoreVersion(ctx context.Context, in *repository.StorageRestoreVersionIn) (*repository.StorageRestoreVersionOut, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	if err = checkLocation(ctx, tx, in.BucketId, in.Location); err != nil {
+		return nil, errors.Join(err, tx.Rollback())
+	}
+
+	var location, fileId string
+	versionQuery := `select location, coalesce(file_id::text, '') from file_versions
+    where bucket_id = $1 and lower(location) = lower($2) and id::text = $3`
+	if err = tx.QueryRowContext(ctx, versionQuery, in.BucketId, in.Location, in.Id).Scan(&location, &fileId); err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+	if fileId == "" {
+		return nil, errors.Join(fmt.Errorf("%w: a delete marker can't be restored", repository.ErrBadRequest), tx.Rollback())
+	}
+
+	versionId, err := publishVersion(ctx, tx, in.BucketId, location, fileId, in.Owner)
+	if err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return &repository.StorageRestoreVersionOut{
+		VersionId: versionId,
+	}, nil
+}
+
+func (r *Repository) DeleteVersion(ctx context.Context, in *repository.StorageDeleteVersionIn) (*repository.StorageDeleteVersionOut, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	if err = lockLocation(ctx, tx, in.BucketId, in.Location); err != nil {
+		return nil, errors.Join(err, tx.Rollback())
+	}
+
+	var fileId string
+	deleteQuery := `delete from file_versions where bucket_id = $1 and lower(location) = lower($2) and id::text = $3
+    returning coalesce(file_id::text, '')`
+	if err = tx.QueryRowContext(ctx, deleteQuery, in.BucketId, in.Location, in.Id).Scan(&fileId); err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+
+	var latestId string
+	latestQuery := `select coalesce(file_id::text, '') from file_versions
+    where bucket_id = $1 and lower(location) = lower($2) order by created_at desc limit 1`
+	err = tx.QueryRowContext(ctx, latestQuery, in.BucketId, in.Location).Scan(&latestId)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+
+	archiveQuery := `update files set latest = false
+    where bucket_id = $1 and lower(location) = lower($2) and latest and id::text <> $3`
+	if _, err = tx.ExecContext(ctx, archiveQuery, in.BucketId, in.Location, latestId); err != nil {
+		return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+	}
+	if latestId != "" {
+		if _, err = tx.ExecContext(ctx, `update files set latest = true where id = $1`, latestId); err != nil {
+			return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+		}
+	}
+
+	out := &repository.StorageDeleteVersionOut{}
+	if fileId != "" {
+		var used bool
+		usedQuery := `select exists(select 1 from file_versions where file_id = $1)`
+		if err = tx.QueryRowContext(ctx, usedQuery, fileId).Scan(&used); err != nil {
+			return nil, pgerr.Parse(errors.Join(err, tx.Rollback()))
+		}
+		if !used {
+			out.UnusedFileId = fileId
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, pgerr.Parse(err)
+	}
+
+	return out, nil
+}
+
+// publishFile makes the pending file the latest one of its location if the
+// conditions hold, the replaced file is kept as an older version when
+// versioned, otherwise it waits for the cleaner. The caller holds the locks of
+// lockLocation.
+func publishFile(ctx context.Context, tx *sql.Tx, bucketId, location, fileId, owner string, versioned bool,
+	conditions repository.StorageFileConditions) (*repository.StoragePublishFileOut, error) {
+	var latestId, checksum string
+	latestQuery := `select id, coalesce(checksum, '') from files 
+    where bucket_id = $1 and lower(location) = lower($2) and latest`
+	err := tx.QueryRowContext(ctx, latestQuery, bucketId, location).Scan(&latestId, &checksum)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if !conditions.Match(latestId != "", checksum) {
+		return nil, fmt.Errorf("%w: the file at %s doesn't match the conditions", repository.ErrPreconditionFailed, location)
+	}
+
+	out := &repository.StoragePublishFileOut{Replaced: latestId != ""}
+	if versioned {
+		if out.VersionId, err = publishVersion(ctx, tx, bucketId, location, fileId, owner); err != nil {
+			return nil, err
+		}
+		return out, nil
+	}
+
+	if latestId != "" {
+		replaceQuery := `update files set latest = false, replaced_at = current_timestamp where id = $1`
+		if _, err = tx.ExecContext(ctx, replaceQuery, latestId); err != nil {
+			return nil, err
+		}
+	}
+	if _, err = tx.ExecContext(ctx, `update files set latest = true where id = $1`, fileId); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// publishVersion makes the file the latest one of its location and records
+// the new version, the caller holds the locks of lockLocation.
+func publishVersion(ctx context.Context, tx *sql.Tx, bucketId, location, fileId, owner string) (string, error) {
+	archiveQuery := `update files set latest = false
+    where bucket_id = $1 and lower(location) = lower($2) and latest and id <> $3`
+	if _, err := tx.ExecContext(ctx, archiveQuery, bucketId, location, fileId); err != nil {
+		return "", err
+	}
+
+	if _, err := tx.ExecContext(ctx, `update files set latest = true where id = $1`, fileId); err != nil {
+		return "", err
+	}
+
+	var versionId string
+	versionQuery := `insert into file_versions (bucket_id, location, file_id, owner)
+    values ($1, $2, $3, nullif($4, '')::uuid) returning id`
+	if err := tx.QueryRowContext(ctx, versionQuery, bucketId, location, fileId, owner).Scan(&versionId); err != nil {
+		return "", err
+	}
+
+	return versionId, nil
+}
+
+func scanVersion(row scanner) (*repository.StorageFileVersion, error) {
+	version := &repository.StorageFileVersion{}
+	if err := row.Scan(&version.Id, &version.Location, &version.FileId, &version.Owner, &version.Size, &version.Checksum,
+		&version.CreatedAt); err != nil {
+		return nil, err
+	}
+	return version, nil
+}
@@ -0,0 +1,19 @@
+set schema 'public';
+
+alter table files add column if not exists size bigint;
+alter table files add column if not exists data_shards smallint;
+alter table files add column if not exists parity_shards smallint not null default 0;
+alter table files add column if not exists block_size int not null default 0;
+
+update files f
+set size        = coalesce(s.size, 0),
+    data_shards = coalesce(s.count, 0)
+from (select file_id, sum(size) size, count(*) count
+      from (select distinct on (file_id, index) file_id, index, size from shards) d
+      group by file_id) s
+where f.id = s.file_id and f.size is null;
+
+update files set size = 0, data_shards = 0 where size is null;
+
+alter table files alter column size set not null;
+alter table files alter column data_shards set not null;
@@ -0,0 +1,4 @@
+set schema 'public';
+
+alter table nodes add column if not exists state smallint not null default 0;
+alter table nodes add column if not exists last_seen timestamp;
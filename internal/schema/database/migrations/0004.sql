@@ -0,0 +1,4 @@
+set schema 'public';
+
+alter table nodes add column if not exists total_bytes bigint not null default 0;
+alter table nodes add column if not exists free_bytes bigint not null default 0;
@@ -0,0 +1,4 @@
+set schema 'public';
+
+alter table files add column if not exists checksum text;
+alter table shards add column if not exists checksum text;
@@ -0,0 +1,3 @@
+set schema 'public';
+
+alter table nodes add column if not exists draining boolean not null default false;
@@ -0,0 +1,16 @@
+set schema 'public';
+
+create table if not exists api_keys
+(
+    id uuid default uuid_generate_v4() not null
+    constraint api_keys_pk primary key,
+    name text not null,
+    role smallint not null,
+    token_hash text not null,
+    created_at timestamp not null default current_timestamp
+);
+
+create unique index if not exists api_keys_token_hash_uindex on api_keys (token_hash);
+
+alter table files add column if not exists owner uuid
+    constraint files_api_keys_id_fk references api_keys on delete set null;
@@ -0,0 +1,28 @@
+set schema 'public';
+
+alter table files add column if not exists created_at timestamp;
+
+update files f
+set created_at = s.created_at
+from (select file_id, min(created_at) created_at from shards group by file_id) s
+where f.id = s.file_id and f.created_at is null;
+
+update files set created_at = current_timestamp where created_at is null;
+
+alter table files alter column created_at set default current_timestamp;
+alter table files alter column created_at set not null;
+
+create index if not exists files_location_prefix_index on files ((lower(location)) collate "C");
+
+create table if not exists directories
+(
+    id uuid default uuid_generate_v4() not null
+    constraint directories_pk primary key,
+    path text not null,
+    owner uuid
+    constraint directories_api_keys_id_fk references api_keys on delete set null,
+    created_at timestamp not null default current_timestamp
+);
+
+create unique index if not exists directories_path_uindex on directories (lower(path));
+create index if not exists directories_path_prefix_index on directories ((lower(path)) collate "C");
@@ -0,0 +1,4 @@
+set schema 'public';
+
+create index if not exists files_size_index on files (size, (lower(location) collate "C"));
+create index if not exists files_created_at_index on files (created_at, (lower(location) collate "C"));
@@ -0,0 +1,32 @@
+set schema 'public';
+
+create table if not exists uploads
+(
+    id uuid default uuid_generate_v4() not null
+    constraint uploads_pk primary key,
+    file_id uuid default uuid_generate_v4() not null,
+    location text not null,
+    owner uuid
+    constraint uploads_api_keys_id_fk references api_keys on delete set null,
+    size bigint not null,
+    chunk_size bigint not null,
+    uploaded bigint not null default 0,
+    hash_state bytea,
+    created_at timestamp not null default current_timestamp,
+    expires_at timestamp not null
+);
+
+create index if not exists uploads_expires_at_index on uploads (expires_at);
+
+create table if not exists upload_shards
+(
+    upload_id uuid not null
+    constraint upload_shards_uploads_id_fk references uploads on delete cascade,
+    node_id uuid not null
+    constraint upload_shards_nodes_id_fk references nodes on delete cascade,
+    index int not null,
+    size bigint not null,
+    checksum text
+);
+
+create unique index if not exists upload_shards_uindex on upload_shards (upload_id, node_id, index);
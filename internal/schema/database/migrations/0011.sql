@@ -0,0 +1,8 @@
+set schema 'public';
+
+alter table api_keys add column if not exists s3_access_key text;
+alter table api_keys add column if not exists s3_secret text;
+
+create unique index if not exists api_keys_s3_access_key_uindex on api_keys (s3_access_key);
+
+alter table uploads add column if not exists multipart boolean not null default false;
@@ -0,0 +1,62 @@
+set schema 'public';
+
+create table if not exists buckets
+(
+    id uuid default uuid_generate_v4() not null
+    constraint buckets_pk primary key,
+    name text not null,
+    owner uuid
+    constraint buckets_api_keys_id_fk references api_keys on delete set null,
+    data_shards smallint not null default 0,
+    parity_shards smallint not null default 0,
+    replicas smallint not null default 0,
+    created_at timestamp not null default current_timestamp
+);
+
+create unique index if not exists buckets_name_uindex on buckets (lower(name));
+
+insert into buckets (name)
+select 'default'
+where not exists (select 1 from buckets where lower(name) = 'default');
+
+alter table files add column if not exists bucket_id uuid
+    constraint files_buckets_id_fk references buckets;
+alter table files add column if not exists replicas smallint not null default 0;
+update files set bucket_id = (select id from buckets where lower(name) = 'default') where bucket_id is null;
+alter table files alter column bucket_id set not null;
+
+alter table directories add column if not exists bucket_id uuid
+    constraint directories_buckets_id_fk references buckets;
+update directories set bucket_id = (select id from buckets where lower(name) = 'default') where bucket_id is null;
+alter table directories alter column bucket_id set not null;
+
+alter table uploads add column if not exists bucket_id uuid
+    constraint uploads_buckets_id_fk references buckets;
+alter table uploads add column if not exists replicas smallint not null default 0;
+update uploads set bucket_id = (select id from buckets where lower(name) = 'default') where bucket_id is null;
+alter table uploads alter column bucket_id set not null;
+
+-- the location indexes created by the earlier migrations are scoped to the bucket,
+-- they keep their names so that the earlier migrations don't create them again
+do
+$$
+    declare
+        index_name text;
+    begin
+        foreach index_name in array array ['files_location_uindex', 'files_location_prefix_index', 'files_size_index',
+            'files_created_at_index', 'directories_path_uindex', 'directories_path_prefix_index']
+            loop
+                if exists(select 1 from pg_indexes where indexname = index_name and indexdef not like '%bucket_id%') then
+                    execute format('drop index %I', index_name);
+                end if;
+            end loop;
+    end
+$$;
+
+create unique index if not exists files_location_uindex on files (bucket_id, lower(location));
+create index if not exists files_location_prefix_index on files (bucket_id, (lower(location)) collate "C");
+create index if not exists files_size_index on files (bucket_id, size, (lower(location) collate "C"));
+create index if not exists files_created_at_index on files (bucket_id, created_at, (lower(location) collate "C"));
+
+create unique index if not exists directories_path_uindex on directories (bucket_id, lower(path));
+create index if not exists directories_path_prefix_index on directories (bucket_id, (lower(path)) collate "C");
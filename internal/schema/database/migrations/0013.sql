@@ -0,0 +1,35 @@
+set schema 'public';
+
+alter table buckets add column if not exists versioning boolean not null default false;
+
+-- older versions of a location stay in files with latest = false
+alter table files add column if not exists latest boolean not null default true;
+
+create table if not exists file_versions
+(
+    id uuid default uuid_generate_v4() not null
+    constraint file_versions_pk primary key,
+    bucket_id uuid not null
+    constraint file_versions_buckets_id_fk references buckets,
+    location text not null,
+    file_id uuid
+    constraint file_versions_files_id_fk references files on delete cascade,
+    owner uuid
+    constraint file_versions_api_keys_id_fk references api_keys on delete set null,
+    created_at timestamp not null default clock_timestamp()
+);
+
+create index if not exists file_versions_location_index on file_versions (bucket_id, lower(location), created_at);
+create index if not exists file_versions_file_id_index on file_versions (file_id);
+
+-- the location index keeps its name so that the earlier migrations don't create it again
+do
+$$
+    begin
+        if exists(select 1 from pg_indexes where indexname = 'files_location_uindex' and indexdef not like '%WHERE%') then
+            drop index files_location_uindex;
+        end if;
+    end
+$$;
+
+create unique index if not exists files_location_uindex on files (bucket_id, lower(location)) where latest;
@@ -0,0 +1,6 @@
+set schema 'public';
+
+-- files replaced by another upload wait for the cleaner to remove their shards
+alter table files add column if not exists replaced_at timestamp;
+
+create index if not exists files_replaced_at_index on files (replaced_at) where replaced_at is not null;
@@ -0,0 +1,9 @@
+set schema 'public';
+
+-- addresses of removed nodes, a node still running there can't join again on its own
+create table if not exists decommissioned_nodes
+(
+    addr       text      not null
+    constraint decommissioned_nodes_pk primary key,
+    removed_at timestamp not null default current_timestamp
+);
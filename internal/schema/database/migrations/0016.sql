@@ -0,0 +1,4 @@
+set schema 'public';
+
+-- a replacing upload takes the place of the file at its location on completion
+alter table uploads add column if not exists replace boolean not null default false;
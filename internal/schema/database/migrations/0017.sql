@@ -0,0 +1,15 @@
+set schema 'public';
+
+-- replicas dropped by repair and rebalancing, their data stays on the node
+-- until delete_after so that downloads in progress can finish
+create table if not exists dropped_shards
+(
+    file_id      uuid      not null,
+    node_id      uuid      not null
+    constraint dropped_shards_nodes_id_fk references nodes on delete cascade,
+    index        smallint  not null,
+    delete_after timestamp not null,
+    constraint dropped_shards_pk primary key (file_id, node_id, index)
+);
+
+create index if not exists dropped_shards_delete_after_index on dropped_shards (delete_after);
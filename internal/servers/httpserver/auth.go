@@ -0,0 +1,75 @@
+package httpserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/fydmer/fileserver/internal/domain/service"
+)
+
+type apiKeyContextKey struct{}
+
+var roleNames = map[service.ControllerRole]string{
+	service.ControllerRoleReadOnly:  "read-only",
+	service.ControllerRoleReadWrite: "read-write",
+	service.ControllerRoleAdmin:     "admin",
+}
+
+// authenticate resolves the bearer token of the request into its API key,
+// handlers get the key by requestApiKey.
+func (x *controllerHandler) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			httpError(w, "header 'Authorization: Bearer <token>' is required", http.StatusUnauthorized)
+			return
+		}
+
+		authenticate, err := x.controller.Authenticate(r.Context(), &service.ControllerAuthenticateIn{
+			Token: strings.TrimSpace(token),
+		})
+		if err != nil {
+			code := getCodeFromPayloadError(err)
+			if code == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			}
+			httpError(w, err.Error(), code)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, authenticate.Key)))
+	})
+}
+
+// require lets the request through when its key has at least the role.
+func require(role service.ControllerRole, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if key := requestApiKey(r); key.Role < role {
+			httpError(w, fmt.Sprintf("the key has role %s, %s is required", roleNames[key.Role], roleNames[role]), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func requestApiKey(r *http.Request) *service.ControllerApiKey {
+	return r.Context().Value(apiKeyContextKey{}).(*service.ControllerApiKey)
+}
+
+// canModify reports whether the key may change a file of the owner, files
+// without an owner are changed by admins only.
+func canModify(key *service.ControllerApiKey, owner string) bool {
+	return key.Role == service.ControllerRoleAdmin || (owner != "" && key.Id == owner)
+}
+
+func parseRole(name string) (service.ControllerRole, bool) {
+	for role, roleName := range roleNames {
+		if roleName == name {
+			return role, true
+		}
+	}
+	return 0, false
+}
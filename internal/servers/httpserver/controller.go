@@ -2,14 +2,22 @@ package httpserver
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"path"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/fydmer/fileserver/internal/domain/repository"
 	"github.com/fydmer/fileserver/internal/domain/service"
 	"github.com/fydmer/fileserver/pkg/random"
 )
@@ -31,7 +39,7 @@ func RunControllerServer(ctx context.Context, port int, controller service.Contr
 	}
 
 	mux := http.NewServeMux()
-	mux.Handle("/api/v1/", http.StripPrefix("/api/v1", handler.getEndpoints()))
+	mux.Handle("/api/v1/", http.StripPrefix("/api/v1", handler.authenticate(handler.getEndpoints())))
 
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%d", port),
@@ -63,25 +71,91 @@ func (s *ControllerServer) Close() {
 func (x *controllerHandler) getEndpoints() *http.ServeMux {
 	mux := http.NewServeMux()
 	{
-		mux.HandleFunc("POST /nodes", x.createNode)
-		mux.HandleFunc("POST /files", x.uploadFile)
-		mux.HandleFunc("GET /files/{location}", x.downloadFile)
-		mux.HandleFunc("DELETE /files/{location}", x.deleteFile)
+		admin := service.ControllerRoleAdmin
+		readWrite := service.ControllerRoleReadWrite
+		readOnly := service.ControllerRoleReadOnly
 
-		mux.HandleFunc("GET /tools/file-generator", x.generateFile)
+		mux.HandleFunc("POST /nodes", require(admin, x.createNode))
+		mux.HandleFunc("GET /nodes/{id}", require(admin, x.getNode))
+		mux.HandleFunc("DELETE /nodes/{id}", require(admin, x.removeNode))
+		mux.HandleFunc("GET /files", require(readOnly, x.listFiles))
+		mux.HandleFunc("POST /files", require(readWrite, x.uploadFile))
+		mux.HandleFunc("PUT /files/{location...}", require(readWrite, x.replaceFile))
+		mux.HandleFunc("GET /files/{location...}", require(readOnly, x.downloadFile))
+		mux.HandleFunc("HEAD /files/{location...}", require(readOnly, x.headFile))
+		mux.HandleFunc("GET /metadata/{location...}", require(readOnly, x.getFileInfo))
+		mux.HandleFunc("DELETE /files/{location...}", require(readWrite, x.deleteFile))
+		mux.HandleFunc("POST /directories/{location...}", require(readWrite, x.createDirectory))
+		mux.HandleFunc("DELETE /directories/{location...}", require(readWrite, x.deleteDirectory))
+		mux.HandleFunc("GET /versions/{location...}", require(readOnly, x.listVersions))
+		mux.HandleFunc("POST /versions/{location...}", require(readWrite, x.restoreVersion))
+		mux.HandleFunc("DELETE /versions/{location...}", require(readWrite, x.purgeVersion))
+		mux.HandleFunc("POST /uploads", require(readWrite, x.createUpload))
+		mux.HandleFunc("GET /uploads/{id}", require(readWrite, x.getUpload))
+		mux.HandleFunc("PUT /uploads/{id}", require(readWrite, x.uploadChunk))
+		mux.HandleFunc("POST /uploads/{id}/complete", require(readWrite, x.completeUpload))
+		mux.HandleFunc("DELETE /uploads/{id}", require(readWrite, x.abortUpload))
+
+		mux.HandleFunc("GET /buckets", require(readOnly, x.listBuckets))
+		mux.HandleFunc("POST /buckets", require(readWrite, x.createBucket))
+		mux.HandleFunc("GET /buckets/{bucket}", require(readOnly, x.getBucket))
+		mux.HandleFunc("DELETE /buckets/{bucket}", require(readWrite, x.deleteBucket))
+		mux.HandleFunc("GET /buckets/{bucket}/files", require(readOnly, x.listFiles))
+		mux.HandleFunc("POST /buckets/{bucket}/files", require(readWrite, x.uploadFile))
+		mux.HandleFunc("PUT /buckets/{bucket}/files/{location...}", require(readWrite, x.replaceFile))
+		mux.HandleFunc("GET /buckets/{bucket}/files/{location...}", require(readOnly, x.downloadFile))
+		mux.HandleFunc("HEAD /buckets/{bucket}/files/{location...}", require(readOnly, x.headFile))
+		mux.HandleFunc("GET /buckets/{bucket}/metadata/{location...}", require(readOnly, x.getFileInfo))
+		mux.HandleFunc("DELETE /buckets/{bucket}/files/{location...}", require(readWrite, x.deleteFile))
+		mux.HandleFunc("POST /buckets/{bucket}/directories/{location...}", require(readWrite, x.createDirectory))
+		mux.HandleFunc("DELETE /buckets/{bucket}/directories/{location...}", require(readWrite, x.deleteDirectory))
+		mux.HandleFunc("GET /buckets/{bucket}/versions/{location...}", require(readOnly, x.listVersions))
+		mux.HandleFunc("POST /buckets/{bucket}/versions/{location...}", require(readWrite, x.restoreVersion))
+		mux.HandleFunc("DELETE /buckets/{bucket}/versions/{location...}", require(readWrite, x.purgeVersion))
+		mux.HandleFunc("POST /buckets/{bucket}/uploads", require(readWrite, x.createUpload))
+
+		mux.HandleFunc("GET /admin/scrub", require(admin, x.getScrubStatus))
+		mux.HandleFunc("POST /admin/scrub", require(admin, x.startScrub))
+		mux.HandleFunc("GET /admin/repair", require(admin, x.getRepairStatus))
+		mux.HandleFunc("POST /admin/repair", require(admin, x.startRepair))
+		mux.HandleFunc("GET /admin/rebalance", require(admin, x.getRebalanceStatus))
+		mux.HandleFunc("POST /admin/rebalance", require(admin, x.startRebalance))
+		mux.HandleFunc("GET /admin/pools", require(admin, x.getNodePools))
+		mux.HandleFunc("GET /admin/keys", require(admin, x.listApiKeys))
+		mux.HandleFunc("POST /admin/keys", require(admin, x.createApiKey))
+		mux.HandleFunc("DELETE /admin/keys/{id}", require(admin, x.deleteApiKey))
+		mux.HandleFunc("POST /admin/keys/{id}/s3", require(admin, x.createS3Credentials))
+
+		mux.HandleFunc("GET /tools/file-generator", require(readOnly, x.generateFile))
 	}
 	return mux
 }
 
 func (x *controllerHandler) createNode(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseMultipartForm(10 * 1024 * 1024); err != nil {
+	if err := r.ParseMultipartForm(10 * 1024 * 1024); err != nil && !errors.Is(err, http.ErrNotMultipart) {
 		httpError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	addr := r.Form.Get("addr")
+	if addr == "" {
+		httpError(w, "form value 'addr' is required", http.StatusBadRequest)
+		return
+	}
+
+	joinIn := &service.ControllerJoinNodeIn{
+		Addr: addr,
+	}
+	if value := r.Form.Get("force"); value != "" {
+		force, err := strconv.ParseBool(value)
+		if err != nil {
+			httpError(w, "form value 'force' must be true or false", http.StatusBadRequest)
+			return
+		}
+		joinIn.Force = force
+	}
 
-	joinNode, err := x.controller.JoinNode(r.Context(), &service.ControllerJoinNodeIn{Addr: addr})
+	joinNode, err := x.controller.JoinNode(r.Context(), joinIn)
 	if err != nil {
 		httpError(w, err.Error(), getCodeFromPayloadError(err))
 		return
@@ -93,16 +167,61 @@ func (x *controllerHandler) createNode(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func (x *controllerHandler) uploadFile(w http.ResponseWriter, r *http.Request) {
-	contentLengthStr := r.Header.Get("Content-Length")
-	contentLength, _ := strconv.ParseInt(contentLengthStr, 10, 64)
-	if contentLengthStr == "" || contentLength == 0 {
-		httpError(w, "header 'Content-Length' is required", http.StatusLengthRequired)
+func (x *controllerHandler) getNode(w http.ResponseWriter, r *http.Request) {
+	getNode, err := x.controller.GetNode(r.Context(), &service.ControllerGetNodeIn{
+		Id: r.PathValue("id"),
+	})
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
 		return
 	}
 
-	if contentLength > maxFileSize {
-		httpError(w, "Content length is too large", http.StatusRequestEntityTooLarge)
+	data := map[string]any{
+		"node_id":     getNode.Id,
+		"addr":        getNode.Addr,
+		"state":       nodeState(getNode.Up, getNode.Draining),
+		"total_bytes": getNode.TotalBytes,
+		"free_bytes":  getNode.FreeBytes,
+		"shards":      getNode.Shards,
+	}
+	if !getNode.LastSeen.IsZero() {
+		data["last_seen"] = getNode.LastSeen.UTC().Format(time.RFC3339)
+	}
+
+	httpJson(w, data, http.StatusOK)
+	return
+}
+
+func (x *controllerHandler) removeNode(w http.ResponseWriter, r *http.Request) {
+	nodeId := r.PathValue("id")
+
+	removeNode, err := x.controller.RemoveNode(r.Context(), &service.ControllerRemoveNodeIn{
+		Id: nodeId,
+	})
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+
+	if removeNode.Removed {
+		httpJson(w, map[string]any{
+			"node_id": nodeId,
+			"state":   "removed",
+		}, http.StatusOK)
+		return
+	}
+
+	httpJson(w, map[string]any{
+		"node_id": nodeId,
+		"state":   "draining",
+		"shards":  removeNode.Shards,
+	}, http.StatusAccepted)
+	return
+}
+
+func (x *controllerHandler) uploadFile(w http.ResponseWriter, r *http.Request) {
+	contentLength, ok := uploadContentLength(w, r)
+	if !ok {
 		return
 	}
 
@@ -112,14 +231,14 @@ func (x *controllerHandler) uploadFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fileDir, fileName := path.Split(location)
-	if fileDir != "" {
-		httpError(w, "unsupported file directories (`/`)", http.StatusBadRequest)
+	if !x.canReplace(w, r, location, false) {
 		return
 	}
 
 	uploadedFile, err := x.controller.UploadFile(r.Context(), &service.ControllerUploadFileIn{
-		Location: fileName,
+		Bucket:   r.PathValue("bucket"),
+		Location: location,
+		Owner:    requestApiKey(r).Id,
 		Size:     contentLength,
 		Content:  r.Body,
 	})
@@ -128,19 +247,87 @@ func (x *controllerHandler) uploadFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	httpJson(w, map[string]any{
+	data := map[string]any{
 		"file_id":  uploadedFile.Id,
-		"location": fileName,
+		"location": location,
 		"size":     contentLength,
-	}, http.StatusCreated)
+	}
+	if uploadedFile.Version != "" {
+		data["version_id"] = uploadedFile.Version
+	}
+	httpJson(w, data, http.StatusCreated)
+	return
+}
+
+// replaceFile stores the body at the location, an existing file is replaced
+// only once the new one is stored and shards of the old one are removed later.
+func (x *controllerHandler) replaceFile(w http.ResponseWriter, r *http.Request) {
+	contentLength, ok := uploadContentLength(w, r)
+	if !ok {
+		return
+	}
+
+	location := r.PathValue("location")
+	if !x.canReplace(w, r, location, true) {
+		return
+	}
+
+	uploadedFile, err := x.controller.UploadFile(r.Context(), &service.ControllerUploadFileIn{
+		Bucket:      r.PathValue("bucket"),
+		Location:    location,
+		Owner:       requestApiKey(r).Id,
+		Size:        contentLength,
+		Content:     r.Body,
+		Replace:     true,
+		IfMatch:     parseETags(r.Header.Get("If-Match"), false),
+		IfNoneMatch: parseETags(r.Header.Get("If-None-Match"), true),
+	})
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+
+	data := map[string]any{
+		"file_id":  uploadedFile.Id,
+		"location": location,
+		"size":     contentLength,
+		"replaced": uploadedFile.Replaced,
+	}
+	if uploadedFile.Version != "" {
+		data["version_id"] = uploadedFile.Version
+	}
+	code := http.StatusCreated
+	if uploadedFile.Replaced {
+		code = http.StatusOK
+	}
+	httpJson(w, data, code)
 	return
 }
 
+// uploadContentLength writes the error response when the body size is
+// missing or too large.
+func uploadContentLength(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	contentLengthStr := r.Header.Get("Content-Length")
+	contentLength, _ := strconv.ParseInt(contentLengthStr, 10, 64)
+	if contentLengthStr == "" || contentLength == 0 {
+		httpError(w, "header 'Content-Length' is required", http.StatusLengthRequired)
+		return 0, false
+	}
+
+	if contentLength > maxFileSize {
+		httpError(w, "Content length is too large", http.StatusRequestEntityTooLarge)
+		return 0, false
+	}
+	return contentLength, true
+}
+
 func (x *controllerHandler) downloadFile(w http.ResponseWriter, r *http.Request) {
 	location := r.PathValue("location")
 
 	searchFile, err := x.controller.SearchFile(r.Context(), &service.ControllerSearchFileIn{
+		Bucket:   r.PathValue("bucket"),
 		Location: location,
+		Version:  r.URL.Query().Get("version"),
 	})
 	if err != nil {
 		httpError(w, err.Error(), getCodeFromPayloadError(err))
@@ -154,22 +341,174 @@ func (x *controllerHandler) downloadFile(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	etag := setFileHeaders(w, location, searchFile)
+
+	var ranges []httpRange
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" && checkIfRange(r, etag, searchFile.ModifiedAt) {
+		if ranges, err = parseRange(rangeHeader, searchFile.Size); err != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", searchFile.Size))
+			httpError(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+	}
+
+	switch len(ranges) {
+	case 0:
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", searchFile.Size))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		err = x.downloadRange(r.Context(), searchFile.Id, 0, searchFile.Size, w)
+	case 1:
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", ranges[0].length))
+		w.Header().Set("Content-Range", ranges[0].contentRange(searchFile.Size))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusPartialContent)
+		err = x.downloadRange(r.Context(), searchFile.Id, ranges[0].start, ranges[0].length, w)
+	default:
+		mw := multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+		w.WriteHeader(http.StatusPartialContent)
+		for _, rng := range ranges {
+			var part io.Writer
+			part, err = mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type":  {"application/octet-stream"},
+				"Content-Range": {rng.contentRange(searchFile.Size)},
+			})
+			if err != nil {
+				break
+			}
+			if err = x.downloadRange(r.Context(), searchFile.Id, rng.start, rng.length, part); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+	}
+	if err != nil && len(ranges) == 0 {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+	if err != nil {
+		// the status line is already sent, so the client sees a truncated body
+		slog.Error("failed to download file",
+			slog.String("location", location),
+			slog.String("error", err.Error()))
+		return
+	}
+
+	return
+}
+
+func (x *controllerHandler) headFile(w http.ResponseWriter, r *http.Request) {
+	location := r.PathValue("location")
+
+	searchFile, err := x.controller.SearchFile(r.Context(), &service.ControllerSearchFileIn{
+		Bucket:   r.PathValue("bucket"),
+		Location: location,
+		Version:  r.URL.Query().Get("version"),
+	})
+	if err != nil {
+		w.WriteHeader(getCodeFromPayloadError(err))
+		return
+	}
+
+	setFileHeaders(w, location, searchFile)
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", searchFile.Size))
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", path.Base(location)))
 	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	return
+}
 
-	_, err = x.controller.DownloadFile(r.Context(), &service.ControllerDownloadFileIn{
-		Id:      searchFile.Id,
-		Content: w,
+// setFileHeaders sets the headers describing the content of the file and
+// returns its entity tag.
+func setFileHeaders(w http.ResponseWriter, location string, searchFile *service.ControllerSearchFileOut) string {
+	w.Header().Set("Accept-Ranges", "bytes")
+	if !searchFile.ModifiedAt.IsZero() {
+		w.Header().Set("Last-Modified", searchFile.ModifiedAt.UTC().Format(http.TimeFormat))
+	}
+	etag := ""
+	if searchFile.Checksum != "" {
+		etag = fmt.Sprintf("\"%s\"", searchFile.Checksum)
+		w.Header().Set("ETag", etag)
+		if digest, err := hex.DecodeString(searchFile.Checksum); err == nil {
+			w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(digest))
+		}
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", path.Base(location)))
+	return etag
+}
+
+func (x *controllerHandler) getFileInfo(w http.ResponseWriter, r *http.Request) {
+	getFileInfo, err := x.controller.GetFileInfo(r.Context(), &service.ControllerGetFileInfoIn{
+		Bucket:   r.PathValue("bucket"),
+		Location: r.PathValue("location"),
+		Version:  r.URL.Query().Get("version"),
 	})
 	if err != nil {
 		httpError(w, err.Error(), getCodeFromPayloadError(err))
 		return
 	}
 
+	httpJson(w, fileInfoJson(getFileInfo), http.StatusOK)
 	return
 }
 
+func (x *controllerHandler) downloadRange(ctx context.Context, id string, start, length int64, w io.Writer) error {
+	if length == 0 {
+		return nil
+	}
+	_, err := x.controller.DownloadFile(ctx, &service.ControllerDownloadFileIn{
+		Id:      id,
+		Offset:  start,
+		Length:  length,
+		Content: w,
+	})
+	return err
+}
+
+// checkIfRange reports whether the Range header should be served according
+// to If-Range: the entity tag must match or the file must not have been
+// modified since the given date.
+func checkIfRange(r *http.Request, etag string, modifiedAt time.Time) bool {
+	ifRange := r.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, "\"") || strings.HasPrefix(ifRange, "W/") {
+		// weak tags never match in If-Range
+		return etag != "" && ifRange == etag
+	}
+	t, err := http.ParseTime(ifRange)
+	if err != nil || modifiedAt.IsZero() {
+		return false
+	}
+	return !modifiedAt.Truncate(time.Second).After(t)
+}
+
+// parseETags returns the checksums of the entity tags of an If-Match or
+// If-None-Match header. Without weak comparison weak tags are kept as they
+// are, so they never match a checksum.
+func parseETags(header string, weak bool) []string {
+	if header == "" {
+		return nil
+	}
+
+	var etags []string
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			etags = append(etags, tag)
+			continue
+		}
+		if strings.HasPrefix(tag, "W/") && !weak {
+			etags = append(etags, tag)
+			continue
+		}
+		etags = append(etags, strings.Trim(strings.TrimPrefix(tag, "W/"), `"`))
+	}
+	return etags
+}
+
 func httpOkIfNotFoundCode(w http.ResponseWriter, err error) {
 	if code := getCodeFromPayloadError(err); code != http.StatusNotFound {
 		httpError(w, err.Error(), code)
@@ -182,6 +521,7 @@ func (x *controllerHandler) deleteFile(w http.ResponseWriter, r *http.Request) {
 	location := r.PathValue("location")
 
 	searchFile, err := x.controller.SearchFile(r.Context(), &service.ControllerSearchFileIn{
+		Bucket:   r.PathValue("bucket"),
 		Location: location,
 	})
 	if err != nil {
@@ -189,8 +529,14 @@ func (x *controllerHandler) deleteFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !canModify(requestApiKey(r), searchFile.Owner) {
+		httpError(w, "the file belongs to another key", http.StatusForbidden)
+		return
+	}
+
 	_, err = x.controller.DeleteFile(r.Context(), &service.ControllerDeleteFileIn{
-		Id: searchFile.Id,
+		Id:    searchFile.Id,
+		Owner: requestApiKey(r).Id,
 	})
 	if err != nil {
 		httpOkIfNotFoundCode(w, err)
@@ -199,23 +545,791 @@ func (x *controllerHandler) deleteFile(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func (x *controllerHandler) generateFile(w http.ResponseWriter, r *http.Request) {
-	name := r.URL.Query().Get("name")
+func (x *controllerHandler) listFiles(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	listIn := &service.ControllerListFilesIn{
+		Bucket:    r.PathValue("bucket"),
+		Prefix:    query.Get("prefix"),
+		Delimiter: query.Get("delimiter"),
+		Owner:     query.Get("owner"),
+		Cursor:    query.Get("cursor"),
+	}
+
+	var err error
+	if listIn.Limit, err = parsePositiveQuery(query, "limit"); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	minSize, err := parsePositiveQuery(query, "min_size")
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxSize, err := parsePositiveQuery(query, "max_size")
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	listIn.MinSize, listIn.MaxSize = int64(minSize), int64(maxSize)
+
+	if listIn.CreatedAfter, err = parseTimeQuery(query, "created_after"); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if listIn.CreatedBefore, err = parseTimeQuery(query, "created_before"); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch query.Get("sort") {
+	case "", "location":
+		listIn.Sort = service.ControllerFileSortLocation
+	case "size":
+		listIn.Sort = service.ControllerFileSortSize
+	case "created_at":
+		listIn.Sort = service.ControllerFileSortCreatedAt
+	default:
+		httpError(w, "query value 'sort' must be one of location, size, created_at", http.StatusBadRequest)
+		return
+	}
+
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		listIn.Desc = true
+	default:
+		httpError(w, "query value 'order' must be one of asc, desc", http.StatusBadRequest)
+		return
+	}
+
+	listFiles, err := x.controller.ListFiles(r.Context(), listIn)
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+
+	files := make([]map[string]any, 0, len(listFiles.Files))
+	for _, file := range listFiles.Files {
+		files = append(files, fileEntryJson(file))
+	}
+
+	directories := make([]map[string]any, 0, len(listFiles.Directories))
+	for _, directory := range listFiles.Directories {
+		directories = append(directories, directoryJson(directory))
+	}
+
+	data := map[string]any{
+		"files":       files,
+		"directories": directories,
+		"prefixes":    listFiles.Prefixes,
+	}
+	if listFiles.Next != "" {
+		data["next"] = listFiles.Next
+	}
+	httpJson(w, data, http.StatusOK)
+	return
+}
+
+func (x *controllerHandler) createDirectory(w http.ResponseWriter, r *http.Request) {
+	createDirectory, err := x.controller.CreateDirectory(r.Context(), &service.ControllerCreateDirectoryIn{
+		Bucket:   r.PathValue("bucket"),
+		Location: r.PathValue("location"),
+		Owner:    requestApiKey(r).Id,
+	})
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+
+	httpJson(w, directoryJson(createDirectory.Directory), http.StatusCreated)
+	return
+}
+
+func (x *controllerHandler) deleteDirectory(w http.ResponseWriter, r *http.Request) {
+	location := r.PathValue("location")
+
+	searchDirectory, err := x.controller.SearchDirectory(r.Context(), &service.ControllerSearchDirectoryIn{
+		Bucket:   r.PathValue("bucket"),
+		Location: location,
+	})
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+
+	if !canModify(requestApiKey(r), searchDirectory.Directory.Owner) {
+		httpError(w, "the directory belongs to another key", http.StatusForbidden)
+		return
+	}
+
+	if _, err = x.controller.DeleteDirectory(r.Context(), &service.ControllerDeleteDirectoryIn{
+		Bucket:   r.PathValue("bucket"),
+		Location: location,
+	}); err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+	return
+}
+
+func (x *controllerHandler) createUpload(w http.ResponseWriter, r *http.Request) {
+	location := r.URL.Query().Get("location")
+	if location == "" {
+		httpError(w, "query value 'location' is required", http.StatusBadRequest)
+		return
+	}
 
 	size, err := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+	if err != nil || size < 0 {
+		httpError(w, "query value 'size' must be a non-negative number", http.StatusBadRequest)
+		return
+	}
+	if size > maxFileSize {
+		httpError(w, "query value 'size' is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if !x.canReplace(w, r, location, false) {
+		return
+	}
+
+	createUpload, err := x.controller.CreateUpload(r.Context(), &service.ControllerCreateUploadIn{
+		Bucket:   r.PathValue("bucket"),
+		Location: location,
+		Owner:    requestApiKey(r).Id,
+		Size:     size,
+	})
 	if err != nil {
-		httpError(w, fmt.Sprintf("failed to parse 'size' value: %s", err.Error()), http.StatusBadRequest)
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
 		return
 	}
 
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", path.Base(name)))
-	w.Header().Set("Content-Type", "application/octet-stream")
+	httpJson(w, uploadJson(createUpload.Upload), http.StatusCreated)
+	return
+}
 
-	if err = random.WriteRandomData(r.Context(), w, size); err != nil {
-		httpError(w, err.Error(), http.StatusInternalServerError)
+func (x *controllerHandler) getUpload(w http.ResponseWriter, r *http.Request) {
+	upload, ok := x.searchUpload(w, r)
+	if !ok {
+		return
+	}
+
+	httpJson(w, uploadJson(upload), http.StatusOK)
+	return
+}
+
+func (x *controllerHandler) uploadChunk(w http.ResponseWriter, r *http.Request) {
+	contentLengthStr := r.Header.Get("Content-Length")
+	contentLength, _ := strconv.ParseInt(contentLengthStr, 10, 64)
+	if contentLengthStr == "" || contentLength == 0 {
+		httpError(w, "header 'Content-Length' is required", http.StatusLengthRequired)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		httpError(w, "query value 'offset' must be a non-negative number", http.StatusBadRequest)
+		return
+	}
+
+	upload, ok := x.searchUpload(w, r)
+	if !ok {
+		return
+	}
+
+	uploadChunk, err := x.controller.UploadChunk(r.Context(), &service.ControllerUploadChunkIn{
+		Id:      upload.Id,
+		Offset:  offset,
+		Size:    contentLength,
+		Content: r.Body,
+	})
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+
+	httpJson(w, uploadJson(uploadChunk.Upload), http.StatusOK)
+	return
+}
+
+func (x *controllerHandler) completeUpload(w http.ResponseWriter, r *http.Request) {
+	upload, ok := x.searchUpload(w, r)
+	if !ok {
 		return
 	}
 
+	completeUpload, err := x.controller.CompleteUpload(r.Context(), &service.ControllerCompleteUploadIn{
+		Id: upload.Id,
+	})
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+
+	data := map[string]any{
+		"file_id":  completeUpload.Id,
+		"location": upload.Location,
+		"size":     upload.Size,
+	}
+	if completeUpload.Version != "" {
+		data["version_id"] = completeUpload.Version
+	}
+	httpJson(w, data, http.StatusCreated)
+	return
+}
+
+func (x *controllerHandler) abortUpload(w http.ResponseWriter, r *http.Request) {
+	upload, ok := x.searchUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := x.controller.AbortUpload(r.Context(), &service.ControllerAbortUploadIn{
+		Id: upload.Id,
+	}); err != nil {
+		httpOkIfNotFoundCode(w, err)
+		return
+	}
+	return
+}
+
+// searchUpload writes the error response when the upload is not found or
+// belongs to another key.
+func (x *controllerHandler) searchUpload(w http.ResponseWriter, r *http.Request) (*service.ControllerUpload, bool) {
+	getUpload, err := x.controller.GetUpload(r.Context(), &service.ControllerGetUploadIn{
+		Id: r.PathValue("id"),
+	})
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return nil, false
+	}
+
+	if !canModify(requestApiKey(r), getUpload.Upload.Owner) {
+		httpError(w, "the upload belongs to another key", http.StatusForbidden)
+		return nil, false
+	}
+
+	return getUpload.Upload, true
+}
+
+// canReplace writes the error response when the upload would replace a file
+// of another key, without replace only a new version in a versioning bucket
+// does so.
+func (x *controllerHandler) canReplace(w http.ResponseWriter, r *http.Request, location string, replace bool) bool {
+	if !replace {
+		getBucket, err := x.controller.GetBucket(r.Context(), &service.ControllerGetBucketIn{
+			Name: r.PathValue("bucket"),
+		})
+		if err != nil {
+			httpError(w, err.Error(), getCodeFromPayloadError(err))
+			return false
+		}
+		if !getBucket.Bucket.Versioning {
+			return true
+		}
+	}
+
+	searchFile, err := x.controller.SearchFile(r.Context(), &service.ControllerSearchFileIn{
+		Bucket:   r.PathValue("bucket"),
+		Location: location,
+	})
+	if errors.Is(err, repository.ErrResourceNotFound) {
+		return true
+	}
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return false
+	}
+
+	if !canModify(requestApiKey(r), searchFile.Owner) {
+		httpError(w, "the file belongs to another key", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (x *controllerHandler) listVersions(w http.ResponseWriter, r *http.Request) {
+	listVersions, err := x.controller.ListVersions(r.Context(), &service.ControllerListVersionsIn{
+		Bucket:   r.PathValue("bucket"),
+		Location: r.PathValue("location"),
+	})
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+
+	versions := make([]map[string]any, 0, len(listVersions.Versions))
+	for _, version := range listVersions.Versions {
+		versions = append(versions, versionJson(version))
+	}
+
+	httpJson(w, map[string]any{
+		"versions": versions,
+	}, http.StatusOK)
+	return
+}
+
+func (x *controllerHandler) restoreVersion(w http.ResponseWriter, r *http.Request) {
+	version, ok := x.searchVersion(w, r)
+	if !ok {
+		return
+	}
+
+	if !x.canReplace(w, r, r.PathValue("location"), true) {
+		return
+	}
+
+	restoreVersion, err := x.controller.RestoreVersion(r.Context(), &service.ControllerRestoreVersionIn{
+		Bucket:   r.PathValue("bucket"),
+		Location: r.PathValue("location"),
+		Version:  version.Id,
+		Owner:    requestApiKey(r).Id,
+	})
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+
+	httpJson(w, map[string]any{
+		"version_id": restoreVersion.Version,
+		"location":   version.Location,
+	}, http.StatusCreated)
+	return
+}
+
+func (x *controllerHandler) purgeVersion(w http.ResponseWriter, r *http.Request) {
+	version, ok := x.searchVersion(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := x.controller.PurgeVersion(r.Context(), &service.ControllerPurgeVersionIn{
+		Bucket:   r.PathValue("bucket"),
+		Location: r.PathValue("location"),
+		Version:  version.Id,
+	}); err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+	return
+}
+
+// searchVersion writes the error response when the version of the query is
+// not found or belongs to another key.
+func (x *controllerHandler) searchVersion(w http.ResponseWriter, r *http.Request) (*service.ControllerFileVersion, bool) {
+	id := r.URL.Query().Get("version")
+	if id == "" {
+		httpError(w, "query value 'version' is required", http.StatusBadRequest)
+		return nil, false
+	}
+
+	listVersions, err := x.controller.ListVersions(r.Context(), &service.ControllerListVersionsIn{
+		Bucket:   r.PathValue("bucket"),
+		Location: r.PathValue("location"),
+	})
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return nil, false
+	}
+
+	index := slices.IndexFunc(listVersions.Versions, func(version *service.ControllerFileVersion) bool {
+		return version.Id == id
+	})
+	if index < 0 {
+		httpError(w, fmt.Sprintf("version %s is not found", id), http.StatusNotFound)
+		return nil, false
+	}
+
+	version := listVersions.Versions[index]
+	if !canModify(requestApiKey(r), version.Owner) {
+		httpError(w, "the version belongs to another key", http.StatusForbidden)
+		return nil, false
+	}
+	return version, true
+}
+
+func (x *controllerHandler) listBuckets(w http.ResponseWriter, r *http.Request) {
+	listBuckets, err := x.controller.ListBuckets(r.Context(), &service.ControllerListBucketsIn{})
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+
+	buckets := make([]map[string]any, 0, len(listBuckets.Buckets))
+	for _, bucket := range listBuckets.Buckets {
+		buckets = append(buckets, bucketJson(bucket))
+	}
+
+	httpJson(w, map[string]any{
+		"buckets": buckets,
+	}, http.StatusOK)
+	return
+}
+
+func (x *controllerHandler) createBucket(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(10 * 1024 * 1024); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	name := r.Form.Get("name")
+	if name == "" {
+		httpError(w, "form value 'name' is required", http.StatusBadRequest)
+		return
+	}
+
+	createIn := &service.ControllerCreateBucketIn{
+		Name:  name,
+		Owner: requestApiKey(r).Id,
+	}
+	if value := r.Form.Get("versioning"); value != "" {
+		versioning, err := strconv.ParseBool(value)
+		if err != nil {
+			httpError(w, "form value 'versioning' must be true or false", http.StatusBadRequest)
+			return
+		}
+		createIn.Versioning = versioning
+	}
+	for field, value := range map[string]*int{
+		"data_shards": &createIn.DataShards,
+		"replicas":    &createIn.Replicas,
+	} {
+		if r.Form.Get(field) == "" {
+			continue
+		}
+		n, err := strconv.Atoi(r.Form.Get(field))
+		if err != nil || n < 1 {
+			httpError(w, fmt.Sprintf("form value '%s' must be a positive number", field), http.StatusBadRequest)
+			return
+		}
+		*value = n
+	}
+	// parity_shards=0 stores files without erasure coding
+	if value := r.Form.Get("parity_shards"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			httpError(w, "form value 'parity_shards' must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		createIn.ParityShards = &n
+	}
+
+	createBucket, err := x.controller.CreateBucket(r.Context(), createIn)
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+
+	httpJson(w, bucketJson(createBucket.Bucket), http.StatusCreated)
+	return
+}
+
+func (x *controllerHandler) getBucket(w http.ResponseWriter, r *http.Request) {
+	getBucket, err := x.controller.GetBucket(r.Context(), &service.ControllerGetBucketIn{
+		Name: r.PathValue("bucket"),
+	})
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+
+	httpJson(w, bucketJson(getBucket.Bucket), http.StatusOK)
+	return
+}
+
+func (x *controllerHandler) deleteBucket(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("bucket")
+
+	getBucket, err := x.controller.GetBucket(r.Context(), &service.ControllerGetBucketIn{
+		Name: name,
+	})
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+
+	if !canModify(requestApiKey(r), getBucket.Bucket.Owner) {
+		httpError(w, "the bucket belongs to another key", http.StatusForbidden)
+		return
+	}
+
+	if _, err = x.controller.DeleteBucket(r.Context(), &service.ControllerDeleteBucketIn{
+		Name: name,
+	}); err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+	return
+}
+
+func (x *controllerHandler) generateFile(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+
+	size, err := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+	if err != nil {
+		httpError(w, fmt.Sprintf("failed to parse 'size' value: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", path.Base(name)))
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	if err = random.WriteRandomData(r.Context(), w, size); err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	return
+}
+
+func (x *controllerHandler) getScrubStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := x.controller.GetScrubStatus(r.Context(), &service.ControllerGetScrubStatusIn{})
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+
+	httpJson(w, map[string]any{
+		"running": status.Running,
+		"current": scrubReportJson(status.Current),
+		"last":    scrubReportJson(status.Last),
+	}, http.StatusOK)
+	return
+}
+
+func (x *controllerHandler) startScrub(w http.ResponseWriter, r *http.Request) {
+	startScrub, err := x.controller.StartScrub(r.Context(), &service.ControllerStartScrubIn{})
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+
+	if !startScrub.Started {
+		httpError(w, "scrubbing is already running", http.StatusConflict)
+		return
+	}
+
+	httpJson(w, map[string]any{
+		"started": true,
+	}, http.StatusAccepted)
+	return
+}
+
+func (x *controllerHandler) getRepairStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := x.controller.GetRepairStatus(r.Context(), &service.ControllerGetRepairStatusIn{})
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+
+	httpJson(w, map[string]any{
+		"running": status.Running,
+		"current": repairReportJson(status.Current),
+		"last":    repairReportJson(status.Last),
+	}, http.StatusOK)
+	return
+}
+
+func (x *controllerHandler) startRepair(w http.ResponseWriter, r *http.Request) {
+	startRepair, err := x.controller.StartRepair(r.Context(), &service.ControllerStartRepairIn{})
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+
+	if !startRepair.Started {
+		httpError(w, "repair is already running", http.StatusConflict)
+		return
+	}
+
+	httpJson(w, map[string]any{
+		"started": true,
+	}, http.StatusAccepted)
+	return
+}
+
+func (x *controllerHandler) getRebalanceStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := x.controller.GetRebalanceStatus(r.Context(), &service.ControllerGetRebalanceStatusIn{})
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+
+	httpJson(w, map[string]any{
+		"running": status.Running,
+		"current": rebalanceReportJson(status.Current),
+		"last":    rebalanceReportJson(status.Last),
+	}, http.StatusOK)
+	return
+}
+
+func (x *controllerHandler) startRebalance(w http.ResponseWriter, r *http.Request) {
+	if dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run")); dryRun {
+		x.planRebalance(w, r)
+		return
+	}
+
+	startRebalance, err := x.controller.StartRebalance(r.Context(), &service.ControllerStartRebalanceIn{})
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+
+	if !startRebalance.Started {
+		httpError(w, "rebalancing is already running", http.StatusConflict)
+		return
+	}
+
+	httpJson(w, map[string]any{
+		"started": true,
+	}, http.StatusAccepted)
+	return
+}
+
+func (x *controllerHandler) planRebalance(w http.ResponseWriter, r *http.Request) {
+	plan, err := x.controller.PlanRebalance(r.Context(), &service.ControllerPlanRebalanceIn{})
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+
+	nodes := make([]map[string]any, 0, len(plan.Nodes))
+	for _, node := range plan.Nodes {
+		nodes = append(nodes, map[string]any{
+			"node_id":       node.Id,
+			"used_bytes":    node.UsedBytes,
+			"total_bytes":   node.TotalBytes,
+			"usage":         node.Usage,
+			"planned_usage": node.PlannedUsage,
+		})
+	}
+
+	moves := make([]map[string]any, 0, len(plan.Moves))
+	var bytes int64
+	for _, move := range plan.Moves {
+		moves = append(moves, map[string]any{
+			"file_id":      move.FileId,
+			"index":        move.Index,
+			"size":         move.Size,
+			"from_node_id": move.FromNodeId,
+			"to_node_id":   move.ToNodeId,
+		})
+		bytes += move.Size
+	}
+
+	httpJson(w, map[string]any{
+		"dry_run":    true,
+		"mean_usage": plan.MeanUsage,
+		"nodes":      nodes,
+		"moves":      moves,
+		"bytes":      bytes,
+	}, http.StatusOK)
+	return
+}
+
+func (x *controllerHandler) getNodePools(w http.ResponseWriter, r *http.Request) {
+	getNodePools, err := x.controller.GetNodePools(r.Context(), &service.ControllerGetNodePoolsIn{})
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+
+	pools := make([]map[string]any, 0, len(getNodePools.Pools))
+	for _, pool := range getNodePools.Pools {
+		pools = append(pools, map[string]any{
+			"node_id":   pool.NodeId,
+			"conns":     pool.Conns,
+			"idle":      pool.Idle,
+			"streams":   pool.Streams,
+			"dials":     pool.Dials,
+			"reuses":    pool.Reuses,
+			"waits":     pool.Waits,
+			"unhealthy": pool.Unhealthy,
+			"expired":   pool.Expired,
+		})
+	}
+
+	httpJson(w, map[string]any{
+		"pools": pools,
+	}, http.StatusOK)
+	return
+}
+
+func (x *controllerHandler) listApiKeys(w http.ResponseWriter, r *http.Request) {
+	listApiKeys, err := x.controller.ListApiKeys(r.Context(), &service.ControllerListApiKeysIn{})
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+
+	keys := make([]map[string]any, 0, len(listApiKeys.Keys))
+	for _, key := range listApiKeys.Keys {
+		keys = append(keys, apiKeyJson(key))
+	}
+
+	httpJson(w, map[string]any{
+		"keys": keys,
+	}, http.StatusOK)
+	return
+}
+
+func (x *controllerHandler) createApiKey(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(10 * 1024 * 1024); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	name := r.Form.Get("name")
+	if name == "" {
+		httpError(w, "form value 'name' is required", http.StatusBadRequest)
+		return
+	}
+
+	role, ok := parseRole(r.Form.Get("role"))
+	if !ok {
+		httpError(w, "form value 'role' must be one of admin, read-write, read-only", http.StatusBadRequest)
+		return
+	}
+
+	createApiKey, err := x.controller.CreateApiKey(r.Context(), &service.ControllerCreateApiKeyIn{
+		Name: name,
+		Role: role,
+	})
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+
+	data := apiKeyJson(createApiKey.Key)
+	data["token"] = createApiKey.Token
+	httpJson(w, data, http.StatusCreated)
+	return
+}
+
+func (x *controllerHandler) createS3Credentials(w http.ResponseWriter, r *http.Request) {
+	createS3Credentials, err := x.controller.CreateS3Credentials(r.Context(), &service.ControllerCreateS3CredentialsIn{
+		KeyId: r.PathValue("id"),
+	})
+	if err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
+
+	httpJson(w, map[string]any{
+		"access_key_id":     createS3Credentials.AccessKey,
+		"secret_access_key": createS3Credentials.Secret,
+	}, http.StatusCreated)
+	return
+}
+
+func (x *controllerHandler) deleteApiKey(w http.ResponseWriter, r *http.Request) {
+	if _, err := x.controller.DeleteApiKey(r.Context(), &service.ControllerDeleteApiKeyIn{
+		Id: r.PathValue("id"),
+	}); err != nil {
+		httpError(w, err.Error(), getCodeFromPayloadError(err))
+		return
+	}
 	return
 }
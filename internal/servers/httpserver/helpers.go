@@ -1,9 +1,18 @@
 package httpserver
 
 import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
+const maxRanges = 16
+
+var errUnsatisfiableRange = errors.New("range is not satisfiable")
+
 func parseContentDisposition(values string) string {
 	sp := strings.Split(values, ";")
 	for _, val := range sp {
@@ -14,3 +23,109 @@ func parseContentDisposition(values string) string {
 	}
 	return ""
 }
+
+// parsePositiveQuery returns 0 when the value is not set.
+func parsePositiveQuery(query url.Values, name string) (int, error) {
+	value := query.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("query value '%s' must be a positive number", name)
+	}
+	return n, nil
+}
+
+// parseTimeQuery returns the zero time when the value is not set.
+func parseTimeQuery(query url.Values, name string) (time.Time, error) {
+	value := query.Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("query value '%s' must be a RFC 3339 time", name)
+	}
+	return t.UTC(), nil
+}
+
+type httpRange struct {
+	start, length int64
+}
+
+func (x httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", x.start, x.start+x.length-1, size)
+}
+
+// parseRange parses a Range header value (RFC 9110, section 14.2) for a file
+// of the given size. Malformed headers are ignored as the RFC allows, ranges
+// out of the file make the whole header unsatisfiable.
+func parseRange(header string, size int64) ([]httpRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return nil, nil
+	}
+
+	var ranges []httpRange
+	valid := 0
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, nil
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+		valid++
+
+		var r httpRange
+		if first == "" {
+			// suffix range: the last n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n == 0 {
+				continue
+			}
+			n = min(n, size)
+			r = httpRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			end := size - 1
+			if last != "" {
+				if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+					return nil, nil
+				}
+				end = min(end, size-1)
+			}
+			if start >= size {
+				continue
+			}
+			r = httpRange{start: start, length: end - start + 1}
+		}
+
+		if r.length > 0 {
+			ranges = append(ranges, r)
+		}
+	}
+
+	if valid == 0 {
+		return nil, nil
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+	if len(ranges) > maxRanges {
+		// too many ranges are not worth serving separately
+		return nil, nil
+	}
+	return ranges, nil
+}
@@ -0,0 +1,104 @@
+package httpserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	tooMany := make([]string, maxRanges+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("%d-%d", i*2, i*2)
+	}
+	limit := make([]httpRange, maxRanges)
+	for i := range limit {
+		limit[i] = httpRange{start: int64(i * 2), length: 1}
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		size   int64
+		want   []httpRange
+		err    error
+	}{
+		{"no header", "", 100, nil, nil},
+		{"other unit", "items=0-10", 100, nil, nil},
+		{"single", "bytes=0-9", 100, []httpRange{{0, 10}}, nil},
+		{"last byte", "bytes=99-99", 100, []httpRange{{99, 1}}, nil},
+		{"end past size", "bytes=90-200", 100, []httpRange{{90, 10}}, nil},
+		{"open ended", "bytes=95-", 100, []httpRange{{95, 5}}, nil},
+		{"open ended from 0", "bytes=0-", 100, []httpRange{{0, 100}}, nil},
+		{"suffix", "bytes=-10", 100, []httpRange{{90, 10}}, nil},
+		{"suffix longer than file", "bytes=-500", 100, []httpRange{{0, 100}}, nil},
+		{"spaces", "bytes= 0-1 , 5-6", 100, []httpRange{{0, 2}, {5, 2}}, nil},
+		{"several", "bytes=0-0,-1", 100, []httpRange{{0, 1}, {99, 1}}, nil},
+		{"overlapping", "bytes=0-49,25-74", 100, []httpRange{{0, 50}, {25, 50}}, nil},
+		{"unsatisfiable ones skipped", "bytes=200-300,0-0", 100, []httpRange{{0, 1}}, nil},
+		{"start at size", "bytes=100-", 100, nil, errUnsatisfiableRange},
+		{"start past size", "bytes=200-300", 100, nil, errUnsatisfiableRange},
+		{"zero suffix", "bytes=-0", 100, nil, errUnsatisfiableRange},
+		{"empty file", "bytes=0-", 0, nil, errUnsatisfiableRange},
+		{"empty file suffix", "bytes=-10", 0, nil, errUnsatisfiableRange},
+		{"end before start", "bytes=10-5", 100, nil, nil},
+		{"no dash", "bytes=10", 100, nil, nil},
+		{"not a number", "bytes=a-5", 100, nil, nil},
+		{"negative suffix", "bytes=--5", 100, nil, nil},
+		{"no ranges", "bytes=", 100, nil, nil},
+		{"at the limit", "bytes=" + strings.Join(tooMany[:maxRanges], ","), 100, limit, nil},
+		{"over the limit", "bytes=" + strings.Join(tooMany, ","), 100, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRange(tt.header, tt.size)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckIfRange(t *testing.T) {
+	modifiedAt := time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC)
+	etag := `"abc"`
+
+	tests := []struct {
+		name       string
+		ifRange    string
+		etag       string
+		modifiedAt time.Time
+		want       bool
+	}{
+		{"no header", "", etag, modifiedAt, true},
+		{"matching etag", `"abc"`, etag, modifiedAt, true},
+		{"other etag", `"abd"`, etag, modifiedAt, false},
+		{"weak etag", `W/"abc"`, etag, modifiedAt, false},
+		{"etag of file without checksum", `"abc"`, "", modifiedAt, false},
+		{"same date", "Wed, 01 May 2024 12:00:00 GMT", etag, modifiedAt, true},
+		{"later date", "Wed, 01 May 2024 13:00:00 GMT", etag, modifiedAt, true},
+		{"earlier date", "Wed, 01 May 2024 11:59:59 GMT", etag, modifiedAt, false},
+		{"date of file without time", "Wed, 01 May 2024 12:00:00 GMT", etag, time.Time{}, false},
+		{"malformed date", "yesterday", etag, modifiedAt, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://example.com/file", nil)
+			if tt.ifRange != "" {
+				r.Header.Set("If-Range", tt.ifRange)
+			}
+			if got := checkIfRange(r, tt.etag, tt.modifiedAt); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
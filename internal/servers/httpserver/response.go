@@ -4,8 +4,10 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"time"
 
 	"github.com/fydmer/fileserver/internal/domain/repository"
+	"github.com/fydmer/fileserver/internal/domain/service"
 )
 
 func getCodeFromPayloadError(err error) int {
@@ -16,6 +18,24 @@ func getCodeFromPayloadError(err error) int {
 		return http.StatusBadRequest
 	case errors.Is(err, repository.ErrResourceAlreadyExists):
 		return http.StatusConflict
+	case errors.Is(err, repository.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, repository.ErrResourceGone):
+		return http.StatusGone
+	case errors.Is(err, repository.ErrPreconditionFailed):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, repository.ErrInsufficientStorage):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, repository.ErrUnauthenticated):
+		return http.StatusUnauthorized
+	case errors.Is(err, repository.ErrPermissionDenied):
+		return http.StatusForbidden
+	case errors.Is(err, repository.ErrChecksumMismatch), errors.Is(err, repository.ErrDataLost):
+		return http.StatusBadGateway
+	case errors.Is(err, repository.ErrMisconfigured):
+		return http.StatusInternalServerError
+	case errors.Is(err, repository.ErrUnavailable):
+		return http.StatusServiceUnavailable
 	case errors.Is(err, repository.ErrUnknown):
 		return http.StatusInternalServerError
 	default:
@@ -32,6 +52,219 @@ func httpJson(w http.ResponseWriter, data map[string]any, code int) {
 	_, _ = w.Write(body)
 }
 
+func nodeState(up, draining bool) string {
+	switch {
+	case draining:
+		return "draining"
+	case up:
+		return "up"
+	default:
+		return "down"
+	}
+}
+
+func scrubReportJson(report *service.ControllerScrubReport) map[string]any {
+	if report == nil {
+		return nil
+	}
+
+	data := map[string]any{
+		"started_at": report.StartedAt.UTC().Format(time.RFC3339),
+		"files":      report.Files,
+		"shards":     report.Shards,
+		"bytes":      report.Bytes,
+		"verified":   report.Verified,
+		"corrupted":  report.Corrupted,
+		"missing":    report.Missing,
+		"skipped":    report.Skipped,
+	}
+	if !report.FinishedAt.IsZero() {
+		data["finished_at"] = report.FinishedAt.UTC().Format(time.RFC3339)
+	}
+	return data
+}
+
+func repairReportJson(report *service.ControllerRepairReport) map[string]any {
+	if report == nil {
+		return nil
+	}
+
+	data := map[string]any{
+		"started_at": report.StartedAt.UTC().Format(time.RFC3339),
+		"files":      report.Files,
+		"degraded":   report.Degraded,
+		"repaired":   report.Repaired,
+		"failed":     report.Failed,
+		"bytes":      report.Bytes,
+	}
+	if !report.FinishedAt.IsZero() {
+		data["finished_at"] = report.FinishedAt.UTC().Format(time.RFC3339)
+	}
+	return data
+}
+
+func rebalanceReportJson(report *service.ControllerRebalanceReport) map[string]any {
+	if report == nil {
+		return nil
+	}
+
+	data := map[string]any{
+		"started_at": report.StartedAt.UTC().Format(time.RFC3339),
+		"planned":    report.Planned,
+		"moved":      report.Moved,
+		"failed":     report.Failed,
+		"skipped":    report.Skipped,
+		"bytes":      report.Bytes,
+	}
+	if !report.FinishedAt.IsZero() {
+		data["finished_at"] = report.FinishedAt.UTC().Format(time.RFC3339)
+	}
+	return data
+}
+
+func apiKeyJson(key *service.ControllerApiKey) map[string]any {
+	return map[string]any{
+		"key_id":     key.Id,
+		"name":       key.Name,
+		"role":       roleNames[key.Role],
+		"created_at": key.CreatedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+func bucketJson(bucket *service.ControllerBucket) map[string]any {
+	data := map[string]any{
+		"name":          bucket.Name,
+		"data_shards":   bucket.DataShards,
+		"parity_shards": bucket.ParityShards,
+		"replicas":      bucket.Replicas,
+		"versioning":    bucket.Versioning,
+		"created_at":    bucket.CreatedAt.UTC().Format(time.RFC3339),
+	}
+	if bucket.Owner != "" {
+		data["owner"] = bucket.Owner
+	}
+	return data
+}
+
+func versionJson(version *service.ControllerFileVersion) map[string]any {
+	data := map[string]any{
+		"version_id": version.Id,
+		"location":   version.Location,
+		"deleted":    version.Deleted,
+		"latest":     version.Latest,
+		"created_at": version.CreatedAt.UTC().Format(time.RFC3339),
+	}
+	if !version.Deleted {
+		data["file_id"] = version.FileId
+		data["size"] = version.Size
+	}
+	if version.Checksum != "" {
+		data["checksum"] = version.Checksum
+	}
+	if version.Owner != "" {
+		data["owner"] = version.Owner
+	}
+	return data
+}
+
+func fileEntryJson(file *service.ControllerFileEntry) map[string]any {
+	data := map[string]any{
+		"file_id":    file.Id,
+		"location":   file.Location,
+		"size":       file.Size,
+		"created_at": file.CreatedAt.UTC().Format(time.RFC3339),
+	}
+	if file.Checksum != "" {
+		data["checksum"] = file.Checksum
+	}
+	if file.Owner != "" {
+		data["owner"] = file.Owner
+	}
+	return data
+}
+
+var fileStatusNames = map[int]string{
+	0: "ok",
+	1: "new",
+	2: "in_progress",
+	3: "error",
+}
+
+func fileInfoJson(info *service.ControllerGetFileInfoOut) map[string]any {
+	shards := make([]map[string]any, 0, len(info.Shards))
+	for _, shard := range info.Shards {
+		data := map[string]any{
+			"index":      shard.Index,
+			"node_id":    shard.NodeId,
+			"size":       shard.Size,
+			"status":     fileStatusNames[shard.Status],
+			"created_at": shard.CreatedAt.UTC().Format(time.RFC3339),
+		}
+		if shard.NodeAddr != "" {
+			data["node_addr"] = shard.NodeAddr
+		}
+		if shard.Checksum != "" {
+			data["checksum"] = shard.Checksum
+		}
+		shards = append(shards, data)
+	}
+
+	data := map[string]any{
+		"file_id":       info.Id,
+		"bucket":        info.Bucket,
+		"location":      info.Location,
+		"size":          info.Size,
+		"status":        fileStatusNames[info.Status],
+		"created_at":    info.CreatedAt.UTC().Format(time.RFC3339),
+		"data_shards":   info.DataShards,
+		"parity_shards": info.ParityShards,
+		"replicas":      info.Replicas,
+		"shards":        shards,
+	}
+	if !info.ModifiedAt.IsZero() {
+		data["modified_at"] = info.ModifiedAt.UTC().Format(time.RFC3339)
+	}
+	if info.BlockSize > 0 {
+		data["block_size"] = info.BlockSize
+	}
+	if info.Checksum != "" {
+		data["checksum"] = info.Checksum
+	}
+	if info.Owner != "" {
+		data["owner"] = info.Owner
+	}
+	return data
+}
+
+func directoryJson(directory *service.ControllerDirectory) map[string]any {
+	data := map[string]any{
+		"directory_id": directory.Id,
+		"location":     directory.Location,
+		"created_at":   directory.CreatedAt.UTC().Format(time.RFC3339),
+	}
+	if directory.Owner != "" {
+		data["owner"] = directory.Owner
+	}
+	return data
+}
+
+func uploadJson(upload *service.ControllerUpload) map[string]any {
+	data := map[string]any{
+		"upload_id":  upload.Id,
+		"bucket":     upload.Bucket,
+		"location":   upload.Location,
+		"size":       upload.Size,
+		"chunk_size": upload.ChunkSize,
+		"uploaded":   upload.Uploaded,
+		"created_at": upload.CreatedAt.UTC().Format(time.RFC3339),
+		"expires_at": upload.ExpiresAt.UTC().Format(time.RFC3339),
+	}
+	if upload.Owner != "" {
+		data["owner"] = upload.Owner
+	}
+	return data
+}
+
 func httpError(w http.ResponseWriter, message string, code int) {
 	httpJson(w, map[string]any{
 		"status":  http.StatusText(code),
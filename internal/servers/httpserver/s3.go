@@ -0,0 +1,695 @@
+package httpserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fydmer/fileserver/internal/domain/repository"
+	"github.com/fydmer/fileserver/internal/domain/service"
+)
+
+const (
+	s3TimeFormat    = "2006-01-02T15:04:05.000Z"
+	s3MaxKeys       = 1000
+	s3MaxXmlBody    = 1024 * 1024
+	s3DefaultRegion = "us-east-1"
+)
+
+// S3Config sets the region expected in signatures, buckets are taken from
+// the host name "<bucket>.<Domain>" when Domain is set and from the first
+// name of the path otherwise.
+type S3Config struct {
+	Region string
+	Domain string
+}
+
+type s3Handler struct {
+	controller service.Controller
+	region     string
+	domain     string
+}
+
+type S3Server struct {
+	server  *http.Server
+	handler *s3Handler
+}
+
+// RunS3Server serves a subset of the S3 REST API over the controller, S3
+// buckets are the buckets of the controller and object keys are file
+// locations.
+func RunS3Server(ctx context.Context, port int, controller service.Controller, config *S3Config) (*S3Server, error) {
+	handler := &s3Handler{
+		controller: controller,
+		region:     config.Region,
+		domain:     config.Domain,
+	}
+	if handler.region == "" {
+		handler.region = s3DefaultRegion
+	}
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: handler.authenticate(http.HandlerFunc(handler.route)),
+	}
+
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.ErrorContext(ctx, "s3 server error", slog.String("error", err.Error()))
+		}
+	}()
+
+	slog.InfoContext(ctx, "s3 server started", slog.Int("port", port), slog.String("region", handler.region))
+
+	return &S3Server{
+		server:  server,
+		handler: handler,
+	}, nil
+}
+
+func (s *S3Server) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_ = s.server.Shutdown(ctx)
+}
+
+// route dispatches the request by the method, the bucket and the key and by
+// the query parameters naming the operation.
+func (x *s3Handler) route(w http.ResponseWriter, r *http.Request) {
+	bucket, key := x.bucketAndKey(r)
+	query := r.URL.Query()
+
+	readOnly := service.ControllerRoleReadOnly
+	readWrite := service.ControllerRoleReadWrite
+
+	switch {
+	case bucket == "" && r.Method == http.MethodGet:
+		s3Require(readOnly, x.listBuckets)(w, r)
+	case bucket == "":
+		s3Error(w, r, errS3NotImplemented)
+	case key == "" && r.Method == http.MethodPut && len(query) == 0:
+		s3Require(readWrite, x.createBucket)(w, r)
+	case !x.searchBucket(w, r, bucket):
+	case key == "":
+		switch {
+		case r.Method == http.MethodGet && query.Has("location"):
+			s3Require(readOnly, x.getBucketLocation)(w, r)
+		case r.Method == http.MethodGet && query.Get("list-type") == "2":
+			s3Require(readOnly, x.listObjectsV2)(w, r)
+		case r.Method == http.MethodHead && len(query) == 0:
+			s3Require(readOnly, x.headBucket)(w, r)
+		case r.Method == http.MethodDelete && len(query) == 0:
+			s3Require(readWrite, x.deleteBucket)(w, r)
+		default:
+			s3Error(w, r, errS3NotImplemented)
+		}
+	default:
+		switch {
+		case r.Method == http.MethodPost && query.Has("uploads"):
+			s3Require(readWrite, x.createMultipartUpload)(w, r)
+		case r.Method == http.MethodPut && query.Has("uploadId") && query.Has("partNumber"):
+			s3Require(readWrite, x.uploadPart)(w, r)
+		case r.Method == http.MethodPost && query.Has("uploadId"):
+			s3Require(readWrite, x.completeMultipartUpload)(w, r)
+		case r.Method == http.MethodDelete && query.Has("uploadId"):
+			s3Require(readWrite, x.abortMultipartUpload)(w, r)
+		case r.Method == http.MethodPut && !query.Has("uploadId") && r.Header.Get("X-Amz-Copy-Source") == "":
+			s3Require(readWrite, x.putObject)(w, r)
+		case r.Method == http.MethodGet && !query.Has("uploadId"):
+			s3Require(readOnly, x.getObject)(w, r)
+		case r.Method == http.MethodHead:
+			s3Require(readOnly, x.headObject)(w, r)
+		case r.Method == http.MethodDelete:
+			s3Require(readWrite, x.deleteObject)(w, r)
+		default:
+			s3Error(w, r, errS3NotImplemented)
+		}
+	}
+}
+
+func (x *s3Handler) bucketAndKey(r *http.Request) (string, string) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if x.domain != "" {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if bucket, ok := strings.CutSuffix(host, "."+x.domain); ok {
+			return bucket, path
+		}
+	}
+	bucket, key, _ := strings.Cut(path, "/")
+	return bucket, key
+}
+
+func s3Require(role service.ControllerRole, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if key := s3RequestKey(r); key.Role < role {
+			s3Error(w, r, fmt.Errorf("%w: the key has role %s, %s is required", repository.ErrPermissionDenied, roleNames[key.Role], roleNames[role]))
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (x *s3Handler) listBuckets(w http.ResponseWriter, r *http.Request) {
+	listBuckets, err := x.controller.ListBuckets(r.Context(), &service.ControllerListBucketsIn{})
+	if err != nil {
+		s3Error(w, r, err)
+		return
+	}
+
+	result := &s3ListAllMyBucketsResult{}
+	for _, bucket := range listBuckets.Buckets {
+		result.Buckets = append(result.Buckets, &s3Bucket{
+			Name:         bucket.Name,
+			CreationDate: bucket.CreatedAt.UTC().Format(s3TimeFormat),
+		})
+	}
+
+	s3Xml(w, result, http.StatusOK)
+	return
+}
+
+func (x *s3Handler) getBucketLocation(w http.ResponseWriter, r *http.Request) {
+	s3Xml(w, &s3LocationConstraint{Region: x.region}, http.StatusOK)
+	return
+}
+
+// headBucket is only reached for an existing bucket, see route.
+func (x *s3Handler) headBucket(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	return
+}
+
+func (x *s3Handler) createBucket(w http.ResponseWriter, r *http.Request) {
+	bucket, _ := x.bucketAndKey(r)
+
+	if _, err := x.controller.CreateBucket(r.Context(), &service.ControllerCreateBucketIn{
+		Name:  bucket,
+		Owner: s3RequestKey(r).Id,
+	}); errors.Is(err, repository.ErrResourceAlreadyExists) {
+		s3Error(w, r, fmt.Errorf("%w: %s", errS3BucketAlreadyExists, err.Error()))
+		return
+	} else if err != nil {
+		s3Error(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", "/"+bucket)
+	w.WriteHeader(http.StatusOK)
+	return
+}
+
+func (x *s3Handler) deleteBucket(w http.ResponseWriter, r *http.Request) {
+	bucket, _ := x.bucketAndKey(r)
+
+	getBucket, err := x.controller.GetBucket(r.Context(), &service.ControllerGetBucketIn{
+		Name: bucket,
+	})
+	if err != nil {
+		s3Error(w, r, err)
+		return
+	}
+
+	if !canModify(s3RequestKey(r), getBucket.Bucket.Owner) {
+		s3Error(w, r, fmt.Errorf("%w: the bucket belongs to another key", repository.ErrPermissionDenied))
+		return
+	}
+
+	if _, err = x.controller.DeleteBucket(r.Context(), &service.ControllerDeleteBucketIn{
+		Name: bucket,
+	}); errors.Is(err, repository.ErrConflict) {
+		s3Error(w, r, fmt.Errorf("%w: %s", errS3BucketNotEmpty, err.Error()))
+		return
+	} else if err != nil {
+		s3Error(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
+
+func (x *s3Handler) listObjectsV2(w http.ResponseWriter, r *http.Request) {
+	bucket, _ := x.bucketAndKey(r)
+	query := r.URL.Query()
+
+	maxKeys := s3MaxKeys
+	if value := query.Get("max-keys"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			s3Error(w, r, fmt.Errorf("%w: max-keys must be a non-negative number", repository.ErrBadRequest))
+			return
+		}
+		maxKeys = min(n, s3MaxKeys)
+	}
+
+	result := &s3ListBucketResult{
+		Name:              bucket,
+		Prefix:            query.Get("prefix"),
+		Delimiter:         query.Get("delimiter"),
+		MaxKeys:           maxKeys,
+		ContinuationToken: query.Get("continuation-token"),
+		StartAfter:        query.Get("start-after"),
+	}
+	if maxKeys == 0 {
+		s3Xml(w, result, http.StatusOK)
+		return
+	}
+
+	listFiles, err := x.controller.ListFiles(r.Context(), &service.ControllerListFilesIn{
+		Bucket:    bucket,
+		Prefix:    result.Prefix,
+		Delimiter: result.Delimiter,
+		Cursor:    result.ContinuationToken,
+		After:     result.StartAfter,
+		Limit:     maxKeys,
+	})
+	if err != nil {
+		s3Error(w, r, err)
+		return
+	}
+
+	for _, file := range listFiles.Files {
+		result.Contents = append(result.Contents, &s3Object{
+			Key:          file.Location,
+			LastModified: file.CreatedAt.UTC().Format(s3TimeFormat),
+			ETag:         s3ETag(file.Checksum),
+			Size:         file.Size,
+			StorageClass: "STANDARD",
+		})
+	}
+	for _, directory := range listFiles.Directories {
+		result.Contents = append(result.Contents, &s3Object{
+			Key:          directory.Location,
+			LastModified: directory.CreatedAt.UTC().Format(s3TimeFormat),
+			StorageClass: "STANDARD",
+		})
+	}
+	for _, prefix := range listFiles.Prefixes {
+		result.CommonPrefixes = append(result.CommonPrefixes, &s3CommonPrefix{
+			Prefix: prefix,
+		})
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	result.IsTruncated = listFiles.Next != ""
+	result.NextContinuationToken = listFiles.Next
+
+	s3Xml(w, result, http.StatusOK)
+	return
+}
+
+// putObject replaces the existing object, a key ending with "/" with no
+// content makes a directory.
+func (x *s3Handler) putObject(w http.ResponseWriter, r *http.Request) {
+	bucket, key := x.bucketAndKey(r)
+
+	if r.ContentLength < 0 {
+		s3Error(w, r, errS3MissingContentLength)
+		return
+	}
+	if r.ContentLength > maxFileSize {
+		s3Error(w, r, errS3EntityTooLarge)
+		return
+	}
+
+	if strings.HasSuffix(key, "/") && r.ContentLength == 0 {
+		if _, err := x.controller.CreateDirectory(r.Context(), &service.ControllerCreateDirectoryIn{
+			Bucket:   bucket,
+			Location: key,
+			Owner:    s3RequestKey(r).Id,
+		}); err != nil && !errors.Is(err, repository.ErrResourceAlreadyExists) {
+			s3Error(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	searchFile, err := x.controller.SearchFile(r.Context(), &service.ControllerSearchFileIn{
+		Bucket:   bucket,
+		Location: key,
+	})
+	if err != nil && !errors.Is(err, repository.ErrResourceNotFound) {
+		s3Error(w, r, err)
+		return
+	}
+	if err == nil && !canModify(s3RequestKey(r), searchFile.Owner) {
+		s3Error(w, r, fmt.Errorf("%w: the object belongs to another key", repository.ErrPermissionDenied))
+		return
+	}
+
+	uploadedFile, err := x.controller.UploadFile(r.Context(), &service.ControllerUploadFileIn{
+		Bucket:      bucket,
+		Location:    key,
+		Owner:       s3RequestKey(r).Id,
+		Size:        r.ContentLength,
+		Content:     r.Body,
+		Replace:     true,
+		IfMatch:     parseETags(r.Header.Get("If-Match"), false),
+		IfNoneMatch: parseETags(r.Header.Get("If-None-Match"), true),
+	})
+	if err != nil {
+		s3Error(w, r, err)
+		return
+	}
+
+	if searchFile, err = x.controller.SearchFile(r.Context(), &service.ControllerSearchFileIn{
+		Bucket:   bucket,
+		Location: key,
+	}); err == nil && searchFile.Id == uploadedFile.Id && searchFile.Checksum != "" {
+		w.Header().Set("ETag", s3ETag(searchFile.Checksum))
+	}
+	w.WriteHeader(http.StatusOK)
+	return
+}
+
+func (x *s3Handler) getObject(w http.ResponseWriter, r *http.Request) {
+	bucket, key := x.bucketAndKey(r)
+
+	searchFile, ok := x.searchObject(w, r, bucket, key)
+	if !ok {
+		return
+	}
+	if searchFile.Status != 0 {
+		s3Error(w, r, fmt.Errorf("%w: the object status is %d", repository.ErrUnavailable, searchFile.Status))
+		return
+	}
+
+	setS3ObjectHeaders(w, searchFile)
+
+	// S3 serves a single range, the object is sent whole for several ranges
+	var ranges []httpRange
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		var err error
+		if ranges, err = parseRange(rangeHeader, searchFile.Size); err != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", searchFile.Size))
+			s3Error(w, r, errS3InvalidRange)
+			return
+		}
+	}
+
+	start, length, code := int64(0), searchFile.Size, http.StatusOK
+	if len(ranges) == 1 {
+		start, length, code = ranges[0].start, ranges[0].length, http.StatusPartialContent
+		w.Header().Set("Content-Range", ranges[0].contentRange(searchFile.Size))
+	}
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", length))
+	w.WriteHeader(code)
+
+	if _, err := x.controller.DownloadFile(r.Context(), &service.ControllerDownloadFileIn{
+		Id:      searchFile.Id,
+		Offset:  start,
+		Length:  length,
+		Content: w,
+	}); err != nil {
+		// the status line is already sent, so the client sees a truncated body
+		slog.Error("failed to download object",
+			slog.String("bucket", bucket),
+			slog.String("key", key),
+			slog.String("error", err.Error()))
+	}
+	return
+}
+
+func (x *s3Handler) headObject(w http.ResponseWriter, r *http.Request) {
+	bucket, key := x.bucketAndKey(r)
+
+	searchFile, err := x.controller.SearchFile(r.Context(), &service.ControllerSearchFileIn{
+		Bucket:   bucket,
+		Location: key,
+	})
+	if err != nil {
+		w.WriteHeader(getCodeFromPayloadError(err))
+		return
+	}
+
+	setS3ObjectHeaders(w, searchFile)
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", searchFile.Size))
+	w.WriteHeader(http.StatusOK)
+	return
+}
+
+// deleteObject succeeds for missing objects as S3 does.
+func (x *s3Handler) deleteObject(w http.ResponseWriter, r *http.Request) {
+	bucket, key := x.bucketAndKey(r)
+
+	searchFile, err := x.controller.SearchFile(r.Context(), &service.ControllerSearchFileIn{
+		Bucket:   bucket,
+		Location: key,
+	})
+	if errors.Is(err, repository.ErrResourceNotFound) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		s3Error(w, r, err)
+		return
+	}
+
+	if !canModify(s3RequestKey(r), searchFile.Owner) {
+		s3Error(w, r, fmt.Errorf("%w: the object belongs to another key", repository.ErrPermissionDenied))
+		return
+	}
+
+	if _, err = x.controller.DeleteFile(r.Context(), &service.ControllerDeleteFileIn{
+		Id:    searchFile.Id,
+		Owner: s3RequestKey(r).Id,
+	}); err != nil && !errors.Is(err, repository.ErrResourceNotFound) {
+		s3Error(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
+
+func (x *s3Handler) createMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	bucket, key := x.bucketAndKey(r)
+
+	searchFile, err := x.controller.SearchFile(r.Context(), &service.ControllerSearchFileIn{
+		Bucket:   bucket,
+		Location: key,
+	})
+	if err != nil && !errors.Is(err, repository.ErrResourceNotFound) {
+		s3Error(w, r, err)
+		return
+	}
+	if err == nil && !canModify(s3RequestKey(r), searchFile.Owner) {
+		s3Error(w, r, fmt.Errorf("%w: the object belongs to another key", repository.ErrPermissionDenied))
+		return
+	}
+
+	createUpload, err := x.controller.CreateUpload(r.Context(), &service.ControllerCreateUploadIn{
+		Bucket:    bucket,
+		Location:  key,
+		Owner:     s3RequestKey(r).Id,
+		Multipart: true,
+		Replace:   true,
+	})
+	if err != nil {
+		s3Error(w, r, err)
+		return
+	}
+
+	s3Xml(w, &s3InitiateMultipartUploadResult{
+		Bucket:   bucket,
+		Key:      key,
+		UploadId: createUpload.Upload.Id,
+	}, http.StatusOK)
+	return
+}
+
+func (x *s3Handler) uploadPart(w http.ResponseWriter, r *http.Request) {
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil {
+		s3Error(w, r, fmt.Errorf("%w: partNumber must be a number", repository.ErrBadRequest))
+		return
+	}
+	if r.ContentLength < 0 {
+		s3Error(w, r, errS3MissingContentLength)
+		return
+	}
+
+	upload, ok := x.searchUpload(w, r)
+	if !ok {
+		return
+	}
+
+	uploadPart, err := x.controller.UploadPart(r.Context(), &service.ControllerUploadPartIn{
+		Id:      upload.Id,
+		Number:  partNumber,
+		Size:    r.ContentLength,
+		Content: r.Body,
+	})
+	if err != nil {
+		s3Error(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", s3ETag(uploadPart.Checksum))
+	w.WriteHeader(http.StatusOK)
+	return
+}
+
+func (x *s3Handler) completeMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	bucket, key := x.bucketAndKey(r)
+
+	request := &s3CompleteMultipartUpload{}
+	if err := xml.NewDecoder(io.LimitReader(r.Body, s3MaxXmlBody)).Decode(request); err != nil {
+		s3Error(w, r, fmt.Errorf("%w: %s", errS3MalformedXml, err.Error()))
+		return
+	}
+
+	upload, ok := x.searchUpload(w, r)
+	if !ok {
+		return
+	}
+
+	parts := make([]*service.ControllerUploadPart, 0, len(request.Parts))
+	for _, part := range request.Parts {
+		parts = append(parts, &service.ControllerUploadPart{
+			Number:   part.PartNumber,
+			Checksum: strings.Trim(part.ETag, `"`),
+		})
+	}
+
+	completeUpload, err := x.controller.CompleteUpload(r.Context(), &service.ControllerCompleteUploadIn{
+		Id:    upload.Id,
+		Parts: parts,
+	})
+	if err != nil {
+		s3Error(w, r, err)
+		return
+	}
+
+	s3Xml(w, &s3CompleteMultipartUploadResult{
+		Location: "/" + bucket + "/" + key,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     s3ETag(completeUpload.Checksum),
+	}, http.StatusOK)
+	return
+}
+
+func (x *s3Handler) abortMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	upload, ok := x.searchUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := x.controller.AbortUpload(r.Context(), &service.ControllerAbortUploadIn{
+		Id: upload.Id,
+	}); err != nil {
+		s3Error(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
+
+// searchUpload writes the error response when the upload is not a multipart
+// upload of the object or belongs to another key.
+func (x *s3Handler) searchUpload(w http.ResponseWriter, r *http.Request) (*service.ControllerUpload, bool) {
+	bucket, key := x.bucketAndKey(r)
+
+	getUpload, err := x.controller.GetUpload(r.Context(), &service.ControllerGetUploadIn{
+		Id: r.URL.Query().Get("uploadId"),
+	})
+	if err != nil || !getUpload.Upload.Multipart || getUpload.Upload.Bucket != bucket || getUpload.Upload.Location != key {
+		s3Error(w, r, errS3NoSuchUpload)
+		return nil, false
+	}
+
+	if !canModify(s3RequestKey(r), getUpload.Upload.Owner) {
+		s3Error(w, r, fmt.Errorf("%w: the upload belongs to another key", repository.ErrPermissionDenied))
+		return nil, false
+	}
+
+	return getUpload.Upload, true
+}
+
+// searchBucket writes the error response when the bucket is not found.
+func (x *s3Handler) searchBucket(w http.ResponseWriter, r *http.Request, bucket string) bool {
+	_, err := x.controller.GetBucket(r.Context(), &service.ControllerGetBucketIn{
+		Name: bucket,
+	})
+	if errors.Is(err, repository.ErrResourceNotFound) {
+		s3Error(w, r, errS3NoSuchBucket)
+		return false
+	}
+	if err != nil {
+		s3Error(w, r, err)
+		return false
+	}
+	return true
+}
+
+// searchObject writes the error response when the object is not found.
+func (x *s3Handler) searchObject(w http.ResponseWriter, r *http.Request, bucket, key string) (*service.ControllerSearchFileOut, bool) {
+	searchFile, err := x.controller.SearchFile(r.Context(), &service.ControllerSearchFileIn{
+		Bucket:   bucket,
+		Location: key,
+	})
+	if errors.Is(err, repository.ErrResourceNotFound) {
+		s3Error(w, r, errS3NoSuchKey)
+		return nil, false
+	}
+	if err != nil {
+		s3Error(w, r, err)
+		return nil, false
+	}
+	return searchFile, true
+}
+
+func setS3ObjectHeaders(w http.ResponseWriter, searchFile *service.ControllerSearchFileOut) {
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if !searchFile.ModifiedAt.IsZero() {
+		w.Header().Set("Last-Modified", searchFile.ModifiedAt.UTC().Format(http.TimeFormat))
+	}
+	if searchFile.Checksum != "" {
+		w.Header().Set("ETag", s3ETag(searchFile.Checksum))
+	}
+}
+
+func s3ETag(checksum string) string {
+	if checksum == "" {
+		return ""
+	}
+	return `"` + checksum + `"`
+}
+
+func s3Xml(w http.ResponseWriter, data any, code int) {
+	body, err := xml.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(code)
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(body)
+}
+
+func s3RequestId() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return strings.ToUpper(hex.EncodeToString(b))
+}
@@ -0,0 +1,491 @@
+package httpserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fydmer/fileserver/internal/domain/service"
+)
+
+const (
+	sigV4Algorithm      = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat     = "20060102T150405Z"
+	sigV4MaxSkew        = 15 * time.Minute
+	sigV4MaxExpires     = 7 * 24 * time.Hour
+	unsignedPayload     = "UNSIGNED-PAYLOAD"
+	streamingPayload    = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingTrailer    = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	streamingUnsigned   = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	emptyPayloadHash    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	maxChunkHeaderBytes = 4096
+)
+
+var (
+	errS3AccessDenied      = errors.New("access denied")
+	errS3MalformedAuth     = errors.New("authorization is malformed")
+	errS3SignatureMismatch = errors.New("the request signature does not match")
+	errS3TimeSkewed        = errors.New("the difference between the request time and the server time is too large")
+	errS3Expired           = errors.New("the request has expired")
+	errS3ContentMismatch   = errors.New("the content does not match its SHA-256")
+)
+
+type s3KeyContextKey struct{}
+
+// sigV4Request is the parsed signature of a request, signingKey and scope
+// also sign the chunks of a streaming payload.
+type sigV4Request struct {
+	accessKey     string
+	date          time.Time
+	scope         string
+	region        string
+	signedHeaders []string
+	signature     string
+	payloadHash   string
+	presigned     bool
+	signingKey    []byte
+}
+
+// authenticate checks the SigV4 signature of the request, in the
+// Authorization header or in the query of a presigned URL. The body of the
+// request is replaced by a reader checking the signed payload.
+func (x *s3Handler) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sig, err := parseSigV4(r)
+		if err != nil {
+			s3Error(w, r, err)
+			return
+		}
+		if sig.region != x.region {
+			s3Error(w, r, fmt.Errorf("%w: region %s is expected", errS3MalformedAuth, x.region))
+			return
+		}
+
+		authenticate, err := x.controller.AuthenticateS3(r.Context(), &service.ControllerAuthenticateS3In{
+			AccessKey: sig.accessKey,
+		})
+		if err != nil {
+			s3Error(w, r, err)
+			return
+		}
+
+		sig.signingKey = sigV4SigningKey(authenticate.Secret, sig.date, sig.region)
+		if !hmac.Equal([]byte(sig.signature), []byte(sigV4Signature(sig, r))) {
+			s3Error(w, r, errS3SignatureMismatch)
+			return
+		}
+
+		if r.Body, err = sig.payloadReader(r); err != nil {
+			s3Error(w, r, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), s3KeyContextKey{}, authenticate.Key)))
+	})
+}
+
+func s3RequestKey(r *http.Request) *service.ControllerApiKey {
+	return r.Context().Value(s3KeyContextKey{}).(*service.ControllerApiKey)
+}
+
+func parseSigV4(r *http.Request) (*sigV4Request, error) {
+	query := r.URL.Query()
+	sig := &sigV4Request{}
+
+	var credential, signedHeaders, date string
+	if query.Get("X-Amz-Algorithm") != "" {
+		if query.Get("X-Amz-Algorithm") != sigV4Algorithm {
+			return nil, fmt.Errorf("%w: algorithm %s is not supported", errS3MalformedAuth, query.Get("X-Amz-Algorithm"))
+		}
+		credential, signedHeaders = query.Get("X-Amz-Credential"), query.Get("X-Amz-SignedHeaders")
+		sig.signature, date = query.Get("X-Amz-Signature"), query.Get("X-Amz-Date")
+		sig.presigned, sig.payloadHash = true, unsignedPayload
+	} else {
+		auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), sigV4Algorithm+" ")
+		if !ok {
+			return nil, fmt.Errorf("%w: %s signature is required", errS3AccessDenied, sigV4Algorithm)
+		}
+		for _, field := range strings.Split(auth, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch name {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				sig.signature = value
+			}
+		}
+		date = r.Header.Get("X-Amz-Date")
+		if date == "" {
+			date = r.Header.Get("Date")
+		}
+		sig.payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if sig.payloadHash == "" {
+			return nil, fmt.Errorf("%w: header 'x-amz-content-sha256' is required", errS3MalformedAuth)
+		}
+	}
+
+	// the credential is <access key>/<date>/<region>/s3/aws4_request
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[3] != "s3" || parts[4] != "aws4_request" {
+		return nil, fmt.Errorf("%w: credential %q", errS3MalformedAuth, credential)
+	}
+	if sig.signature == "" || signedHeaders == "" {
+		return nil, fmt.Errorf("%w: signature and signed headers are required", errS3MalformedAuth)
+	}
+	sig.accessKey, sig.region = parts[0], parts[2]
+	sig.scope = strings.Join(parts[1:], "/")
+	sig.signedHeaders = strings.Split(signedHeaders, ";")
+	if !slices.Contains(sig.signedHeaders, "host") {
+		return nil, fmt.Errorf("%w: host header must be signed", errS3MalformedAuth)
+	}
+
+	var err error
+	if sig.date, err = time.Parse(sigV4TimeFormat, date); err != nil {
+		if sig.date, err = http.ParseTime(date); err != nil {
+			return nil, fmt.Errorf("%w: date %q", errS3MalformedAuth, date)
+		}
+	}
+	if sig.date.UTC().Format("20060102") != parts[1] {
+		return nil, fmt.Errorf("%w: credential date %s is not the request date", errS3MalformedAuth, parts[1])
+	}
+
+	if sig.presigned {
+		expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || expires < 0 || time.Duration(expires)*time.Second > sigV4MaxExpires {
+			return nil, fmt.Errorf("%w: expires %q", errS3MalformedAuth, query.Get("X-Amz-Expires"))
+		}
+		if time.Now().After(sig.date.Add(time.Duration(expires) * time.Second)) {
+			return nil, errS3Expired
+		}
+	} else if skew := time.Since(sig.date); skew > sigV4MaxSkew || skew < -sigV4MaxSkew {
+		return nil, errS3TimeSkewed
+	}
+
+	return sig, nil
+}
+
+func sigV4SigningKey(secret string, date time.Time, region string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date.UTC().Format("20060102"))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	return hmacSHA256(key, "aws4_request")
+}
+
+func sigV4Signature(sig *sigV4Request, r *http.Request) string {
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		sigV4Escape(r.URL.Path, false),
+		sigV4CanonicalQuery(r.URL.Query(), sig.presigned),
+		sigV4CanonicalHeaders(r, sig.signedHeaders),
+		strings.Join(sig.signedHeaders, ";"),
+		sig.payloadHash,
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		sig.date.UTC().Format(sigV4TimeFormat),
+		sig.scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	return hex.EncodeToString(hmacSHA256(sig.signingKey, stringToSign))
+}
+
+func sigV4CanonicalQuery(query url.Values, presigned bool) string {
+	// parameters are sorted by the name and then by the value
+	params := make([][2]string, 0, len(query))
+	for name, values := range query {
+		if presigned && name == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			params = append(params, [2]string{sigV4Escape(name, true), sigV4Escape(value, true)})
+		}
+	}
+	slices.SortFunc(params, func(a, b [2]string) int {
+		if c := strings.Compare(a[0], b[0]); c != 0 {
+			return c
+		}
+		return strings.Compare(a[1], b[1])
+	})
+
+	pairs := make([]string, 0, len(params))
+	for _, param := range params {
+		pairs = append(pairs, param[0]+"="+param[1])
+	}
+	return strings.Join(pairs, "&")
+}
+
+func sigV4CanonicalHeaders(r *http.Request, signedHeaders []string) string {
+	var b strings.Builder
+	for _, name := range signedHeaders {
+		var values []string
+		switch name {
+		case "host":
+			values = []string{r.Host}
+		case "content-length":
+			values = []string{strconv.FormatInt(r.ContentLength, 10)}
+		default:
+			values = slices.Clone(r.Header.Values(name))
+		}
+		for i := range values {
+			values[i] = strings.Join(strings.Fields(values[i]), " ")
+		}
+		b.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+	return b.String()
+}
+
+// sigV4Escape percent-encodes everything except the unreserved characters,
+// "/" is kept in paths.
+func sigV4Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// payloadReader returns the decoded body checked against the signed payload
+// hash or the chunk signatures.
+func (sig *sigV4Request) payloadReader(r *http.Request) (io.ReadCloser, error) {
+	switch sig.payloadHash {
+	case unsignedPayload:
+		return r.Body, nil
+	case streamingPayload, streamingTrailer, streamingUnsigned:
+		size, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("%w: header 'x-amz-decoded-content-length' is required", errS3MalformedAuth)
+		}
+		r.ContentLength = size
+		return &chunkedReader{
+			body:      r.Body,
+			r:         bufio.NewReader(r.Body),
+			sig:       sig,
+			signed:    sig.payloadHash != streamingUnsigned,
+			trailer:   sig.payloadHash != streamingPayload,
+			prevSig:   sig.signature,
+			remaining: size,
+		}, nil
+	default:
+		if _, err := hex.DecodeString(sig.payloadHash); err != nil || len(sig.payloadHash) != sha256.Size*2 {
+			return nil, fmt.Errorf("%w: payload hash %q", errS3MalformedAuth, sig.payloadHash)
+		}
+		return &hashedReader{
+			body:      r.Body,
+			hash:      sha256.New(),
+			expected:  sig.payloadHash,
+			remaining: r.ContentLength,
+		}, nil
+	}
+}
+
+// hashedReader fails the read completing the body when the body does not
+// match the hash, the bytes of that read are dropped as io.ReadFull ignores
+// an error returned with a full buffer. A negative remaining is an unknown
+// length.
+type hashedReader struct {
+	body      io.ReadCloser
+	hash      hash.Hash
+	expected  string
+	remaining int64
+}
+
+func (x *hashedReader) Read(p []byte) (int, error) {
+	n, err := x.body.Read(p)
+	x.hash.Write(p[:n])
+	if x.remaining >= 0 {
+		x.remaining -= int64(n)
+	}
+	if x.remaining == 0 || err == io.EOF {
+		if hex.EncodeToString(x.hash.Sum(nil)) != x.expected {
+			return 0, errS3ContentMismatch
+		}
+	}
+	return n, err
+}
+
+func (x *hashedReader) Close() error {
+	return x.body.Close()
+}
+
+// chunkedReader decodes the aws-chunked body, the signature of a chunk is
+// checked when the chunk is read to its end and the bytes of that read are
+// dropped on a mismatch.
+type chunkedReader struct {
+	body      io.Closer
+	r         *bufio.Reader
+	sig       *sigV4Request
+	signed    bool
+	trailer   bool
+	prevSig   string
+	chunkSig  string
+	chunkHash hash.Hash
+	chunkLeft int64
+	remaining int64
+	done      bool
+}
+
+func (x *chunkedReader) Read(p []byte) (int, error) {
+	if x.done {
+		return 0, io.EOF
+	}
+
+	if x.chunkLeft == 0 {
+		if err := x.nextChunk(); err != nil {
+			return 0, err
+		}
+		if x.done {
+			return 0, io.EOF
+		}
+	}
+
+	if int64(len(p)) > x.chunkLeft {
+		p = p[:x.chunkLeft]
+	}
+	n, err := x.r.Read(p)
+	x.chunkHash.Write(p[:n])
+	x.chunkLeft -= int64(n)
+	x.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && x.chunkLeft == 0 {
+		if err = x.endChunk(); err != nil {
+			return 0, err
+		}
+	}
+	return n, err
+}
+
+// nextChunk reads the chunk header "<hex size>;chunk-signature=<signature>".
+func (x *chunkedReader) nextChunk() error {
+	line, err := x.readLine()
+	if errors.Is(err, io.EOF) {
+		// the body ends with the final chunk
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+
+	sizeHex, ext, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeHex), 16, 64)
+	if err != nil || size < 0 || size > x.remaining {
+		return fmt.Errorf("%w: chunk size %q", errS3MalformedAuth, sizeHex)
+	}
+	x.chunkSig, _ = strings.CutPrefix(ext, "chunk-signature=")
+	if x.signed && x.chunkSig == "" {
+		return fmt.Errorf("%w: chunk signature is required", errS3MalformedAuth)
+	}
+	x.chunkHash, x.chunkLeft = sha256.New(), size
+
+	if size == 0 {
+		if err = x.checkChunk(); err != nil {
+			return err
+		}
+		if x.remaining != 0 {
+			return fmt.Errorf("%w: %d bytes are missing", io.ErrUnexpectedEOF, x.remaining)
+		}
+		// trailing headers end with an empty line, their checksums are not verified
+		for {
+			if line, err = x.readLine(); err != nil {
+				if errors.Is(err, io.EOF) && !x.trailer {
+					break
+				}
+				return err
+			}
+			if line == "" {
+				break
+			}
+		}
+		x.done = true
+	}
+	return nil
+}
+
+func (x *chunkedReader) endChunk() error {
+	if err := x.checkChunk(); err != nil {
+		return err
+	}
+	line, err := x.readLine()
+	if err != nil {
+		return err
+	}
+	if line != "" {
+		return fmt.Errorf("%w: chunk is longer than its size", errS3MalformedAuth)
+	}
+	return nil
+}
+
+func (x *chunkedReader) checkChunk() error {
+	if !x.signed {
+		return nil
+	}
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256-PAYLOAD",
+		x.sig.date.UTC().Format(sigV4TimeFormat),
+		x.sig.scope,
+		x.prevSig,
+		emptyPayloadHash,
+		hex.EncodeToString(x.chunkHash.Sum(nil)),
+	}, "\n")
+
+	signature := hex.EncodeToString(hmacSHA256(x.sig.signingKey, stringToSign))
+	if !hmac.Equal([]byte(signature), []byte(x.chunkSig)) {
+		return errS3SignatureMismatch
+	}
+	x.prevSig = signature
+	return nil
+}
+
+func (x *chunkedReader) readLine() (string, error) {
+	line, err := x.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) || len(line) > maxChunkHeaderBytes {
+		return "", fmt.Errorf("%w: chunk header is too long", errS3MalformedAuth)
+	}
+	if err != nil {
+		if errors.Is(err, io.EOF) && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return string(bytes.TrimRight(line, "\r\n")), nil
+}
+
+func (x *chunkedReader) Close() error {
+	return x.body.Close()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,153 @@
+package httpserver
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+
+	"github.com/fydmer/fileserver/internal/domain/repository"
+)
+
+var (
+	errS3NotImplemented       = errors.New("the operation is not implemented")
+	errS3MissingContentLength = errors.New("header 'Content-Length' is required")
+	errS3EntityTooLarge       = errors.New("the object is too large")
+	errS3InvalidRange         = errors.New("the range is not satisfiable")
+	errS3MalformedXml         = errors.New("the request body is not valid xml")
+	errS3NoSuchKey            = errors.New("the object does not exist")
+	errS3NoSuchBucket         = errors.New("the bucket does not exist")
+	errS3BucketAlreadyExists  = errors.New("the bucket already exists")
+	errS3NoSuchUpload         = errors.New("the multipart upload does not exist")
+	errS3BucketNotEmpty       = errors.New("the bucket is not empty")
+)
+
+// s3Errors maps errors to S3 error codes, the first matching one is used.
+var s3Errors = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{errS3AccessDenied, http.StatusForbidden, "AccessDenied"},
+	{errS3MalformedAuth, http.StatusBadRequest, "AuthorizationHeaderMalformed"},
+	{errS3SignatureMismatch, http.StatusForbidden, "SignatureDoesNotMatch"},
+	{errS3TimeSkewed, http.StatusForbidden, "RequestTimeTooSkewed"},
+	{errS3Expired, http.StatusForbidden, "AccessDenied"},
+	{errS3ContentMismatch, http.StatusBadRequest, "XAmzContentSHA256Mismatch"},
+	{errS3NotImplemented, http.StatusNotImplemented, "NotImplemented"},
+	{errS3MissingContentLength, http.StatusLengthRequired, "MissingContentLength"},
+	{errS3EntityTooLarge, http.StatusBadRequest, "EntityTooLarge"},
+	{errS3InvalidRange, http.StatusRequestedRangeNotSatisfiable, "InvalidRange"},
+	{errS3MalformedXml, http.StatusBadRequest, "MalformedXML"},
+	{errS3NoSuchKey, http.StatusNotFound, "NoSuchKey"},
+	{errS3NoSuchBucket, http.StatusNotFound, "NoSuchBucket"},
+	{errS3BucketAlreadyExists, http.StatusConflict, "BucketAlreadyExists"},
+	{errS3NoSuchUpload, http.StatusNotFound, "NoSuchUpload"},
+	{errS3BucketNotEmpty, http.StatusConflict, "BucketNotEmpty"},
+	{repository.ErrResourceNotFound, http.StatusNotFound, "NoSuchKey"},
+	{repository.ErrBadRequest, http.StatusBadRequest, "InvalidArgument"},
+	{repository.ErrResourceAlreadyExists, http.StatusConflict, "OperationAborted"},
+	{repository.ErrConflict, http.StatusConflict, "OperationAborted"},
+	{repository.ErrPreconditionFailed, http.StatusPreconditionFailed, "PreconditionFailed"},
+	{repository.ErrInsufficientStorage, http.StatusInsufficientStorage, "InsufficientStorage"},
+	{repository.ErrUnauthenticated, http.StatusForbidden, "InvalidAccessKeyId"},
+	{repository.ErrPermissionDenied, http.StatusForbidden, "AccessDenied"},
+	{repository.ErrUnavailable, http.StatusServiceUnavailable, "ServiceUnavailable"},
+}
+
+type s3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestId string   `xml:"RequestId"`
+}
+
+func s3Error(w http.ResponseWriter, r *http.Request, err error) {
+	status, code := http.StatusInternalServerError, "InternalError"
+	for _, e := range s3Errors {
+		if errors.Is(err, e.err) {
+			status, code = e.status, e.code
+			break
+		}
+	}
+
+	w.Header().Del("Content-Length")
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+
+	s3Xml(w, &s3ErrorResponse{
+		Code:      code,
+		Message:   err.Error(),
+		Resource:  r.URL.Path,
+		RequestId: s3RequestId(),
+	}, status)
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate,omitempty"`
+}
+
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name    `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Buckets []*s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3LocationConstraint struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+	Region  string   `xml:",chardata"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag,omitempty"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name          `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string            `xml:"Name"`
+	Prefix                string            `xml:"Prefix"`
+	Delimiter             string            `xml:"Delimiter,omitempty"`
+	MaxKeys               int               `xml:"MaxKeys"`
+	KeyCount              int               `xml:"KeyCount"`
+	IsTruncated           bool              `xml:"IsTruncated"`
+	ContinuationToken     string            `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string            `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string            `xml:"StartAfter,omitempty"`
+	Contents              []*s3Object       `xml:"Contents"`
+	CommonPrefixes        []*s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadId string   `xml:"UploadId"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name           `xml:"CompleteMultipartUpload"`
+	Parts   []*s3CompletedPart `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
@@ -1,13 +1,54 @@
 package tcpserver
 
 import (
-	"strings"
+	"context"
+	"errors"
+	"os"
+
+	"github.com/fydmer/fileserver/internal/domain/repository"
+	"github.com/fydmer/fileserver/pkg/nodeproto"
 )
 
-func parseNodeHeader(headerStr string) (string, string) {
-	sp := strings.SplitN(headerStr, ":", 2)
-	if len(sp) != 2 {
-		return "", ""
+// statusError maps a failure of the node onto a protocol status.
+func statusError(err error) *nodeproto.Error {
+	var protoErr *nodeproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr
+	}
+
+	status := nodeproto.StatusInternal
+	switch {
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, repository.ErrResourceNotFound):
+		status = nodeproto.StatusNotFound
+	case errors.Is(err, repository.ErrInsufficientStorage):
+		status = nodeproto.StatusInsufficientStorage
+	case errors.Is(err, os.ErrPermission), errors.Is(err, repository.ErrPermissionDenied):
+		status = nodeproto.StatusPermissionDenied
+	case errors.Is(err, repository.ErrChecksumMismatch):
+		status = nodeproto.StatusChecksumMismatch
+	case errors.Is(err, repository.ErrBadRequest):
+		status = nodeproto.StatusBadRequest
+	case errors.Is(err, context.Canceled):
+		status = nodeproto.StatusCanceled
+	}
+
+	return &nodeproto.Error{
+		Status:  status,
+		Message: err.Error(),
+	}
+}
+
+// responseWriter sends the response header before the first data written to
+// the stream, so a failure before any data is still reported as a status.
+type responseWriter struct {
+	stream *nodeproto.Stream
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if !w.stream.Responded() {
+		if err := w.stream.Respond(&nodeproto.Response{}, false); err != nil {
+			return 0, err
+		}
 	}
-	return sp[0], strings.TrimSpace(sp[1])
+	return w.stream.Write(p)
 }
@@ -1,16 +1,17 @@
 package tcpserver
 
 import (
-	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
-	"strconv"
-	"strings"
+	"sync"
 
 	"github.com/fydmer/fileserver/internal/domain/service"
+	"github.com/fydmer/fileserver/pkg/nodeproto"
 )
 
 type nodeHandler struct {
@@ -20,24 +21,40 @@ type nodeHandler struct {
 type NodeServer struct {
 	listener net.Listener
 	handler  *nodeHandler
+	auth     *nodeproto.Authenticator
+
+	mu    sync.Mutex
+	conns map[*nodeproto.Conn]struct{}
 }
 
-func RunNodeServer(ctx context.Context, port int, node service.Node) (*NodeServer, error) {
+// RunNodeServer serves plain tcp when tlsConfig is nil. File operations
+// require clients to authenticate with secret unless it is empty.
+func RunNodeServer(ctx context.Context, port int, tlsConfig *tls.Config, secret []byte, node service.Node) (*NodeServer, error) {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return nil, err
 	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
 
 	handler := &nodeHandler{node: node}
 
 	server := &NodeServer{
 		listener: listener,
 		handler:  handler,
+		conns:    make(map[*nodeproto.Conn]struct{}),
+	}
+	if len(secret) > 0 {
+		server.auth = nodeproto.NewAuthenticator(secret)
 	}
 
 	go func(lis net.Listener) {
 		for {
-			conn, _ := lis.Accept()
+			conn, err := lis.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 
 			select {
 			case <-ctx.Done():
@@ -45,119 +62,170 @@ func RunNodeServer(ctx context.Context, port int, node service.Node) (*NodeServe
 				return
 			default:
 				if conn != nil {
-					go server.router(context.Background(), conn)
+					go server.serveConn(conn)
 				}
 			}
 		}
 	}(listener)
 
-	slog.InfoContext(ctx, "tcp server started", slog.Int("port", port))
+	slog.InfoContext(ctx, "tcp server started", slog.Int("port", port), slog.Bool("tls", tlsConfig != nil), slog.Bool("auth", server.auth != nil))
 
 	return server, nil
 }
 
+// Close stops accepting connections and breaks the open ones.
 func (s *NodeServer) Close() {
 	_ = s.listener.Close()
-}
 
-func (x *nodeHandler) saveFile(ctx context.Context, r *bufio.Reader, w *bufio.Writer, headerValue string) error {
-	sp := strings.SplitN(headerValue, ":", 2)
-	if len(sp) != 2 {
-		return fmt.Errorf("invalid header: %s", headerValue)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		_ = conn.Close()
 	}
+}
 
-	size, err := strconv.ParseInt(sp[0], 10, 64)
+func (s *NodeServer) serveConn(netConn net.Conn) {
+	conn, err := nodeproto.Server(netConn, s.auth)
 	if err != nil {
-		return err
+		slog.Warn("handshake failed",
+			slog.String("remote_addr", netConn.RemoteAddr().String()),
+			slog.String("error", err.Error()))
+		_ = netConn.Close()
+		return
 	}
 
-	saveFile, err := x.node.SaveFile(ctx, &service.NodeSaveFileIn{
-		Name:       sp[1],
-		DataReader: io.LimitReader(r, size),
-	})
-	if err != nil {
-		return err
+	s.mu.Lock()
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		_ = conn.Close()
+	}()
+
+	for {
+		stream, err := conn.Accept()
+		if err != nil {
+			return
+		}
+		go s.router(stream, conn.Authenticated())
 	}
+}
 
-	_, err = w.WriteString(fmt.Sprintf("%d\n", saveFile.Written))
+func (x *nodeHandler) saveFile(ctx context.Context, stream *nodeproto.Stream, req *nodeproto.Request) error {
+	saveFile, err := x.node.SaveFile(ctx, &service.NodeSaveFileIn{
+		Name:       req.Name,
+		Size:       req.Size,
+		DataReader: io.LimitReader(stream, req.Size),
+	})
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return stream.Respond(&nodeproto.Response{
+		Size:     saveFile.Written,
+		Checksum: saveFile.Checksum,
+	}, true)
 }
 
-func (x *nodeHandler) getFile(ctx context.Context, r *bufio.Reader, w *bufio.Writer, filename string) error {
-	getFile, err := x.node.GetFile(ctx, &service.NodeGetFileIn{
-		Name:       filename,
-		DataWriter: w,
-	})
-	if err != nil {
+func (x *nodeHandler) getFile(ctx context.Context, stream *nodeproto.Stream, req *nodeproto.Request) error {
+	if _, err := x.node.GetFile(ctx, &service.NodeGetFileIn{
+		Name:       req.Name,
+		Offset:     req.Offset,
+		Length:     req.Length,
+		DataWriter: &responseWriter{stream: stream},
+	}); err != nil {
 		return err
 	}
 
-	if err = w.Flush(); err != nil {
-		return err
+	if !stream.Responded() {
+		if err := stream.Respond(&nodeproto.Response{}, false); err != nil {
+			return err
+		}
 	}
+	return stream.CloseWrite()
+}
 
-	writtenStr, err := r.ReadString('\n')
-	if err != nil {
+func (x *nodeHandler) deleteFile(ctx context.Context, stream *nodeproto.Stream, req *nodeproto.Request) error {
+	if _, err := x.node.DeleteFile(ctx, &service.NodeDeleteFileIn{
+		Name: req.Name,
+	}); err != nil {
 		return err
 	}
 
-	written, err := strconv.ParseInt(strings.TrimSpace(writtenStr), 10, 64)
+	return stream.Respond(&nodeproto.Response{}, true)
+}
+
+func (x *nodeHandler) hashFile(ctx context.Context, stream *nodeproto.Stream, req *nodeproto.Request) error {
+	hashFile, err := x.node.HashFile(ctx, &service.NodeHashFileIn{
+		Name: req.Name,
+	})
 	if err != nil {
 		return err
 	}
 
-	if getFile.Written != written {
-		return fmt.Errorf("file size not equal %d != %d", getFile.Written, written)
-	}
-
-	return nil
+	return stream.Respond(&nodeproto.Response{
+		Size:     hashFile.Size,
+		Checksum: hashFile.Checksum,
+	}, true)
 }
 
-func (x *nodeHandler) deleteFile(ctx context.Context, _ *bufio.Reader, _ *bufio.Writer, filename string) error {
-	_, err := x.node.DeleteFile(ctx, &service.NodeDeleteFileIn{
-		Name: filename,
-	})
+func (x *nodeHandler) ping(ctx context.Context, stream *nodeproto.Stream, _ *nodeproto.Request) error {
+	ping, err := x.node.Ping(ctx, &service.NodePingIn{})
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return stream.Respond(&nodeproto.Response{
+		TotalBytes: ping.TotalBytes,
+		FreeBytes:  ping.FreeBytes,
+	}, true)
 }
 
-func (s *NodeServer) router(parentCtx context.Context, conn net.Conn) {
-	defer conn.Close()
-
-	ctx, cancel := context.WithCancel(parentCtx)
-	defer cancel()
-
-	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
-	defer w.Flush()
-
-	headerStr, err := r.ReadString('\n')
-	if err != nil {
+// router dispatches the operation, only ping is served to clients which have
+// not authenticated.
+func (s *NodeServer) router(stream *nodeproto.Stream, authenticated bool) {
+	defer stream.Close()
+
+	ctx, req := stream.Context(), stream.Request()
+
+	var err error
+	switch {
+	case !authenticated && req.Op != nodeproto.OpPing:
+		err = &nodeproto.Error{Status: nodeproto.StatusUnauthenticated, Message: fmt.Sprintf("%s requires authentication", req.Op)}
+	case req.Op == nodeproto.OpSaveFile:
+		err = s.handler.saveFile(ctx, stream, req)
+	case req.Op == nodeproto.OpGetFile:
+		err = s.handler.getFile(ctx, stream, req)
+	case req.Op == nodeproto.OpDeleteFile:
+		err = s.handler.deleteFile(ctx, stream, req)
+	case req.Op == nodeproto.OpHashFile:
+		err = s.handler.hashFile(ctx, stream, req)
+	case req.Op == nodeproto.OpPing:
+		err = s.handler.ping(ctx, stream, req)
+	default:
+		err = &nodeproto.Error{Status: nodeproto.StatusBadRequest, Message: fmt.Sprintf("unknown operation %s", req.Op)}
+	}
+	if err == nil {
 		return
 	}
-	headerStr = strings.TrimSpace(headerStr)
 
-	switch prefix, headerValue := parseNodeHeader(headerStr); prefix {
-	case "save_file":
-		err = s.handler.saveFile(ctx, r, w, headerValue)
-	case "get_file":
-		err = s.handler.getFile(ctx, r, w, headerValue)
-	case "delete_file":
-		err = s.handler.deleteFile(ctx, r, w, headerValue)
-	default:
+	failure := statusError(err)
+	if failure.Status == nodeproto.StatusInternal {
+		slog.Error("operation was fatal", slog.String("op", req.Op.String()), slog.String("error", err.Error()))
+	} else {
+		slog.Warn("operation failed", slog.String("op", req.Op.String()), slog.String("error", err.Error()))
 	}
 
-	if err != nil {
-		slog.Error("operation was fatal", slog.String("error", err.Error()))
-
-		errMsg := strings.ReplaceAll(err.Error(), "\n", " ")
-		_, _ = w.WriteString(fmt.Sprintf("error:%s\n", errMsg))
+	// a failure in the middle of the data can only abort the stream
+	if stream.Responded() {
+		_ = stream.Reset(failure)
+		return
 	}
-	return
+	_ = stream.Respond(&nodeproto.Response{
+		Status:  failure.Status,
+		Message: failure.Message,
+	}, true)
 }
@@ -0,0 +1,101 @@
+package tcpserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/fydmer/fileserver/internal/domain/service"
+	"github.com/fydmer/fileserver/pkg/nodeproto"
+)
+
+type fakeNode struct{}
+
+func (fakeNode) SaveFile(_ context.Context, in *service.NodeSaveFileIn) (*service.NodeSaveFileOut, error) {
+	n, err := io.Copy(io.Discard, in.DataReader)
+	return &service.NodeSaveFileOut{Written: n}, err
+}
+
+func (fakeNode) GetFile(_ context.Context, in *service.NodeGetFileIn) (*service.NodeGetFileOut, error) {
+	_, err := in.DataWriter.Write([]byte("data"))
+	return &service.NodeGetFileOut{}, err
+}
+
+func (fakeNode) DeleteFile(context.Context, *service.NodeDeleteFileIn) (*service.NodeDeleteFileOut, error) {
+	return &service.NodeDeleteFileOut{}, nil
+}
+
+func (fakeNode) HashFile(context.Context, *service.NodeHashFileIn) (*service.NodeHashFileOut, error) {
+	return &service.NodeHashFileOut{}, nil
+}
+
+func (fakeNode) Ping(context.Context, *service.NodePingIn) (*service.NodePingOut, error) {
+	return &service.NodePingOut{TotalBytes: 100, FreeBytes: 50}, nil
+}
+
+func TestRouterAuthentication(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    []byte
+		op     nodeproto.Op
+		status nodeproto.Status
+	}{
+		{"ping without key", nil, nodeproto.OpPing, nodeproto.StatusOK},
+		{"save without key", nil, nodeproto.OpSaveFile, nodeproto.StatusUnauthenticated},
+		{"get without key", nil, nodeproto.OpGetFile, nodeproto.StatusUnauthenticated},
+		{"delete without key", nil, nodeproto.OpDeleteFile, nodeproto.StatusUnauthenticated},
+		{"hash without key", nil, nodeproto.OpHashFile, nodeproto.StatusUnauthenticated},
+		{"ping with key", []byte("key"), nodeproto.OpPing, nodeproto.StatusOK},
+		{"save with key", []byte("key"), nodeproto.OpSaveFile, nodeproto.StatusOK},
+		{"get with key", []byte("key"), nodeproto.OpGetFile, nodeproto.StatusOK},
+		{"delete with key", []byte("key"), nodeproto.OpDeleteFile, nodeproto.StatusOK},
+		{"hash with key", []byte("key"), nodeproto.OpHashFile, nodeproto.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s := net.Pipe()
+			server := &NodeServer{
+				handler: &nodeHandler{node: fakeNode{}},
+				auth:    nodeproto.NewAuthenticator([]byte("key")),
+				conns:   make(map[*nodeproto.Conn]struct{}),
+			}
+			go server.serveConn(s)
+
+			conn, err := nodeproto.Client(context.Background(), c, tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			req := &nodeproto.Request{Op: tt.op, Name: "file.0"}
+			end := true
+			if tt.op == nodeproto.OpSaveFile {
+				req.Size, end = 4, false
+			}
+			stream, err := conn.Open(context.Background(), req, end)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stream.Close()
+
+			if !end {
+				if _, err = io.Copy(stream, bytes.NewReader([]byte("data"))); err != nil && !errors.Is(err, nodeproto.ErrStreamDone) {
+					t.Fatal(err)
+				}
+				_ = stream.CloseWrite()
+			}
+
+			resp, err := stream.Response()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Status != tt.status {
+				t.Fatalf("got %v, want %v", resp.Status, tt.status)
+			}
+		})
+	}
+}
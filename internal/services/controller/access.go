@@ -0,0 +1,166 @@
+package controller
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/fydmer/fileserver/internal/domain/repository"
+	"github.com/fydmer/fileserver/internal/domain/service"
+)
+
+const (
+	tokenPrefix       = "fs_"
+	s3AccessKeyPrefix = "FS"
+)
+
+func (x *Controller) Authenticate(ctx context.Context, in *service.ControllerAuthenticateIn) (*service.ControllerAuthenticateOut, error) {
+	if in.Token == "" {
+		return nil, fmt.Errorf("%w: token is required", repository.ErrUnauthenticated)
+	}
+
+	getApiKey, err := x.access.GetApiKey(ctx, &repository.AccessGetApiKeyIn{
+		TokenHash: hashToken(in.Token),
+	})
+	if errors.Is(err, repository.ErrResourceNotFound) {
+		return nil, fmt.Errorf("%w: unknown token", repository.ErrUnauthenticated)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &service.ControllerAuthenticateOut{
+		Key: apiKey(getApiKey.Key),
+	}, nil
+}
+
+func (x *Controller) CreateApiKey(ctx context.Context, in *service.ControllerCreateApiKeyIn) (*service.ControllerCreateApiKeyOut, error) {
+	if in.Name == "" {
+		return nil, fmt.Errorf("%w: key name is required", repository.ErrBadRequest)
+	}
+	if in.Role < service.ControllerRoleReadOnly || in.Role > service.ControllerRoleAdmin {
+		return nil, fmt.Errorf("%w: unknown role %d", repository.ErrBadRequest, in.Role)
+	}
+
+	token := in.Token
+	if token == "" {
+		var err error
+		if token, err = generateToken(); err != nil {
+			return nil, err
+		}
+	}
+
+	createApiKey, err := x.access.CreateApiKey(ctx, &repository.AccessCreateApiKeyIn{
+		Name:      in.Name,
+		Role:      repository.AccessRole(in.Role),
+		TokenHash: hashToken(token),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &service.ControllerCreateApiKeyOut{
+		Key:   apiKey(createApiKey.Key),
+		Token: token,
+	}, nil
+}
+
+func (x *Controller) ListApiKeys(ctx context.Context, _ *service.ControllerListApiKeysIn) (*service.ControllerListApiKeysOut, error) {
+	listApiKeys, err := x.access.ListApiKeys(ctx, &repository.AccessListApiKeysIn{})
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*service.ControllerApiKey, 0, len(listApiKeys.Keys))
+	for _, key := range listApiKeys.Keys {
+		keys = append(keys, apiKey(key))
+	}
+
+	return &service.ControllerListApiKeysOut{
+		Keys: keys,
+	}, nil
+}
+
+// DeleteApiKey revokes the key, its files are left without an owner.
+func (x *Controller) DeleteApiKey(ctx context.Context, in *service.ControllerDeleteApiKeyIn) (*service.ControllerDeleteApiKeyOut, error) {
+	if _, err := x.access.DeleteApiKey(ctx, &repository.AccessDeleteApiKeyIn{
+		Id: in.Id,
+	}); err != nil {
+		return nil, err
+	}
+
+	return &service.ControllerDeleteApiKeyOut{}, nil
+}
+
+func (x *Controller) CreateS3Credentials(ctx context.Context, in *service.ControllerCreateS3CredentialsIn) (*service.ControllerCreateS3CredentialsOut, error) {
+	b := make([]byte, 45)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	accessKey := s3AccessKeyPrefix + base32.StdEncoding.EncodeToString(b[:15])[:18]
+	secret := base64.RawURLEncoding.EncodeToString(b[15:])
+
+	if _, err := x.access.SetS3Credentials(ctx, &repository.AccessSetS3CredentialsIn{
+		Id:        in.KeyId,
+		AccessKey: accessKey,
+		Secret:    secret,
+	}); err != nil {
+		return nil, err
+	}
+
+	return &service.ControllerCreateS3CredentialsOut{
+		AccessKey: accessKey,
+		Secret:    secret,
+	}, nil
+}
+
+func (x *Controller) AuthenticateS3(ctx context.Context, in *service.ControllerAuthenticateS3In) (*service.ControllerAuthenticateS3Out, error) {
+	if in.AccessKey == "" {
+		return nil, fmt.Errorf("%w: access key is required", repository.ErrUnauthenticated)
+	}
+
+	getS3Credentials, err := x.access.GetS3Credentials(ctx, &repository.AccessGetS3CredentialsIn{
+		AccessKey: in.AccessKey,
+	})
+	if errors.Is(err, repository.ErrResourceNotFound) {
+		return nil, fmt.Errorf("%w: unknown access key", repository.ErrUnauthenticated)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &service.ControllerAuthenticateS3Out{
+		Key:    apiKey(getS3Credentials.Key),
+		Secret: getS3Credentials.Secret,
+	}, nil
+}
+
+func apiKey(key *repository.AccessApiKey) *service.ControllerApiKey {
+	return &service.ControllerApiKey{
+		Id:        key.Id,
+		Name:      key.Name,
+		Role:      service.ControllerRole(key.Role),
+		CreatedAt: key.CreatedAt,
+	}
+}
+
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return tokenPrefix + hex.EncodeToString(b), nil
+}
+
+// hashToken is the stored form of a token, tokens are random so a plain hash
+// is enough.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
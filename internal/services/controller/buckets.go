@@ -0,0 +1,185 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/fydmer/fileserver/internal/domain/repository"
+	"github.com/fydmer/fileserver/internal/domain/service"
+	"github.com/fydmer/fileserver/pkg/erasure"
+)
+
+const (
+	minBucketNameLength = 3
+	maxBucketNameLength = 63
+)
+
+func (x *Controller) CreateBucket(ctx context.Context, in *service.ControllerCreateBucketIn) (*service.ControllerCreateBucketOut, error) {
+	if err := checkBucketName(in.Name); err != nil {
+		return nil, err
+	}
+	if in.DataShards < 0 || in.Replicas < 0 || in.ParityShards != nil && *in.ParityShards < 0 {
+		return nil, fmt.Errorf("%w: bucket settings can't be negative", repository.ErrBadRequest)
+	}
+
+	// the settings are stored, so the files of the bucket are placed the same
+	// way after the controller flags change
+	dataShards, parityShards, replicas := in.DataShards, x.parityShards, in.Replicas
+	if dataShards == 0 {
+		dataShards = x.countFileParts
+	}
+	if in.ParityShards != nil {
+		parityShards = *in.ParityShards
+	}
+	if replicas == 0 {
+		replicas = x.replicas
+	}
+	if _, err := erasure.New(dataShards, parityShards); err != nil {
+		return nil, fmt.Errorf("%w: %s", repository.ErrBadRequest, err.Error())
+	}
+
+	createBucket, err := x.storage.CreateBucket(ctx, &repository.StorageCreateBucketIn{
+		Name:         in.Name,
+		Owner:        in.Owner,
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+		Replicas:     replicas,
+		Versioning:   in.Versioning,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &service.ControllerCreateBucketOut{
+		Bucket: x.bucketInfo(createBucket.Bucket),
+	}, nil
+}
+
+func (x *Controller) GetBucket(ctx context.Context, in *service.ControllerGetBucketIn) (*service.ControllerGetBucketOut, error) {
+	bucket, err := x.getBucket(ctx, in.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &service.ControllerGetBucketOut{
+		Bucket: x.bucketInfo(bucket),
+	}, nil
+}
+
+func (x *Controller) ListBuckets(ctx context.Context, _ *service.ControllerListBucketsIn) (*service.ControllerListBucketsOut, error) {
+	listBuckets, err := x.storage.ListBuckets(ctx, &repository.StorageListBucketsIn{})
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := make([]*service.ControllerBucket, 0, len(listBuckets.Buckets))
+	for _, bucket := range listBuckets.Buckets {
+		buckets = append(buckets, x.bucketInfo(bucket))
+	}
+
+	return &service.ControllerListBucketsOut{
+		Buckets: buckets,
+	}, nil
+}
+
+func (x *Controller) DeleteBucket(ctx context.Context, in *service.ControllerDeleteBucketIn) (*service.ControllerDeleteBucketOut, error) {
+	bucket, err := x.getBucket(ctx, in.Name)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(bucket.Name, service.ControllerDefaultBucket) {
+		return nil, fmt.Errorf("%w: the default bucket can't be removed", repository.ErrBadRequest)
+	}
+
+	if _, err = x.storage.DeleteBucket(ctx, &repository.StorageDeleteBucketIn{
+		Id: bucket.Id,
+	}); err != nil {
+		return nil, err
+	}
+
+	return &service.ControllerDeleteBucketOut{}, nil
+}
+
+// getBucket returns the default bucket for an empty name.
+func (x *Controller) getBucket(ctx context.Context, name string) (*repository.StorageBucket, error) {
+	if name == "" {
+		name = service.ControllerDefaultBucket
+	}
+
+	getBucket, err := x.storage.GetBucket(ctx, &repository.StorageGetBucketIn{
+		Name: name,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: bucket %s", err, name)
+	}
+
+	return getBucket.Bucket, nil
+}
+
+func (x *Controller) bucketDataShards(bucket *repository.StorageBucket) int {
+	if bucket.DataShards > 0 {
+		return bucket.DataShards
+	}
+	return x.countFileParts
+}
+
+func (x *Controller) bucketParityShards(bucket *repository.StorageBucket) int {
+	if bucket.DataShards > 0 {
+		return bucket.ParityShards
+	}
+	return x.parityShards
+}
+
+func (x *Controller) bucketReplicas(bucket *repository.StorageBucket) int {
+	if bucket.Replicas > 0 {
+		return bucket.Replicas
+	}
+	return x.replicas
+}
+
+// fileReplicas is the number of copies of the file shards the repair keeps.
+func (x *Controller) fileReplicas(file *repository.StorageGetFileOut) int {
+	if file.Replicas > 0 {
+		return file.Replicas
+	}
+	return x.replicas
+}
+
+// bucketInfo has the settings new files of the bucket get.
+func (x *Controller) bucketInfo(bucket *repository.StorageBucket) *service.ControllerBucket {
+	return &service.ControllerBucket{
+		Name:         bucket.Name,
+		Owner:        bucket.Owner,
+		DataShards:   x.bucketDataShards(bucket),
+		ParityShards: x.bucketParityShards(bucket),
+		Replicas:     x.bucketReplicas(bucket),
+		Versioning:   bucket.Versioning,
+		CreatedAt:    bucket.CreatedAt,
+	}
+}
+
+// checkBucketName accepts lowercase letters, digits, "-" and "." between
+// letters or digits, like S3 bucket names.
+func checkBucketName(name string) error {
+	if len(name) < minBucketNameLength || len(name) > maxBucketNameLength {
+		return fmt.Errorf("%w: bucket name must be %d to %d characters long",
+			repository.ErrBadRequest, minBucketNameLength, maxBucketNameLength)
+	}
+
+	for i, c := range []byte(name) {
+		alnum := 'a' <= c && c <= 'z' || '0' <= c && c <= '9'
+		switch {
+		case alnum:
+		case (c == '-' || c == '.') && i > 0 && i < len(name)-1:
+		default:
+			return fmt.Errorf("%w: bucket name %q may only have lowercase letters, digits, \"-\" and \".\" inside",
+				repository.ErrBadRequest, name)
+		}
+	}
+	if strings.Contains(name, "..") {
+		return fmt.Errorf("%w: bucket name %q has adjacent dots", repository.ErrBadRequest, name)
+	}
+
+	return nil
+}
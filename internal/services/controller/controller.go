@@ -1,16 +1,23 @@
 package controller
 
 import (
-	"cmp"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/fydmer/fileserver/internal/domain/repository"
 	"github.com/fydmer/fileserver/internal/domain/service"
+	"github.com/fydmer/fileserver/internal/errors/nodeerr"
+	"github.com/fydmer/fileserver/pkg/erasure"
 	"github.com/fydmer/fileserver/pkg/nodecli"
 )
 
@@ -19,30 +26,221 @@ type nodeClients struct {
 	dict map[string]*nodecli.Client
 }
 
+type Config struct {
+	DataShards   int
+	ParityShards int
+	Replicas     int
+
+	// Concurrency limits shards transferred at once by a request, erasure
+	// coded files are always read by DataShards streams.
+	Concurrency int
+	// BufferSize is the prefetch buffer of a downloaded shard and the memory
+	// part of an uploaded shard spool, the rest is spooled to SpoolDir.
+	BufferSize int
+	SpoolDir   string
+
+	HeartbeatInterval time.Duration
+	NodeDownAfter     time.Duration
+
+	// ScrubInterval is the pause between scrubbing passes, 0 disables
+	// periodic scrubbing. ScrubRate limits bytes per second hashed by nodes.
+	ScrubInterval time.Duration
+	ScrubRate     int64
+
+	// RepairInterval is the pause between repair passes, 0 disables periodic
+	// repair. Replicas on nodes not seen for RepairDelay are considered lost.
+	RepairInterval time.Duration
+	RepairDelay    time.Duration
+
+	// RebalanceInterval is the pause between rebalancing passes, 0 disables
+	// periodic rebalancing. Shards are moved away from nodes whose usage
+	// exceeds the mean by more than RebalanceThreshold, at most
+	// RebalanceRate bytes per second.
+	RebalanceInterval  time.Duration
+	RebalanceThreshold float64
+	RebalanceRate      int64
+
+	// NodeMaxConns and NodeMaxStreams limit connections to a node and
+	// operations on each of them, connections idle for NodeIdleTimeout
+	// are closed.
+	NodeMaxConns    int
+	NodeMaxStreams  int
+	NodeIdleTimeout time.Duration
+	// NodeTLS secures the node connections when set, NodeSecret is the
+	// pre-shared key to authenticate on the nodes with.
+	NodeTLS    *tls.Config
+	NodeSecret []byte
+
+	// UploadChunkSize is the shard size of resumable uploads, sessions not
+	// continued for UploadExpiry are removed with their shards.
+	UploadChunkSize int64
+	UploadExpiry    time.Duration
+
+	// ReplacedFileDelay is the time shards of a replaced file and replicas
+	// dropped by repair or rebalancing are kept for the downloads in progress.
+	ReplacedFileDelay time.Duration
+}
+
 type Controller struct {
-	countFileParts int
-	infra          repository.Infra
-	storage        repository.Storage
-	nodeClients    nodeClients
+	countFileParts    int
+	parityShards      int
+	replicas          int
+	concurrency       int
+	bufferSize        int
+	spoolDir          string
+	heartbeatInterval time.Duration
+	nodeDownAfter     time.Duration
+	scrubInterval     time.Duration
+	scrubRate         int64
+	repairInterval    time.Duration
+	repairDelay       time.Duration
+	rebalanceInterval time.Duration
+	rebalanceLimit    float64
+	rebalanceRate     int64
+	infra             repository.Infra
+	storage           repository.Storage
+	access            repository.Access
+	nodeClients       nodeClients
+	nodeClientConfig  nodecli.Config
+	scrub             jobState[service.ControllerScrubReport]
+	repair            jobState[service.ControllerRepairReport]
+	rebalance         jobState[service.ControllerRebalanceReport]
+	uploadChunkSize   int64
+	uploadExpiry      time.Duration
+	replacedFileDelay time.Duration
+	activeUploads     sync.Map
+	// replicaMu serializes the replica changes of repair, rebalancing and
+	// the removal of dropped replicas.
+	replicaMu sync.Mutex
 }
 
-const defaultCountFileParts = 6
+const (
+	defaultCountFileParts    = 6
+	defaultReplicas          = 1
+	defaultHeartbeatInterval = 5 * time.Second
+	defaultConcurrency       = 4
+	defaultBufferSize        = 4 * 1024 * 1024
+	defaultScrubRate         = 16 * 1024 * 1024
+	defaultRepairDelay       = 10 * time.Minute
+	defaultRebalanceLimit    = 0.1
+	defaultRebalanceRate     = 16 * 1024 * 1024
+)
+
+func NewController(infra repository.Infra, storage repository.Storage, access repository.Access, config *Config) (*Controller, error) {
+	countFileParts := config.DataShards
+	if countFileParts < 1 {
+		countFileParts = defaultCountFileParts
+	}
+
+	replicas := config.Replicas
+	if replicas < 1 {
+		replicas = defaultReplicas
+	}
+
+	concurrency := config.Concurrency
+	if concurrency < 1 {
+		concurrency = defaultConcurrency
+	}
+
+	bufferSize := config.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultBufferSize
+	}
+
+	heartbeatInterval := config.HeartbeatInterval
+	if heartbeatInterval <= 0 {
+		heartbeatInterval = defaultHeartbeatInterval
+	}
+
+	nodeDownAfter := config.NodeDownAfter
+	if nodeDownAfter <= 0 {
+		nodeDownAfter = 3 * heartbeatInterval
+	}
+
+	scrubRate := config.ScrubRate
+	if scrubRate <= 0 {
+		scrubRate = defaultScrubRate
+	}
+
+	repairDelay := config.RepairDelay
+	if repairDelay <= 0 {
+		repairDelay = defaultRepairDelay
+	}
+
+	rebalanceLimit := config.RebalanceThreshold
+	if rebalanceLimit <= 0 {
+		rebalanceLimit = defaultRebalanceLimit
+	}
+
+	rebalanceRate := config.RebalanceRate
+	if rebalanceRate <= 0 {
+		rebalanceRate = defaultRebalanceRate
+	}
+
+	uploadChunkSize := config.UploadChunkSize
+	if uploadChunkSize <= 0 {
+		uploadChunkSize = defaultUploadChunkSize
+	}
+
+	uploadExpiry := config.UploadExpiry
+	if uploadExpiry <= 0 {
+		uploadExpiry = defaultUploadExpiry
+	}
+
+	replacedFileDelay := config.ReplacedFileDelay
+	if replacedFileDelay <= 0 {
+		replacedFileDelay = defaultReplacedFileDelay
+	}
+
+	if config.ParityShards > 0 {
+		if _, err := erasure.New(countFileParts, config.ParityShards); err != nil {
+			return nil, err
+		}
+	}
 
-func NewController(infra repository.Infra, storage repository.Storage) *Controller {
 	return &Controller{
-		countFileParts: defaultCountFileParts,
-		infra:          infra,
-		storage:        storage,
+		countFileParts:    countFileParts,
+		parityShards:      config.ParityShards,
+		replicas:          replicas,
+		concurrency:       concurrency,
+		bufferSize:        bufferSize,
+		spoolDir:          config.SpoolDir,
+		heartbeatInterval: heartbeatInterval,
+		nodeDownAfter:     nodeDownAfter,
+		scrubInterval:     config.ScrubInterval,
+		scrubRate:         scrubRate,
+		repairInterval:    config.RepairInterval,
+		repairDelay:       repairDelay,
+		rebalanceInterval: config.RebalanceInterval,
+		rebalanceLimit:    rebalanceLimit,
+		rebalanceRate:     rebalanceRate,
+		infra:             infra,
+		storage:           storage,
+		access:            access,
 		nodeClients: nodeClients{
 			mu:   sync.Mutex{},
 			dict: make(map[string]*nodecli.Client),
 		},
-	}
+		nodeClientConfig: nodecli.Config{
+			MaxConns:    config.NodeMaxConns,
+			MaxStreams:  config.NodeMaxStreams,
+			IdleTimeout: config.NodeIdleTimeout,
+			TLS:         config.NodeTLS,
+			Secret:      config.NodeSecret,
+		},
+		scrub:             newJobState[service.ControllerScrubReport](),
+		repair:            newJobState[service.ControllerRepairReport](),
+		rebalance:         newJobState[service.ControllerRebalanceReport](),
+		uploadChunkSize:   uploadChunkSize,
+		uploadExpiry:      uploadExpiry,
+		replacedFileDelay: replacedFileDelay,
+	}, nil
 }
 
 func (x *Controller) JoinNode(ctx context.Context, in *service.ControllerJoinNodeIn) (*service.ControllerJoinNodeOut, error) {
 	createNode, err := x.infra.CreateNode(ctx, &repository.InfraCreateNodeIn{
-		Addr: in.Addr,
+		Addr:  in.Addr,
+		Force: in.Force,
 	})
 	if err != nil {
 		return nil, err
@@ -52,6 +250,58 @@ func (x *Controller) JoinNode(ctx context.Context, in *service.ControllerJoinNod
 	}, nil
 }
 
+func (x *Controller) GetNode(ctx context.Context, in *service.ControllerGetNodeIn) (*service.ControllerGetNodeOut, error) {
+	getNode, err := x.infra.GetNode(ctx, &repository.InfraGetNodeIn{
+		Id: in.Id,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	countShards, err := x.storage.CountNodeShards(ctx, &repository.StorageCountNodeShardsIn{
+		NodeId: in.Id,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &service.ControllerGetNodeOut{
+		Id:         getNode.Node.Id,
+		Addr:       getNode.Node.Addr,
+		Up:         getNode.Node.State == repository.InfraNodeStateUp,
+		Draining:   getNode.Node.Draining,
+		LastSeen:   getNode.Node.LastSeen,
+		TotalBytes: getNode.Node.TotalBytes,
+		FreeBytes:  getNode.Node.FreeBytes,
+		Shards:     countShards.Count,
+	}, nil
+}
+
+// RemoveNode stops placing shards on the node and removes it after the
+// repair moves all its shards to other nodes.
+func (x *Controller) RemoveNode(ctx context.Context, in *service.ControllerRemoveNodeIn) (*service.ControllerRemoveNodeOut, error) {
+	if _, err := x.infra.SetNodeDraining(ctx, &repository.InfraSetNodeDrainingIn{
+		Id:       in.Id,
+		Draining: true,
+	}); err != nil {
+		return nil, err
+	}
+
+	removed, shards, err := x.removeDrainedNode(ctx, in.Id)
+	if err != nil {
+		return nil, err
+	}
+	if !removed {
+		slog.InfoContext(ctx, "node is draining", slog.String("node_id", in.Id), slog.Int64("shards", shards))
+		x.repair.schedule()
+	}
+
+	return &service.ControllerRemoveNodeOut{
+		Removed: removed,
+		Shards:  shards,
+	}, nil
+}
+
 func (x *Controller) getNodeClient(ctx context.Context, node *repository.InfraNode) (*nodecli.Client, error) {
 	x.nodeClients.mu.Lock()
 	defer x.nodeClients.mu.Unlock()
@@ -61,7 +311,7 @@ func (x *Controller) getNodeClient(ctx context.Context, node *repository.InfraNo
 		return cli, nil
 	}
 
-	cli, err := nodecli.NewClient(ctx, node.Addr)
+	cli, err := nodecli.NewClient(ctx, node.Addr, &x.nodeClientConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -70,33 +320,112 @@ func (x *Controller) getNodeClient(ctx context.Context, node *repository.InfraNo
 	return cli, nil
 }
 
+// GetNodePools returns the usage of the connection pools of the nodes the
+// controller has talked to.
+func (x *Controller) GetNodePools(ctx context.Context, in *service.ControllerGetNodePoolsIn) (*service.ControllerGetNodePoolsOut, error) {
+	x.nodeClients.mu.Lock()
+	defer x.nodeClients.mu.Unlock()
+
+	pools := make([]*service.ControllerNodePool, 0, len(x.nodeClients.dict))
+	for nodeId, cli := range x.nodeClients.dict {
+		stats := cli.Stats()
+		pools = append(pools, &service.ControllerNodePool{
+			NodeId:    nodeId,
+			Conns:     stats.Conns,
+			Idle:      stats.Idle,
+			Streams:   stats.Streams,
+			Dials:     stats.Dials,
+			Reuses:    stats.Reuses,
+			Waits:     stats.Waits,
+			Unhealthy: stats.Unhealthy,
+			Expired:   stats.Expired,
+		})
+	}
+	slices.SortFunc(pools, func(a, b *service.ControllerNodePool) int {
+		return strings.Compare(a.NodeId, b.NodeId)
+	})
+
+	return &service.ControllerGetNodePoolsOut{
+		Pools: pools,
+	}, nil
+}
+
 func (x *Controller) UploadFile(ctx context.Context, in *service.ControllerUploadFileIn) (*service.ControllerUploadFileOut, error) {
-	parts := calculateFileParts(in.Size, x.countFileParts)
+	if err := checkFileLocation(in.Location); err != nil {
+		return nil, err
+	}
+
+	bucket, err := x.getBucket(ctx, in.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	dataShards, parityShards, replicas := x.bucketDataShards(bucket), x.bucketParityShards(bucket), x.bucketReplicas(bucket)
+
+	conditions := repository.StorageFileConditions{
+		IfMatch:     in.IfMatch,
+		IfNoneMatch: in.IfNoneMatch,
+	}
+	if in.Replace {
+		// the conditions are checked again when the file is published, this
+		// spares the upload when they already fail
+		if err = x.checkConditions(ctx, bucket, in.Location, conditions); err != nil {
+			return nil, err
+		}
+	}
+	pending := bucket.Versioning || in.Replace
+
+	var encoder *erasure.Encoder
+	blockSize := 0
+	parts := calculateFileParts(in.Size, dataShards)
+	if parityShards > 0 {
+		if encoder, err = erasure.New(dataShards, parityShards); err != nil {
+			return nil, err
+		}
+		blockSize = calculateErasureBlockSize(in.Size, dataShards)
+		parts = calculateErasureParts(in.Size, dataShards, parityShards, blockSize)
+	}
 
 	freerNodes, err := x.infra.GetFreerNodes(ctx, &repository.InfraGetFreerNodesIn{
-		Count: x.countFileParts,
+		Count:        len(parts) * replicas,
+		MinFreeBytes: slices.Max(parts),
 	})
 	if err != nil {
 		return nil, err
 	}
-	if len(parts) != len(freerNodes.Nodes) {
-		return nil, errors.New("wrong number of parts or number of nodes")
+	if len(freerNodes.Nodes) < len(parts) || len(freerNodes.Nodes) < replicas {
+		return nil, fmt.Errorf("%w: %d nodes have room for %d parts of %d bytes",
+			repository.ErrInsufficientStorage, len(freerNodes.Nodes), len(parts)*replicas, slices.Max(parts))
 	}
 
 	slices.Reverse(freerNodes.Nodes)
 
+	placement := placeShards(freerNodes.Nodes, len(parts), replicas)
+	if err = checkCapacity(placement, parts); err != nil {
+		return nil, err
+	}
+
 	var shards []*repository.StorageCreateShard
-	for index, node := range freerNodes.Nodes {
-		shards = append(shards, &repository.StorageCreateShard{
-			NodeId: node.Id,
-			Index:  index,
-			Size:   parts[index],
-		})
+	for index, nodes := range placement {
+		for _, node := range nodes {
+			shards = append(shards, &repository.StorageCreateShard{
+				NodeId: node.Id,
+				Index:  index,
+				Size:   parts[index],
+			})
+		}
 	}
 
 	file, err := x.storage.CreateFile(ctx, &repository.StorageCreateFileIn{
-		Location: in.Location,
-		Shards:   shards,
+		BucketId:     bucket.Id,
+		Location:     in.Location,
+		Owner:        in.Owner,
+		Size:         in.Size,
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+		BlockSize:    blockSize,
+		Replicas:     replicas,
+		Pending:      pending,
+		Shards:       shards,
 	})
 	if err != nil {
 		return nil, err
@@ -111,61 +440,93 @@ func (x *Controller) UploadFile(ctx context.Context, in *service.ControllerUploa
 		}
 	})
 
+	sem := make(chan struct{}, x.concurrency)
+	uploads := make([]*shardUpload, 0, len(parts))
 	for index, size := range parts {
-		nodeClient, err := x.getNodeClient(ctx, freerNodes.Nodes[index])
-		if err != nil {
-			return nil, errWithRollback(err, rollback)
-		}
-
-		st := newShardStatusUpdater(x.storage, file.Id, freerNodes.Nodes[index].Id, index)
-		if err = st.setInProgress(ctx); err != nil {
-			return nil, errWithRollback(err, rollback)
-		}
-
 		filename := fmt.Sprintf("%s.%d", file.Id, index)
 
-		rollback = append(rollback, func(ctx context.Context) {
-			if err := nodeClient.DeleteFile(ctx, filename); err != nil {
-				slog.Error("error to clean wrong file data", slog.String("error", err.Error()))
+		var nodeClients []*nodecli.Client
+		var statuses []*shardStatusUpdater
+		for _, node := range placement[index] {
+			nodeClient, err := x.getNodeClient(ctx, node)
+			if err != nil {
+				return nil, errWithRollback(finishShardUploads(ctx, uploads, err), rollback)
 			}
-		})
 
-		if err = nodeClient.SaveFile(ctx, filename, in.Content, size); err != nil {
-			return nil, errors.Join(errWithRollback(err, rollback), st.setError(ctx))
+			st := newShardStatusUpdater(x.storage, file.Id, node.Id, index)
+			if err = st.setInProgress(ctx); err != nil {
+				return nil, errWithRollback(finishShardUploads(ctx, uploads, err), rollback)
+			}
+
+			rollback = append(rollback, func(ctx context.Context) {
+				if err := nodeClient.DeleteFile(ctx, filename); err != nil {
+					slog.Error("error to clean wrong file data", slog.String("error", err.Error()))
+				}
+			})
+
+			nodeClients = append(nodeClients, nodeClient)
+			statuses = append(statuses, st)
 		}
 
-		if err = st.setOK(ctx); err != nil {
+		uploads = append(uploads, x.startShardUpload(ctx, sem, nodeClients, statuses, filename, size))
+	}
+
+	dst := make([]io.Writer, len(uploads))
+	for index, upload := range uploads {
+		dst[index] = upload
+	}
+
+	fileHash := sha256.New()
+	src := io.TeeReader(in.Content, fileHash)
+	if encoder == nil {
+		err = writeParts(src, parts, dst)
+	} else {
+		err = writeStripes(encoder, src, in.Size, blockSize, dst)
+	}
+
+	if err = finishShardUploads(ctx, uploads, err); err != nil {
+		return nil, errWithRollback(err, rollback)
+	}
+
+	if _, err = x.storage.SetFileChecksum(ctx, &repository.StorageSetFileChecksumIn{
+		FileId:   file.Id,
+		Checksum: hex.EncodeToString(fileHash.Sum(nil)),
+	}); err != nil {
+		return nil, errWithRollback(err, rollback)
+	}
+
+	out := &service.ControllerUploadFileOut{
+		Id: file.Id,
+	}
+	if pending {
+		publishFile, err := x.storage.PublishFile(ctx, &repository.StoragePublishFileIn{
+			FileId:     file.Id,
+			Versioned:  bucket.Versioning,
+			Conditions: conditions,
+		})
+		if err != nil {
 			return nil, errWithRollback(err, rollback)
 		}
+		out.Version = publishFile.VersionId
+		out.Replaced = publishFile.Replaced
 	}
 
-	return &service.ControllerUploadFileOut{
-		Id: file.Id,
-	}, nil
+	return out, nil
 }
 
 func (x *Controller) SearchFile(ctx context.Context, in *service.ControllerSearchFileIn) (*service.ControllerSearchFileOut, error) {
-	file, err := x.storage.GetFileByLocation(ctx, &repository.StorageGetFileByLocationIn{
-		Location: in.Location,
-	})
+	file, err := x.findFile(ctx, in.Bucket, in.Location, in.Version)
 	if err != nil {
 		return nil, err
 	}
 
-	var size int64
-	status := repository.StorageShardStatusOK
-
-	for _, shard := range file.Shards {
-		size += shard.Size
-		if shard.Status > status {
-			status = shard.Status
-		}
-	}
-
 	return &service.ControllerSearchFileOut{
-		Id:     file.Id,
-		Size:   size,
-		Status: int(status),
+		Id:         file.Id,
+		Owner:      file.Owner,
+		Size:       file.Size,
+		Status:     int(fileStatus(file)),
+		ModifiedAt: fileModifiedAt(file),
+		Checksum:   file.Checksum,
 	}, nil
 }
 
@@ -177,31 +538,129 @@ func (x *Controller) DownloadFile(ctx context.Context, in *service.ControllerDow
 		return nil, err
 	}
 
-	slices.SortFunc(file.Shards, func(a, b *repository.StorageShard) int {
-		return cmp.Compare(a.Index, b.Index)
-	})
+	offset, length := in.Offset, in.Length
+	if length <= 0 {
+		length = file.Size - offset
+	}
+	if offset < 0 || length < 0 || offset+length > file.Size {
+		return nil, fmt.Errorf("%w: range %d+%d is out of the file size %d", repository.ErrBadRequest, offset, length, file.Size)
+	}
+
+	if file.ParityShards > 0 {
+		if err = x.downloadStripes(ctx, file, offset, length, in.Content); err != nil {
+			return nil, err
+		}
+		return &service.ControllerDownloadFileOut{}, nil
+	}
+
+	// shards are prefetched concurrently into bounded buffers and written in order
+	ranges := plainShardRanges(groupShardsByIndex(file.Shards), offset, length)
+	readers := make([]io.ReadCloser, len(ranges))
+	defer func() {
+		for _, r := range readers {
+			if r != nil {
+				_ = r.Close()
+			}
+		}
+	}()
+
+	for index, sr := range ranges {
+		for prefetch := index; prefetch < min(index+x.concurrency, len(ranges)); prefetch++ {
+			if readers[prefetch] == nil {
+				pr := ranges[prefetch]
+				readers[prefetch] = x.openShardReader(ctx, in.Id, pr.replicas, pr.offset, pr.length)
+			}
+		}
+
+		if _, err = io.CopyN(in.Content, readers[index], sr.length); err != nil {
+			return nil, err
+		}
+		if err = checkShardEnd(readers[index]); err != nil {
+			return nil, err
+		}
+	}
+
+	return &service.ControllerDownloadFileOut{}, nil
+}
+
+// downloadShard writes length bytes of a shard from offset to dst, falling
+// back to the next replica when a node fails. The next replica continues
+// from the point where the failed one stopped.
+func (x *Controller) downloadShard(ctx context.Context, fileId string, replicas []*repository.StorageShard, offset, length int64, dst io.Writer) error {
+	cw := &countingWriter{w: dst}
+	filename := fmt.Sprintf("%s.%d", fileId, replicas[0].Index)
+
+	var errs []error
+	for _, shard := range replicas {
+		if shard.Status != repository.StorageShardStatusOK {
+			continue
+		}
 
-	for _, shard := range file.Shards {
 		getNode, err := x.infra.GetNode(ctx, &repository.InfraGetNodeIn{
 			Id: shard.NodeId,
 		})
+		if errors.Is(err, repository.ErrResourceNotFound) {
+			errs = append(errs, fmt.Errorf("%w: node %s is removed", repository.ErrUnavailable, shard.NodeId))
+			continue
+		}
 		if err != nil {
-			return nil, err
+			errs = append(errs, err)
+			continue
+		}
+		if getNode.Node.State == repository.InfraNodeStateDown {
+			errs = append(errs, fmt.Errorf("%w: node %s is down", repository.ErrUnavailable, shard.NodeId))
+			continue
 		}
 
 		cli, err := x.getNodeClient(ctx, getNode.Node)
 		if err != nil {
-			return nil, err
+			errs = append(errs, err)
+			continue
 		}
 
-		filename := fmt.Sprintf("%s.%d", in.Id, shard.Index)
-
-		if err = cli.GetFile(ctx, filename, in.Content, shard.Size); err != nil {
-			return nil, err
+		if offset == 0 && length == shard.Size && cw.written == 0 {
+			err = cli.GetFile(ctx, filename, cw, shard.Size, shard.Checksum)
+		} else {
+			err = cli.GetFileRange(ctx, filename, cw, offset+cw.written, length-cw.written)
+		}
+		if err == nil {
+			return nil
+		}
+		err = nodeerr.Parse(err)
+		// the file exists, so a missing shard is a fault of the node
+		if errors.Is(err, repository.ErrResourceNotFound) {
+			err = fmt.Errorf("%w: shard %s is missing on node %s", repository.ErrDataLost, filename, shard.NodeId)
+		}
+		if errors.Is(err, repository.ErrChecksumMismatch) {
+			slog.Error("shard replica is corrupted",
+				slog.String("file", filename),
+				slog.String("node_id", shard.NodeId))
+			if stErr := newShardStatusUpdater(x.storage, fileId, shard.NodeId, shard.Index).setError(ctx); stErr != nil {
+				err = errors.Join(err, stErr)
+			}
+			// the node rejects a corrupted shard before sending it, data
+			// damaged on the way is already written and can't be taken back
+			if cw.written > 0 || cw.err != nil || ctx.Err() != nil {
+				return err
+			}
+			errs = append(errs, err)
+			continue
+		}
+		if cw.err != nil || ctx.Err() != nil {
+			return err
 		}
+
+		slog.Warn("failed to read shard replica",
+			slog.String("file", filename),
+			slog.String("node_id", shard.NodeId),
+			slog.String("error", err.Error()))
+		errs = append(errs, err)
 	}
 
-	return &service.ControllerDownloadFileOut{}, nil
+	if len(errs) == 0 {
+		return fmt.Errorf("%w: no healthy replicas of shard %s", repository.ErrUnavailable, filename)
+	}
+	return errors.Join(errs...)
 }
 
 func (x *Controller) DeleteFile(ctx context.Context, in *service.ControllerDeleteFileIn) (*service.ControllerDeleteFileOut, error) {
@@ -212,31 +671,75 @@ func (x *Controller) DeleteFile(ctx context.Context, in *service.ControllerDelet
 		return nil, err
 	}
 
+	if file.Latest {
+		bucket, err := x.getBucket(ctx, file.Bucket)
+		if err != nil {
+			return nil, err
+		}
+		if bucket.Versioning {
+			archiveFile, err := x.storage.ArchiveFile(ctx, &repository.StorageArchiveFileIn{
+				FileId: file.Id,
+				Owner:  in.Owner,
+			})
+			if err != nil {
+				return nil, err
+			}
+			return &service.ControllerDeleteFileOut{
+				Version: archiveFile.VersionId,
+			}, nil
+		}
+	}
+
+	if err = x.removeFile(ctx, file); err != nil {
+		return nil, err
+	}
+
+	return &service.ControllerDeleteFileOut{}, nil
+}
+
+// removeFile deletes the shards of the file from the nodes and then the file.
+// Shards of removed nodes are skipped, the ones on unreachable nodes are left
+// to the cleaner of dropped replicas.
+func (x *Controller) removeFile(ctx context.Context, file *repository.StorageGetFileOut) error {
 	for _, shard := range file.Shards {
 		getNode, err := x.infra.GetNode(ctx, &repository.InfraGetNodeIn{
 			Id: shard.NodeId,
 		})
-		if err != nil {
-			return nil, err
+		if errors.Is(err, repository.ErrResourceNotFound) {
+			continue
 		}
-
-		cli, err := x.getNodeClient(ctx, getNode.Node)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		filename := fmt.Sprintf("%s.%d", in.Id, shard.Index)
+		filename := fmt.Sprintf("%s.%d", file.Id, shard.Index)
 
-		if err = cli.DeleteFile(ctx, filename); err != nil {
-			return nil, err
+		if getNode.Node.State == repository.InfraNodeStateUp {
+			cli, err := x.getNodeClient(ctx, getNode.Node)
+			if err == nil {
+				err = nodeerr.Parse(cli.DeleteFile(ctx, filename))
+			}
+			// a shard missing on the node is already deleted
+			if err == nil || errors.Is(err, repository.ErrResourceNotFound) {
+				continue
+			}
+			slog.WarnContext(ctx, "failed to delete shard, it is left to the cleaner",
+				slog.String("node_id", shard.NodeId),
+				slog.String("filename", filename),
+				slog.String("error", err.Error()))
 		}
-	}
 
-	if _, err = x.storage.DeleteFile(ctx, &repository.StorageDeleteFileIn{
-		Id: file.Id,
-	}); err != nil {
-		return nil, err
+		if _, err = x.storage.DropShard(ctx, &repository.StorageDropShardIn{
+			FileId: file.Id,
+			NodeId: shard.NodeId,
+			Index:  shard.Index,
+		}); err != nil {
+			return err
+		}
 	}
 
-	return &service.ControllerDeleteFileOut{}, nil
+	_, err := x.storage.DeleteFile(ctx, &repository.StorageDeleteFileIn{
+		Id: file.Id,
+	})
+	return err
 }
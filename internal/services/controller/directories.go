@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/fydmer/fileserver/internal/domain/repository"
+	"github.com/fydmer/fileserver/internal/domain/service"
+)
+
+const maxLocationLength = 1024
+
+func (x *Controller) CreateDirectory(ctx context.Context, in *service.ControllerCreateDirectoryIn) (*service.ControllerCreateDirectoryOut, error) {
+	location := directoryLocation(in.Location)
+	if err := checkLocation(location); err != nil {
+		return nil, err
+	}
+
+	bucket, err := x.getBucket(ctx, in.Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = x.storage.CreateDirectory(ctx, &repository.StorageCreateDirectoryIn{
+		BucketId: bucket.Id,
+		Location: location,
+		Owner:    in.Owner,
+	}); err != nil {
+		return nil, err
+	}
+
+	searchDirectory, err := x.SearchDirectory(ctx, &service.ControllerSearchDirectoryIn{
+		Bucket:   bucket.Name,
+		Location: location,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &service.ControllerCreateDirectoryOut{
+		Directory: searchDirectory.Directory,
+	}, nil
+}
+
+func (x *Controller) SearchDirectory(ctx context.Context, in *service.ControllerSearchDirectoryIn) (*service.ControllerSearchDirectoryOut, error) {
+	bucket, err := x.getBucket(ctx, in.Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	getDirectory, err := x.storage.GetDirectory(ctx, &repository.StorageGetDirectoryIn{
+		BucketId: bucket.Id,
+		Location: directoryLocation(in.Location),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &service.ControllerSearchDirectoryOut{
+		Directory: &service.ControllerDirectory{
+			Id:        getDirectory.Id,
+			Location:  getDirectory.Location,
+			Owner:     getDirectory.Owner,
+			CreatedAt: getDirectory.CreatedAt,
+		},
+	}, nil
+}
+
+// DeleteDirectory removes the directory when there are no files and
+// directories in it.
+func (x *Controller) DeleteDirectory(ctx context.Context, in *service.ControllerDeleteDirectoryIn) (*service.ControllerDeleteDirectoryOut, error) {
+	bucket, err := x.getBucket(ctx, in.Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	getDirectory, err := x.storage.GetDirectory(ctx, &repository.StorageGetDirectoryIn{
+		BucketId: bucket.Id,
+		Location: directoryLocation(in.Location),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	listEntries, err := x.storage.ListEntries(ctx, &repository.StorageListEntriesIn{
+		BucketId: bucket.Id,
+		Prefix:   getDirectory.Location,
+		Limit:    1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(listEntries.Entries) > 0 {
+		return nil, fmt.Errorf("%w: directory %s is not empty", repository.ErrConflict, getDirectory.Location)
+	}
+
+	if _, err = x.storage.DeleteDirectory(ctx, &repository.StorageDeleteDirectoryIn{
+		Id: getDirectory.Id,
+	}); err != nil {
+		return nil, err
+	}
+
+	return &service.ControllerDeleteDirectoryOut{}, nil
+}
+
+// checkLocation accepts "/" separated names without "." and "..", locations
+// of directories end with "/".
+func checkLocation(location string) error {
+	if location == "" || location == "/" {
+		return fmt.Errorf("%w: location is empty", repository.ErrBadRequest)
+	}
+	if len(location) > maxLocationLength {
+		return fmt.Errorf("%w: location is longer than %d bytes", repository.ErrBadRequest, maxLocationLength)
+	}
+	if !utf8.ValidString(location) || strings.ContainsRune(location, 0) {
+		return fmt.Errorf("%w: location %q is not a valid utf-8 string", repository.ErrBadRequest, location)
+	}
+
+	for _, name := range strings.Split(strings.TrimSuffix(location, "/"), "/") {
+		switch name {
+		case "":
+			return fmt.Errorf("%w: location %q has an empty name", repository.ErrBadRequest, location)
+		case ".", "..":
+			return fmt.Errorf("%w: location %q has a relative name", repository.ErrBadRequest, location)
+		}
+	}
+
+	return nil
+}
+
+func checkFileLocation(location string) error {
+	if err := checkLocation(location); err != nil {
+		return err
+	}
+	if strings.HasSuffix(location, "/") {
+		return fmt.Errorf("%w: file location %q ends with \"/\"", repository.ErrBadRequest, location)
+	}
+	return nil
+}
+
+func directoryLocation(location string) string {
+	if location == "" || strings.HasSuffix(location, "/") {
+		return location
+	}
+	return location + "/"
+}
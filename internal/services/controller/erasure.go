@@ -0,0 +1,189 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/fydmer/fileserver/internal/domain/repository"
+	"github.com/fydmer/fileserver/pkg/erasure"
+)
+
+const erasureBlockSize = 256 * 1024
+
+// writeStripes splits src into stripes of DataShards blocks, computes parity
+// blocks for every stripe and writes block i of each stripe to dst[i].
+// The last stripe is padded with zeros.
+func writeStripes(encoder *erasure.Encoder, src io.Reader, size int64, blockSize int, dst []io.Writer) error {
+	dataShards := encoder.DataShards()
+
+	stripe := make([]byte, dataShards*blockSize)
+	blocks := make([][]byte, len(dst))
+	for i := range blocks {
+		if i < dataShards {
+			blocks[i] = stripe[i*blockSize : (i+1)*blockSize]
+		} else {
+			blocks[i] = make([]byte, blockSize)
+		}
+	}
+
+	for remaining := size; remaining > 0; {
+		n := min(remaining, int64(len(stripe)))
+		if _, err := io.ReadFull(src, stripe[:n]); err != nil {
+			return err
+		}
+		clear(stripe[n:])
+
+		if err := encoder.Encode(blocks); err != nil {
+			return err
+		}
+
+		for i, w := range dst {
+			if _, err := w.Write(blocks[i]); err != nil {
+				return err
+			}
+		}
+		remaining -= n
+	}
+
+	return nil
+}
+
+// openShardReader streams a range of a shard in background, prefetching up
+// to bufferSize bytes, see downloadShard.
+func (x *Controller) openShardReader(ctx context.Context, fileId string, replicas []*repository.StorageShard, offset, length int64) io.ReadCloser {
+	pipe := newBufferedPipe(x.bufferSize)
+	go func() {
+		_ = pipe.CloseWithError(x.downloadShard(ctx, fileId, replicas, offset, length, pipe))
+	}()
+	return pipe
+}
+
+// downloadStripes reads a range of an erasure coded file, only the stripes
+// covering the range are fetched.
+func (x *Controller) downloadStripes(ctx context.Context, file *repository.StorageGetFileOut, offset, length int64, dst io.Writer) error {
+	if length == 0 {
+		return nil
+	}
+
+	blockSize := int64(file.BlockSize)
+	stripeSize := int64(file.DataShards) * blockSize
+	end := offset + length
+
+	return x.readStripes(ctx, file, offset/stripeSize, (end-1)/stripeSize, false, func(stripe int64, blocks [][]byte) error {
+		stripeStart := stripe * stripeSize
+		from, to := max(offset, stripeStart)-stripeStart, min(end, stripeStart+stripeSize)-stripeStart
+		for index := from / blockSize; index*blockSize < to; index++ {
+			blockStart := index * blockSize
+			if _, err := dst.Write(blocks[index][max(from, blockStart)-blockStart : min(to, blockStart+blockSize)-blockStart]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// readStripes passes stripes from firstStripe to lastStripe of an erasure
+// coded file to fn, with missing data blocks reconstructed, or all missing
+// blocks when full is set. Only DataShards shards are read at once, data
+// shards are preferred; when one of them fails, the next healthy shard is
+// opened at the current stripe.
+func (x *Controller) readStripes(ctx context.Context, file *repository.StorageGetFileOut, firstStripe, lastStripe int64, full bool,
+	fn func(stripe int64, blocks [][]byte) error) error {
+	encoder, err := erasure.New(file.DataShards, file.ParityShards)
+	if err != nil {
+		return err
+	}
+
+	total := file.DataShards + file.ParityShards
+	replicas := make([][]*repository.StorageShard, total)
+	for _, group := range groupShardsByIndex(file.Shards) {
+		if group[0].Index < total {
+			replicas[group[0].Index] = group
+		}
+	}
+
+	failed := make([]bool, total)
+	for index := range replicas {
+		failed[index] = replicas[index] == nil
+	}
+
+	readers := make([]io.ReadCloser, total)
+	defer func() {
+		for _, r := range readers {
+			if r != nil {
+				_ = r.Close()
+			}
+		}
+	}()
+
+	buffers := make([][]byte, total)
+	for index := range buffers {
+		buffers[index] = make([]byte, file.BlockSize)
+	}
+	blocks := make([][]byte, total)
+
+	blockSize := int64(file.BlockSize)
+	for stripe := firstStripe; stripe <= lastStripe; stripe++ {
+		present := 0
+		for index := 0; index < total; index++ {
+			blocks[index] = buffers[index][:0]
+			if failed[index] || present == file.DataShards {
+				continue
+			}
+
+			if readers[index] == nil {
+				readers[index] = x.openShardReader(ctx, file.Id, replicas[index],
+					stripe*blockSize, (lastStripe-stripe+1)*blockSize)
+			}
+
+			if _, err = io.ReadFull(readers[index], buffers[index]); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+
+				slog.Warn("failed to read erasure shard",
+					slog.String("file_id", file.Id),
+					slog.Int("index", index),
+					slog.String("error", err.Error()))
+
+				failed[index] = true
+				_ = readers[index].Close()
+				readers[index] = nil
+				continue
+			}
+
+			blocks[index] = buffers[index]
+			present++
+		}
+
+		if present < file.DataShards {
+			return fmt.Errorf("not enough healthy shards to read file %s", file.Id)
+		}
+
+		if full {
+			err = encoder.Reconstruct(blocks)
+		} else {
+			err = encoder.ReconstructData(blocks)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err = fn(stripe, blocks); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range readers {
+		if r == nil {
+			continue
+		}
+		if err = checkShardEnd(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/fydmer/fileserver/internal/domain/repository"
+	"github.com/fydmer/fileserver/pkg/nodecli"
+)
+
+// RunHeartbeat pings every node each heartbeat interval until ctx is done.
+// A node is marked down when it has not answered for nodeDownAfter.
+func (x *Controller) RunHeartbeat(ctx context.Context) {
+	ticker := time.NewTicker(x.heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		x.checkNodes(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (x *Controller) checkNodes(ctx context.Context) {
+	listNodes, err := x.infra.ListNodes(ctx, &repository.InfraListNodesIn{})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to list nodes", slog.String("error", err.Error()))
+		return
+	}
+
+	wg := &sync.WaitGroup{}
+	for _, node := range listNodes.Nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			x.checkNode(ctx, node)
+		}()
+	}
+	wg.Wait()
+}
+
+func (x *Controller) checkNode(ctx context.Context, node *repository.InfraNode) {
+	req := &repository.InfraSetNodeStateIn{
+		Id:    node.Id,
+		State: repository.InfraNodeStateUp,
+	}
+
+	status, err := x.pingNode(ctx, node)
+	if err != nil {
+		if node.State == repository.InfraNodeStateDown || time.Since(node.LastSeen) < x.nodeDownAfter {
+			return
+		}
+
+		slog.WarnContext(ctx, "node is down",
+			slog.String("node_id", node.Id),
+			slog.String("addr", node.Addr),
+			slog.String("error", err.Error()))
+		req.State = repository.InfraNodeStateDown
+	} else {
+		if node.State == repository.InfraNodeStateDown {
+			slog.InfoContext(ctx, "node is up", slog.String("node_id", node.Id), slog.String("addr", node.Addr))
+		}
+		req.LastSeen = time.Now()
+		req.Capacity = &repository.InfraNodeCapacity{
+			TotalBytes: status.TotalBytes,
+			FreeBytes:  status.FreeBytes,
+		}
+	}
+
+	if _, err = x.infra.SetNodeState(ctx, req); err != nil {
+		slog.ErrorContext(ctx, "failed to set node state",
+			slog.String("node_id", node.Id),
+			slog.String("error", err.Error()))
+	}
+}
+
+func (x *Controller) pingNode(ctx context.Context, node *repository.InfraNode) (*nodecli.Status, error) {
+	ctx, cancel := context.WithTimeout(ctx, x.heartbeatInterval)
+	defer cancel()
+
+	cli, err := x.getNodeClient(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+
+	return cli.Ping(ctx)
+}
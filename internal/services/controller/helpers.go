@@ -1,10 +1,21 @@
 package controller
 
 import (
+	"cmp"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/fydmer/fileserver/internal/domain/repository"
+	"github.com/fydmer/fileserver/internal/errors/nodeerr"
+	"github.com/fydmer/fileserver/pkg/nodecli"
 )
 
 func calculateFileParts(fileSize int64, partsCount int) []int64 {
@@ -26,6 +37,273 @@ func calculateFileParts(fileSize int64, partsCount int) []int64 {
 	return parts
 }
 
+// calculateErasureBlockSize picks the stripe block size, small files are
+// stored as a single stripe to keep the padding low.
+func calculateErasureBlockSize(fileSize int64, dataShards int) int {
+	blockSize := (fileSize + int64(dataShards) - 1) / int64(dataShards)
+	return int(max(1, min(blockSize, erasureBlockSize)))
+}
+
+// calculateErasureParts returns sizes of data and parity shards, every shard
+// holds one block of each stripe so all of them are equal.
+func calculateErasureParts(fileSize int64, dataShards, parityShards, blockSize int) []int64 {
+	stripeSize := int64(dataShards * blockSize)
+	stripes := (fileSize + stripeSize - 1) / stripeSize
+
+	parts := make([]int64, dataShards+parityShards)
+	for i := range parts {
+		parts[i] = stripes * int64(blockSize)
+	}
+	return parts
+}
+
+// fileStatus reports the worst status among shards needed to read the file:
+// all the parts of a plain file or any DataShards parts of an erasure coded one.
+func fileStatus(file *repository.StorageGetFileOut) repository.StorageShardStatus {
+	if file.DataShards == 0 {
+		return repository.StorageShardStatusOK
+	}
+
+	statuses := make([]repository.StorageShardStatus, file.DataShards+file.ParityShards)
+	for i := range statuses {
+		statuses[i] = repository.StorageShardStatusError
+	}
+	for _, replicas := range groupShardsByIndex(file.Shards) {
+		if replicas[0].Index < len(statuses) {
+			statuses[replicas[0].Index] = replicas[0].Status
+		}
+	}
+
+	slices.Sort(statuses)
+	return statuses[file.DataShards-1]
+}
+
+// fileModifiedAt dates the upload by the oldest shard, repaired shards are
+// newer than the file.
+func fileModifiedAt(file *repository.StorageGetFileOut) time.Time {
+	var modifiedAt time.Time
+	for _, shard := range file.Shards {
+		if modifiedAt.IsZero() || shard.CreatedAt.Before(modifiedAt) {
+			modifiedAt = shard.CreatedAt
+		}
+	}
+	return modifiedAt
+}
+
+// shardRange is a part of a shard needed to read a range of a file.
+type shardRange struct {
+	replicas       []*repository.StorageShard
+	offset, length int64
+}
+
+// plainShardRanges maps a byte range of a plain file onto its contiguous shards.
+func plainShardRanges(groups [][]*repository.StorageShard, offset, length int64) []*shardRange {
+	var ranges []*shardRange
+	var start int64
+	for _, replicas := range groups {
+		size := replicas[0].Size
+		if from, to := max(offset, start), min(offset+length, start+size); from < to {
+			ranges = append(ranges, &shardRange{
+				replicas: replicas,
+				offset:   from - start,
+				length:   to - from,
+			})
+		}
+		start += size
+	}
+	return ranges
+}
+
+// placeShards assigns every part to replicas distinct nodes, going round-robin
+// over nodes so the load is spread evenly.
+func placeShards(nodes []*repository.InfraNode, partsCount, replicas int) [][]*repository.InfraNode {
+	placement := make([][]*repository.InfraNode, partsCount)
+	for index := range placement {
+		for replica := 0; replica < replicas; replica++ {
+			placement[index] = append(placement[index], nodes[(index*replicas+replica)%len(nodes)])
+		}
+	}
+	return placement
+}
+
+// checkCapacity makes sure every node has room for all the parts placed on it.
+func checkCapacity(placement [][]*repository.InfraNode, parts []int64) error {
+	required := make(map[string]int64)
+	for index, nodes := range placement {
+		for _, node := range nodes {
+			required[node.Id] += parts[index]
+			if required[node.Id] > node.FreeBytes {
+				return fmt.Errorf("%w: node %s has %d bytes free, %d bytes required",
+					repository.ErrInsufficientStorage, node.Id, node.FreeBytes, required[node.Id])
+			}
+		}
+	}
+	return nil
+}
+
+// groupShardsByIndex returns replicas of every shard ordered by index,
+// healthiest replicas go first.
+func groupShardsByIndex(shards []*repository.StorageShard) [][]*repository.StorageShard {
+	sorted := slices.Clone(shards)
+	slices.SortFunc(sorted, func(a, b *repository.StorageShard) int {
+		return cmp.Or(cmp.Compare(a.Index, b.Index), cmp.Compare(a.Status, b.Status))
+	})
+
+	var groups [][]*repository.StorageShard
+	for i, shard := range sorted {
+		if i == 0 || sorted[i-1].Index != shard.Index {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], shard)
+	}
+	return groups
+}
+
+// saveReplicas streams size bytes of src to all clients at once.
+func saveReplicas(ctx context.Context, clients []*nodecli.Client, filename string, src io.Reader, size int64) error {
+	if len(clients) == 1 {
+		return nodeerr.Parse(clients[0].SaveFile(ctx, filename, src, size))
+	}
+
+	wg := &sync.WaitGroup{}
+	errs := make([]error, len(clients)+1)
+	writers := make([]io.Writer, len(clients))
+	pipes := make([]*io.PipeWriter, len(clients))
+
+	for i, cli := range clients {
+		pr, pw := io.Pipe()
+		writers[i], pipes[i] = pw, pw
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = nodeerr.Parse(cli.SaveFile(ctx, filename, pr, size))
+			_ = pr.CloseWithError(errs[i])
+		}()
+	}
+
+	_, errs[len(clients)] = io.CopyN(io.MultiWriter(writers...), src, size)
+	for _, pw := range pipes {
+		_ = pw.CloseWithError(errs[len(clients)])
+	}
+
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// shardUpload streams one shard to its replicas in background. The data is
+// spooled, so the request body is read on without waiting for slow nodes,
+// and at most concurrency shards of a request are sent at once.
+type shardUpload struct {
+	spool    *spool
+	hash     hash.Hash
+	done     chan error
+	statuses []*shardStatusUpdater
+	// expected is the known checksum of the shard, set when it is restored
+	expected string
+}
+
+func (x *Controller) startShardUpload(ctx context.Context, sem chan struct{}, clients []*nodecli.Client, statuses []*shardStatusUpdater, filename string, size int64) *shardUpload {
+	upload := &shardUpload{
+		spool:    newSpool(x.spoolDir, x.bufferSize),
+		hash:     sha256.New(),
+		done:     make(chan error, 1),
+		statuses: statuses,
+	}
+
+	go func() {
+		sem <- struct{}{}
+		defer func() { <-sem }()
+
+		upload.done <- saveReplicas(ctx, clients, filename, upload.spool, size)
+	}()
+
+	return upload
+}
+
+func (x *shardUpload) Write(p []byte) (int, error) {
+	n, err := x.spool.Write(p)
+	x.hash.Write(p[:n])
+	return n, err
+}
+
+// finish closes the shard stream with cause and records the result of the upload.
+func (x *shardUpload) finish(ctx context.Context, cause error) error {
+	if cause != nil {
+		_ = x.spool.Close()
+	} else {
+		_ = x.spool.CloseWithError(nil)
+	}
+
+	err := <-x.done
+	_ = x.spool.Close()
+
+	checksum := hex.EncodeToString(x.hash.Sum(nil))
+	if err == nil && x.expected != "" && checksum != x.expected {
+		err = fmt.Errorf("%w: written shard differs from the original", repository.ErrChecksumMismatch)
+	}
+
+	if err != nil {
+		for _, st := range x.statuses {
+			err = errors.Join(err, st.setError(ctx))
+		}
+		return err
+	}
+
+	for _, st := range x.statuses {
+		if err := st.setOK(ctx, checksum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func finishShardUploads(ctx context.Context, uploads []*shardUpload, cause error) error {
+	errs := []error{cause}
+	for _, upload := range uploads {
+		errs = append(errs, upload.finish(ctx, cause))
+	}
+	return errors.Join(errs...)
+}
+
+func writeParts(src io.Reader, parts []int64, dst []io.Writer) error {
+	for index, size := range parts {
+		if _, err := io.CopyN(dst[index], src, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkShardEnd makes sure a fully read shard stream has ended without an
+// error, checksum mismatches are reported only after the last byte.
+func checkShardEnd(r io.Reader) error {
+	var b [1]byte
+	n, err := r.Read(b[:])
+	if n > 0 {
+		return errors.New("shard is longer than expected")
+	}
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+type countingWriter struct {
+	w       io.Writer
+	written int64
+	err     error
+}
+
+func (x *countingWriter) Write(p []byte) (int, error) {
+	n, err := x.w.Write(p)
+	x.written += int64(n)
+	if err != nil {
+		x.err = err
+	}
+	return n, err
+}
+
 type shardStatusUpdater struct {
 	storage        repository.Storage
 	fileId, nodeId string
@@ -69,9 +347,10 @@ func (x *shardStatusUpdater) setError(ctx context.Context) error {
 	return nil
 }
 
-func (x *shardStatusUpdater) setOK(ctx context.Context) error {
+func (x *shardStatusUpdater) setOK(ctx context.Context, checksum string) error {
 	req := x.toSetShardStatusIn()
 	req.Status = repository.StorageShardStatusOK
+	req.Checksum = checksum
 	_, err := x.storage.SetShardStatus(ctx, req)
 	if err != nil {
 		return err
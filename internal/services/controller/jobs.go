@@ -0,0 +1,125 @@
+package controller
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// jobState tracks a background job run periodically or on demand, R is the
+// report of a single pass.
+type jobState[R any] struct {
+	mu      sync.Mutex
+	current *R
+	last    *R
+	trigger chan struct{}
+}
+
+func newJobState[R any]() jobState[R] {
+	return jobState[R]{
+		trigger: make(chan struct{}, 1),
+	}
+}
+
+// run calls pass every interval and when triggered by start until ctx is
+// done, a zero interval disables the periodic runs.
+func (x *jobState[R]) run(ctx context.Context, interval time.Duration, pass func(ctx context.Context)) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+		case <-x.trigger:
+		}
+
+		pass(ctx)
+	}
+}
+
+// start asks for a pass, it reports false if a pass is running or pending.
+func (x *jobState[R]) start() bool {
+	x.mu.Lock()
+	running := x.current != nil
+	x.mu.Unlock()
+	if running {
+		return false
+	}
+
+	select {
+	case x.trigger <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// schedule asks for a pass after the running one, if any.
+func (x *jobState[R]) schedule() {
+	select {
+	case x.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (x *jobState[R]) begin(report *R) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.current = report
+}
+
+// update applies fn to the report of the running pass.
+func (x *jobState[R]) update(fn func(report *R)) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	fn(x.current)
+}
+
+// end finishes the running pass with fn applied to its report.
+func (x *jobState[R]) end(fn func(report *R)) *R {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	fn(x.current)
+	x.current, x.last = nil, x.current
+	return x.last
+}
+
+// status returns copies of the running and the last finished pass reports.
+func (x *jobState[R]) status() (current, last *R) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.current != nil {
+		report := *x.current
+		current = &report
+	}
+	if x.last != nil {
+		report := *x.last
+		last = &report
+	}
+	return current, last
+}
+
+// throttle waits until size bytes processed since started fit into rate
+// bytes per second.
+func throttle(ctx context.Context, size, rate int64, started time.Time) error {
+	pause := time.Duration(float64(size)/float64(rate)*float64(time.Second)) - time.Since(started)
+	if pause <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(pause)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,245 @@
+package controller
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/fydmer/fileserver/internal/domain/repository"
+	"github.com/fydmer/fileserver/internal/domain/service"
+)
+
+const defaultListLimit = 1000
+
+// listCursor continues a listing after the last returned file or prefix,
+// it is valid for the same order only.
+type listCursor struct {
+	Sort      service.ControllerFileSort `json:"s"`
+	Desc      bool                       `json:"d,omitempty"`
+	Location  string                     `json:"l"`
+	Size      int64                      `json:"z,omitempty"`
+	CreatedAt time.Time                  `json:"t,omitempty"`
+}
+
+func (x *Controller) ListFiles(ctx context.Context, in *service.ControllerListFilesIn) (*service.ControllerListFilesOut, error) {
+	limit := in.Limit
+	if limit <= 0 || limit > defaultListLimit {
+		limit = defaultListLimit
+	}
+
+	var after *listCursor
+	if in.Cursor != "" {
+		var err error
+		if after, err = decodeListCursor(in.Cursor); err != nil {
+			return nil, err
+		}
+		if after.Sort != in.Sort || after.Desc != in.Desc {
+			return nil, fmt.Errorf("%w: the cursor is of another sort order", repository.ErrBadRequest)
+		}
+	} else if in.After != "" {
+		if in.Sort != service.ControllerFileSortLocation || in.Desc {
+			return nil, fmt.Errorf("%w: listings sorted by location only start after a location", repository.ErrBadRequest)
+		}
+		after = &listCursor{
+			Sort:     in.Sort,
+			Location: in.After,
+		}
+	}
+
+	bucket, err := x.getBucket(ctx, in.Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	if in.Delimiter != "" {
+		return x.listEntries(ctx, in, bucket, after, limit)
+	}
+
+	sort, ok := map[service.ControllerFileSort]repository.StorageFileSort{
+		service.ControllerFileSortLocation:  repository.StorageFileSortLocation,
+		service.ControllerFileSortSize:      repository.StorageFileSortSize,
+		service.ControllerFileSortCreatedAt: repository.StorageFileSortCreatedAt,
+	}[in.Sort]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown sort %d", repository.ErrBadRequest, in.Sort)
+	}
+
+	searchIn := &repository.StorageSearchFilesIn{
+		BucketId:      bucket.Id,
+		Prefix:        in.Prefix,
+		Owner:         in.Owner,
+		MinSize:       in.MinSize,
+		MaxSize:       in.MaxSize,
+		CreatedAfter:  in.CreatedAfter,
+		CreatedBefore: in.CreatedBefore,
+		Sort:          sort,
+		Desc:          in.Desc,
+		Limit:         limit,
+	}
+	if after != nil {
+		searchIn.After = &repository.StorageEntry{
+			Location:  after.Location,
+			Size:      after.Size,
+			CreatedAt: after.CreatedAt,
+		}
+	}
+
+	searchFiles, err := x.storage.SearchFiles(ctx, searchIn)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &service.ControllerListFilesOut{
+		Files:       make([]*service.ControllerFileEntry, 0, len(searchFiles.Files)),
+		Directories: make([]*service.ControllerDirectory, 0),
+		Prefixes:    make([]string, 0),
+	}
+	for _, file := range searchFiles.Files {
+		out.Files = append(out.Files, fileEntry(file))
+	}
+	if last := len(searchFiles.Files) - 1; searchFiles.More && last >= 0 {
+		out.Next = encodeListCursor(&listCursor{
+			Sort:      in.Sort,
+			Desc:      in.Desc,
+			Location:  searchFiles.Files[last].Location,
+			Size:      searchFiles.Files[last].Size,
+			CreatedAt: searchFiles.Files[last].CreatedAt,
+		})
+	}
+
+	return out, nil
+}
+
+// listEntries lists a level of the directory tree, the entries are rolled
+// up by the delimiter and sorted by location.
+func (x *Controller) listEntries(ctx context.Context, in *service.ControllerListFilesIn, bucket *repository.StorageBucket, after *listCursor, limit int) (*service.ControllerListFilesOut, error) {
+	if in.Sort != service.ControllerFileSortLocation || in.Desc {
+		return nil, fmt.Errorf("%w: listings with a delimiter are sorted by location only", repository.ErrBadRequest)
+	}
+	if in.Owner != "" || in.MinSize > 0 || in.MaxSize > 0 || !in.CreatedAfter.IsZero() || !in.CreatedBefore.IsZero() {
+		return nil, fmt.Errorf("%w: listings with a delimiter can't be filtered", repository.ErrBadRequest)
+	}
+
+	listIn := &repository.StorageListEntriesIn{
+		BucketId:  bucket.Id,
+		Prefix:    in.Prefix,
+		Delimiter: in.Delimiter,
+		Limit:     limit,
+	}
+	if after != nil {
+		listIn.After = after.Location
+	}
+
+	listEntries, err := x.storage.ListEntries(ctx, listIn)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &service.ControllerListFilesOut{
+		Files:       make([]*service.ControllerFileEntry, 0, len(listEntries.Entries)),
+		Directories: make([]*service.ControllerDirectory, 0),
+		Prefixes:    listEntries.Prefixes,
+	}
+	for _, entry := range listEntries.Entries {
+		if entry.Directory {
+			out.Directories = append(out.Directories, &service.ControllerDirectory{
+				Id:        entry.Id,
+				Location:  entry.Location,
+				Owner:     entry.Owner,
+				CreatedAt: entry.CreatedAt,
+			})
+			continue
+		}
+		out.Files = append(out.Files, fileEntry(entry))
+	}
+	if out.Prefixes == nil {
+		out.Prefixes = make([]string, 0)
+	}
+	if listEntries.Next != "" {
+		out.Next = encodeListCursor(&listCursor{
+			Location: listEntries.Next,
+		})
+	}
+
+	return out, nil
+}
+
+func (x *Controller) GetFileInfo(ctx context.Context, in *service.ControllerGetFileInfoIn) (*service.ControllerGetFileInfoOut, error) {
+	file, err := x.findFile(ctx, in.Bucket, in.Location, in.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	listNodes, err := x.infra.ListNodes(ctx, &repository.InfraListNodesIn{})
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make(map[string]string, len(listNodes.Nodes))
+	for _, node := range listNodes.Nodes {
+		addrs[node.Id] = node.Addr
+	}
+
+	shards := make([]*service.ControllerShardInfo, 0, len(file.Shards))
+	for _, replicas := range groupShardsByIndex(file.Shards) {
+		for _, shard := range replicas {
+			shards = append(shards, &service.ControllerShardInfo{
+				Index:     shard.Index,
+				NodeId:    shard.NodeId,
+				NodeAddr:  addrs[shard.NodeId],
+				Size:      shard.Size,
+				Status:    int(shard.Status),
+				Checksum:  shard.Checksum,
+				CreatedAt: shard.CreatedAt,
+			})
+		}
+	}
+
+	return &service.ControllerGetFileInfoOut{
+		Id:           file.Id,
+		Bucket:       file.Bucket,
+		Location:     file.Location,
+		Owner:        file.Owner,
+		Size:         file.Size,
+		Status:       int(fileStatus(file)),
+		CreatedAt:    file.CreatedAt,
+		ModifiedAt:   fileModifiedAt(file),
+		Checksum:     file.Checksum,
+		DataShards:   file.DataShards,
+		ParityShards: file.ParityShards,
+		BlockSize:    file.BlockSize,
+		Replicas:     x.fileReplicas(file),
+		Shards:       shards,
+	}, nil
+}
+
+func fileEntry(entry *repository.StorageEntry) *service.ControllerFileEntry {
+	return &service.ControllerFileEntry{
+		Id:        entry.Id,
+		Location:  entry.Location,
+		Owner:     entry.Owner,
+		Size:      entry.Size,
+		Checksum:  entry.Checksum,
+		CreatedAt: entry.CreatedAt,
+	}
+}
+
+func encodeListCursor(cursor *listCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeListCursor(s string) (*listCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid cursor", repository.ErrBadRequest)
+	}
+
+	cursor := &listCursor{}
+	if err = json.Unmarshal(data, cursor); err != nil {
+		return nil, fmt.Errorf("%w: invalid cursor", repository.ErrBadRequest)
+	}
+	return cursor, nil
+}
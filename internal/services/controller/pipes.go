@@ -0,0 +1,242 @@
+package controller
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// bufferedPipe is an in-memory pipe with a bounded ring buffer: writes block
+// only when the buffer is full, so the writer may run ahead of the reader.
+type bufferedPipe struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    []byte
+	start  int
+	length int
+	werr   error // set when the writer is done, io.EOF on success
+	rerr   error // set when the reader gave up
+}
+
+func newBufferedPipe(size int) *bufferedPipe {
+	p := &bufferedPipe{buf: make([]byte, size)}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (x *bufferedPipe) Write(p []byte) (int, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	written := 0
+	for written < len(p) {
+		for x.length == len(x.buf) && x.rerr == nil {
+			x.cond.Wait()
+		}
+		if x.rerr != nil {
+			return written, x.rerr
+		}
+		if x.werr != nil {
+			return written, io.ErrClosedPipe
+		}
+
+		end := (x.start + x.length) % len(x.buf)
+		free := len(x.buf) - x.length
+		if end+free > len(x.buf) {
+			free = len(x.buf) - end
+		}
+
+		n := copy(x.buf[end:end+free], p[written:])
+		x.length += n
+		written += n
+		x.cond.Broadcast()
+	}
+	return written, nil
+}
+
+func (x *bufferedPipe) Read(p []byte) (int, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for x.length == 0 && x.werr == nil && x.rerr == nil {
+		x.cond.Wait()
+	}
+	if x.rerr != nil {
+		return 0, io.ErrClosedPipe
+	}
+	if x.length == 0 {
+		return 0, x.werr
+	}
+
+	available := min(x.length, len(x.buf)-x.start)
+	n := copy(p, x.buf[x.start:x.start+available])
+	x.start = (x.start + n) % len(x.buf)
+	x.length -= n
+	x.cond.Broadcast()
+	return n, nil
+}
+
+// CloseWithError finishes the writing side, the reader gets err after the
+// buffered data is drained, io.EOF when err is nil.
+func (x *bufferedPipe) CloseWithError(err error) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if err == nil {
+		err = io.EOF
+	}
+	if x.werr == nil {
+		x.werr = err
+	}
+	x.cond.Broadcast()
+	return nil
+}
+
+// Close is called by the reader, pending and later writes fail.
+func (x *bufferedPipe) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.rerr == nil {
+		x.rerr = io.ErrClosedPipe
+	}
+	x.buf = nil
+	x.length = 0
+	x.cond.Broadcast()
+	return nil
+}
+
+// spool is a pipe whose writes never block: the first memLimit bytes are kept
+// in memory and the rest goes to a temporary file in dir.
+type spool struct {
+	dir      string
+	memLimit int
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	mem    []byte
+	file   *os.File
+	size   int64
+	offset int64
+	werr   error
+	rerr   error
+}
+
+func newSpool(dir string, memLimit int) *spool {
+	s := &spool{dir: dir, memLimit: memLimit}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (x *spool) Write(p []byte) (int, error) {
+	x.mu.Lock()
+	if x.rerr != nil {
+		x.mu.Unlock()
+		return 0, x.rerr
+	}
+	if x.werr != nil {
+		x.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+
+	if x.file == nil && len(x.mem)+len(p) <= x.memLimit {
+		x.mem = append(x.mem, p...)
+		x.size += int64(len(p))
+		x.cond.Broadcast()
+		x.mu.Unlock()
+		return len(p), nil
+	}
+
+	if x.file == nil {
+		f, err := os.CreateTemp(x.dir, "upload-*.spool")
+		if err != nil {
+			x.mu.Unlock()
+			return 0, err
+		}
+		x.file = f
+	}
+	f, fileOffset := x.file, x.size-int64(len(x.mem))
+	x.mu.Unlock()
+
+	// there is a single writer, so the file region past size is not shared
+	n, err := f.WriteAt(p, fileOffset)
+
+	x.mu.Lock()
+	x.size += int64(n)
+	x.cond.Broadcast()
+	x.mu.Unlock()
+
+	return n, err
+}
+
+func (x *spool) Read(p []byte) (int, error) {
+	x.mu.Lock()
+	for x.offset == x.size && x.werr == nil && x.rerr == nil {
+		x.cond.Wait()
+	}
+	if x.rerr != nil {
+		x.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	if x.offset == x.size {
+		x.mu.Unlock()
+		return 0, x.werr
+	}
+
+	if x.offset < int64(len(x.mem)) {
+		n := copy(p, x.mem[x.offset:])
+		x.offset += int64(n)
+		x.mu.Unlock()
+		return n, nil
+	}
+
+	f, fileOffset := x.file, x.offset-int64(len(x.mem))
+	p = p[:min(int64(len(p)), x.size-x.offset)]
+	x.mu.Unlock()
+
+	n, err := f.ReadAt(p, fileOffset)
+
+	x.mu.Lock()
+	x.offset += int64(n)
+	x.mu.Unlock()
+
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// CloseWithError finishes the writing side, see bufferedPipe.CloseWithError.
+func (x *spool) CloseWithError(err error) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if err == nil {
+		err = io.EOF
+	}
+	if x.werr == nil {
+		x.werr = err
+	}
+	x.cond.Broadcast()
+	return nil
+}
+
+// Close is called by the reader, it fails the writer and drops the spooled data.
+func (x *spool) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.rerr == nil {
+		x.rerr = io.ErrClosedPipe
+	}
+	x.mem = nil
+	x.cond.Broadcast()
+
+	if x.file == nil {
+		return nil
+	}
+	name := x.file.Name()
+	_ = x.file.Close()
+	x.file = nil
+	return os.Remove(name)
+}
@@ -0,0 +1,231 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+type pipe interface {
+	io.ReadWriteCloser
+	CloseWithError(err error) error
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+// transfer writes the chunks of data in another goroutine and reads them
+// back with reads of readSize bytes.
+func transfer(t *testing.T, p pipe, data []byte, chunk, readSize int) []byte {
+	t.Helper()
+
+	werr := make(chan error, 1)
+	go func() {
+		for rest := data; len(rest) > 0; {
+			n := min(chunk, len(rest))
+			if _, err := p.Write(rest[:n]); err != nil {
+				werr <- err
+				return
+			}
+			rest = rest[n:]
+		}
+		werr <- p.CloseWithError(nil)
+	}()
+
+	got := &bytes.Buffer{}
+	buf := make([]byte, readSize)
+	for {
+		n, err := p.Read(buf)
+		got.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-werr; err != nil {
+		t.Fatal(err)
+	}
+	return got.Bytes()
+}
+
+func TestBufferedPipe(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		data     int
+		chunk    int
+		readSize int
+	}{
+		{"fits the buffer", 64, 50, 10, 64},
+		{"wrap-around", 10, 1000, 7, 4},
+		{"wrap-around with exact chunks", 8, 64, 4, 3},
+		{"write larger than the buffer", 8, 1000, 1000, 5},
+		{"read larger than the buffer", 8, 1000, 3, 100},
+		{"one byte buffer", 1, 100, 10, 10},
+		{"empty", 16, 0, 1, 16},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := testData(tt.data)
+			if got := transfer(t, newBufferedPipe(tt.size), data, tt.chunk, tt.readSize); !bytes.Equal(got, data) {
+				t.Fatalf("got %d bytes, want %d equal ones", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestSpool(t *testing.T) {
+	tests := []struct {
+		name     string
+		memLimit int
+		data     int
+		chunk    int
+		readSize int
+		spilled  bool
+	}{
+		{"in memory", 100, 100, 10, 7, false},
+		{"spilled", 100, 1000, 30, 7, true},
+		{"spilled at once", 100, 1000, 1000, 64, true},
+		{"no memory", 0, 100, 10, 100, true},
+		{"empty", 100, 0, 1, 10, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := newSpool(dir, tt.memLimit)
+
+			data := testData(tt.data)
+			if got := transfer(t, s, data, tt.chunk, tt.readSize); !bytes.Equal(got, data) {
+				t.Fatalf("got %d bytes, want %d equal ones", len(got), len(data))
+			}
+
+			if spilled := s.file != nil; spilled != tt.spilled {
+				t.Fatalf("got spilled %v, want %v", spilled, tt.spilled)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Fatalf("got %d files left, want none", len(entries))
+			}
+		})
+	}
+}
+
+func TestPipeCloseWithError(t *testing.T) {
+	failure := errors.New("failure")
+
+	pipes := []struct {
+		name string
+		new  func(t *testing.T) pipe
+	}{
+		{"buffered pipe", func(*testing.T) pipe { return newBufferedPipe(16) }},
+		{"spool", func(t *testing.T) pipe { return newSpool(t.TempDir(), 4) }},
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"success", nil, io.EOF},
+		{"failure", failure, failure},
+	}
+
+	for _, pp := range pipes {
+		for _, tt := range tests {
+			t.Run(pp.name+" "+tt.name, func(t *testing.T) {
+				p := pp.new(t)
+				defer p.Close()
+
+				data := testData(10)
+				if _, err := p.Write(data); err != nil {
+					t.Fatal(err)
+				}
+				_ = p.CloseWithError(tt.err)
+				// the first error is kept
+				_ = p.CloseWithError(errors.New("later"))
+
+				if _, err := p.Write(data); !errors.Is(err, io.ErrClosedPipe) {
+					t.Fatalf("got %v, want %v", err, io.ErrClosedPipe)
+				}
+
+				// the buffered data is read before the error
+				got, err := io.ReadAll(p)
+				if !bytes.Equal(got, data) {
+					t.Fatalf("got %v, want %v", got, data)
+				}
+				if tt.want == io.EOF {
+					if err != nil {
+						t.Fatalf("got %v, want %v", err, tt.want)
+					}
+				} else if !errors.Is(err, tt.want) {
+					t.Fatalf("got %v, want %v", err, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestPipeReaderClose(t *testing.T) {
+	t.Run("buffered pipe", func(t *testing.T) {
+		p := newBufferedPipe(4)
+
+		// the writer blocked on the full buffer is released
+		werr := make(chan error, 1)
+		go func() {
+			_, err := p.Write(testData(100))
+			werr <- err
+		}()
+
+		select {
+		case err := <-werr:
+			t.Fatalf("write of 100 bytes to a buffer of 4 returned %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		_ = p.Close()
+		if err := <-werr; !errors.Is(err, io.ErrClosedPipe) {
+			t.Fatalf("got %v, want %v", err, io.ErrClosedPipe)
+		}
+		if _, err := p.Read(make([]byte, 1)); !errors.Is(err, io.ErrClosedPipe) {
+			t.Fatalf("got %v, want %v", err, io.ErrClosedPipe)
+		}
+	})
+
+	t.Run("spool", func(t *testing.T) {
+		dir := t.TempDir()
+		s := newSpool(dir, 4)
+		if _, err := s.Write(testData(100)); err != nil {
+			t.Fatal(err)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+			t.Fatalf("got %d spool files, want 1", len(entries))
+		}
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Fatalf("got %d files left, want none", len(entries))
+		}
+		if _, err := s.Write(testData(1)); !errors.Is(err, io.ErrClosedPipe) {
+			t.Fatalf("got %v, want %v", err, io.ErrClosedPipe)
+		}
+		if _, err := s.Read(make([]byte, 1)); !errors.Is(err, io.ErrClosedPipe) {
+			t.Fatalf("got %v, want %v", err, io.ErrClosedPipe)
+		}
+	})
+}
@@ -0,0 +1,384 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/fydmer/fileserver/internal/domain/repository"
+	"github.com/fydmer/fileserver/internal/domain/service"
+)
+
+const (
+	rebalancePageSize = 100
+	// rebalancePlanSize limits the moves planned by a single pass.
+	rebalancePlanSize = 1000
+)
+
+// rebalanceNode is a node taking part in rebalancing, used and free are
+// updated by the planned moves.
+type rebalanceNode struct {
+	node    *repository.InfraNode
+	initial int64
+	used    int64
+	free    int64
+}
+
+// usage is the share of the node capacity taken by shards after delta bytes
+// are added to it.
+func (x *rebalanceNode) usage(delta int64) float64 {
+	return float64(x.used+delta) / float64(x.node.TotalBytes)
+}
+
+type rebalancePlan struct {
+	mean  float64
+	nodes []*rebalanceNode
+	moves []*service.ControllerRebalanceMove
+	// files caches the files of planned moves, their shards are updated
+	// by the moves
+	files map[string]*repository.StorageGetFileOut
+}
+
+// RunRebalancer evens out the disk usage of nodes every rebalance interval
+// and when asked by StartRebalance, until ctx is done.
+func (x *Controller) RunRebalancer(ctx context.Context) {
+	x.rebalance.run(ctx, x.rebalanceInterval, x.rebalanceNodes)
+}
+
+func (x *Controller) GetRebalanceStatus(_ context.Context, _ *service.ControllerGetRebalanceStatusIn) (*service.ControllerGetRebalanceStatusOut, error) {
+	current, last := x.rebalance.status()
+	return &service.ControllerGetRebalanceStatusOut{
+		Running: current != nil,
+		Current: current,
+		Last:    last,
+	}, nil
+}
+
+func (x *Controller) StartRebalance(_ context.Context, _ *service.ControllerStartRebalanceIn) (*service.ControllerStartRebalanceOut, error) {
+	return &service.ControllerStartRebalanceOut{
+		Started: x.rebalance.start(),
+	}, nil
+}
+
+// PlanRebalance returns the moves the next rebalancing pass would make
+// without moving anything.
+func (x *Controller) PlanRebalance(ctx context.Context, _ *service.ControllerPlanRebalanceIn) (*service.ControllerPlanRebalanceOut, error) {
+	plan, err := x.planRebalance(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &service.ControllerPlanRebalanceOut{
+		MeanUsage: plan.mean,
+		Moves:     plan.moves,
+	}
+	for _, node := range plan.nodes {
+		out.Nodes = append(out.Nodes, &service.ControllerRebalanceNode{
+			Id:           node.node.Id,
+			UsedBytes:    node.initial,
+			TotalBytes:   node.node.TotalBytes,
+			Usage:        float64(node.initial) / float64(node.node.TotalBytes),
+			PlannedUsage: node.usage(0),
+		})
+	}
+	return out, nil
+}
+
+func (x *Controller) rebalanceNodes(ctx context.Context) {
+	x.rebalance.begin(&service.ControllerRebalanceReport{StartedAt: time.Now()})
+
+	plan, err := x.planRebalance(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to plan rebalancing", slog.String("error", err.Error()))
+	} else {
+		x.rebalance.update(func(report *service.ControllerRebalanceReport) {
+			report.Planned = int64(len(plan.moves))
+		})
+
+		for _, move := range plan.moves {
+			if ctx.Err() != nil {
+				break
+			}
+
+			started := time.Now()
+			moved, err := x.moveShard(ctx, move)
+			x.rebalance.update(func(report *service.ControllerRebalanceReport) {
+				switch {
+				case err != nil:
+					report.Failed++
+				case moved:
+					report.Moved++
+					report.Bytes += move.Size
+				default:
+					report.Skipped++
+				}
+			})
+			if err != nil {
+				slog.ErrorContext(ctx, "failed to move shard",
+					slog.String("file_id", move.FileId),
+					slog.Int("index", move.Index),
+					slog.String("from_node_id", move.FromNodeId),
+					slog.String("to_node_id", move.ToNodeId),
+					slog.String("error", err.Error()))
+				continue
+			}
+
+			if moved && throttle(ctx, move.Size, x.rebalanceRate, started) != nil {
+				break
+			}
+		}
+	}
+
+	report := x.rebalance.end(func(report *service.ControllerRebalanceReport) {
+		report.FinishedAt = time.Now()
+	})
+
+	if report.Planned > 0 {
+		slog.InfoContext(ctx, "rebalancing finished",
+			slog.Int64("planned", report.Planned),
+			slog.Int64("moved", report.Moved),
+			slog.Int64("failed", report.Failed),
+			slog.Int64("skipped", report.Skipped),
+			slog.Int64("bytes", report.Bytes))
+	}
+}
+
+// planRebalance computes the usage of up nodes from the shards they hold and
+// moves shards from nodes above the mean usage by more than the threshold to
+// nodes below the mean, until the source nodes reach the mean.
+func (x *Controller) planRebalance(ctx context.Context) (*rebalancePlan, error) {
+	listNodes, err := x.infra.ListNodes(ctx, &repository.InfraListNodesIn{})
+	if err != nil {
+		return nil, err
+	}
+
+	getUsage, err := x.storage.GetNodesUsage(ctx, &repository.StorageGetNodesUsageIn{})
+	if err != nil {
+		return nil, err
+	}
+
+	used := make(map[string]int64)
+	for _, usage := range getUsage.Nodes {
+		used[usage.NodeId] = usage.Bytes
+	}
+
+	plan := &rebalancePlan{
+		files: make(map[string]*repository.StorageGetFileOut),
+	}
+
+	var usedBytes, totalBytes int64
+	for _, node := range listNodes.Nodes {
+		if node.State != repository.InfraNodeStateUp || node.Draining || node.TotalBytes <= 0 {
+			continue
+		}
+
+		plan.nodes = append(plan.nodes, &rebalanceNode{
+			node:    node,
+			initial: used[node.Id],
+			used:    used[node.Id],
+			free:    node.FreeBytes,
+		})
+		usedBytes += used[node.Id]
+		totalBytes += node.TotalBytes
+	}
+	if len(plan.nodes) < 2 {
+		return plan, nil
+	}
+
+	plan.mean = float64(usedBytes) / float64(totalBytes)
+
+	sources := slices.Clone(plan.nodes)
+	slices.SortFunc(sources, func(a, b *rebalanceNode) int {
+		return compareUsage(b, a)
+	})
+
+	for _, src := range sources {
+		if src.usage(0) <= plan.mean+x.rebalanceLimit || len(plan.moves) == rebalancePlanSize {
+			break
+		}
+		if err = x.planNodeMoves(ctx, plan, src); err != nil {
+			return nil, err
+		}
+	}
+
+	return plan, nil
+}
+
+// planNodeMoves plans moves of the node shards until its usage drops to the
+// mean.
+func (x *Controller) planNodeMoves(ctx context.Context, plan *rebalancePlan, src *rebalanceNode) error {
+	afterFileId, afterIndex := "", 0
+	for {
+		listShards, err := x.storage.ListNodeShards(ctx, &repository.StorageListNodeShardsIn{
+			NodeId:      src.node.Id,
+			AfterFileId: afterFileId,
+			AfterIndex:  afterIndex,
+			Limit:       rebalancePageSize,
+		})
+		if err != nil {
+			return err
+		}
+		if len(listShards.Shards) == 0 {
+			return nil
+		}
+
+		for _, shard := range listShards.Shards {
+			if src.usage(0) <= plan.mean || len(plan.moves) == rebalancePlanSize {
+				return nil
+			}
+			afterFileId, afterIndex = shard.FileId, shard.Index
+
+			dst, err := x.findRebalanceTarget(ctx, plan, src, shard)
+			if err != nil {
+				return err
+			}
+			if dst == nil {
+				continue
+			}
+
+			src.used -= shard.Size
+			dst.used += shard.Size
+			dst.free -= shard.Size
+			for _, fileShard := range plan.files[shard.FileId].Shards {
+				if fileShard.NodeId == src.node.Id && fileShard.Index == shard.Index {
+					fileShard.NodeId = dst.node.Id
+				}
+			}
+
+			plan.moves = append(plan.moves, &service.ControllerRebalanceMove{
+				FileId:     shard.FileId,
+				Index:      shard.Index,
+				Size:       shard.Size,
+				FromNodeId: src.node.Id,
+				ToNodeId:   dst.node.Id,
+			})
+		}
+	}
+}
+
+// findRebalanceTarget chooses the least used node below the mean for the
+// shard. The target must not hold a replica of the shard and must not end up
+// with more shards of the file than the source node had, so moves never make
+// the file less fault tolerant.
+func (x *Controller) findRebalanceTarget(ctx context.Context, plan *rebalancePlan, src *rebalanceNode, shard *repository.StorageNodeShard) (*rebalanceNode, error) {
+	file, ok := plan.files[shard.FileId]
+	if !ok {
+		getFile, err := x.storage.GetFile(ctx, &repository.StorageGetFileIn{
+			FileId: shard.FileId,
+		})
+		if err != nil && !errors.Is(err, repository.ErrResourceNotFound) {
+			return nil, err
+		}
+		file = getFile
+		plan.files[shard.FileId] = file
+	}
+	if file == nil || isFileUploading(file) {
+		return nil, nil
+	}
+
+	holding := make(map[string]int)
+	replicated := make(map[string]bool)
+	for _, fileShard := range file.Shards {
+		holding[fileShard.NodeId]++
+		if fileShard.Index == shard.Index {
+			replicated[fileShard.NodeId] = true
+		}
+	}
+
+	targets := slices.Clone(plan.nodes)
+	slices.SortFunc(targets, compareUsage)
+
+	for _, dst := range targets {
+		if dst.usage(0) >= plan.mean {
+			break
+		}
+		if dst == src || replicated[dst.node.Id] || holding[dst.node.Id] >= holding[src.node.Id] || dst.free < shard.Size {
+			continue
+		}
+		if dst.usage(shard.Size) > plan.mean+x.rebalanceLimit || dst.usage(shard.Size) > src.usage(-shard.Size) {
+			continue
+		}
+		return dst, nil
+	}
+	return nil, nil
+}
+
+func compareUsage(a, b *rebalanceNode) int {
+	switch ua, ub := a.usage(0), b.usage(0); {
+	case ua < ub:
+		return -1
+	case ua > ub:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// moveShard copies the shard to the target node and forgets the source
+// replica. It reports false when the move is no longer valid, e.g. the file
+// has changed since the plan was made.
+func (x *Controller) moveShard(ctx context.Context, move *service.ControllerRebalanceMove) (bool, error) {
+	x.replicaMu.Lock()
+	defer x.replicaMu.Unlock()
+
+	file, err := x.storage.GetFile(ctx, &repository.StorageGetFileIn{
+		FileId: move.FileId,
+	})
+	if errors.Is(err, repository.ErrResourceNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if isFileUploading(file) {
+		return false, nil
+	}
+
+	var source *repository.StorageShard
+	var others []*repository.StorageShard
+	for _, shard := range file.Shards {
+		if shard.Index != move.Index {
+			continue
+		}
+		switch {
+		case shard.NodeId == move.ToNodeId:
+			return false, nil
+		case shard.Status != repository.StorageShardStatusOK:
+		case shard.NodeId == move.FromNodeId:
+			source = shard
+		default:
+			others = append(others, shard)
+		}
+	}
+	if source == nil {
+		return false, nil
+	}
+
+	getNode, err := x.infra.GetNode(ctx, &repository.InfraGetNodeIn{
+		Id: move.ToNodeId,
+	})
+	if errors.Is(err, repository.ErrResourceNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if getNode.Node.State != repository.InfraNodeStateUp || getNode.Node.Draining {
+		return false, nil
+	}
+
+	repair := &shardRepair{
+		index:   move.Index,
+		size:    source.Size,
+		alive:   others,
+		sources: append([]*repository.StorageShard{source}, others...),
+		lost:    []*repository.StorageShard{source},
+		targets: []*repository.InfraNode{getNode.Node},
+	}
+	if err = x.restoreShards(ctx, file, []*shardRepair{repair}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
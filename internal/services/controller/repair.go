@@ -0,0 +1,468 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/fydmer/fileserver/internal/domain/repository"
+	"github.com/fydmer/fileserver/internal/domain/service"
+	"github.com/fydmer/fileserver/pkg/nodecli"
+)
+
+const (
+	repairPageSize = 100
+	// staleUploadAfter is the age of a shard stuck in upload after which
+	// the upload is considered dead and the shard lost.
+	staleUploadAfter = 24 * time.Hour
+)
+
+// shardRepair is a shard with fewer healthy replicas than configured, the
+// missing replicas are copied from sources to targets. Sources are the alive
+// replicas and the ones on draining nodes.
+type shardRepair struct {
+	index   int
+	size    int64
+	alive   []*repository.StorageShard
+	sources []*repository.StorageShard
+	lost    []*repository.StorageShard
+	targets []*repository.InfraNode
+}
+
+// RunRepair restores lost shard replicas every repair interval and when
+// asked by StartRepair, until ctx is done.
+func (x *Controller) RunRepair(ctx context.Context) {
+	x.repair.run(ctx, x.repairInterval, x.repairFiles)
+}
+
+func (x *Controller) GetRepairStatus(_ context.Context, _ *service.ControllerGetRepairStatusIn) (*service.ControllerGetRepairStatusOut, error) {
+	current, last := x.repair.status()
+	return &service.ControllerGetRepairStatusOut{
+		Running: current != nil,
+		Current: current,
+		Last:    last,
+	}, nil
+}
+
+func (x *Controller) StartRepair(_ context.Context, _ *service.ControllerStartRepairIn) (*service.ControllerStartRepairOut, error) {
+	return &service.ControllerStartRepairOut{
+		Started: x.repair.start(),
+	}, nil
+}
+
+func (x *Controller) repairFiles(ctx context.Context) {
+	x.repair.begin(&service.ControllerRepairReport{StartedAt: time.Now()})
+
+	listNodes, err := x.infra.ListNodes(ctx, &repository.InfraListNodesIn{})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to list nodes", slog.String("error", err.Error()))
+	}
+
+	nodes := make(map[string]*repository.InfraNode)
+	if listNodes != nil {
+		for _, node := range listNodes.Nodes {
+			nodes[node.Id] = node
+		}
+	}
+
+	afterId := ""
+	for ctx.Err() == nil && len(nodes) > 0 {
+		listFiles, err := x.storage.ListFiles(ctx, &repository.StorageListFilesIn{
+			AfterId: afterId,
+			Limit:   repairPageSize,
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to list files", slog.String("error", err.Error()))
+			break
+		}
+		if len(listFiles.Ids) == 0 {
+			break
+		}
+
+		for _, fileId := range listFiles.Ids {
+			afterId = fileId
+			if err = x.repairFile(ctx, fileId, nodes); err != nil {
+				slog.ErrorContext(ctx, "failed to repair file",
+					slog.String("file_id", fileId),
+					slog.String("error", err.Error()))
+			}
+		}
+	}
+
+	for _, node := range nodes {
+		if !node.Draining || ctx.Err() != nil {
+			continue
+		}
+		if _, _, err = x.removeDrainedNode(ctx, node.Id); err != nil {
+			slog.ErrorContext(ctx, "failed to remove drained node",
+				slog.String("node_id", node.Id),
+				slog.String("error", err.Error()))
+		}
+	}
+
+	report := x.repair.end(func(report *service.ControllerRepairReport) {
+		report.FinishedAt = time.Now()
+	})
+
+	if report.Degraded > 0 {
+		slog.InfoContext(ctx, "repair finished",
+			slog.Int64("files", report.Files),
+			slog.Int64("degraded", report.Degraded),
+			slog.Int64("repaired", report.Repaired),
+			slog.Int64("failed", report.Failed))
+	}
+}
+
+// repairFile brings every shard of the file back to the configured number
+// of healthy replicas, copying a surviving replica or reconstructing the
+// shard from the others for erasure coded files.
+func (x *Controller) repairFile(ctx context.Context, fileId string, nodes map[string]*repository.InfraNode) error {
+	x.replicaMu.Lock()
+	defer x.replicaMu.Unlock()
+
+	file, err := x.storage.GetFile(ctx, &repository.StorageGetFileIn{
+		FileId: fileId,
+	})
+	if errors.Is(err, repository.ErrResourceNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	x.repair.update(func(report *service.ControllerRepairReport) {
+		report.Files++
+	})
+
+	if isFileUploading(file) {
+		return nil
+	}
+
+	repairs, forget := x.findShardRepairs(file, nodes)
+	for _, shard := range forget {
+		x.forgetReplica(ctx, file.Id, shard)
+	}
+	if len(repairs) == 0 {
+		return nil
+	}
+
+	x.repair.update(func(report *service.ControllerRepairReport) {
+		report.Degraded++
+	})
+
+	if file.ParityShards == 0 {
+		// a part of a plain file without replicas is gone for good
+		recoverable := slices.DeleteFunc(slices.Clone(repairs), func(repair *shardRepair) bool {
+			return len(repair.sources) == 0
+		})
+		if lost := len(repairs) - len(recoverable); lost > 0 {
+			x.repair.update(func(report *service.ControllerRepairReport) {
+				report.Failed += int64(lost)
+			})
+			err = fmt.Errorf("%d parts have no healthy replicas", lost)
+		}
+		repairs = recoverable
+	}
+	if len(repairs) == 0 {
+		return err
+	}
+
+	placed, placeErr := x.placeShardRepairs(ctx, file, repairs, len(nodes))
+	if placeErr == nil && len(placed) < len(repairs) {
+		placeErr = fmt.Errorf("%w: no nodes to restore %d shards", repository.ErrInsufficientStorage, len(repairs)-len(placed))
+	}
+	err = errors.Join(err, placeErr)
+	if len(placed) == 0 {
+		return err
+	}
+
+	if restoreErr := x.restoreShards(ctx, file, placed); restoreErr != nil {
+		x.repair.update(func(report *service.ControllerRepairReport) {
+			report.Failed += int64(len(placed))
+		})
+		return errors.Join(err, restoreErr)
+	}
+
+	x.repair.update(func(report *service.ControllerRepairReport) {
+		for _, repair := range placed {
+			report.Repaired += int64(len(repair.targets))
+			report.Bytes += repair.size * int64(len(repair.targets))
+		}
+	})
+	return err
+}
+
+// isFileUploading reports whether some shards of the file are being written,
+// shards stuck for staleUploadAfter do not count.
+func isFileUploading(file *repository.StorageGetFileOut) bool {
+	for _, shard := range file.Shards {
+		if (shard.Status == repository.StorageShardStatusNew || shard.Status == repository.StorageShardStatusInProgress) &&
+			time.Since(shard.CreatedAt) < staleUploadAfter {
+			return true
+		}
+	}
+	return false
+}
+
+// findShardRepairs returns shards lacking healthy replicas and the lost
+// replicas of other shards, which can be forgotten right away.
+func (x *Controller) findShardRepairs(file *repository.StorageGetFileOut, nodes map[string]*repository.InfraNode) ([]*shardRepair, []*repository.StorageShard) {
+	// parts of plain files are not always split evenly, resumable uploads
+	// store chunks of a fixed size, so the recorded sizes are used
+	sizes := make([]int64, file.DataShards)
+	for _, shard := range file.Shards {
+		if shard.Index < len(sizes) {
+			sizes[shard.Index] = shard.Size
+		}
+	}
+	if file.ParityShards > 0 {
+		sizes = calculateErasureParts(file.Size, file.DataShards, file.ParityShards, file.BlockSize)
+	}
+
+	groups := make([][]*repository.StorageShard, len(sizes))
+	for _, shard := range file.Shards {
+		if shard.Index < len(groups) {
+			groups[shard.Index] = append(groups[shard.Index], shard)
+		}
+	}
+
+	var repairs []*shardRepair
+	var forget []*repository.StorageShard
+	for index, replicas := range groups {
+		repair := &shardRepair{index: index, size: sizes[index]}
+		var draining []*repository.StorageShard
+		for _, shard := range replicas {
+			switch {
+			case x.isReplicaLost(shard, nodes):
+				repair.lost = append(repair.lost, shard)
+			case nodes[shard.NodeId].Draining:
+				// the replica is healthy but has to be moved away
+				repair.lost = append(repair.lost, shard)
+				draining = append(draining, shard)
+			default:
+				repair.alive = append(repair.alive, shard)
+			}
+		}
+		repair.sources = append(slices.Clone(repair.alive), draining...)
+
+		if len(repair.alive) < x.fileReplicas(file) {
+			repairs = append(repairs, repair)
+		} else {
+			forget = append(forget, repair.lost...)
+		}
+	}
+	return repairs, forget
+}
+
+// isReplicaLost reports whether the replica can not come back by itself.
+// Replicas on nodes that are down for a short time are not lost yet.
+func (x *Controller) isReplicaLost(shard *repository.StorageShard, nodes map[string]*repository.InfraNode) bool {
+	if shard.Status != repository.StorageShardStatusOK {
+		return true
+	}
+
+	node, ok := nodes[shard.NodeId]
+	if !ok {
+		return true
+	}
+	return node.State == repository.InfraNodeStateDown && time.Since(node.LastSeen) > x.repairDelay
+}
+
+// placeShardRepairs chooses target nodes for missing replicas among the
+// freer nodes, nodes without other shards of the file go first. Repairs
+// without any target are left out.
+func (x *Controller) placeShardRepairs(ctx context.Context, file *repository.StorageGetFileOut, repairs []*shardRepair, nodesCount int) ([]*shardRepair, error) {
+	minSize := repairs[0].size
+	for _, repair := range repairs {
+		minSize = min(minSize, repair.size)
+	}
+
+	freerNodes, err := x.infra.GetFreerNodes(ctx, &repository.InfraGetFreerNodesIn{
+		Count:        nodesCount,
+		MinFreeBytes: minSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	holding := make(map[string]map[int]bool)
+	for _, shard := range file.Shards {
+		if holding[shard.NodeId] == nil {
+			holding[shard.NodeId] = make(map[int]bool)
+		}
+		holding[shard.NodeId][shard.Index] = true
+	}
+
+	planned := make(map[string]int64)
+	var placed []*shardRepair
+	for _, repair := range repairs {
+		candidates := slices.Clone(freerNodes.Nodes)
+		slices.SortStableFunc(candidates, func(a, b *repository.InfraNode) int {
+			return len(holding[a.Id]) - len(holding[b.Id])
+		})
+
+		for _, node := range candidates {
+			if len(repair.alive)+len(repair.targets) == x.fileReplicas(file) {
+				break
+			}
+			if holding[node.Id][repair.index] || node.FreeBytes-planned[node.Id] < repair.size {
+				continue
+			}
+
+			repair.targets = append(repair.targets, node)
+			planned[node.Id] += repair.size
+			if holding[node.Id] == nil {
+				holding[node.Id] = make(map[int]bool)
+			}
+			holding[node.Id][repair.index] = true
+		}
+
+		if len(repair.targets) > 0 {
+			placed = append(placed, repair)
+		}
+	}
+	return placed, nil
+}
+
+// restoreShards writes the missing replicas, then forgets the lost ones. The
+// caller holds replicaMu.
+func (x *Controller) restoreShards(ctx context.Context, file *repository.StorageGetFileOut, repairs []*shardRepair) error {
+	var rollback []func(ctx context.Context)
+	sem := make(chan struct{}, x.concurrency)
+	uploads := make([]*shardUpload, 0, len(repairs))
+	for _, repair := range repairs {
+		filename := fmt.Sprintf("%s.%d", file.Id, repair.index)
+
+		var nodeClients []*nodecli.Client
+		var statuses []*shardStatusUpdater
+		for _, node := range repair.targets {
+			nodeClient, err := x.getNodeClient(ctx, node)
+			if err != nil {
+				return errWithRollback(finishShardUploads(ctx, uploads, err), rollback)
+			}
+
+			if _, err = x.storage.AddShard(ctx, &repository.StorageAddShardIn{
+				FileId: file.Id,
+				NodeId: node.Id,
+				Index:  repair.index,
+				Size:   repair.size,
+			}); err != nil {
+				return errWithRollback(finishShardUploads(ctx, uploads, err), rollback)
+			}
+
+			rollback = append(rollback, func(ctx context.Context) {
+				if _, err := x.storage.DeleteShard(ctx, &repository.StorageDeleteShardIn{
+					FileId: file.Id,
+					NodeId: node.Id,
+					Index:  repair.index,
+				}); err != nil {
+					slog.Error("error to clean wrong shard record", slog.String("error", err.Error()))
+				}
+				if err := nodeClient.DeleteFile(ctx, filename); err != nil {
+					slog.Error("error to clean wrong file data", slog.String("error", err.Error()))
+				}
+			})
+
+			st := newShardStatusUpdater(x.storage, file.Id, node.Id, repair.index)
+			if err = st.setInProgress(ctx); err != nil {
+				return errWithRollback(finishShardUploads(ctx, uploads, err), rollback)
+			}
+
+			nodeClients = append(nodeClients, nodeClient)
+			statuses = append(statuses, st)
+		}
+
+		upload := x.startShardUpload(ctx, sem, nodeClients, statuses, filename, repair.size)
+		for _, shard := range append(slices.Clone(repair.sources), repair.lost...) {
+			if shard.Checksum != "" {
+				upload.expected = shard.Checksum
+				break
+			}
+		}
+		uploads = append(uploads, upload)
+	}
+
+	// shards are copied when possible, the rest is rebuilt from the other
+	// shards of an erasure coded file in a single pass
+	var err error
+	var rebuild []int
+	for i, repair := range repairs {
+		if len(repair.sources) == 0 {
+			rebuild = append(rebuild, i)
+			continue
+		}
+		if err = x.downloadShard(ctx, file.Id, repair.sources, 0, repair.size, uploads[i]); err != nil {
+			break
+		}
+	}
+
+	if err == nil && len(rebuild) > 0 {
+		stripes := repairs[rebuild[0]].size / int64(file.BlockSize)
+		err = x.readStripes(ctx, file, 0, stripes-1, true, func(_ int64, blocks [][]byte) error {
+			for _, i := range rebuild {
+				if _, err := uploads[i].Write(blocks[repairs[i].index]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	if err = finishShardUploads(ctx, uploads, err); err != nil {
+		return errWithRollback(err, rollback)
+	}
+
+	for _, repair := range repairs {
+		for _, shard := range repair.lost {
+			x.forgetReplica(ctx, file.Id, shard)
+		}
+	}
+	return nil
+}
+
+// forgetReplica drops the replica record, downloads in progress may still
+// read its data, so the cleaner removes it after the replaced file delay.
+func (x *Controller) forgetReplica(ctx context.Context, fileId string, shard *repository.StorageShard) {
+	if _, err := x.storage.DropShard(ctx, &repository.StorageDropShardIn{
+		FileId: fileId,
+		NodeId: shard.NodeId,
+		Index:  shard.Index,
+		Delay:  x.replacedFileDelay,
+	}); err != nil {
+		slog.ErrorContext(ctx, "failed to drop lost shard record", slog.String("error", err.Error()))
+	}
+}
+
+// removeDrainedNode deletes the draining node once no shards are left on it
+// and the dropped ones are not read anymore, it returns the number of shards
+// left otherwise.
+func (x *Controller) removeDrainedNode(ctx context.Context, nodeId string) (bool, int64, error) {
+	countShards, err := x.storage.CountNodeShards(ctx, &repository.StorageCountNodeShardsIn{
+		NodeId: nodeId,
+	})
+	if err != nil {
+		return false, 0, err
+	}
+	if countShards.Count > 0 || countShards.Dropped > 0 {
+		return false, countShards.Count, nil
+	}
+
+	if _, err = x.infra.DeleteNode(ctx, &repository.InfraDeleteNodeIn{
+		Id: nodeId,
+	}); err != nil {
+		return false, 0, err
+	}
+
+	x.nodeClients.mu.Lock()
+	if cli, ok := x.nodeClients.dict[nodeId]; ok {
+		_ = cli.Close()
+		delete(x.nodeClients.dict, nodeId)
+	}
+	x.nodeClients.mu.Unlock()
+
+	slog.InfoContext(ctx, "drained node is removed", slog.String("node_id", nodeId))
+	return true, 0, nil
+}
@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/fydmer/fileserver/internal/domain/repository"
+	"github.com/fydmer/fileserver/internal/errors/nodeerr"
+)
+
+const (
+	defaultReplacedFileDelay = time.Minute
+	replacedCleanupInterval  = 30 * time.Second
+	replacedCleanupBatch     = 100
+)
+
+// checkConditions fails with ErrPreconditionFailed when the conditions don't
+// hold for the latest file at the location.
+func (x *Controller) checkConditions(ctx context.Context, bucket *repository.StorageBucket, location string,
+	conditions repository.StorageFileConditions) error {
+	if len(conditions.IfMatch) == 0 && len(conditions.IfNoneMatch) == 0 {
+		return nil
+	}
+
+	file, err := x.storage.GetFileByLocation(ctx, &repository.StorageGetFileByLocationIn{
+		BucketId: bucket.Id,
+		Location: location,
+	})
+	if err != nil && !errors.Is(err, repository.ErrResourceNotFound) {
+		return err
+	}
+
+	checksum := ""
+	if file != nil {
+		checksum = file.Checksum
+	}
+	if !conditions.Match(file != nil, checksum) {
+		return fmt.Errorf("%w: the file at %s doesn't match the conditions", repository.ErrPreconditionFailed, location)
+	}
+	return nil
+}
+
+// RunReplacedCleaner removes files replaced by another upload with their
+// shards and the data of dropped replicas until ctx is done.
+func (x *Controller) RunReplacedCleaner(ctx context.Context) {
+	ticker := time.NewTicker(replacedCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		x.removeReplacedFiles(ctx)
+		x.removeDroppedShards(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (x *Controller) removeReplacedFiles(ctx context.Context) {
+	listReplacedFiles, err := x.storage.ListReplacedFiles(ctx, &repository.StorageListReplacedFilesIn{
+		Delay: x.replacedFileDelay,
+		Limit: replacedCleanupBatch,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to list replaced files", slog.String("error", err.Error()))
+		return
+	}
+
+	for _, id := range listReplacedFiles.Ids {
+		file, err := x.storage.GetFile(ctx, &repository.StorageGetFileIn{
+			FileId: id,
+		})
+		if err == nil {
+			err = x.removeFile(ctx, file)
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to remove replaced file",
+				slog.String("file_id", id),
+				slog.String("error", err.Error()))
+			continue
+		}
+		slog.InfoContext(ctx, "replaced file is removed",
+			slog.String("file_id", id),
+			slog.String("location", file.Location))
+	}
+}
+
+// removeDroppedShards deletes the data of dropped replicas from up nodes, the
+// replicas of nodes down now wait for them.
+func (x *Controller) removeDroppedShards(ctx context.Context) {
+	listNodes, err := x.infra.ListNodes(ctx, &repository.InfraListNodesIn{})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to list nodes", slog.String("error", err.Error()))
+		return
+	}
+
+	nodes := make(map[string]*repository.InfraNode)
+	var nodeIds []string
+	for _, node := range listNodes.Nodes {
+		if node.State == repository.InfraNodeStateUp {
+			nodes[node.Id] = node
+			nodeIds = append(nodeIds, node.Id)
+		}
+	}
+	if len(nodeIds) == 0 {
+		return
+	}
+
+	// a replica added again by repair or rebalancing is not dropped anymore
+	x.replicaMu.Lock()
+	defer x.replicaMu.Unlock()
+
+	listDroppedShards, err := x.storage.ListDroppedShards(ctx, &repository.StorageListDroppedShardsIn{
+		NodeIds: nodeIds,
+		Limit:   replacedCleanupBatch,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to list dropped shards", slog.String("error", err.Error()))
+		return
+	}
+
+	for _, shard := range listDroppedShards.Shards {
+		filename := fmt.Sprintf("%s.%d", shard.FileId, shard.Index)
+
+		cli, err := x.getNodeClient(ctx, nodes[shard.NodeId])
+		if err == nil {
+			err = nodeerr.Parse(cli.DeleteFile(ctx, filename))
+		}
+		if err == nil || errors.Is(err, repository.ErrResourceNotFound) {
+			_, err = x.storage.DeleteDroppedShard(ctx, &repository.StorageDeleteDroppedShardIn{
+				FileId: shard.FileId,
+				NodeId: shard.NodeId,
+				Index:  shard.Index,
+			})
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "failed to remove dropped shard",
+				slog.String("node_id", shard.NodeId),
+				slog.String("filename", filename),
+				slog.String("error", err.Error()))
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/fydmer/fileserver/internal/domain/repository"
+	"github.com/fydmer/fileserver/internal/domain/service"
+	"github.com/fydmer/fileserver/pkg/nodecli"
+)
+
+const scrubPageSize = 100
+
+// RunScrubber verifies all the stored shards every scrub interval and when
+// asked by StartScrub, until ctx is done.
+func (x *Controller) RunScrubber(ctx context.Context) {
+	x.scrub.run(ctx, x.scrubInterval, x.scrubFiles)
+}
+
+func (x *Controller) GetScrubStatus(_ context.Context, _ *service.ControllerGetScrubStatusIn) (*service.ControllerGetScrubStatusOut, error) {
+	current, last := x.scrub.status()
+	return &service.ControllerGetScrubStatusOut{
+		Running: current != nil,
+		Current: current,
+		Last:    last,
+	}, nil
+}
+
+func (x *Controller) StartScrub(_ context.Context, _ *service.ControllerStartScrubIn) (*service.ControllerStartScrubOut, error) {
+	return &service.ControllerStartScrubOut{
+		Started: x.scrub.start(),
+	}, nil
+}
+
+func (x *Controller) scrubFiles(ctx context.Context) {
+	x.scrub.begin(&service.ControllerScrubReport{StartedAt: time.Now()})
+
+	slog.InfoContext(ctx, "scrubbing started")
+
+	afterId := ""
+	for ctx.Err() == nil {
+		listFiles, err := x.storage.ListFiles(ctx, &repository.StorageListFilesIn{
+			AfterId: afterId,
+			Limit:   scrubPageSize,
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to list files", slog.String("error", err.Error()))
+			break
+		}
+		if len(listFiles.Ids) == 0 {
+			break
+		}
+
+		for _, fileId := range listFiles.Ids {
+			afterId = fileId
+			if err = x.scrubFile(ctx, fileId); err != nil {
+				slog.ErrorContext(ctx, "failed to scrub file",
+					slog.String("file_id", fileId),
+					slog.String("error", err.Error()))
+			}
+		}
+	}
+
+	report := x.scrub.end(func(report *service.ControllerScrubReport) {
+		report.FinishedAt = time.Now()
+	})
+
+	slog.InfoContext(ctx, "scrubbing finished",
+		slog.Int64("files", report.Files),
+		slog.Int64("shards", report.Shards),
+		slog.Int64("verified", report.Verified),
+		slog.Int64("corrupted", report.Corrupted),
+		slog.Int64("missing", report.Missing),
+		slog.Int64("skipped", report.Skipped))
+}
+
+func (x *Controller) scrubFile(ctx context.Context, fileId string) error {
+	file, err := x.storage.GetFile(ctx, &repository.StorageGetFileIn{
+		FileId: fileId,
+	})
+	if errors.Is(err, repository.ErrResourceNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	x.scrub.update(func(report *service.ControllerScrubReport) {
+		report.Files++
+	})
+
+	for _, shard := range file.Shards {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err = x.scrubShard(ctx, fileId, shard); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scrubShard asks the node to hash the shard and marks the shard as failed
+// when the data is missing or does not match the checksum. Reads are paced
+// to keep the node disks below scrubRate.
+func (x *Controller) scrubShard(ctx context.Context, fileId string, shard *repository.StorageShard) error {
+	x.scrub.update(func(report *service.ControllerScrubReport) {
+		report.Shards++
+	})
+
+	skip := func() error {
+		x.scrub.update(func(report *service.ControllerScrubReport) {
+			report.Skipped++
+		})
+		return nil
+	}
+
+	if shard.Status != repository.StorageShardStatusOK || shard.Checksum == "" {
+		return skip()
+	}
+
+	getNode, err := x.infra.GetNode(ctx, &repository.InfraGetNodeIn{
+		Id: shard.NodeId,
+	})
+	if err != nil {
+		return err
+	}
+	if getNode.Node.State != repository.InfraNodeStateUp {
+		return skip()
+	}
+
+	cli, err := x.getNodeClient(ctx, getNode.Node)
+	if err != nil {
+		return err
+	}
+
+	filename := fmt.Sprintf("%s.%d", fileId, shard.Index)
+	started := time.Now()
+
+	hash, err := cli.HashFile(ctx, filename)
+	switch {
+	case errors.Is(err, nodecli.ErrFileNotFound):
+		slog.ErrorContext(ctx, "shard is missing",
+			slog.String("file", filename),
+			slog.String("node_id", shard.NodeId))
+		x.scrub.update(func(report *service.ControllerScrubReport) {
+			report.Missing++
+		})
+		return newShardStatusUpdater(x.storage, fileId, shard.NodeId, shard.Index).setError(ctx)
+	case err != nil:
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		slog.WarnContext(ctx, "failed to hash shard",
+			slog.String("file", filename),
+			slog.String("node_id", shard.NodeId),
+			slog.String("error", err.Error()))
+		return skip()
+	}
+
+	x.scrub.update(func(report *service.ControllerScrubReport) {
+		report.Bytes += hash.Size
+	})
+
+	if hash.Size != shard.Size || hash.Checksum != shard.Checksum {
+		slog.ErrorContext(ctx, "shard is corrupted",
+			slog.String("file", filename),
+			slog.String("node_id", shard.NodeId),
+			slog.Int64("size", hash.Size),
+			slog.String("checksum", hash.Checksum))
+		x.scrub.update(func(report *service.ControllerScrubReport) {
+			report.Corrupted++
+		})
+		if err = newShardStatusUpdater(x.storage, fileId, shard.NodeId, shard.Index).setError(ctx); err != nil {
+			return err
+		}
+	} else {
+		x.scrub.update(func(report *service.ControllerScrubReport) {
+			report.Verified++
+		})
+	}
+
+	return throttle(ctx, hash.Size, x.scrubRate, started)
+}
@@ -0,0 +1,660 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/fydmer/fileserver/internal/domain/repository"
+	"github.com/fydmer/fileserver/internal/domain/service"
+	"github.com/fydmer/fileserver/pkg/nodecli"
+)
+
+const (
+	defaultUploadChunkSize = 64 * 1024 * 1024
+	defaultUploadExpiry    = 24 * time.Hour
+	uploadCleanupInterval  = 10 * time.Minute
+	uploadCleanupBatch     = 100
+	maxUploadParts         = 10000
+)
+
+// CreateUpload places the chunks of a resumable upload on nodes. Every chunk
+// is stored as a shard of a plain file as soon as it is received, erasure
+// coding needs the whole file at once. Parts of a multipart upload are
+// placed when they are received.
+func (x *Controller) CreateUpload(ctx context.Context, in *service.ControllerCreateUploadIn) (*service.ControllerCreateUploadOut, error) {
+	if err := checkFileLocation(in.Location); err != nil {
+		return nil, err
+	}
+	if in.Size < 0 {
+		return nil, fmt.Errorf("%w: negative file size %d", repository.ErrBadRequest, in.Size)
+	}
+
+	bucket, err := x.getBucket(ctx, in.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	replicas := x.bucketReplicas(bucket)
+
+	var parts []int64
+	if !in.Multipart {
+		parts = calculateUploadParts(in.Size, x.uploadChunkSize)
+	}
+
+	var shards []*repository.StorageCreateShard
+	if len(parts) > 0 {
+		freerNodes, err := x.infra.GetFreerNodes(ctx, &repository.InfraGetFreerNodesIn{
+			Count:        len(parts) * replicas,
+			MinFreeBytes: slices.Max(parts),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(freerNodes.Nodes) < replicas {
+			return nil, fmt.Errorf("%w: %d nodes have room for %d replicas of %d bytes",
+				repository.ErrInsufficientStorage, len(freerNodes.Nodes), replicas, slices.Max(parts))
+		}
+
+		slices.Reverse(freerNodes.Nodes)
+
+		placement := placeShards(freerNodes.Nodes, len(parts), replicas)
+		if err = checkCapacity(placement, parts); err != nil {
+			return nil, err
+		}
+
+		for index, nodes := range placement {
+			for _, node := range nodes {
+				shards = append(shards, &repository.StorageCreateShard{
+					NodeId: node.Id,
+					Index:  index,
+					Size:   parts[index],
+				})
+			}
+		}
+	}
+
+	createUpload, err := x.storage.CreateUpload(ctx, &repository.StorageCreateUploadIn{
+		BucketId:  bucket.Id,
+		Location:  in.Location,
+		Owner:     in.Owner,
+		Size:      in.Size,
+		ChunkSize: x.uploadChunkSize,
+		Multipart: in.Multipart,
+		Expiry:    x.uploadExpiry,
+		Replicas:  replicas,
+		Versioned: bucket.Versioning,
+		Replace:   in.Replace,
+		Shards:    shards,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	getUpload, err := x.GetUpload(ctx, &service.ControllerGetUploadIn{
+		Id: createUpload.Id,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &service.ControllerCreateUploadOut{
+		Upload: getUpload.Upload,
+	}, nil
+}
+
+func (x *Controller) GetUpload(ctx context.Context, in *service.ControllerGetUploadIn) (*service.ControllerGetUploadOut, error) {
+	upload, err := x.storage.GetUpload(ctx, &repository.StorageGetUploadIn{
+		Id: in.Id,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &service.ControllerGetUploadOut{
+		Upload: uploadInfo(upload),
+	}, nil
+}
+
+// UploadChunk stores the chunks one by one, the stored ones are kept when a
+// later chunk fails and the upload is continued after them.
+func (x *Controller) UploadChunk(ctx context.Context, in *service.ControllerUploadChunkIn) (*service.ControllerUploadChunkOut, error) {
+	if _, busy := x.activeUploads.LoadOrStore(in.Id, struct{}{}); busy {
+		return nil, fmt.Errorf("%w: another chunk of the upload is being written", repository.ErrConflict)
+	}
+	defer x.activeUploads.Delete(in.Id)
+
+	upload, err := x.storage.GetUpload(ctx, &repository.StorageGetUploadIn{
+		Id: in.Id,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if upload.Multipart {
+		return nil, fmt.Errorf("%w: multipart upload is written by parts", repository.ErrBadRequest)
+	}
+
+	end := in.Offset + in.Size
+	if in.Offset != upload.Uploaded {
+		return nil, fmt.Errorf("%w: upload is at %d bytes, the chunk starts at %d", repository.ErrConflict, upload.Uploaded, in.Offset)
+	}
+	if in.Size <= 0 || end > upload.Size || (end != upload.Size && in.Size%upload.ChunkSize != 0) {
+		return nil, fmt.Errorf("%w: chunk of %d bytes must be a multiple of %d bytes or end the file of %d bytes",
+			repository.ErrBadRequest, in.Size, upload.ChunkSize, upload.Size)
+	}
+
+	fileHash := sha256.New()
+	if len(upload.HashState) > 0 {
+		if err = fileHash.(encoding.BinaryUnmarshaler).UnmarshalBinary(upload.HashState); err != nil {
+			return nil, err
+		}
+	}
+
+	listNodes, err := x.infra.ListNodes(ctx, &repository.InfraListNodesIn{})
+	if err != nil {
+		return nil, err
+	}
+
+	// a received shard is stored even when the client goes away right after it
+	storeCtx := context.WithoutCancel(ctx)
+	for upload.Uploaded < end {
+		index := int(upload.Uploaded / upload.ChunkSize)
+		if err = x.storeUploadShard(storeCtx, upload, index, listNodes.Nodes, in.Content, fileHash); err != nil {
+			return nil, err
+		}
+	}
+
+	return &service.ControllerUploadChunkOut{
+		Upload: uploadInfo(upload),
+	}, nil
+}
+
+// storeUploadShard writes the shard to all its replicas and records it, the
+// upload is moved to the end of the shard.
+func (x *Controller) storeUploadShard(ctx context.Context, upload *repository.StorageGetUploadOut, index int, nodes []*repository.InfraNode, src io.Reader, fileHash hash.Hash) error {
+	var size int64
+	var clients []*nodecli.Client
+	for _, shard := range upload.Shards {
+		if shard.Index != index {
+			continue
+		}
+
+		i := slices.IndexFunc(nodes, func(node *repository.InfraNode) bool { return node.Id == shard.NodeId })
+		if i < 0 {
+			return fmt.Errorf("%w: node %s of shard %d is removed", repository.ErrUnavailable, shard.NodeId, index)
+		}
+
+		cli, err := x.getNodeClient(ctx, nodes[i])
+		if err != nil {
+			return err
+		}
+		size, clients = shard.Size, append(clients, cli)
+	}
+	if len(clients) == 0 {
+		return fmt.Errorf("%w: shard %d of the upload has no replicas", repository.ErrUnavailable, index)
+	}
+
+	shardHash := sha256.New()
+	content := io.TeeReader(&exactReader{r: src, n: size}, io.MultiWriter(shardHash, fileHash))
+	if err := saveReplicas(ctx, clients, fmt.Sprintf("%s.%d", upload.FileId, index), content, size); err != nil {
+		return err
+	}
+
+	hashState, err := fileHash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	if _, err = x.storage.SetUploadProgress(ctx, &repository.StorageSetUploadProgressIn{
+		Id:        upload.Id,
+		From:      upload.Uploaded,
+		To:        upload.Uploaded + size,
+		HashState: hashState,
+		Index:     index,
+		Checksum:  hex.EncodeToString(shardHash.Sum(nil)),
+		Expiry:    x.uploadExpiry,
+	}); err != nil {
+		return err
+	}
+
+	upload.Uploaded += size
+	upload.HashState = hashState
+	return nil
+}
+
+// UploadPart stores the part as a shard of the file, its replicas are put on
+// the freest nodes.
+func (x *Controller) UploadPart(ctx context.Context, in *service.ControllerUploadPartIn) (*service.ControllerUploadPartOut, error) {
+	if in.Number < 1 || in.Number > maxUploadParts {
+		return nil, fmt.Errorf("%w: part number %d is out of 1-%d", repository.ErrBadRequest, in.Number, maxUploadParts)
+	}
+	if in.Size < 0 {
+		return nil, fmt.Errorf("%w: negative part size %d", repository.ErrBadRequest, in.Size)
+	}
+
+	partKey := fmt.Sprintf("%s/%d", in.Id, in.Number)
+	if _, busy := x.activeUploads.LoadOrStore(partKey, struct{}{}); busy {
+		return nil, fmt.Errorf("%w: part %d of the upload is being written", repository.ErrConflict, in.Number)
+	}
+	defer x.activeUploads.Delete(partKey)
+
+	upload, err := x.storage.GetUpload(ctx, &repository.StorageGetUploadIn{
+		Id: in.Id,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !upload.Multipart {
+		return nil, fmt.Errorf("%w: upload is written by chunks", repository.ErrBadRequest)
+	}
+
+	replicas := upload.Replicas
+	if replicas == 0 {
+		replicas = x.replicas
+	}
+
+	freerNodes, err := x.infra.GetFreerNodes(ctx, &repository.InfraGetFreerNodesIn{
+		Count:        replicas,
+		MinFreeBytes: in.Size,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(freerNodes.Nodes) < replicas {
+		return nil, fmt.Errorf("%w: %d nodes have room for %d replicas of %d bytes",
+			repository.ErrInsufficientStorage, len(freerNodes.Nodes), replicas, in.Size)
+	}
+
+	clients := make([]*nodecli.Client, 0, len(freerNodes.Nodes))
+	for _, node := range freerNodes.Nodes {
+		cli, err := x.getNodeClient(ctx, node)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, cli)
+	}
+
+	index := in.Number - 1
+	partHash := sha256.New()
+	content := io.TeeReader(&exactReader{r: in.Content, n: in.Size}, partHash)
+	if err = saveReplicas(ctx, clients, fmt.Sprintf("%s.%d", upload.FileId, index), content, in.Size); err != nil {
+		return nil, err
+	}
+	checksum := hex.EncodeToString(partHash.Sum(nil))
+
+	shards := make([]*repository.StorageUploadShard, 0, len(freerNodes.Nodes))
+	for _, node := range freerNodes.Nodes {
+		shards = append(shards, &repository.StorageUploadShard{
+			NodeId:   node.Id,
+			Index:    index,
+			Size:     in.Size,
+			Checksum: checksum,
+		})
+	}
+
+	setUploadPart, err := x.storage.SetUploadPart(ctx, &repository.StorageSetUploadPartIn{
+		Id:     upload.Id,
+		Index:  index,
+		Shards: shards,
+		Expiry: x.uploadExpiry,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// replicas on the same nodes are already overwritten by the new part
+	replaced := slices.DeleteFunc(setUploadPart.Replaced, func(shard *repository.StorageUploadShard) bool {
+		return slices.ContainsFunc(shards, func(s *repository.StorageUploadShard) bool { return s.NodeId == shard.NodeId })
+	})
+	x.deleteUploadShards(ctx, upload, replaced)
+
+	return &service.ControllerUploadPartOut{
+		Checksum: checksum,
+	}, nil
+}
+
+// CompleteUpload turns the fully stored upload into a file at once.
+func (x *Controller) CompleteUpload(ctx context.Context, in *service.ControllerCompleteUploadIn) (*service.ControllerCompleteUploadOut, error) {
+	upload, err := x.storage.GetUpload(ctx, &repository.StorageGetUploadIn{
+		Id: in.Id,
+	})
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := x.getBucket(ctx, upload.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if upload.Multipart {
+		return x.completeMultipartUpload(ctx, upload, bucket, in.Parts)
+	}
+	if upload.Uploaded != upload.Size {
+		return nil, fmt.Errorf("%w: %d of %d bytes are uploaded", repository.ErrConflict, upload.Uploaded, upload.Size)
+	}
+
+	fileHash := sha256.New()
+	if len(upload.HashState) > 0 {
+		if err = fileHash.(encoding.BinaryUnmarshaler).UnmarshalBinary(upload.HashState); err != nil {
+			return nil, err
+		}
+	}
+
+	completeUpload, err := x.storage.CompleteUpload(ctx, &repository.StorageCompleteUploadIn{
+		Id:        upload.Id,
+		Checksum:  hex.EncodeToString(fileHash.Sum(nil)),
+		Versioned: bucket.Versioning,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &service.ControllerCompleteUploadOut{
+		Id:       completeUpload.FileId,
+		Version:  completeUpload.VersionId,
+		Size:     upload.Size,
+		Checksum: hex.EncodeToString(fileHash.Sum(nil)),
+	}, nil
+}
+
+// completeMultipartUpload makes the file of the listed parts. The parts are
+// read to get the SHA-256 of the whole file, a part stored at another index
+// than its place in the file is copied there on the same nodes.
+func (x *Controller) completeMultipartUpload(ctx context.Context, upload *repository.StorageGetUploadOut, bucket *repository.StorageBucket,
+	parts []*service.ControllerUploadPart) (*service.ControllerCompleteUploadOut, error) {
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("%w: multipart upload has no parts listed", repository.ErrBadRequest)
+	}
+
+	stored := make(map[int][]*repository.StorageUploadShard, len(upload.Shards))
+	for _, shard := range upload.Shards {
+		stored[shard.Index] = append(stored[shard.Index], shard)
+	}
+
+	var size int64
+	fileHash := sha256.New()
+	for i, part := range parts {
+		if i > 0 && part.Number <= parts[i-1].Number {
+			return nil, fmt.Errorf("%w: part numbers must be increasing, got %d after %d",
+				repository.ErrBadRequest, part.Number, parts[i-1].Number)
+		}
+
+		replicas, ok := stored[part.Number-1]
+		if !ok {
+			return nil, fmt.Errorf("%w: part %d is not uploaded", repository.ErrBadRequest, part.Number)
+		}
+		if part.Checksum != "" && part.Checksum != replicas[0].Checksum {
+			return nil, fmt.Errorf("%w: part %d has checksum %s", repository.ErrBadRequest, part.Number, replicas[0].Checksum)
+		}
+	}
+
+	// parts are moved to lower indexes only, so a part is read before its
+	// index is taken by another one
+	for i, part := range parts {
+		replicas := stored[part.Number-1]
+		if err := x.readUploadPart(ctx, upload, replicas, i, fileHash); err != nil {
+			return nil, fmt.Errorf("part %d: %w", part.Number, err)
+		}
+		size += replicas[0].Size
+	}
+
+	checksum := hex.EncodeToString(fileHash.Sum(nil))
+
+	completeUpload, err := x.storage.CompleteUpload(ctx, &repository.StorageCompleteUploadIn{
+		Id:        upload.Id,
+		Checksum:  checksum,
+		Size:      size,
+		Parts:     len(parts),
+		Versioned: bucket.Versioning,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dropped := slices.DeleteFunc(upload.Shards, func(shard *repository.StorageUploadShard) bool {
+		return shard.Index < len(parts)
+	})
+	x.deleteUploadShards(ctx, upload, dropped)
+
+	return &service.ControllerCompleteUploadOut{
+		Id:       completeUpload.FileId,
+		Version:  completeUpload.VersionId,
+		Size:     size,
+		Checksum: checksum,
+	}, nil
+}
+
+// readUploadPart adds the part to the file hash, a part stored at another
+// index is copied to the index on the nodes of its replicas.
+func (x *Controller) readUploadPart(ctx context.Context, upload *repository.StorageGetUploadOut, replicas []*repository.StorageUploadShard,
+	index int, fileHash hash.Hash) error {
+	size := replicas[0].Size
+	shards := make([]*repository.StorageShard, 0, len(replicas))
+	for _, replica := range replicas {
+		shards = append(shards, &repository.StorageShard{
+			NodeId:   replica.NodeId,
+			Index:    replica.Index,
+			Size:     replica.Size,
+			Status:   repository.StorageShardStatusOK,
+			Checksum: replica.Checksum,
+		})
+	}
+	if replicas[0].Index == index {
+		return x.downloadShard(ctx, upload.FileId, shards, 0, size, fileHash)
+	}
+
+	clients := make([]*nodecli.Client, 0, len(replicas))
+	for _, replica := range replicas {
+		getNode, err := x.infra.GetNode(ctx, &repository.InfraGetNodeIn{
+			Id: replica.NodeId,
+		})
+		if err != nil {
+			return err
+		}
+		cli, err := x.getNodeClient(ctx, getNode.Node)
+		if err != nil {
+			return err
+		}
+		clients = append(clients, cli)
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := x.downloadShard(ctx, upload.FileId, shards, 0, size, io.MultiWriter(fileHash, pw))
+		_ = pw.CloseWithError(err)
+		done <- err
+	}()
+
+	err := saveReplicas(ctx, clients, fmt.Sprintf("%s.%d", upload.FileId, index), pr, size)
+	_ = pr.CloseWithError(err)
+	if downloadErr := <-done; downloadErr != nil {
+		return downloadErr
+	}
+	if err != nil {
+		return err
+	}
+
+	moved := make([]*repository.StorageUploadShard, 0, len(replicas))
+	for _, replica := range replicas {
+		moved = append(moved, &repository.StorageUploadShard{
+			NodeId:   replica.NodeId,
+			Index:    index,
+			Size:     replica.Size,
+			Checksum: replica.Checksum,
+		})
+	}
+
+	setUploadPart, err := x.storage.SetUploadPart(ctx, &repository.StorageSetUploadPartIn{
+		Id:     upload.Id,
+		Index:  index,
+		Shards: moved,
+		Expiry: x.uploadExpiry,
+	})
+	if err != nil {
+		return err
+	}
+
+	// replicas on the same nodes are already overwritten by the moved part
+	replaced := slices.DeleteFunc(setUploadPart.Replaced, func(shard *repository.StorageUploadShard) bool {
+		return slices.ContainsFunc(moved, func(s *repository.StorageUploadShard) bool { return s.NodeId == shard.NodeId })
+	})
+	x.deleteUploadShards(ctx, upload, replaced)
+	return nil
+}
+
+func (x *Controller) AbortUpload(ctx context.Context, in *service.ControllerAbortUploadIn) (*service.ControllerAbortUploadOut, error) {
+	upload, err := x.storage.GetUpload(ctx, &repository.StorageGetUploadIn{
+		Id: in.Id,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = x.removeUpload(ctx, upload); err != nil {
+		return nil, err
+	}
+
+	return &service.ControllerAbortUploadOut{}, nil
+}
+
+// RunUploadCleaner removes expired uploads with their stored shards until
+// ctx is done.
+func (x *Controller) RunUploadCleaner(ctx context.Context) {
+	ticker := time.NewTicker(uploadCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		x.removeExpiredUploads(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (x *Controller) removeExpiredUploads(ctx context.Context) {
+	listExpiredUploads, err := x.storage.ListExpiredUploads(ctx, &repository.StorageListExpiredUploadsIn{
+		Limit: uploadCleanupBatch,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to list expired uploads", slog.String("error", err.Error()))
+		return
+	}
+
+	for _, upload := range listExpiredUploads.Uploads {
+		if err = x.removeUpload(ctx, upload); err != nil {
+			slog.ErrorContext(ctx, "failed to remove expired upload",
+				slog.String("upload_id", upload.Id),
+				slog.String("error", err.Error()))
+			continue
+		}
+		slog.InfoContext(ctx, "expired upload is removed",
+			slog.String("upload_id", upload.Id),
+			slog.String("location", upload.Location))
+	}
+}
+
+// removeUpload deletes the stored shards of the upload and then the upload,
+// shards of unreachable nodes are left behind.
+func (x *Controller) removeUpload(ctx context.Context, upload *repository.StorageGetUploadOut) error {
+	stored := slices.DeleteFunc(slices.Clone(upload.Shards), func(shard *repository.StorageUploadShard) bool {
+		return shard.Checksum == ""
+	})
+	x.deleteUploadShards(ctx, upload, stored)
+
+	_, err := x.storage.DeleteUpload(ctx, &repository.StorageDeleteUploadIn{
+		Id: upload.Id,
+	})
+	return err
+}
+
+// deleteUploadShards deletes the shards from their nodes, failures are logged
+// only.
+func (x *Controller) deleteUploadShards(ctx context.Context, upload *repository.StorageGetUploadOut, shards []*repository.StorageUploadShard) {
+	if len(shards) == 0 {
+		return
+	}
+
+	listNodes, err := x.infra.ListNodes(ctx, &repository.InfraListNodesIn{})
+	if err != nil {
+		slog.WarnContext(ctx, "failed to delete shards of upload",
+			slog.String("upload_id", upload.Id),
+			slog.String("error", err.Error()))
+		return
+	}
+
+	for _, shard := range shards {
+		filename := fmt.Sprintf("%s.%d", upload.FileId, shard.Index)
+		i := slices.IndexFunc(listNodes.Nodes, func(node *repository.InfraNode) bool { return node.Id == shard.NodeId })
+		if i < 0 {
+			continue
+		}
+
+		cli, err := x.getNodeClient(ctx, listNodes.Nodes[i])
+		if err == nil {
+			err = cli.DeleteFile(ctx, filename)
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "failed to delete shard of upload",
+				slog.String("upload_id", upload.Id),
+				slog.String("node_id", shard.NodeId),
+				slog.String("filename", filename),
+				slog.String("error", err.Error()))
+		}
+	}
+}
+
+func uploadInfo(upload *repository.StorageGetUploadOut) *service.ControllerUpload {
+	return &service.ControllerUpload{
+		Id:        upload.Id,
+		Bucket:    upload.Bucket,
+		Location:  upload.Location,
+		Owner:     upload.Owner,
+		Size:      upload.Size,
+		ChunkSize: upload.ChunkSize,
+		Multipart: upload.Multipart,
+		Uploaded:  upload.Uploaded,
+		CreatedAt: upload.CreatedAt,
+		ExpiresAt: upload.ExpiresAt,
+	}
+}
+
+// calculateUploadParts splits the file into chunks of chunkSize bytes, the
+// last one is shorter.
+func calculateUploadParts(fileSize, chunkSize int64) []int64 {
+	var parts []int64
+	for offset := int64(0); offset < fileSize; offset += chunkSize {
+		parts = append(parts, min(chunkSize, fileSize-offset))
+	}
+	return parts
+}
+
+// exactReader reads n bytes of r, a shorter r is an io.ErrUnexpectedEOF.
+type exactReader struct {
+	r io.Reader
+	n int64
+}
+
+func (x *exactReader) Read(p []byte) (int, error) {
+	if x.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > x.n {
+		p = p[:x.n]
+	}
+	n, err := x.r.Read(p)
+	x.n -= int64(n)
+	if err == io.EOF && x.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
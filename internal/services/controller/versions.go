@@ -0,0 +1,131 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fydmer/fileserver/internal/domain/repository"
+	"github.com/fydmer/fileserver/internal/domain/service"
+)
+
+func (x *Controller) ListVersions(ctx context.Context, in *service.ControllerListVersionsIn) (*service.ControllerListVersionsOut, error) {
+	bucket, err := x.getBucket(ctx, in.Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	listVersions, err := x.storage.ListVersions(ctx, &repository.StorageListVersionsIn{
+		BucketId: bucket.Id,
+		Location: in.Location,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]*service.ControllerFileVersion, 0, len(listVersions.Versions))
+	for i, version := range listVersions.Versions {
+		versions = append(versions, &service.ControllerFileVersion{
+			Id:        version.Id,
+			Location:  version.Location,
+			FileId:    version.FileId,
+			Owner:     version.Owner,
+			Size:      version.Size,
+			Checksum:  version.Checksum,
+			Deleted:   version.FileId == "",
+			Latest:    i == 0 && version.FileId != "",
+			CreatedAt: version.CreatedAt,
+		})
+	}
+
+	return &service.ControllerListVersionsOut{
+		Versions: versions,
+	}, nil
+}
+
+func (x *Controller) RestoreVersion(ctx context.Context, in *service.ControllerRestoreVersionIn) (*service.ControllerRestoreVersionOut, error) {
+	bucket, err := x.getBucket(ctx, in.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !bucket.Versioning {
+		return nil, fmt.Errorf("%w: bucket %s has no versioning", repository.ErrBadRequest, bucket.Name)
+	}
+
+	restoreVersion, err := x.storage.RestoreVersion(ctx, &repository.StorageRestoreVersionIn{
+		BucketId: bucket.Id,
+		Location: in.Location,
+		Id:       in.Version,
+		Owner:    in.Owner,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &service.ControllerRestoreVersionOut{
+		Version: restoreVersion.VersionId,
+	}, nil
+}
+
+// PurgeVersion deletes the shards of the version once no other version
+// refers to its file.
+func (x *Controller) PurgeVersion(ctx context.Context, in *service.ControllerPurgeVersionIn) (*service.ControllerPurgeVersionOut, error) {
+	bucket, err := x.getBucket(ctx, in.Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteVersion, err := x.storage.DeleteVersion(ctx, &repository.StorageDeleteVersionIn{
+		BucketId: bucket.Id,
+		Location: in.Location,
+		Id:       in.Version,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if deleteVersion.UnusedFileId != "" {
+		file, err := x.storage.GetFile(ctx, &repository.StorageGetFileIn{
+			FileId: deleteVersion.UnusedFileId,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err = x.removeFile(ctx, file); err != nil {
+			return nil, err
+		}
+	}
+
+	return &service.ControllerPurgeVersionOut{}, nil
+}
+
+// findFile returns the latest file at the location or the file of the
+// version when it is set.
+func (x *Controller) findFile(ctx context.Context, bucketName, location, version string) (*repository.StorageGetFileOut, error) {
+	bucket, err := x.getBucket(ctx, bucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	if version == "" {
+		return x.storage.GetFileByLocation(ctx, &repository.StorageGetFileByLocationIn{
+			BucketId: bucket.Id,
+			Location: location,
+		})
+	}
+
+	getVersion, err := x.storage.GetVersion(ctx, &repository.StorageGetVersionIn{
+		BucketId: bucket.Id,
+		Location: location,
+		Id:       version,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if getVersion.FileId == "" {
+		return nil, fmt.Errorf("%w: version %s is a delete marker", repository.ErrResourceNotFound, version)
+	}
+
+	return x.storage.GetFile(ctx, &repository.StorageGetFileIn{
+		FileId: getVersion.FileId,
+	})
+}
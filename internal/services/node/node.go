@@ -1,56 +1,263 @@
 package node
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
-	"os"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
 
 	"github.com/fydmer/fileserver/internal/domain/repository"
 	"github.com/fydmer/fileserver/internal/domain/service"
 )
 
+const (
+	// checksumBlockSize is the size of the blocks hashed one by one, so a
+	// range is verified by the blocks it touches only.
+	checksumBlockSize = 1024 * 1024
+	// checksumLineSize is a hex SHA-256 with a new line.
+	checksumLineSize = sha256.Size*2 + 1
+)
+
+type Config struct {
+	MaxBytes int64
+}
+
 type Node struct {
+	maxBytes int64
 	diskfile repository.Diskfile
 }
 
-func NewNode(diskfile repository.Diskfile) *Node {
+func NewNode(diskfile repository.Diskfile, config *Config) *Node {
 	return &Node{
+		maxBytes: config.MaxBytes,
 		diskfile: diskfile,
 	}
 }
 
+// capacity returns the disk size and free space, limited by the quota if it is set.
+func (x *Node) capacity(ctx context.Context) (total, free int64, err error) {
+	usage, err := x.diskfile.Usage(ctx, &repository.DiskfileUsageIn{})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	total, free = usage.TotalBytes, usage.FreeBytes
+	if x.maxBytes > 0 {
+		total = min(total, x.maxBytes)
+		free = max(0, min(free, x.maxBytes-usage.UsedBytes))
+	}
+	return total, free, nil
+}
+
 func (x *Node) SaveFile(ctx context.Context, in *service.NodeSaveFileIn) (*service.NodeSaveFileOut, error) {
+	_, free, err := x.capacity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if in.Size > free {
+		return nil, fmt.Errorf("%w: %d bytes requested, %d bytes free", repository.ErrInsufficientStorage, in.Size, free)
+	}
+
+	hash := sha256.New()
+	blocks := &blockHasher{hash: sha256.New()}
 	write, err := x.diskfile.Write(ctx, &repository.DiskfileWriteIn{
 		Name:   in.Name,
-		Source: in.DataReader,
+		Source: io.TeeReader(in.DataReader, io.MultiWriter(hash, blocks)),
 	})
 	if err != nil {
-		_, _ = x.diskfile.Remove(ctx, &repository.DiskfileRemoveIn{Name: in.Name})
+		x.remove(ctx, in.Name)
 		return nil, err
 	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	blocks.flush()
+	if _, err = x.diskfile.Write(ctx, &repository.DiskfileWriteIn{
+		Name:   checksumFilename(in.Name),
+		Source: io.MultiReader(strings.NewReader(checksum+"\n"), &blocks.sums),
+	}); err != nil {
+		x.remove(ctx, in.Name)
+		return nil, err
+	}
+
 	return &service.NodeSaveFileOut{
-		Written: write.Written,
+		Written:  write.Written,
+		Checksum: checksum,
 	}, nil
 }
 
+// checksumFilename is the name of the file keeping the SHA-256 of the data
+// file and then of its blocks, a line each, so the data can be verified
+// without the controller.
+func checksumFilename(name string) string {
+	return name + ".sha256"
+}
+
+func (x *Node) remove(ctx context.Context, name string) {
+	_, _ = x.diskfile.Remove(ctx, &repository.DiskfileRemoveIn{Name: name})
+	_, _ = x.diskfile.Remove(ctx, &repository.DiskfileRemoveIn{Name: checksumFilename(name)})
+}
+
+// GetFile verifies the requested part of the file before any data is sent,
+// so a corrupted file is reported as a failure and never served.
 func (x *Node) GetFile(ctx context.Context, in *service.NodeGetFileIn) (*service.NodeGetFileOut, error) {
+	if err := x.verify(ctx, in.Name, in.Offset, in.Length); err != nil {
+		return nil, err
+	}
+
 	read, err := x.diskfile.Read(ctx, &repository.DiskfileReadIn{
 		Name:        in.Name,
+		Offset:      in.Offset,
+		Length:      in.Length,
 		Destination: in.DataWriter,
 	})
 	if err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
-			return nil, err
-		}
+		return nil, err
 	}
 	return &service.NodeGetFileOut{
 		Written: read.Written,
 	}, nil
 }
 
+// verify compares the blocks of the file touched by the range with their
+// SHA-256 stored on save, the rest of the file if length is 0. Files saved
+// without block checksums are verified as a whole, files saved without any
+// are not verified.
+func (x *Node) verify(ctx context.Context, name string, offset, length int64) error {
+	var head bytes.Buffer
+	if _, err := x.diskfile.Read(ctx, &repository.DiskfileReadIn{
+		Name:        checksumFilename(name),
+		Length:      2 * checksumLineSize,
+		Destination: &head,
+	}); err != nil {
+		if errors.Is(err, repository.ErrResourceNotFound) {
+			return nil
+		}
+		return err
+	}
+	if head.Len() <= checksumLineSize {
+		return x.verifyWhole(ctx, name, strings.TrimSpace(head.String()))
+	}
+
+	first, count := offset/checksumBlockSize, int64(0)
+	if length > 0 {
+		count = (offset+length-1)/checksumBlockSize - first + 1
+	}
+
+	var sums bytes.Buffer
+	if _, err := x.diskfile.Read(ctx, &repository.DiskfileReadIn{
+		Name:        checksumFilename(name),
+		Offset:      (first + 1) * checksumLineSize,
+		Length:      count * checksumLineSize,
+		Destination: &sums,
+	}); err != nil {
+		return err
+	}
+
+	// blocks past the end of the file have no checksums and are not read
+	blocks := &blockHasher{hash: sha256.New()}
+	if sums.Len() > 0 {
+		if _, err := x.diskfile.Read(ctx, &repository.DiskfileReadIn{
+			Name:        name,
+			Offset:      first * checksumBlockSize,
+			Length:      int64(sums.Len()/checksumLineSize) * checksumBlockSize,
+			Destination: blocks,
+		}); err != nil {
+			return err
+		}
+	}
+	blocks.flush()
+
+	if !bytes.Equal(blocks.sums.Bytes(), sums.Bytes()) {
+		return fmt.Errorf("%w: file %s differs from its stored checksum", repository.ErrChecksumMismatch, name)
+	}
+	return nil
+}
+
+func (x *Node) verifyWhole(ctx context.Context, name, checksum string) error {
+	hash := sha256.New()
+	if _, err := x.diskfile.Read(ctx, &repository.DiskfileReadIn{
+		Name:        name,
+		Destination: hash,
+	}); err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(hash.Sum(nil)) != checksum {
+		return fmt.Errorf("%w: file %s differs from its stored checksum", repository.ErrChecksumMismatch, name)
+	}
+	return nil
+}
+
+// blockHasher collects the hex SHA-256 of every checksumBlockSize bytes
+// written, a line each, flush adds the last incomplete block.
+type blockHasher struct {
+	hash hash.Hash
+	size int
+	sums bytes.Buffer
+}
+
+func (b *blockHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		k := min(len(p), checksumBlockSize-b.size)
+		b.hash.Write(p[:k])
+		b.size += k
+		p = p[k:]
+		if b.size == checksumBlockSize {
+			b.flush()
+		}
+	}
+	return n, nil
+}
+
+func (b *blockHasher) flush() {
+	if b.size == 0 {
+		return
+	}
+	b.sums.WriteString(hex.EncodeToString(b.hash.Sum(nil)))
+	b.sums.WriteByte('\n')
+	b.hash.Reset()
+	b.size = 0
+}
+
 func (x *Node) DeleteFile(ctx context.Context, in *service.NodeDeleteFileIn) (*service.NodeDeleteFileOut, error) {
 	if _, err := x.diskfile.Remove(ctx, &repository.DiskfileRemoveIn{Name: in.Name}); err != nil {
 		return nil, err
 	}
+	if _, err := x.diskfile.Remove(ctx, &repository.DiskfileRemoveIn{Name: checksumFilename(in.Name)}); err != nil {
+		return nil, err
+	}
 	return &service.NodeDeleteFileOut{}, nil
 }
+
+// HashFile reads the whole file back from the disk and returns its SHA-256.
+func (x *Node) HashFile(ctx context.Context, in *service.NodeHashFileIn) (*service.NodeHashFileOut, error) {
+	hash := sha256.New()
+	read, err := x.diskfile.Read(ctx, &repository.DiskfileReadIn{
+		Name:        in.Name,
+		Destination: hash,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &service.NodeHashFileOut{
+		Size:     read.Written,
+		Checksum: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+func (x *Node) Ping(ctx context.Context, _ *service.NodePingIn) (*service.NodePingOut, error) {
+	total, free, err := x.capacity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &service.NodePingOut{
+		TotalBytes: total,
+		FreeBytes:  free,
+	}, nil
+}
@@ -0,0 +1,40 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/fydmer/fileserver/pkg/controllercli"
+)
+
+// KeepRegistered joins the node to the controller and repeats it every
+// interval, so the node comes back after the controller loses its state.
+// Joining is idempotent, the controller keeps the id of a known address.
+// It stops once the node is decommissioned.
+func KeepRegistered(ctx context.Context, cli *controllercli.Client, addr string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	nodeId := ""
+	for {
+		id, err := cli.JoinNode(ctx, addr)
+		if errors.Is(err, controllercli.ErrNodeDecommissioned) {
+			slog.WarnContext(ctx, "node is decommissioned, registration stopped", slog.String("addr", addr))
+			return
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "failed to register node", slog.String("addr", addr), slog.String("error", err.Error()))
+		} else if id != nodeId {
+			slog.InfoContext(ctx, "node registered", slog.String("addr", addr), slog.String("node_id", id))
+			nodeId = id
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package controllercli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// NewClient authenticates requests with the API token, joining nodes requires
+// an admin one.
+func NewClient(ctx context.Context, baseURL string, token string) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid controller address '%s'", baseURL)
+	}
+
+	c := &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+
+	return c, nil
+}
+
+// ErrNodeDecommissioned is returned by JoinNode for the address of a removed
+// node.
+var ErrNodeDecommissioned = errors.New("node is decommissioned")
+
+type errorResponse struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+func (c *Client) JoinNode(ctx context.Context, addr string) (string, error) {
+	form := url.Values{}
+	form.Set("addr", addr)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/api/v1/nodes", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to controller: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		errResp := &errorResponse{}
+		_ = json.NewDecoder(resp.Body).Decode(errResp)
+		if resp.StatusCode == http.StatusGone {
+			return "", fmt.Errorf("%w: %s", ErrNodeDecommissioned, errResp.Message)
+		}
+		return "", fmt.Errorf("controller responded %d: %s", resp.StatusCode, errResp.Message)
+	}
+
+	joinResp := &struct {
+		NodeId string `json:"node_id"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(joinResp); err != nil {
+		return "", fmt.Errorf("failed to parse controller response: %w", err)
+	}
+
+	return joinResp.NodeId, nil
+}
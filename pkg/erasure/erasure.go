@@ -0,0 +1,162 @@
+package erasure
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrSingularMatrix   = errors.New("erasure: matrix is singular")
+	ErrTooFewShards     = errors.New("erasure: too few shards to reconstruct")
+	ErrShardSize        = errors.New("erasure: shards differ in size")
+	ErrWrongShardsCount = errors.New("erasure: wrong number of shards")
+)
+
+// Encoder is a systematic Reed-Solomon coder: the first DataShards rows of
+// the encoding matrix are the identity, so data shards are stored as is.
+type Encoder struct {
+	dataShards   int
+	parityShards int
+	matrix       matrix
+}
+
+func New(dataShards, parityShards int) (*Encoder, error) {
+	if dataShards <= 0 || parityShards < 0 || dataShards+parityShards > 256 {
+		return nil, fmt.Errorf("erasure: invalid shards configuration %d+%d", dataShards, parityShards)
+	}
+
+	total := dataShards + parityShards
+	vm := vandermondeMatrix(total, dataShards)
+
+	top, err := vm[:dataShards].invert()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Encoder{
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		matrix:       vm.multiply(top),
+	}, nil
+}
+
+func (e *Encoder) DataShards() int {
+	return e.dataShards
+}
+
+func (e *Encoder) ParityShards() int {
+	return e.parityShards
+}
+
+// Encode fills parity shards from data shards. All shards must be allocated
+// and have the same size.
+func (e *Encoder) Encode(shards [][]byte) error {
+	if len(shards) != e.dataShards+e.parityShards {
+		return ErrWrongShardsCount
+	}
+
+	size := len(shards[0])
+	for _, shard := range shards {
+		if len(shard) != size {
+			return ErrShardSize
+		}
+	}
+
+	e.encodeRows(shards[:e.dataShards], shards[e.dataShards:], e.matrix[e.dataShards:])
+	return nil
+}
+
+func (e *Encoder) encodeRows(inputs, outputs [][]byte, rows matrix) {
+	for i, out := range outputs {
+		clear(out)
+		for j, in := range inputs {
+			gfMulSliceXor(rows[i][j], in, out)
+		}
+	}
+}
+
+// Reconstruct restores missing shards, which are marked by zero length.
+// Slices with enough capacity are reused, others are allocated.
+func (e *Encoder) Reconstruct(shards [][]byte) error {
+	return e.reconstruct(shards, false)
+}
+
+// ReconstructData is like Reconstruct but only restores data shards.
+func (e *Encoder) ReconstructData(shards [][]byte) error {
+	return e.reconstruct(shards, true)
+}
+
+func (e *Encoder) reconstruct(shards [][]byte, dataOnly bool) error {
+	if len(shards) != e.dataShards+e.parityShards {
+		return ErrWrongShardsCount
+	}
+
+	size, present := 0, 0
+	for _, shard := range shards {
+		if len(shard) == 0 {
+			continue
+		}
+		if size != 0 && len(shard) != size {
+			return ErrShardSize
+		}
+		size = len(shard)
+		present++
+	}
+	if present == len(shards) {
+		return nil
+	}
+	if present < e.dataShards {
+		return ErrTooFewShards
+	}
+
+	subMatrix := newMatrix(e.dataShards, e.dataShards)
+	subShards := make([][]byte, 0, e.dataShards)
+	for i, shard := range shards {
+		if len(subShards) == e.dataShards {
+			break
+		}
+		if len(shard) != 0 {
+			copy(subMatrix[len(subShards)], e.matrix[i])
+			subShards = append(subShards, shard)
+		}
+	}
+
+	decode, err := subMatrix.invert()
+	if err != nil {
+		return err
+	}
+
+	var outputs [][]byte
+	var rows matrix
+	for i := 0; i < e.dataShards; i++ {
+		if len(shards[i]) == 0 {
+			shards[i] = allocShard(shards[i], size)
+			outputs = append(outputs, shards[i])
+			rows = append(rows, decode[i])
+		}
+	}
+	e.encodeRows(subShards, outputs, rows)
+
+	if dataOnly {
+		return nil
+	}
+
+	outputs, rows = nil, nil
+	for i := e.dataShards; i < len(shards); i++ {
+		if len(shards[i]) == 0 {
+			shards[i] = allocShard(shards[i], size)
+			outputs = append(outputs, shards[i])
+			rows = append(rows, e.matrix[i])
+		}
+	}
+	e.encodeRows(shards[:e.dataShards], outputs, rows)
+
+	return nil
+}
+
+func allocShard(shard []byte, size int) []byte {
+	if cap(shard) >= size {
+		return shard[:size]
+	}
+	return make([]byte, size)
+}
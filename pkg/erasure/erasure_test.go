@@ -0,0 +1,179 @@
+package erasure
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+var configs = []struct {
+	dataShards   int
+	parityShards int
+}{
+	{1, 1},
+	{2, 1},
+	{3, 2},
+	{4, 2},
+	{6, 3},
+	{10, 4},
+}
+
+func newShards(t *testing.T, e *Encoder, size int, seed int64) [][]byte {
+	t.Helper()
+
+	rnd := rand.New(rand.NewSource(seed))
+	shards := make([][]byte, e.DataShards()+e.ParityShards())
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		if i < e.DataShards() {
+			rnd.Read(shards[i])
+		}
+	}
+	if err := e.Encode(shards); err != nil {
+		t.Fatal(err)
+	}
+	return shards
+}
+
+func copyShards(shards [][]byte) [][]byte {
+	out := make([][]byte, len(shards))
+	for i, shard := range shards {
+		out[i] = bytes.Clone(shard)
+	}
+	return out
+}
+
+// erasures calls fn with every set of up to max indexes out of total.
+func erasures(total, max int, fn func(lost []int)) {
+	var walk func(start int, lost []int)
+	walk = func(start int, lost []int) {
+		fn(lost)
+		if len(lost) == max {
+			return
+		}
+		for i := start; i < total; i++ {
+			walk(i+1, append(lost, i))
+		}
+	}
+	walk(0, nil)
+}
+
+func TestReconstruct(t *testing.T) {
+	for _, cfg := range configs {
+		t.Run(fmt.Sprintf("%d+%d", cfg.dataShards, cfg.parityShards), func(t *testing.T) {
+			e, err := New(cfg.dataShards, cfg.parityShards)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := newShards(t, e, 257, int64(cfg.dataShards*100+cfg.parityShards))
+
+			erasures(len(want), cfg.parityShards, func(lost []int) {
+				shards := copyShards(want)
+				for _, i := range lost {
+					shards[i] = nil
+				}
+				if err := e.Reconstruct(shards); err != nil {
+					t.Fatalf("lost %v: %v", lost, err)
+				}
+				for i := range shards {
+					if !bytes.Equal(shards[i], want[i]) {
+						t.Fatalf("lost %v: shard %d differs", lost, i)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestReconstructData(t *testing.T) {
+	for _, cfg := range configs {
+		t.Run(fmt.Sprintf("%d+%d", cfg.dataShards, cfg.parityShards), func(t *testing.T) {
+			e, err := New(cfg.dataShards, cfg.parityShards)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := newShards(t, e, 100, int64(cfg.dataShards*100+cfg.parityShards))
+
+			erasures(len(want), cfg.parityShards, func(lost []int) {
+				shards := copyShards(want)
+				for _, i := range lost {
+					shards[i] = nil
+				}
+				if err := e.ReconstructData(shards); err != nil {
+					t.Fatalf("lost %v: %v", lost, err)
+				}
+				for i := range shards {
+					if i < cfg.dataShards && !bytes.Equal(shards[i], want[i]) {
+						t.Fatalf("lost %v: data shard %d differs", lost, i)
+					}
+					if i >= cfg.dataShards && len(shards[i]) != 0 && !bytes.Equal(shards[i], want[i]) {
+						t.Fatalf("lost %v: parity shard %d changed", lost, i)
+					}
+				}
+				for _, i := range lost {
+					if i >= cfg.dataShards && len(shards[i]) != 0 {
+						t.Fatalf("lost %v: parity shard %d is restored", lost, i)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestReconstructReusesShards(t *testing.T) {
+	e, err := New(4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := newShards(t, e, 64, 1)
+
+	shards := copyShards(want)
+	buf := shards[1][:0]
+	shards[1] = buf
+	if err = e.Reconstruct(shards); err != nil {
+		t.Fatal(err)
+	}
+	if &shards[1][0] != &buf[:1][0] {
+		t.Fatal("shard with enough capacity is reallocated")
+	}
+	if !bytes.Equal(shards[1], want[1]) {
+		t.Fatal("shard 1 differs")
+	}
+}
+
+func TestReconstructErrors(t *testing.T) {
+	e, err := New(3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := newShards(t, e, 16, 1)
+
+	shards := copyShards(want)
+	shards[0], shards[2], shards[4] = nil, nil, nil
+	if err = e.Reconstruct(shards); !errors.Is(err, ErrTooFewShards) {
+		t.Fatalf("got %v, want %v", err, ErrTooFewShards)
+	}
+
+	shards = copyShards(want)
+	shards[0], shards[1] = nil, shards[1][:8]
+	if err = e.Reconstruct(shards); !errors.Is(err, ErrShardSize) {
+		t.Fatalf("got %v, want %v", err, ErrShardSize)
+	}
+
+	if err = e.Reconstruct(want[:4]); !errors.Is(err, ErrWrongShardsCount) {
+		t.Fatalf("got %v, want %v", err, ErrWrongShardsCount)
+	}
+	if err = e.Encode(want[:4]); !errors.Is(err, ErrWrongShardsCount) {
+		t.Fatalf("got %v, want %v", err, ErrWrongShardsCount)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, cfg := range []struct{ dataShards, parityShards int }{{0, 1}, {1, -1}, {200, 57}} {
+		if _, err := New(cfg.dataShards, cfg.parityShards); err == nil {
+			t.Fatalf("%d+%d: expected an error", cfg.dataShards, cfg.parityShards)
+		}
+	}
+}
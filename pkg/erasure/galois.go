@@ -0,0 +1,139 @@
+package erasure
+
+// Arithmetic over GF(2^8) with the 0x11d generator polynomial.
+
+var (
+	gfExp [512]byte
+	gfLog [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])*n)%255]
+}
+
+// gfMulSliceXor computes dst ^= c * src.
+func gfMulSliceXor(c byte, src, dst []byte) {
+	if c == 0 {
+		return
+	}
+	logC := int(gfLog[c])
+	for i, v := range src {
+		if v != 0 {
+			dst[i] ^= gfExp[logC+int(gfLog[v])]
+		}
+	}
+}
+
+type matrix [][]byte
+
+func newMatrix(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for i := range m {
+		m[i] = make([]byte, cols)
+	}
+	return m
+}
+
+func vandermondeMatrix(rows, cols int) matrix {
+	m := newMatrix(rows, cols)
+	for r := range m {
+		for c := range m[r] {
+			m[r][c] = gfPow(byte(r), c)
+		}
+	}
+	return m
+}
+
+func (m matrix) multiply(other matrix) matrix {
+	out := newMatrix(len(m), len(other[0]))
+	for r := range out {
+		for c := range out[r] {
+			var v byte
+			for i := range other {
+				v ^= gfMul(m[r][i], other[i][c])
+			}
+			out[r][c] = v
+		}
+	}
+	return out
+}
+
+// invert returns the inverse of a square matrix using Gauss-Jordan elimination.
+func (m matrix) invert() (matrix, error) {
+	size := len(m)
+	work := newMatrix(size, size*2)
+	for r := range m {
+		copy(work[r], m[r])
+		work[r][size+r] = 1
+	}
+
+	for c := 0; c < size; c++ {
+		if work[c][c] == 0 {
+			for r := c + 1; r < size; r++ {
+				if work[r][c] != 0 {
+					work[c], work[r] = work[r], work[c]
+					break
+				}
+			}
+		}
+		if work[c][c] == 0 {
+			return nil, ErrSingularMatrix
+		}
+
+		if pivot := work[c][c]; pivot != 1 {
+			for i := range work[c] {
+				work[c][i] = gfDiv(work[c][i], pivot)
+			}
+		}
+
+		for r := 0; r < size; r++ {
+			if r != c && work[r][c] != 0 {
+				factor := work[r][c]
+				for i := range work[r] {
+					work[r][i] ^= gfMul(factor, work[c][i])
+				}
+			}
+		}
+	}
+
+	out := newMatrix(size, size)
+	for r := range out {
+		copy(out[r], work[r][size:])
+	}
+	return out, nil
+}
@@ -1,53 +1,209 @@
 package nodecli
 
 import (
-	"bufio"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"strconv"
-	"strings"
 	"time"
+
+	"github.com/fydmer/fileserver/pkg/nodeproto"
 )
 
+// Client runs operations as concurrent streams of pooled connections to the
+// node.
 type Client struct {
 	addr   string
 	dialer net.Dialer
+	tls    *tls.Config
+	secret []byte
+	pool   *pool
+}
+
+type Config struct {
+	// MaxConns limits connections to the node, MaxStreams limits operations
+	// running at once on a connection. Operations wait for a free stream
+	// when all the connections are busy.
+	MaxConns   int
+	MaxStreams int
+	// IdleTimeout is the time a connection without operations is kept open.
+	IdleTimeout time.Duration
+	// TLS secures the connections when set, the server name defaults to the
+	// host of the node address.
+	TLS *tls.Config
+	// Secret is the pre-shared key the connections are authenticated with.
+	Secret []byte
 }
 
 const (
 	sendFileChunkSize = 1024 * 1024
+
+	defaultMaxConns    = 4
+	defaultMaxStreams  = 16
+	defaultIdleTimeout = 90 * time.Second
+)
+
+var (
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	ErrFileNotFound     = errors.New("file not found")
 )
 
-func NewClient(ctx context.Context, addr string) (*Client, error) {
+func NewClient(ctx context.Context, addr string, config *Config) (*Client, error) {
+	maxConns := config.MaxConns
+	if maxConns < 1 {
+		maxConns = defaultMaxConns
+	}
+
+	maxStreams := config.MaxStreams
+	if maxStreams < 1 {
+		maxStreams = defaultMaxStreams
+	}
+
+	idleTimeout := config.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+
+	tlsConfig := config.TLS
+	if tlsConfig != nil && tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+
 	c := &Client{
 		addr: addr,
 		dialer: net.Dialer{
 			Timeout:   5 * time.Second,
 			KeepAlive: 30 * time.Second,
 		},
+		tls:    tlsConfig,
+		secret: config.Secret,
 	}
+	c.pool = newPool(c.connect, maxConns, maxStreams, idleTimeout)
 
 	return c, nil
 }
 
-func (c *Client) SaveFile(ctx context.Context, filename string, src io.Reader, size int64) error {
-	conn, err := c.dialer.DialContext(ctx, "tcp", c.addr)
+// Close breaks the connections, the client still can be used after it.
+func (c *Client) Close() error {
+	c.pool.close()
+	return nil
+}
+
+// Stats returns the usage of the connection pool.
+func (c *Client) Stats() PoolStats {
+	return c.pool.statistics()
+}
+
+func (c *Client) connect(ctx context.Context) (*nodeproto.Conn, error) {
+	netConn, err := c.dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+
+	if c.tls != nil {
+		tlsConn := tls.Client(netConn, c.tls)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			_ = netConn.Close()
+			return nil, fmt.Errorf("failed to establish tls with node: %w", err)
+		}
+		netConn = tlsConn
+	}
+
+	conn, err := nodeproto.Client(ctx, netConn, c.secret)
+	if err != nil {
+		_ = netConn.Close()
+		return nil, fmt.Errorf("failed to handshake with node: %w", err)
+	}
+
+	return conn, nil
+}
+
+// stream is an operation holding a stream of a pooled connection until it
+// is closed.
+type stream struct {
+	*nodeproto.Stream
+	pc   *poolConn
+	pool *pool
+	// broken drops the connection on close instead of returning it
+	broken bool
+}
+
+func (s *stream) Close() error {
+	err := s.Stream.Close()
+	if s.broken {
+		s.pool.discard(s.pc)
+	} else {
+		s.pool.put(s.pc)
+	}
+	return err
+}
+
+// open starts an operation, a connection found broken is replaced once.
+func (c *Client) open(ctx context.Context, req *nodeproto.Request, end bool) (*stream, error) {
+	for attempt := 0; ; attempt++ {
+		pc, err := c.pool.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		s, err := pc.conn.Open(ctx, req, end)
+		if err == nil {
+			return &stream{Stream: s, pc: pc, pool: c.pool}, nil
+		}
+
+		c.pool.discard(pc)
+		if attempt > 0 || ctx.Err() != nil {
+			return nil, fmt.Errorf("failed to send request: %w", err)
+		}
+	}
+}
+
+// response waits for the response and converts its status to an error.
+func response(stream *stream, filename string) (*nodeproto.Response, error) {
+	resp, err := stream.Response()
 	if err != nil {
-		return fmt.Errorf("failed to connect to node: %w", err)
+		return nil, fmt.Errorf("failed to receive response: %w", err)
 	}
-	defer conn.Close()
 
-	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	switch resp.Status {
+	case nodeproto.StatusOK:
+		return resp, nil
+	case nodeproto.StatusNotFound:
+		return nil, fmt.Errorf("%w: %s", ErrFileNotFound, filename)
+	case nodeproto.StatusChecksumMismatch:
+		return nil, fmt.Errorf("%w: %s", ErrChecksumMismatch, resp.Message)
+	default:
+		return nil, resp.Err()
+	}
+}
 
-	if _, err = w.WriteString(fmt.Sprintf("save_file:%d:%s\n", size, filename)); err != nil {
-		return fmt.Errorf("failed to send header: %w", err)
+func (c *Client) SaveFile(ctx context.Context, filename string, src io.Reader, size int64) error {
+	stream, err := c.open(ctx, &nodeproto.Request{
+		Op:   nodeproto.OpSaveFile,
+		Name: filename,
+		Size: size,
+	}, false)
+	if err != nil {
+		return err
 	}
+	defer stream.Close()
 
-	lr := io.LimitReader(src, size)
+	hash := sha256.New()
+	lr := io.TeeReader(io.LimitReader(src, size), hash)
 
+	// a failed send is explained by the response when the node gives up on
+	// the file, e.g. when its disk is full
 	var writtenSum int64
+	var sendErr error
 	chunkBuf := make([]byte, sendFileChunkSize)
 	for {
 		n, err := lr.Read(chunkBuf)
@@ -58,68 +214,159 @@ func (c *Client) SaveFile(ctx context.Context, filename string, src io.Reader, s
 			break
 		}
 
-		written, err := w.Write(chunkBuf[:n])
+		written, err := stream.Write(chunkBuf[:n])
+		writtenSum += int64(written)
 		if err != nil {
-			return fmt.Errorf("failed to send chunk: %w", err)
+			sendErr = fmt.Errorf("failed to send chunk: %w", err)
+			break
 		}
-		writtenSum += int64(written)
 	}
-	if err = w.Flush(); err != nil {
-		return fmt.Errorf("failed to send bufferized data: %w", err)
+	if sendErr == nil {
+		if err = stream.CloseWrite(); err != nil {
+			sendErr = fmt.Errorf("failed to send end of data: %w", err)
+		}
 	}
 
-	nodeWrittenStr, err := r.ReadString('\n')
+	resp, err := response(stream, filename)
 	if err != nil {
-		return fmt.Errorf("failed to recieve written size: %w", err)
+		return err
 	}
-
-	nodeWritten, err := strconv.ParseInt(strings.TrimSpace(nodeWrittenStr), 10, 64)
-	if err != nil {
-		return fmt.Errorf("failed to parse written size: %w", err)
+	if sendErr != nil {
+		return sendErr
 	}
 
-	if nodeWritten != writtenSum {
+	if resp.Size != writtenSum {
 		return fmt.Errorf("written size does not match file size")
 	}
 
+	if resp.Checksum != hex.EncodeToString(hash.Sum(nil)) {
+		return fmt.Errorf("%w: file %s is corrupted on save", ErrChecksumMismatch, filename)
+	}
+
 	return nil
 }
 
-func (c *Client) GetFile(ctx context.Context, filename string, dst io.Writer, size int64) error {
-	conn, err := c.dialer.DialContext(ctx, "tcp", c.addr)
-	if err != nil {
-		return fmt.Errorf("failed to connect to node: %w", err)
+// GetFile reads the whole file and verifies its SHA-256 checksum, the check is
+// skipped when checksum is empty. The node verifies the file before sending
+// it, this check catches data damaged on the way and, as the data is written
+// to dst first, is only reported at the end.
+func (c *Client) GetFile(ctx context.Context, filename string, dst io.Writer, size int64, checksum string) error {
+	if checksum == "" {
+		return c.GetFileRange(ctx, filename, dst, 0, size)
 	}
-	defer conn.Close()
 
-	if _, err = conn.Write([]byte(fmt.Sprintf("get_file:%s\n", filename))); err != nil {
-		return fmt.Errorf("failed to send header: %w", err)
+	hash := sha256.New()
+	if err := c.GetFileRange(ctx, filename, io.MultiWriter(dst, hash), 0, size); err != nil {
+		return err
 	}
 
-	lr := io.LimitReader(conn, size)
+	if hex.EncodeToString(hash.Sum(nil)) != checksum {
+		return fmt.Errorf("%w: file %s", ErrChecksumMismatch, filename)
+	}
+	return nil
+}
 
-	written, err := io.Copy(dst, lr)
+// GetFileRange reads size bytes of the file starting from offset.
+func (c *Client) GetFileRange(ctx context.Context, filename string, dst io.Writer, offset, size int64) error {
+	if size == 0 {
+		return nil
+	}
+
+	stream, err := c.open(ctx, &nodeproto.Request{
+		Op:     nodeproto.OpGetFile,
+		Name:   filename,
+		Offset: offset,
+		Length: size,
+	}, true)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	if _, err = response(stream, filename); err != nil {
+		return err
+	}
+
+	written, err := io.Copy(dst, io.LimitReader(stream, size))
 	if err != nil {
 		return fmt.Errorf("failed to receive file data: %w", err)
 	}
 
-	if _, err = conn.Write([]byte(fmt.Sprintf("%d\n", written))); err != nil {
-		return fmt.Errorf("failed to send written size info: %w", err)
+	if written != size {
+		return fmt.Errorf("received size does not match file size")
 	}
 
 	return nil
 }
 
 func (c *Client) DeleteFile(ctx context.Context, filename string) error {
-	conn, err := c.dialer.DialContext(ctx, "tcp", c.addr)
+	stream, err := c.open(ctx, &nodeproto.Request{
+		Op:   nodeproto.OpDeleteFile,
+		Name: filename,
+	}, true)
 	if err != nil {
-		return fmt.Errorf("failed to connect to node: %w", err)
+		return err
 	}
-	defer conn.Close()
+	defer stream.Close()
+
+	_, err = response(stream, filename)
+	return err
+}
+
+type FileHash struct {
+	Size     int64
+	Checksum string
+}
 
-	if _, err = conn.Write([]byte(fmt.Sprintf("delete_file:%s\n", filename))); err != nil {
-		return fmt.Errorf("failed to send header: %w", err)
+// HashFile makes the node read the file from its disk and compute SHA-256,
+// the data itself is not transferred.
+func (c *Client) HashFile(ctx context.Context, filename string) (*FileHash, error) {
+	stream, err := c.open(ctx, &nodeproto.Request{
+		Op:   nodeproto.OpHashFile,
+		Name: filename,
+	}, true)
+	if err != nil {
+		return nil, err
 	}
+	defer stream.Close()
 
-	return nil
+	resp, err := response(stream, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileHash{
+		Size:     resp.Size,
+		Checksum: resp.Checksum,
+	}, nil
+}
+
+type Status struct {
+	TotalBytes int64
+	FreeBytes  int64
+}
+
+// Ping asks the node for its capacity. The connection is dropped when the
+// node does not answer in time, so a dead peer is not kept in the pool.
+func (c *Client) Ping(ctx context.Context) (*Status, error) {
+	stream, err := c.open(ctx, &nodeproto.Request{
+		Op: nodeproto.OpPing,
+	}, true)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	resp, err := response(stream, "")
+	if err != nil {
+		if ctx.Err() != nil {
+			stream.broken = true
+		}
+		return nil, err
+	}
+
+	return &Status{
+		TotalBytes: resp.TotalBytes,
+		FreeBytes:  resp.FreeBytes,
+	}, nil
 }
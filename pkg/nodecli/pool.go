@@ -0,0 +1,254 @@
+package nodecli
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fydmer/fileserver/pkg/nodeproto"
+)
+
+const (
+	// healthCheckAfter is the idle time after which a connection is pinged
+	// before it is used again.
+	healthCheckAfter   = 10 * time.Second
+	healthCheckTimeout = 2 * time.Second
+)
+
+// PoolStats describes the connections of a client. Conns, Idle and Streams
+// are the current numbers, the rest are counters since the client creation.
+type PoolStats struct {
+	Conns   int
+	Idle    int
+	Streams int
+	// Dials counts new connections, Reuses counts operations run on an
+	// existing one and Waits counts operations waiting for a free stream.
+	Dials  int64
+	Reuses int64
+	Waits  int64
+	// Unhealthy counts connections dropped by a failed health check or
+	// found broken, Expired counts connections closed after IdleTimeout.
+	Unhealthy int64
+	Expired   int64
+}
+
+type poolConn struct {
+	conn     *nodeproto.Conn
+	streams  int
+	lastUsed time.Time
+	idle     *time.Timer
+}
+
+// pool keeps up to maxConns connections to a node, each of them running up
+// to maxStreams operations at once. New connections are dialed only when
+// the open ones are full.
+type pool struct {
+	dial        func(ctx context.Context) (*nodeproto.Conn, error)
+	maxConns    int
+	maxStreams  int
+	idleTimeout time.Duration
+
+	mu      sync.Mutex
+	conns   []*poolConn
+	dialing int
+	freed   chan struct{}
+	stats   PoolStats
+}
+
+func newPool(dial func(ctx context.Context) (*nodeproto.Conn, error), maxConns, maxStreams int, idleTimeout time.Duration) *pool {
+	return &pool{
+		dial:        dial,
+		maxConns:    maxConns,
+		maxStreams:  maxStreams,
+		idleTimeout: idleTimeout,
+		freed:       make(chan struct{}),
+	}
+}
+
+// get reserves a stream on a connection, the reservation is returned by put.
+func (p *pool) get(ctx context.Context) (*poolConn, error) {
+	for {
+		p.mu.Lock()
+		p.dropBroken()
+
+		var best *poolConn
+		for _, pc := range p.conns {
+			if pc.streams < p.maxStreams && (best == nil || pc.streams < best.streams) {
+				best = pc
+			}
+		}
+
+		if best != nil {
+			check := best.streams == 0 && time.Since(best.lastUsed) > healthCheckAfter
+			p.reserve(best)
+			p.stats.Reuses++
+			p.mu.Unlock()
+
+			if check && !p.healthy(ctx, best) {
+				p.discard(best)
+				continue
+			}
+			return best, nil
+		}
+
+		if len(p.conns)+p.dialing < p.maxConns {
+			p.dialing++
+			p.stats.Dials++
+			p.mu.Unlock()
+
+			conn, err := p.dial(ctx)
+
+			p.mu.Lock()
+			p.dialing--
+			if err != nil {
+				p.notify()
+				p.mu.Unlock()
+				return nil, err
+			}
+
+			pc := &poolConn{conn: conn, streams: 1, lastUsed: time.Now()}
+			p.conns = append(p.conns, pc)
+			p.mu.Unlock()
+			return pc, nil
+		}
+
+		freed := p.freed
+		p.stats.Waits++
+		p.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// put returns the stream reserved by get, a connection left without streams
+// is closed after the idle timeout.
+func (p *pool) put(pc *poolConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pc.streams--
+	pc.lastUsed = time.Now()
+	if pc.streams == 0 && slices.Contains(p.conns, pc) {
+		pc.idle = time.AfterFunc(p.idleTimeout, func() {
+			p.expire(pc)
+		})
+	}
+	p.notify()
+}
+
+// discard closes a connection that failed, the operations running on it
+// fail as well.
+func (p *pool) discard(pc *poolConn) {
+	p.mu.Lock()
+	if p.remove(pc) {
+		p.stats.Unhealthy++
+	}
+	p.mu.Unlock()
+
+	_ = pc.conn.Close()
+	p.put(pc)
+}
+
+func (p *pool) close() {
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = nil
+	for _, pc := range conns {
+		if pc.idle != nil {
+			pc.idle.Stop()
+		}
+	}
+	p.mu.Unlock()
+
+	for _, pc := range conns {
+		_ = pc.conn.Close()
+	}
+}
+
+func (p *pool) statistics() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.dropBroken()
+	stats := p.stats
+	stats.Conns = len(p.conns)
+	for _, pc := range p.conns {
+		stats.Streams += pc.streams
+		if pc.streams == 0 {
+			stats.Idle++
+		}
+	}
+	return stats
+}
+
+func (p *pool) reserve(pc *poolConn) {
+	pc.streams++
+	if pc.idle != nil {
+		pc.idle.Stop()
+		pc.idle = nil
+	}
+}
+
+func (p *pool) expire(pc *poolConn) {
+	p.mu.Lock()
+	expired := pc.streams == 0 && p.remove(pc)
+	if expired {
+		p.stats.Expired++
+	}
+	p.mu.Unlock()
+
+	if expired {
+		_ = pc.conn.Close()
+	}
+}
+
+// healthy pings the node on the connection.
+func (p *pool) healthy(ctx context.Context, pc *poolConn) bool {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	stream, err := pc.conn.Open(ctx, &nodeproto.Request{Op: nodeproto.OpPing}, true)
+	if err != nil {
+		return false
+	}
+	defer stream.Close()
+
+	resp, err := stream.Response()
+	return err == nil && resp.Status == nodeproto.StatusOK
+}
+
+// dropBroken forgets the connections closed by the peer.
+func (p *pool) dropBroken() {
+	for _, pc := range slices.Clone(p.conns) {
+		select {
+		case <-pc.conn.Done():
+			p.remove(pc)
+			p.stats.Unhealthy++
+		default:
+		}
+	}
+}
+
+func (p *pool) remove(pc *poolConn) bool {
+	i := slices.Index(p.conns, pc)
+	if i < 0 {
+		return false
+	}
+	if pc.idle != nil {
+		pc.idle.Stop()
+		pc.idle = nil
+	}
+	p.conns = slices.Delete(p.conns, i, i+1)
+	return true
+}
+
+// notify wakes the operations waiting for a free stream.
+func (p *pool) notify() {
+	close(p.freed)
+	p.freed = make(chan struct{})
+}
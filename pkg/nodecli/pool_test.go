@@ -0,0 +1,263 @@
+package nodecli
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fydmer/fileserver/pkg/nodeproto"
+)
+
+// testNode accepts connections over memory and answers pings.
+type testNode struct {
+	mu    sync.Mutex
+	conns []*nodeproto.Conn
+}
+
+func (x *testNode) dial(ctx context.Context) (*nodeproto.Conn, error) {
+	c, s := net.Pipe()
+	accepted := make(chan *nodeproto.Conn, 1)
+	go func() {
+		conn, err := nodeproto.Server(s, nil)
+		accepted <- conn
+		if err != nil {
+			return
+		}
+
+		for {
+			stream, err := conn.Accept()
+			if err != nil {
+				return
+			}
+			_ = stream.Respond(&nodeproto.Response{}, true)
+			_ = stream.Close()
+		}
+	}()
+
+	conn, err := nodeproto.Client(ctx, c, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.conns = append(x.conns, <-accepted)
+	return conn, nil
+}
+
+// breakAll closes the connections on the side of the node.
+func (x *testNode) breakAll() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, conn := range x.conns {
+		_ = conn.Close()
+	}
+	x.conns = nil
+}
+
+func TestPoolReuse(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxConns   int
+		maxStreams int
+		gets       int
+		conns      int
+	}{
+		{"one stream", 1, 1, 1, 1},
+		{"shared connection", 2, 4, 4, 1},
+		{"second connection", 2, 2, 3, 2},
+		{"all connections", 3, 2, 6, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := &testNode{}
+			p := newPool(node.dial, tt.maxConns, tt.maxStreams, time.Minute)
+			defer p.close()
+
+			ctx := context.Background()
+			reserved := make([]*poolConn, tt.gets)
+			for i := range reserved {
+				pc, err := p.get(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				reserved[i] = pc
+			}
+
+			stats := p.statistics()
+			if stats.Conns != tt.conns || stats.Dials != int64(tt.conns) || stats.Streams != tt.gets {
+				t.Fatalf("got %+v, want %d connections and %d streams", stats, tt.conns, tt.gets)
+			}
+
+			for _, pc := range reserved {
+				p.put(pc)
+			}
+
+			// released connections are used again instead of dialing
+			for i := 0; i < tt.gets; i++ {
+				pc, err := p.get(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				p.put(pc)
+			}
+
+			stats = p.statistics()
+			if stats.Dials != int64(tt.conns) || stats.Reuses != int64(2*tt.gets-tt.conns) || stats.Idle != tt.conns {
+				t.Fatalf("got %+v, want %d dials and %d reuses", stats, tt.conns, 2*tt.gets-tt.conns)
+			}
+		})
+	}
+}
+
+func TestPoolBroken(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("closed by the node", func(t *testing.T) {
+		node := &testNode{}
+		p := newPool(node.dial, 1, 1, time.Minute)
+		defer p.close()
+
+		pc, err := p.get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.put(pc)
+
+		node.breakAll()
+		select {
+		case <-pc.conn.Done():
+		case <-time.After(time.Second):
+			t.Fatal("connection is not broken")
+		}
+
+		next, err := p.get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.put(next)
+
+		if next == pc {
+			t.Fatal("broken connection is reused")
+		}
+		if stats := p.statistics(); stats.Conns != 1 || stats.Dials != 2 || stats.Unhealthy != 1 {
+			t.Fatalf("got %+v, want 1 connection, 2 dials and 1 unhealthy", stats)
+		}
+	})
+
+	t.Run("discarded", func(t *testing.T) {
+		node := &testNode{}
+		p := newPool(node.dial, 1, 2, time.Minute)
+		defer p.close()
+
+		pc, err := p.get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.discard(pc)
+
+		select {
+		case <-pc.conn.Done():
+		default:
+			t.Fatal("discarded connection is not closed")
+		}
+
+		next, err := p.get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.put(next)
+
+		if next == pc {
+			t.Fatal("discarded connection is reused")
+		}
+		if stats := p.statistics(); stats.Conns != 1 || stats.Streams != 1 || stats.Unhealthy != 1 {
+			t.Fatalf("got %+v, want 1 connection, 1 stream and 1 unhealthy", stats)
+		}
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		node := &testNode{}
+		p := newPool(node.dial, 1, 1, 10*time.Millisecond)
+		defer p.close()
+
+		pc, err := p.get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.put(pc)
+
+		select {
+		case <-pc.conn.Done():
+		case <-time.After(time.Second):
+			t.Fatal("idle connection is not closed")
+		}
+		if stats := p.statistics(); stats.Conns != 0 || stats.Expired != 1 {
+			t.Fatalf("got %+v, want no connections and 1 expired", stats)
+		}
+	})
+}
+
+func TestPoolConcurrency(t *testing.T) {
+	const maxConns, maxStreams, workers = 3, 2, 50
+
+	node := &testNode{}
+	p := newPool(node.dial, maxConns, maxStreams, time.Minute)
+	defer p.close()
+
+	var running, peak atomic.Int64
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			pc, err := p.get(context.Background())
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer p.put(pc)
+
+			n := running.Add(1)
+			defer running.Add(-1)
+			for {
+				old := peak.Load()
+				if n <= old || peak.CompareAndSwap(old, n) {
+					break
+				}
+			}
+
+			p.mu.Lock()
+			streams := pc.streams
+			p.mu.Unlock()
+			if streams > maxStreams {
+				errs <- fmt.Errorf("got %d streams on a connection, want at most %d", streams, maxStreams)
+			}
+
+			time.Sleep(time.Millisecond)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	stats := p.statistics()
+	if stats.Conns > maxConns || stats.Dials > maxConns || stats.Streams != 0 {
+		t.Fatalf("got %+v, want at most %d connections and no streams", stats, maxConns)
+	}
+	if peak.Load() > maxConns*maxStreams {
+		t.Fatalf("got %d operations at once, want at most %d", peak.Load(), maxConns*maxStreams)
+	}
+	if stats.Waits == 0 {
+		t.Fatal("no operation waited for a free stream")
+	}
+}
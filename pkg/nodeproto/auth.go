@@ -0,0 +1,106 @@
+package nodeproto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	nonceSize = 16
+	macSize   = sha256.Size
+	// authPayloadSize is the timestamp, the client nonce and the mac.
+	authPayloadSize = 8 + nonceSize + macSize
+	// authMaxSkew is the allowed difference between the clocks of the
+	// client and the server.
+	authMaxSkew = time.Minute
+)
+
+var authLabel = []byte("FSNP-AUTH")
+
+// Authenticator verifies that clients know the pre-shared key. The proof
+// covers the nonce sent by the server, so it is bound to the connection, and
+// the timestamp and nonce of the client, which are remembered while the
+// timestamp is valid, so a handshake can not be replayed.
+type Authenticator struct {
+	key []byte
+
+	mu   sync.Mutex
+	seen map[[nonceSize]byte]time.Time
+}
+
+func NewAuthenticator(key []byte) *Authenticator {
+	return &Authenticator{
+		key:  key,
+		seen: make(map[[nonceSize]byte]time.Time),
+	}
+}
+
+func (a *Authenticator) verify(version uint16, serverNonce, payload []byte, now time.Time) error {
+	if len(payload) != authPayloadSize {
+		return fmt.Errorf("%w: malformed authentication", errProtocol)
+	}
+
+	timestamp := time.Unix(int64(binary.BigEndian.Uint64(payload[:8])), 0)
+	clientNonce := [nonceSize]byte(payload[8 : 8+nonceSize])
+	mac := payload[8+nonceSize:]
+
+	expected := authMac(a.key, version, serverNonce, clientNonce[:], timestamp)
+	if !hmac.Equal(mac, expected) {
+		return &Error{Status: StatusUnauthenticated, Message: "invalid key"}
+	}
+
+	if timestamp.Before(now.Add(-authMaxSkew)) || timestamp.After(now.Add(authMaxSkew)) {
+		return &Error{Status: StatusUnauthenticated, Message: "timestamp is out of the allowed clock skew"}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for nonce, expires := range a.seen {
+		if now.After(expires) {
+			delete(a.seen, nonce)
+		}
+	}
+	if _, ok := a.seen[clientNonce]; ok {
+		return &Error{Status: StatusUnauthenticated, Message: "nonce is reused"}
+	}
+	a.seen[clientNonce] = timestamp.Add(authMaxSkew)
+
+	return nil
+}
+
+// authPayload proves the knowledge of key for the handshake.
+func authPayload(key []byte, version uint16, serverNonce []byte, now time.Time) ([]byte, error) {
+	clientNonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := now.Truncate(time.Second)
+	payload := binary.BigEndian.AppendUint64(nil, uint64(timestamp.Unix()))
+	payload = append(payload, clientNonce...)
+	return append(payload, authMac(key, version, serverNonce, clientNonce, timestamp)...), nil
+}
+
+func authMac(key []byte, version uint16, serverNonce, clientNonce []byte, timestamp time.Time) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(authLabel)
+	h.Write(binary.BigEndian.AppendUint16(nil, version))
+	h.Write(serverNonce)
+	h.Write(clientNonce)
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(timestamp.Unix())))
+	return h.Sum(nil)
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
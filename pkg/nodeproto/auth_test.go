@@ -0,0 +1,174 @@
+package nodeproto
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAuthenticatorVerify(t *testing.T) {
+	key, now := []byte("key"), time.Unix(1700000000, 0)
+	serverNonce, err := newNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		key     []byte
+		version uint16
+		nonce   []byte
+		time    time.Time
+		err     error
+		message string
+	}{
+		{"valid", key, Version, serverNonce, now, nil, ""},
+		{"slow clock", key, Version, serverNonce, now.Add(-authMaxSkew), nil, ""},
+		{"fast clock", key, Version, serverNonce, now.Add(authMaxSkew), nil, ""},
+		{"wrong key", []byte("other"), Version, serverNonce, now, nil, "invalid key"},
+		{"other server nonce", key, Version, make([]byte, nonceSize), now, nil, "invalid key"},
+		{"other version", key, Version + 1, serverNonce, now, nil, "invalid key"},
+		{"too slow clock", key, Version, serverNonce, now.Add(-authMaxSkew - time.Second), nil, "timestamp is out of the allowed clock skew"},
+		{"too fast clock", key, Version, serverNonce, now.Add(authMaxSkew + time.Second), nil, "timestamp is out of the allowed clock skew"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := authPayload(tt.key, tt.version, tt.nonce, tt.time)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = NewAuthenticator(key).verify(Version, serverNonce, payload, now)
+			if tt.message == "" {
+				if err != nil {
+					t.Fatalf("got %v, want nil", err)
+				}
+				return
+			}
+			var e *Error
+			if !errors.As(err, &e) || e.Status != StatusUnauthenticated || e.Message != tt.message {
+				t.Fatalf("got %v, want %v", err, tt.message)
+			}
+		})
+	}
+
+	payload, _ := authPayload(key, Version, serverNonce, now)
+	if err = NewAuthenticator(key).verify(Version, serverNonce, payload[:authPayloadSize-1], now); !errors.Is(err, errProtocol) {
+		t.Fatalf("got %v, want %v", err, errProtocol)
+	}
+}
+
+func TestAuthenticatorReplay(t *testing.T) {
+	key, now := []byte("key"), time.Unix(1700000000, 0)
+	serverNonce, _ := newNonce()
+	a := NewAuthenticator(key)
+
+	payload, err := authPayload(key, Version, serverNonce, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.verify(Version, serverNonce, payload, now); err != nil {
+		t.Fatal(err)
+	}
+
+	var e *Error
+	if err = a.verify(Version, serverNonce, payload, now.Add(time.Second)); !errors.As(err, &e) || e.Message != "nonce is reused" {
+		t.Fatalf("got %v, want nonce is reused", err)
+	}
+
+	// the nonce is forgotten when its timestamp is not valid anymore
+	later := now.Add(2*authMaxSkew + time.Second)
+	fresh, _ := authPayload(key, Version, serverNonce, later)
+	if err = a.verify(Version, serverNonce, fresh, later); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.seen) != 1 {
+		t.Fatalf("got %d nonces, want 1", len(a.seen))
+	}
+	if err = a.verify(Version, serverNonce, payload, later); !errors.As(err, &e) || e.Message != "timestamp is out of the allowed clock skew" {
+		t.Fatalf("got %v, want out of the allowed clock skew", err)
+	}
+}
+
+func TestHandshakeAuth(t *testing.T) {
+	tests := []struct {
+		name          string
+		key           []byte
+		auth          *Authenticator
+		authenticated bool
+		status        Status
+	}{
+		{"right key", []byte("key"), NewAuthenticator([]byte("key")), true, StatusOK},
+		{"wrong key", []byte("other"), NewAuthenticator([]byte("key")), false, StatusUnauthenticated},
+		{"no key", nil, NewAuthenticator([]byte("key")), false, StatusOK},
+		{"server without key", nil, nil, true, StatusOK},
+		{"key to server without key", []byte("key"), nil, true, StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s := net.Pipe()
+
+			server := make(chan *Conn, 1)
+			go func() {
+				conn, err := Server(s, tt.auth)
+				if err != nil {
+					_ = s.Close()
+				}
+				server <- conn
+			}()
+
+			client, err := Client(context.Background(), c, tt.key)
+			conn := <-server
+
+			if tt.status != StatusOK {
+				var e *Error
+				if !errors.As(err, &e) || e.Status != tt.status {
+					t.Fatalf("got %v, want %v", err, tt.status)
+				}
+				if conn != nil {
+					t.Fatal("server accepted the connection")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			defer conn.Close()
+
+			if client.Authenticated() != tt.authenticated || conn.Authenticated() != tt.authenticated {
+				t.Fatalf("got %v and %v, want %v", client.Authenticated(), conn.Authenticated(), tt.authenticated)
+			}
+		})
+	}
+}
+
+func TestHandshakeV1Client(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+
+	server := make(chan *Conn, 1)
+	go func() {
+		conn, _ := Server(s, NewAuthenticator([]byte("key")))
+		server <- conn
+	}()
+
+	// a client of version 1 can not authenticate, the node serves it only ping
+	version, err := rawClient(c, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := <-server
+	defer conn.Close()
+
+	if version != 1 || conn.Version() != 1 {
+		t.Fatalf("got versions %d and %d, want 1", version, conn.Version())
+	}
+	if conn.Authenticated() {
+		t.Fatal("v1 client is authenticated")
+	}
+}
@@ -0,0 +1,450 @@
+package nodeproto
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// handshakeTimeout limits the handshake of the server side.
+const handshakeTimeout = 10 * time.Second
+
+// acceptBacklog is the number of opened streams waiting for Accept before
+// the connection stops reading frames.
+const acceptBacklog = 64
+
+// Conn multiplexes streams over a network connection. Streams are opened by
+// the client side and accepted by the server side.
+type Conn struct {
+	conn          net.Conn
+	server        bool
+	version       uint16
+	authenticated bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	lastId  uint32
+	err     error
+
+	accept chan *Stream
+	done   chan struct{}
+}
+
+// Client performs the client handshake on conn and starts serving frames. The
+// client authenticates with key unless it is empty.
+func Client(ctx context.Context, conn net.Conn, key []byte) (*Conn, error) {
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	if err := writeFrame(w, helloFrame(MinVersion, Version, nil)); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	f, err := readFrame(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive handshake: %w", err)
+	}
+	if f.typ == frameReset {
+		if e, err := unmarshalError(f.payload); err == nil {
+			return nil, e
+		}
+	}
+
+	version, _, nonce, err := parseHello(f)
+	if err != nil {
+		return nil, err
+	}
+	if version < MinVersion || version > Version {
+		return nil, &Error{Status: StatusUnsupported, Message: fmt.Sprintf("protocol version %d", version)}
+	}
+
+	authenticated := false
+	if version >= versionAuth {
+		if authenticated, err = clientAuth(r, w, key, version, nonce); err != nil {
+			return nil, err
+		}
+	}
+
+	if !stop() {
+		return nil, ctx.Err()
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	return newConn(conn, false, version, authenticated, r, w), nil
+}
+
+// clientAuth sends the proof of the key, an empty one without the key, and
+// reads whether the server considers the client authenticated.
+func clientAuth(r *bufio.Reader, w *bufio.Writer, key []byte, version uint16, nonce []byte) (bool, error) {
+	var payload []byte
+	if len(key) > 0 {
+		var err error
+		if payload, err = authPayload(key, version, nonce, time.Now()); err != nil {
+			return false, err
+		}
+	}
+
+	if err := writeFrame(w, &frame{typ: frameAuth, payload: payload}); err != nil {
+		return false, err
+	}
+	if err := w.Flush(); err != nil {
+		return false, err
+	}
+
+	f, err := readFrame(r)
+	if err != nil {
+		return false, fmt.Errorf("failed to receive authentication: %w", err)
+	}
+	if f.typ == frameReset {
+		if e, err := unmarshalError(f.payload); err == nil {
+			return false, e
+		}
+	}
+	if f.typ != frameAuth || len(f.payload) != 1 {
+		return false, fmt.Errorf("%w: bad authentication", errProtocol)
+	}
+	return f.payload[0] == 1, nil
+}
+
+// Server performs the server handshake on conn and starts serving frames.
+// Clients are authenticated by auth, all of them are considered
+// authenticated when it is nil. A client failing to prove the key is
+// rejected, one not trying to is accepted as not authenticated.
+func Server(conn net.Conn, auth *Authenticator) (*Conn, error) {
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	f, err := readFrame(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive handshake: %w", err)
+	}
+
+	minVersion, maxVersion, _, err := parseHello(f)
+	if err != nil {
+		return nil, err
+	}
+
+	version := min(maxVersion, Version)
+	if version < max(minVersion, MinVersion) {
+		e := &Error{
+			Status:  StatusUnsupported,
+			Message: fmt.Sprintf("protocol versions %d-%d, supported %d-%d", minVersion, maxVersion, MinVersion, Version),
+		}
+		rejectHandshake(w, e)
+		return nil, e
+	}
+
+	var nonce []byte
+	if version >= versionAuth {
+		if nonce, err = newNonce(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = writeFrame(w, helloFrame(version, version, nonce)); err != nil {
+		return nil, err
+	}
+	if err = w.Flush(); err != nil {
+		return nil, err
+	}
+
+	authenticated := auth == nil
+	if version >= versionAuth {
+		if authenticated, err = serverAuth(r, w, auth, version, nonce); err != nil {
+			return nil, err
+		}
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	return newConn(conn, true, version, authenticated, r, w), nil
+}
+
+func serverAuth(r *bufio.Reader, w *bufio.Writer, auth *Authenticator, version uint16, nonce []byte) (bool, error) {
+	f, err := readFrame(r)
+	if err != nil {
+		return false, fmt.Errorf("failed to receive authentication: %w", err)
+	}
+	if f.typ != frameAuth {
+		return false, fmt.Errorf("%w: bad authentication", errProtocol)
+	}
+
+	authenticated := auth == nil
+	if auth != nil && len(f.payload) > 0 {
+		if err = auth.verify(version, nonce, f.payload, time.Now()); err != nil {
+			var e *Error
+			if errors.As(err, &e) {
+				rejectHandshake(w, e)
+			}
+			return false, err
+		}
+		authenticated = true
+	}
+
+	var payload byte
+	if authenticated {
+		payload = 1
+	}
+	if err = writeFrame(w, &frame{typ: frameAuth, payload: []byte{payload}}); err != nil {
+		return false, err
+	}
+	return authenticated, w.Flush()
+}
+
+func rejectHandshake(w *bufio.Writer, e *Error) {
+	_ = writeFrame(w, &frame{typ: frameReset, payload: marshalError(e)})
+	_ = w.Flush()
+}
+
+func newConn(conn net.Conn, server bool, version uint16, authenticated bool, r *bufio.Reader, w *bufio.Writer) *Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Conn{
+		conn:          conn,
+		server:        server,
+		version:       version,
+		authenticated: authenticated,
+		ctx:           ctx,
+		cancel:        cancel,
+		w:             w,
+		streams:       make(map[uint32]*Stream),
+		done:          make(chan struct{}),
+	}
+	if server {
+		c.accept = make(chan *Stream, acceptBacklog)
+	}
+
+	go c.readLoop(r)
+	return c
+}
+
+// Version returns the negotiated protocol version.
+func (c *Conn) Version() uint16 {
+	return c.version
+}
+
+// Authenticated reports whether the server has verified the key of the
+// client or does not require it.
+func (c *Conn) Authenticated() bool {
+	return c.authenticated
+}
+
+// Done is closed when the connection is broken or closed.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the reason the connection is done.
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Streams returns the number of open streams.
+func (c *Conn) Streams() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.streams)
+}
+
+func (c *Conn) Close() error {
+	c.fail(ErrClosed)
+	return nil
+}
+
+// Open starts a stream with the request, end tells that no data follows it.
+// The stream is reset when ctx is done.
+func (c *Conn) Open(ctx context.Context, req *Request, end bool) (*Stream, error) {
+	if c.server {
+		return nil, errors.New("nodeproto: streams are opened by the client")
+	}
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.lastId++
+	s := newStream(c, c.lastId, ctx)
+	s.request = req
+	s.localEnd = end
+	c.streams[s.id] = s
+	c.mu.Unlock()
+
+	var flags uint8
+	if end {
+		flags = flagEnd
+	}
+	if err := c.writeFrame(&frame{typ: frameRequest, flags: flags, stream: s.id, payload: req.marshal()}); err != nil {
+		s.release()
+		return nil, err
+	}
+
+	s.watch(ctx)
+	return s, nil
+}
+
+// Accept waits for a stream opened by the client.
+func (c *Conn) Accept() (*Stream, error) {
+	select {
+	case s := <-c.accept:
+		return s, nil
+	case <-c.done:
+		return nil, c.Err()
+	}
+}
+
+func (c *Conn) writeFrame(f *frame) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if err := c.Err(); err != nil {
+		return err
+	}
+
+	err := writeFrame(c.w, f)
+	if err == nil {
+		err = c.w.Flush()
+	}
+	if err != nil {
+		c.fail(err)
+	}
+	return err
+}
+
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.err = err
+	streams := c.streams
+	c.streams = make(map[uint32]*Stream)
+	c.mu.Unlock()
+
+	close(c.done)
+	c.cancel()
+	_ = c.conn.Close()
+
+	for _, s := range streams {
+		s.onReset(fmt.Errorf("connection is lost: %w", err))
+	}
+}
+
+func (c *Conn) stream(id uint32) *Stream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.streams[id]
+}
+
+func (c *Conn) remove(id uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.streams, id)
+}
+
+func (c *Conn) readLoop(r *bufio.Reader) {
+	for {
+		f, err := readFrame(r)
+		if err == nil {
+			err = c.handle(f)
+		}
+		if err != nil {
+			c.fail(err)
+			return
+		}
+	}
+}
+
+// handle dispatches a frame to its stream, frames of streams closed on this
+// side are dropped.
+func (c *Conn) handle(f *frame) error {
+	end := f.flags&flagEnd != 0
+
+	if f.typ == frameRequest {
+		if !c.server {
+			return fmt.Errorf("%w: request sent to the client", errProtocol)
+		}
+
+		req := &Request{}
+		if err := req.unmarshal(f.payload); err != nil {
+			return err
+		}
+
+		c.mu.Lock()
+		if _, ok := c.streams[f.stream]; ok || f.stream <= c.lastId {
+			c.mu.Unlock()
+			return fmt.Errorf("%w: stream %d is reused", errProtocol, f.stream)
+		}
+		c.lastId = f.stream
+		s := newStream(c, f.stream, c.ctx)
+		s.request = req
+		s.remoteEnd = end
+		c.streams[s.id] = s
+		c.mu.Unlock()
+
+		select {
+		case c.accept <- s:
+			return nil
+		case <-c.done:
+			return c.Err()
+		}
+	}
+
+	s := c.stream(f.stream)
+	if s == nil {
+		if f.typ == frameHello || f.typ > frameReset {
+			return fmt.Errorf("%w: unexpected frame %d", errProtocol, f.typ)
+		}
+		return nil
+	}
+
+	switch f.typ {
+	case frameResponse:
+		if c.server {
+			return fmt.Errorf("%w: response sent to the server", errProtocol)
+		}
+		resp := &Response{}
+		if err := resp.unmarshal(f.payload); err != nil {
+			return err
+		}
+		s.onResponse(resp, end)
+	case frameData:
+		return s.onData(f.payload, end)
+	case frameWindow:
+		if len(f.payload) != 4 {
+			return fmt.Errorf("%w: malformed window", errProtocol)
+		}
+		s.onWindow(int64(binary.BigEndian.Uint32(f.payload)))
+	case frameReset:
+		e, err := unmarshalError(f.payload)
+		if err != nil {
+			return err
+		}
+		s.onReset(e)
+	default:
+		return fmt.Errorf("%w: unexpected frame %d", errProtocol, f.typ)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package nodeproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+type frameType uint8
+
+const (
+	frameHello frameType = iota + 1
+	frameRequest
+	frameResponse
+	frameData
+	frameWindow
+	frameReset
+	frameAuth
+)
+
+// flagEnd marks the last frame sent by a side of the stream.
+const flagEnd uint8 = 1
+
+const (
+	// frameHeaderSize is type, flags, stream id and payload length.
+	frameHeaderSize = 10
+	// MaxFrameSize limits the payload of a frame.
+	MaxFrameSize = 64 * 1024
+)
+
+var helloMagic = []byte("FSNP")
+
+type frame struct {
+	typ     frameType
+	flags   uint8
+	stream  uint32
+	payload []byte
+}
+
+func readFrame(r io.Reader) (*frame, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	f := &frame{
+		typ:    frameType(header[0]),
+		flags:  header[1],
+		stream: binary.BigEndian.Uint32(header[2:6]),
+	}
+
+	length := binary.BigEndian.Uint32(header[6:10])
+	if length > MaxFrameSize {
+		return nil, fmt.Errorf("%w: frame of %d bytes", errProtocol, length)
+	}
+
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func writeFrame(w io.Writer, f *frame) error {
+	var header [frameHeaderSize]byte
+	header[0] = byte(f.typ)
+	header[1] = f.flags
+	binary.BigEndian.PutUint32(header[2:6], f.stream)
+	binary.BigEndian.PutUint32(header[6:10], uint32(len(f.payload)))
+
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(f.payload)
+	return err
+}
+
+// hello is the handshake frame, the client offers a range of versions and
+// the server answers with the chosen one as both bounds. Since version 2 the
+// server adds a nonce the client authenticates with.
+func helloFrame(minVersion, maxVersion uint16, nonce []byte) *frame {
+	payload := bytes.Clone(helloMagic)
+	payload = binary.BigEndian.AppendUint16(payload, minVersion)
+	payload = binary.BigEndian.AppendUint16(payload, maxVersion)
+	payload = append(payload, nonce...)
+	return &frame{typ: frameHello, payload: payload}
+}
+
+func parseHello(f *frame) (minVersion, maxVersion uint16, nonce []byte, err error) {
+	size := len(helloMagic) + 4
+	if f.typ != frameHello || (len(f.payload) != size && len(f.payload) != size+nonceSize) || !bytes.HasPrefix(f.payload, helloMagic) {
+		return 0, 0, nil, fmt.Errorf("%w: bad handshake", errProtocol)
+	}
+	versions := f.payload[len(helloMagic):size]
+	return binary.BigEndian.Uint16(versions[0:2]), binary.BigEndian.Uint16(versions[2:4]), f.payload[size:], nil
+}
@@ -0,0 +1,250 @@
+// Package nodeproto implements the binary protocol between the controller and
+// the nodes.
+//
+// A connection starts with a handshake negotiating the protocol version and
+// optionally authenticating the client by a pre-shared key, then carries
+// length-prefixed frames of many concurrent streams. Every operation is a
+// stream opened by the client with a request frame, the node answers with a
+// response frame carrying a status code. Both sides may follow their header
+// with data frames, the last frame of each side is flagged as the end. Data is
+// flow controlled per stream, so a slow reader never blocks other streams.
+package nodeproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// Version is the latest protocol version, MinVersion is the oldest one
+	// still supported.
+	Version    uint16 = 2
+	MinVersion uint16 = 1
+
+	// versionAuth adds the authentication to the handshake, clients of
+	// older versions are never authenticated.
+	versionAuth uint16 = 2
+)
+
+type Op uint8
+
+const (
+	OpSaveFile Op = iota + 1
+	OpGetFile
+	OpDeleteFile
+	OpHashFile
+	OpPing
+)
+
+func (x Op) String() string {
+	switch x {
+	case OpSaveFile:
+		return "save_file"
+	case OpGetFile:
+		return "get_file"
+	case OpDeleteFile:
+		return "delete_file"
+	case OpHashFile:
+		return "hash_file"
+	case OpPing:
+		return "ping"
+	default:
+		return fmt.Sprintf("op(%d)", uint8(x))
+	}
+}
+
+type Status uint8
+
+const (
+	StatusOK Status = iota
+	StatusNotFound
+	StatusInsufficientStorage
+	StatusPermissionDenied
+	StatusChecksumMismatch
+	StatusBadRequest
+	StatusUnsupported
+	StatusCanceled
+	StatusInternal
+	StatusUnauthenticated
+)
+
+func (x Status) String() string {
+	switch x {
+	case StatusOK:
+		return "ok"
+	case StatusNotFound:
+		return "not found"
+	case StatusInsufficientStorage:
+		return "insufficient storage"
+	case StatusPermissionDenied:
+		return "permission denied"
+	case StatusChecksumMismatch:
+		return "checksum mismatch"
+	case StatusBadRequest:
+		return "bad request"
+	case StatusUnsupported:
+		return "unsupported"
+	case StatusCanceled:
+		return "canceled"
+	case StatusInternal:
+		return "internal error"
+	case StatusUnauthenticated:
+		return "unauthenticated"
+	default:
+		return fmt.Sprintf("status(%d)", uint8(x))
+	}
+}
+
+// Error is a failure reported by the peer.
+type Error struct {
+	Status  Status
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return e.Status.String()
+	}
+	return e.Message
+}
+
+var (
+	ErrClosed     = errors.New("nodeproto: connection is closed")
+	ErrStreamDone = errors.New("nodeproto: stream is finished by the peer")
+	errProtocol   = errors.New("nodeproto: protocol violation")
+)
+
+// Request opens a stream. Size is the length of the data following a
+// save_file request, Offset and Length select the range of get_file, zero
+// Length reads to the end of the file.
+type Request struct {
+	Op     Op
+	Name   string
+	Size   int64
+	Offset int64
+	Length int64
+}
+
+// Response is the answer of the node. Size is the number of bytes written
+// by save_file or hashed by hash_file, TotalBytes and FreeBytes are the node
+// capacity returned by ping.
+type Response struct {
+	Status     Status
+	Message    string
+	Size       int64
+	Checksum   string
+	TotalBytes int64
+	FreeBytes  int64
+}
+
+// Err returns the failure carried by the response, if any.
+func (x *Response) Err() error {
+	if x.Status == StatusOK {
+		return nil
+	}
+	return &Error{Status: x.Status, Message: x.Message}
+}
+
+func (x *Request) marshal() []byte {
+	b := []byte{byte(x.Op)}
+	b = appendString(b, x.Name)
+	b = binary.AppendVarint(b, x.Size)
+	b = binary.AppendVarint(b, x.Offset)
+	b = binary.AppendVarint(b, x.Length)
+	return b
+}
+
+func (x *Request) unmarshal(b []byte) error {
+	d := &decoder{b: b}
+	x.Op = Op(d.byte())
+	x.Name = d.string()
+	x.Size = d.varint()
+	x.Offset = d.varint()
+	x.Length = d.varint()
+	return d.err
+}
+
+func (x *Response) marshal() []byte {
+	b := []byte{byte(x.Status)}
+	b = appendString(b, x.Message)
+	b = binary.AppendVarint(b, x.Size)
+	b = appendString(b, x.Checksum)
+	b = binary.AppendVarint(b, x.TotalBytes)
+	b = binary.AppendVarint(b, x.FreeBytes)
+	return b
+}
+
+func (x *Response) unmarshal(b []byte) error {
+	d := &decoder{b: b}
+	x.Status = Status(d.byte())
+	x.Message = d.string()
+	x.Size = d.varint()
+	x.Checksum = d.string()
+	x.TotalBytes = d.varint()
+	x.FreeBytes = d.varint()
+	return d.err
+}
+
+func marshalError(e *Error) []byte {
+	return appendString([]byte{byte(e.Status)}, e.Message)
+}
+
+func unmarshalError(b []byte) (*Error, error) {
+	d := &decoder{b: b}
+	e := &Error{
+		Status:  Status(d.byte()),
+		Message: d.string(),
+	}
+	return e, d.err
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// decoder reads fields in order, the first failure is kept in err and the
+// following reads return zero values.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: malformed message", errProtocol)
+	}
+	d.b = nil
+}
+
+func (d *decoder) byte() byte {
+	if len(d.b) < 1 {
+		d.fail()
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	l, n := binary.Uvarint(d.b)
+	if n <= 0 || uint64(len(d.b)-n) < l {
+		d.fail()
+		return ""
+	}
+	v := string(d.b[n : n+int(l)])
+	d.b = d.b[n+int(l):]
+	return v
+}
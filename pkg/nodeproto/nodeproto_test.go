@@ -0,0 +1,375 @@
+package nodeproto
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame *frame
+	}{
+		{"empty", &frame{typ: frameData, stream: 1, payload: []byte{}}},
+		{"end", &frame{typ: frameData, flags: flagEnd, stream: 7, payload: []byte("data")}},
+		{"large stream id", &frame{typ: frameWindow, stream: 1<<32 - 1, payload: []byte{0, 0, 1, 0}}},
+		{"max size", &frame{typ: frameData, stream: 2, payload: bytes.Repeat([]byte{0xab}, MaxFrameSize)}},
+		{"hello", helloFrame(MinVersion, Version, bytes.Repeat([]byte{1}, nonceSize))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			if err := writeFrame(buf, tt.frame); err != nil {
+				t.Fatal(err)
+			}
+			if buf.Len() != frameHeaderSize+len(tt.frame.payload) {
+				t.Fatalf("got %d bytes, want %d", buf.Len(), frameHeaderSize+len(tt.frame.payload))
+			}
+
+			got, err := readFrame(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.frame) {
+				t.Fatalf("got %+v, want %+v", got, tt.frame)
+			}
+		})
+	}
+}
+
+func TestReadFrameMalformed(t *testing.T) {
+	header := func(length uint32) []byte {
+		b := []byte{byte(frameData), 0, 0, 0, 0, 1}
+		return binary.BigEndian.AppendUint32(b, length)
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+		err   error
+	}{
+		{"too large", header(MaxFrameSize + 1), errProtocol},
+		{"huge", header(1<<32 - 1), errProtocol},
+		{"short header", header(0)[:5], io.ErrUnexpectedEOF},
+		{"short payload", append(header(10), 1, 2, 3), io.ErrUnexpectedEOF},
+		{"nothing", nil, io.EOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := readFrame(bytes.NewReader(tt.input)); !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	requests := []*Request{
+		{},
+		{Op: OpSaveFile, Name: "file.0", Size: 1 << 40},
+		{Op: OpGetFile, Name: "file.1", Offset: 10, Length: 20},
+		{Op: OpPing, Size: -1},
+	}
+	for _, want := range requests {
+		got := &Request{}
+		if err := got.unmarshal(want.marshal()); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+	}
+
+	responses := []*Response{
+		{},
+		{Status: StatusNotFound, Message: "file is not found"},
+		{Size: 5, Checksum: "abc"},
+		{TotalBytes: 1 << 40, FreeBytes: 1 << 30},
+	}
+	for _, want := range responses {
+		got := &Response{}
+		if err := got.unmarshal(want.marshal()); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+	}
+
+	b := (&Request{Op: OpGetFile, Name: "file.0"}).marshal()
+	if err := (&Request{}).unmarshal(b[:3]); !errors.Is(err, errProtocol) {
+		t.Fatalf("got %v, want %v", err, errProtocol)
+	}
+}
+
+// pipe connects a client and a server over memory.
+func pipe(t *testing.T, key []byte, auth *Authenticator) (*Conn, *Conn) {
+	t.Helper()
+
+	c, s := net.Pipe()
+	server := make(chan *Conn, 1)
+	go func() {
+		conn, err := Server(s, auth)
+		if err != nil {
+			_ = s.Close()
+		}
+		server <- conn
+	}()
+
+	client, err := Client(context.Background(), c, key)
+	if err != nil {
+		<-server
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+
+	conn := <-server
+	if conn == nil {
+		t.Fatal("server handshake failed")
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return client, conn
+}
+
+func TestInterleavedStreams(t *testing.T) {
+	client, server := pipe(t, nil, nil)
+
+	// the server echoes the data of every stream
+	go func() {
+		for {
+			s, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer s.Close()
+				if err := s.Respond(&Response{Message: s.Request().Name}, false); err != nil {
+					return
+				}
+				if _, err := io.Copy(s, s); err != nil {
+					return
+				}
+				_ = s.CloseWrite()
+			}()
+		}
+	}()
+
+	const streams, chunks = 8, 16
+	chunk := func(i, j int) []byte {
+		return bytes.Repeat([]byte{byte(i), byte(j)}, 1000+i*100)
+	}
+
+	opened := make([]*Stream, streams)
+	for i := range opened {
+		s, err := client.Open(context.Background(), &Request{Op: OpSaveFile, Name: fmt.Sprint(i)}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opened[i] = s
+	}
+
+	// frames of all the streams alternate on the connection
+	for j := 0; j < chunks; j++ {
+		for i, s := range opened {
+			if _, err := s.Write(chunk(i, j)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, s := range opened {
+		if err := s.CloseWrite(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, streams)
+	for i, s := range opened {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.Close()
+
+			resp, err := s.Response()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if resp.Message != fmt.Sprint(i) {
+				errs <- fmt.Errorf("got response of stream %s, want %d", resp.Message, i)
+				return
+			}
+
+			got, err := io.ReadAll(s)
+			if err != nil {
+				errs <- err
+				return
+			}
+			want := &bytes.Buffer{}
+			for j := 0; j < chunks; j++ {
+				want.Write(chunk(i, j))
+			}
+			if !bytes.Equal(got, want.Bytes()) {
+				errs <- fmt.Errorf("got %d bytes of stream %d, want %d", len(got), i, want.Len())
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+// rawClient performs the client handshake offering the versions, without
+// authenticating.
+func rawClient(conn net.Conn, minVersion, maxVersion uint16) (uint16, error) {
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	if err := writeFrame(w, helloFrame(minVersion, maxVersion, nil)); err != nil {
+		return 0, err
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+
+	f, err := readFrame(r)
+	if err != nil {
+		return 0, err
+	}
+	if f.typ == frameReset {
+		e, err := unmarshalError(f.payload)
+		if err != nil {
+			return 0, err
+		}
+		return 0, e
+	}
+	version, _, _, err := parseHello(f)
+	if err != nil || version < versionAuth {
+		return version, err
+	}
+
+	if err = writeFrame(w, &frame{typ: frameAuth}); err != nil {
+		return 0, err
+	}
+	if err = w.Flush(); err != nil {
+		return 0, err
+	}
+	_, err = readFrame(r)
+	return version, err
+}
+
+func TestServerVersion(t *testing.T) {
+	tests := []struct {
+		name       string
+		minVersion uint16
+		maxVersion uint16
+		want       uint16
+		status     Status
+	}{
+		{"v1 client", 1, 1, 1, StatusOK},
+		{"v1 and v2 client", 1, 2, 2, StatusOK},
+		{"v2 client", 2, 2, 2, StatusOK},
+		{"newer client", 1, Version + 1, Version, StatusOK},
+		{"too new client", Version + 1, Version + 2, 0, StatusUnsupported},
+		{"too old client", 0, 0, 0, StatusUnsupported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s := net.Pipe()
+			defer c.Close()
+
+			server := make(chan *Conn, 1)
+			go func() {
+				conn, _ := Server(s, NewAuthenticator([]byte("key")))
+				server <- conn
+			}()
+
+			version, err := rawClient(c, tt.minVersion, tt.maxVersion)
+			conn := <-server
+
+			if tt.status != StatusOK {
+				var e *Error
+				if !errors.As(err, &e) || e.Status != tt.status {
+					t.Fatalf("got %v, want %v", err, tt.status)
+				}
+				if conn != nil {
+					t.Fatal("server accepted the connection")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if version != tt.want || conn.Version() != tt.want {
+				t.Fatalf("got versions %d and %d, want %d", version, conn.Version(), tt.want)
+			}
+			if conn.Authenticated() {
+				t.Fatal("client without key is authenticated")
+			}
+		})
+	}
+}
+
+func TestClientVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		version uint16
+		want    uint16
+		status  Status
+	}{
+		{"v1 server", 1, 1, StatusOK},
+		{"too old server", 0, 0, StatusUnsupported},
+		{"too new server", Version + 1, 0, StatusUnsupported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s := net.Pipe()
+			defer s.Close()
+
+			// the server of an older version answers without a nonce
+			go func() {
+				r, w := bufio.NewReader(s), bufio.NewWriter(s)
+				if _, err := readFrame(r); err != nil {
+					return
+				}
+				_ = writeFrame(w, helloFrame(tt.version, tt.version, nil))
+				_ = w.Flush()
+			}()
+
+			conn, err := Client(context.Background(), c, []byte("key"))
+			if tt.status != StatusOK {
+				var e *Error
+				if !errors.As(err, &e) || e.Status != tt.status {
+					t.Fatalf("got %v, want %v", err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if conn.Version() != tt.want {
+				t.Fatalf("got %d, want %d", conn.Version(), tt.want)
+			}
+			if conn.Authenticated() {
+				t.Fatal("v1 connection is authenticated")
+			}
+		})
+	}
+}
@@ -0,0 +1,348 @@
+package nodeproto
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// streamWindow is the amount of data a side may send before the receiver
+// confirms reading it.
+const streamWindow = 1024 * 1024
+
+var errStreamClosed = errors.New("nodeproto: stream is closed")
+
+// Stream is a single operation on a connection. The client writes the
+// request data and reads the response data, the server does the opposite.
+type Stream struct {
+	conn *Conn
+	id   uint32
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	stop   func() bool
+
+	mu   sync.Mutex
+	cond sync.Cond
+
+	request   *Request
+	response  *Response
+	responded bool
+
+	recv       [][]byte
+	recvCredit int64
+	consumed   int64
+	remoteEnd  bool
+
+	sendCredit int64
+	localEnd   bool
+
+	err error
+}
+
+func newStream(c *Conn, id uint32, parent context.Context) *Stream {
+	ctx, cancel := context.WithCancel(parent)
+	s := &Stream{
+		conn:       c,
+		id:         id,
+		ctx:        ctx,
+		cancel:     cancel,
+		recvCredit: streamWindow,
+		sendCredit: streamWindow,
+	}
+	s.cond.L = &s.mu
+	return s
+}
+
+// Context is done when the stream is reset or closed.
+func (s *Stream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *Stream) Request() *Request {
+	return s.request
+}
+
+// Response waits for the response of the server.
+func (s *Stream) Response() (*Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.response == nil && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.response != nil {
+		return s.response, nil
+	}
+	return nil, s.err
+}
+
+// Responded reports whether the server has sent the response.
+func (s *Stream) Responded() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.responded
+}
+
+// Respond sends the response of the server, end tells that no data follows.
+func (s *Stream) Respond(resp *Response, end bool) error {
+	s.mu.Lock()
+	if !s.conn.server || s.responded {
+		s.mu.Unlock()
+		return errors.New("nodeproto: unexpected response")
+	}
+	if s.err != nil {
+		s.mu.Unlock()
+		return s.err
+	}
+	s.responded = true
+	s.localEnd = end
+	s.mu.Unlock()
+
+	var flags uint8
+	if end {
+		flags = flagEnd
+	}
+	if err := s.conn.writeFrame(&frame{typ: frameResponse, flags: flags, stream: s.id, payload: resp.marshal()}); err != nil {
+		return err
+	}
+	s.releaseIfDone()
+	return nil
+}
+
+// Read reads the data sent by the peer, it returns io.EOF after the last
+// frame of the peer.
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for len(s.recv) == 0 && !s.remoteEnd && s.err == nil {
+		s.cond.Wait()
+	}
+
+	if len(s.recv) == 0 {
+		defer s.mu.Unlock()
+		if s.remoteEnd {
+			return 0, io.EOF
+		}
+		return 0, s.err
+	}
+
+	n := copy(p, s.recv[0])
+	if s.recv[0] = s.recv[0][n:]; len(s.recv[0]) == 0 {
+		s.recv[0] = nil
+		s.recv = s.recv[1:]
+	}
+
+	// the peer may send more once half of the window is read
+	var increment int64
+	if s.consumed += int64(n); s.consumed >= streamWindow/2 && !s.remoteEnd {
+		increment, s.consumed = s.consumed, 0
+		s.recvCredit += increment
+	}
+	s.mu.Unlock()
+
+	if increment > 0 {
+		payload := binary.BigEndian.AppendUint32(nil, uint32(increment))
+		_ = s.conn.writeFrame(&frame{typ: frameWindow, stream: s.id, payload: payload})
+	}
+	return n, nil
+}
+
+// Write sends data to the peer in frames, waiting for the peer to read the
+// previous ones when the window is exhausted.
+func (s *Stream) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		s.mu.Lock()
+		for s.sendCredit == 0 && s.err == nil && !s.localEnd && !s.peerDone() {
+			s.cond.Wait()
+		}
+
+		var err error
+		switch {
+		case s.err != nil:
+			err = s.err
+		case s.localEnd:
+			err = errors.New("nodeproto: write after end of stream")
+		case s.peerDone():
+			err = ErrStreamDone
+		case s.conn.server && !s.responded:
+			err = errors.New("nodeproto: data before response")
+		}
+		if err != nil {
+			s.mu.Unlock()
+			return written, err
+		}
+
+		n := int(min(int64(len(p)), s.sendCredit, MaxFrameSize))
+		s.sendCredit -= int64(n)
+		s.mu.Unlock()
+
+		if err = s.conn.writeFrame(&frame{typ: frameData, stream: s.id, payload: p[:n]}); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// peerDone reports whether the server has finished the stream, so the data
+// of the client would not be read anymore.
+func (s *Stream) peerDone() bool {
+	return !s.conn.server && s.remoteEnd
+}
+
+// CloseWrite tells the peer that no more data follows.
+func (s *Stream) CloseWrite() error {
+	s.mu.Lock()
+	if s.localEnd {
+		s.mu.Unlock()
+		return nil
+	}
+	if s.err != nil {
+		s.mu.Unlock()
+		return s.err
+	}
+	if s.conn.server && !s.responded {
+		s.mu.Unlock()
+		return errors.New("nodeproto: end of stream before response")
+	}
+	s.localEnd = true
+	s.mu.Unlock()
+
+	if err := s.conn.writeFrame(&frame{typ: frameData, flags: flagEnd, stream: s.id}); err != nil {
+		return err
+	}
+	s.releaseIfDone()
+	return nil
+}
+
+// Reset aborts the stream reporting the failure to the peer.
+func (s *Stream) Reset(e *Error) error {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return s.err
+	}
+	s.err = e
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	err := s.conn.writeFrame(&frame{typ: frameReset, stream: s.id, payload: marshalError(e)})
+	s.release()
+	return err
+}
+
+// Close releases the stream, an unfinished stream is reset. The server may
+// close a stream without reading all the data of the client once it has
+// sent the whole response.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	reset := s.err == nil && (!s.localEnd || (!s.remoteEnd && !s.conn.server))
+	if s.err == nil {
+		s.err = errStreamClosed
+		s.cond.Broadcast()
+	}
+	stop := s.stop
+	s.mu.Unlock()
+
+	if stop != nil {
+		stop()
+	}
+
+	var err error
+	if reset {
+		err = s.conn.writeFrame(&frame{typ: frameReset, stream: s.id, payload: marshalError(&Error{Status: StatusCanceled})})
+	}
+	s.release()
+	return err
+}
+
+// watch resets the stream when ctx is done.
+func (s *Stream) watch(ctx context.Context) {
+	stop := context.AfterFunc(ctx, func() {
+		s.mu.Lock()
+		if s.err != nil || (s.localEnd && s.remoteEnd) {
+			s.mu.Unlock()
+			return
+		}
+		s.err = ctx.Err()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+
+		_ = s.conn.writeFrame(&frame{typ: frameReset, stream: s.id, payload: marshalError(&Error{Status: StatusCanceled})})
+		s.release()
+	})
+
+	s.mu.Lock()
+	s.stop = stop
+	s.mu.Unlock()
+}
+
+func (s *Stream) release() {
+	s.conn.remove(s.id)
+	s.cancel()
+}
+
+func (s *Stream) releaseIfDone() {
+	s.mu.Lock()
+	done := s.localEnd && s.remoteEnd
+	s.mu.Unlock()
+
+	if done {
+		s.conn.remove(s.id)
+	}
+}
+
+func (s *Stream) onResponse(resp *Response, end bool) {
+	s.mu.Lock()
+	s.response = resp
+	s.remoteEnd = end
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.releaseIfDone()
+}
+
+func (s *Stream) onData(payload []byte, end bool) error {
+	s.mu.Lock()
+	if int64(len(payload)) > s.recvCredit {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: stream %d exceeds its window", errProtocol, s.id)
+	}
+	s.recvCredit -= int64(len(payload))
+	if len(payload) > 0 {
+		s.recv = append(s.recv, payload)
+	}
+	s.remoteEnd = s.remoteEnd || end
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if end {
+		s.releaseIfDone()
+	}
+	return nil
+}
+
+func (s *Stream) onWindow(increment int64) {
+	s.mu.Lock()
+	s.sendCredit += increment
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// onReset fails the stream, the data already received by the end of the
+// peer stays readable.
+func (s *Stream) onReset(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.release()
+}
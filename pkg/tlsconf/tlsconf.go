@@ -0,0 +1,93 @@
+package tlsconf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Config points to PEM files. CAFile verifies the peer: the server requires
+// client certificates signed by it, the client checks the server certificate
+// against it instead of the system roots.
+type Config struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	// ServerName is checked against the server certificate instead of the
+	// host the client connects to.
+	ServerName string
+}
+
+// NewServerConfig returns nil when no certificate is configured.
+func NewServerConfig(config *Config) (*tls.Config, error) {
+	if config.CertFile == "" && config.KeyFile == "" && config.CAFile == "" {
+		return nil, nil
+	}
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("tls certificate and key are required")
+	}
+
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tls certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if config.CAFile != "" {
+		if tlsConfig.ClientCAs, err = loadCA(config.CAFile); err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// NewClientConfig returns nil when neither a certificate nor a CA is
+// configured.
+func NewClientConfig(config *Config) (*tls.Config, error) {
+	if config.CertFile == "" && config.KeyFile == "" && config.CAFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: config.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tls certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if config.CAFile != "" {
+		var err error
+		if tlsConfig.RootCAs, err = loadCA(config.CAFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+func loadCA(filename string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tls ca: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", filename)
+	}
+	return pool, nil
+}